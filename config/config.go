@@ -0,0 +1,833 @@
+// Package config loads the application settings from a YAML or TOML file,
+// applies environment variable overrides and validates the result.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting the server needs at startup
+type Config struct {
+	Server    ServerConfig    `yaml:"server" toml:"server"`
+	Database  DatabaseConfig  `yaml:"database" toml:"database"`
+	Auth      AuthConfig      `yaml:"auth" toml:"auth"`
+	Publisher PublisherConfig `yaml:"publisher" toml:"publisher"`
+	Feed      FeedConfig      `yaml:"feed" toml:"feed"`
+	Mail      MailConfig      `yaml:"mail" toml:"mail"`
+	// PasswordReset controls the forgot/reset password flow
+	PasswordReset PasswordResetConfig `yaml:"password_reset" toml:"password_reset"`
+	// EmailVerification controls the links that verify email addresses
+	EmailVerification EmailVerificationConfig `yaml:"email_verification" toml:"email_verification"`
+	// OAuth controls sign-in with external identity providers
+	OAuth OAuthConfig `yaml:"oauth" toml:"oauth"`
+	// Account controls account deletion and personal data exports
+	Account AccountConfig `yaml:"account" toml:"account"`
+	// Notifications controls the live delivery of notifications
+	Notifications NotificationsConfig `yaml:"notifications" toml:"notifications"`
+	// Webhooks controls the delivery of outgoing webhooks
+	Webhooks WebhooksConfig `yaml:"webhooks" toml:"webhooks"`
+}
+
+// ServerConfig controls the HTTP listener
+type ServerConfig struct {
+	Addr string `yaml:"addr" toml:"addr" env:"APP_SERVER_ADDR"`
+	// Mode is the gin mode: debug, release or test
+	Mode string `yaml:"mode" toml:"mode" env:"APP_SERVER_MODE"`
+	// TrustedProxies lists the proxy addresses or CIDRs whose
+	// X-Forwarded-For header is believed. Empty trusts none, so the client
+	// IP is the address of the connection.
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies" env:"APP_SERVER_TRUSTED_PROXIES"`
+}
+
+// DatabaseConfig describes the PostgreSQL connection
+type DatabaseConfig struct {
+	Host         string `yaml:"host" toml:"host" env:"APP_DATABASE_HOST"`
+	Port         int    `yaml:"port" toml:"port" env:"APP_DATABASE_PORT"`
+	User         string `yaml:"user" toml:"user" env:"APP_DATABASE_USER"`
+	Password     string `yaml:"password" toml:"password" env:"APP_DATABASE_PASSWORD"`
+	PasswordFile string `yaml:"password_file" toml:"password_file" env:"APP_DATABASE_PASSWORD_FILE"`
+	Name         string `yaml:"name" toml:"name" env:"APP_DATABASE_NAME"`
+	SSLMode      string `yaml:"sslmode" toml:"sslmode" env:"APP_DATABASE_SSLMODE"`
+	// Migrations is what the server does with pending migrations on startup:
+	// "auto" applies them, "check" refuses to start and "off" ignores them
+	Migrations string `yaml:"migrations" toml:"migrations" env:"APP_DATABASE_MIGRATIONS"`
+}
+
+// DSN returns the connection string for the PostgreSQL driver. Every value
+// is quoted, so a password with spaces or quotes cannot add settings.
+func (d DatabaseConfig) DSN() string {
+	return fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%d sslmode=%s",
+		dsnValue(d.Host), dsnValue(d.User), dsnValue(d.Password), dsnValue(d.Name), d.Port, dsnValue(d.SSLMode))
+}
+
+// dsnValue quotes v as a value of a libpq keyword/value connection string
+func dsnValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// AuthConfig controls how tokens are signed and carried
+type AuthConfig struct {
+	// JWTSecret only verifies HS256 tokens issued before signing keys were
+	// introduced; unset it once refresh_token_ttl has passed since then
+	JWTSecret       string   `yaml:"jwt_secret" toml:"jwt_secret" env:"APP_AUTH_JWT_SECRET"`
+	JWTSecretFile   string   `yaml:"jwt_secret_file" toml:"jwt_secret_file" env:"APP_AUTH_JWT_SECRET_FILE"`
+	AccessTokenTTL  Duration `yaml:"access_token_ttl" toml:"access_token_ttl" env:"APP_AUTH_ACCESS_TOKEN_TTL"`
+	RefreshTokenTTL Duration `yaml:"refresh_token_ttl" toml:"refresh_token_ttl" env:"APP_AUTH_REFRESH_TOKEN_TTL"`
+	// TokenSources lists "header" and/or "cookie" in the order the access
+	// token is looked up
+	TokenSources []string `yaml:"token_sources" toml:"token_sources" env:"APP_AUTH_TOKEN_SOURCES"`
+	// CSRF requires a double-submit token on unsafe cookie-authenticated requests
+	CSRF      bool            `yaml:"csrf" toml:"csrf" env:"APP_AUTH_CSRF"`
+	Cookie    CookieConfig    `yaml:"cookie" toml:"cookie"`
+	Signing   SigningConfig   `yaml:"signing" toml:"signing"`
+	TwoFactor TwoFactorConfig `yaml:"two_factor" toml:"two_factor"`
+	Lockout   LockoutConfig   `yaml:"lockout" toml:"lockout"`
+	Sessions  SessionsConfig  `yaml:"sessions" toml:"sessions"`
+}
+
+// SessionsConfig controls the session recorded for every login
+type SessionsConfig struct {
+	// FlushInterval is how often each instance writes the last-seen times
+	// of the sessions it served, instead of writing on every request
+	FlushInterval Duration `yaml:"flush_interval" toml:"flush_interval" env:"APP_AUTH_SESSIONS_FLUSH_INTERVAL"`
+}
+
+// SigningConfig controls the asymmetric keys that sign tokens. Keys live in
+// the database and are managed with the keys command.
+type SigningConfig struct {
+	// Algorithm is "RS256" or "EdDSA", used for keys generated without an
+	// explicit algorithm, including the first one
+	Algorithm string `yaml:"algorithm" toml:"algorithm" env:"APP_AUTH_SIGNING_ALGORITHM"`
+	// KeyCacheTTL is how long an instance caches the keys, and so how long
+	// a new key may take to start signing everywhere
+	KeyCacheTTL Duration `yaml:"key_cache_ttl" toml:"key_cache_ttl" env:"APP_AUTH_SIGNING_KEY_CACHE_TTL"`
+}
+
+// LockoutConfig throttles failed logins per account and per client IP.
+// Once an account or IP has more failures than its free attempts, each new
+// failure makes it wait twice as long as the last, from BaseDelay up to
+// MaxDelay; at its max failures it is locked out for LockDuration.
+type LockoutConfig struct {
+	Enabled bool `yaml:"enabled" toml:"enabled" env:"APP_AUTH_LOCKOUT_ENABLED"`
+	// Window is how long a failure counts; a quiet window resets the count
+	Window       Duration `yaml:"window" toml:"window" env:"APP_AUTH_LOCKOUT_WINDOW"`
+	BaseDelay    Duration `yaml:"base_delay" toml:"base_delay" env:"APP_AUTH_LOCKOUT_BASE_DELAY"`
+	MaxDelay     Duration `yaml:"max_delay" toml:"max_delay" env:"APP_AUTH_LOCKOUT_MAX_DELAY"`
+	LockDuration Duration `yaml:"lock_duration" toml:"lock_duration" env:"APP_AUTH_LOCKOUT_LOCK_DURATION"`
+
+	AccountFreeAttempts int `yaml:"account_free_attempts" toml:"account_free_attempts" env:"APP_AUTH_LOCKOUT_ACCOUNT_FREE_ATTEMPTS"`
+	AccountMaxFailures  int `yaml:"account_max_failures" toml:"account_max_failures" env:"APP_AUTH_LOCKOUT_ACCOUNT_MAX_FAILURES"`
+	// The IP limits are higher because many users can share an address
+	IPFreeAttempts int `yaml:"ip_free_attempts" toml:"ip_free_attempts" env:"APP_AUTH_LOCKOUT_IP_FREE_ATTEMPTS"`
+	IPMaxFailures  int `yaml:"ip_max_failures" toml:"ip_max_failures" env:"APP_AUTH_LOCKOUT_IP_MAX_FAILURES"`
+}
+
+// TwoFactorConfig controls TOTP two-factor authentication
+type TwoFactorConfig struct {
+	// Issuer is the account name shown by authenticator apps
+	Issuer string `yaml:"issuer" toml:"issuer" env:"APP_AUTH_TWO_FACTOR_ISSUER"`
+	// ChallengeTTL is how long a password login has to be completed with a code
+	ChallengeTTL Duration `yaml:"challenge_ttl" toml:"challenge_ttl" env:"APP_AUTH_TWO_FACTOR_CHALLENGE_TTL"`
+	// RecoveryCodes is how many one-time recovery codes are issued at a time
+	RecoveryCodes int `yaml:"recovery_codes" toml:"recovery_codes" env:"APP_AUTH_TWO_FACTOR_RECOVERY_CODES"`
+}
+
+// PublisherConfig controls the background worker that publishes scheduled posts
+type PublisherConfig struct {
+	Enabled  bool     `yaml:"enabled" toml:"enabled" env:"APP_PUBLISHER_ENABLED"`
+	Interval Duration `yaml:"interval" toml:"interval" env:"APP_PUBLISHER_INTERVAL"`
+	// BatchSize is how many posts are published per query
+	BatchSize int `yaml:"batch_size" toml:"batch_size" env:"APP_PUBLISHER_BATCH_SIZE"`
+}
+
+// FeedConfig controls how home timelines are built and paged
+type FeedConfig struct {
+	// Strategy is "pull" to query the follow graph on read or "fanout" to
+	// materialize timelines on write
+	Strategy    string `yaml:"strategy" toml:"strategy" env:"APP_FEED_STRATEGY"`
+	PageSize    int    `yaml:"page_size" toml:"page_size" env:"APP_FEED_PAGE_SIZE"`
+	MaxPageSize int    `yaml:"max_page_size" toml:"max_page_size" env:"APP_FEED_MAX_PAGE_SIZE"`
+}
+
+// MailConfig selects how emails are delivered
+type MailConfig struct {
+	// Transport is "smtp", "file" to write messages into Dir, or "log"
+	Transport string `yaml:"transport" toml:"transport" env:"APP_MAIL_TRANSPORT"`
+	// AllowLog enables the log transport. It prints reset and verification
+	// links where anyone reading the logs can use them, so it is off unless
+	// asked for.
+	AllowLog bool       `yaml:"allow_log" toml:"allow_log" env:"APP_MAIL_ALLOW_LOG"`
+	From     string     `yaml:"from" toml:"from" env:"APP_MAIL_FROM"`
+	Dir      string     `yaml:"dir" toml:"dir" env:"APP_MAIL_DIR"`
+	SMTP     SMTPConfig `yaml:"smtp" toml:"smtp"`
+}
+
+// SMTPConfig describes the SMTP server used by the smtp mail transport
+type SMTPConfig struct {
+	Host         string `yaml:"host" toml:"host" env:"APP_MAIL_SMTP_HOST"`
+	Port         int    `yaml:"port" toml:"port" env:"APP_MAIL_SMTP_PORT"`
+	Username     string `yaml:"username" toml:"username" env:"APP_MAIL_SMTP_USERNAME"`
+	Password     string `yaml:"password" toml:"password" env:"APP_MAIL_SMTP_PASSWORD"`
+	PasswordFile string `yaml:"password_file" toml:"password_file" env:"APP_MAIL_SMTP_PASSWORD_FILE"`
+}
+
+// PasswordResetConfig controls the tokens mailed to users who forgot their
+// password
+type PasswordResetConfig struct {
+	TokenTTL Duration `yaml:"token_ttl" toml:"token_ttl" env:"APP_PASSWORD_RESET_TOKEN_TTL"`
+	// MaxActiveTokens caps the links a user can have outstanding; further
+	// requests are accepted but mail nothing until one is used or expires
+	MaxActiveTokens int `yaml:"max_active_tokens" toml:"max_active_tokens" env:"APP_PASSWORD_RESET_MAX_ACTIVE_TOKENS"`
+	// URL is the page the emailed link opens; the token is appended as the
+	// token query parameter
+	URL string `yaml:"url" toml:"url" env:"APP_PASSWORD_RESET_URL"`
+}
+
+// EmailVerificationConfig controls the tokens mailed to verify an email
+// address
+type EmailVerificationConfig struct {
+	TokenTTL Duration `yaml:"token_ttl" toml:"token_ttl" env:"APP_EMAIL_VERIFICATION_TOKEN_TTL"`
+	// URL is the page the emailed link opens; the token is appended as the
+	// token query parameter
+	URL string `yaml:"url" toml:"url" env:"APP_EMAIL_VERIFICATION_URL"`
+}
+
+// AccountConfig controls account deletion and personal data exports
+type AccountConfig struct {
+	// DeletionGracePeriod is how long a deleted account can be restored
+	// before its data is erased
+	DeletionGracePeriod Duration `yaml:"deletion_grace_period" toml:"deletion_grace_period" env:"APP_ACCOUNT_DELETION_GRACE_PERIOD"`
+	// Erasure is "anonymize" to keep the posts, comments and likes of an
+	// erased account under a nameless placeholder, or "delete" to remove them
+	Erasure string `yaml:"erasure" toml:"erasure" env:"APP_ACCOUNT_ERASURE"`
+	// ExportDir is where export archives are written
+	ExportDir string `yaml:"export_dir" toml:"export_dir" env:"APP_ACCOUNT_EXPORT_DIR"`
+	// ExportTTL is how long a finished export can be downloaded
+	ExportTTL Duration `yaml:"export_ttl" toml:"export_ttl" env:"APP_ACCOUNT_EXPORT_TTL"`
+	// WorkerInterval is how often exports are built and due deletions
+	// carried out
+	WorkerInterval Duration `yaml:"worker_interval" toml:"worker_interval" env:"APP_ACCOUNT_WORKER_INTERVAL"`
+}
+
+// NotificationsConfig controls the notification streams
+type NotificationsConfig struct {
+	// Broker is "memory" to deliver notifications to the streams of this
+	// process only, or "postgres" to fan them out to every replica with
+	// LISTEN/NOTIFY
+	Broker string `yaml:"broker" toml:"broker" env:"APP_NOTIFICATIONS_BROKER"`
+	// Heartbeat is how often an idle stream is sent a heartbeat event
+	Heartbeat Duration `yaml:"heartbeat" toml:"heartbeat" env:"APP_NOTIFICATIONS_HEARTBEAT"`
+	// ReplayLimit caps the notifications replayed to a stream that resumes
+	// from a Last-Event-ID
+	ReplayLimit int `yaml:"replay_limit" toml:"replay_limit" env:"APP_NOTIFICATIONS_REPLAY_LIMIT"`
+	// AllowedOrigins lists the browser origins besides the server's own
+	// that may open the WebSocket
+	AllowedOrigins []string `yaml:"allowed_origins" toml:"allowed_origins" env:"APP_NOTIFICATIONS_ALLOWED_ORIGINS"`
+	// Digest controls the email digest of unread notifications
+	Digest DigestConfig `yaml:"digest" toml:"digest"`
+}
+
+// DigestConfig controls the daily and weekly emails summing up the
+// notifications users have not read. Digests cover the day or week up to
+// Hour (UTC) and are sent once that period has ended.
+type DigestConfig struct {
+	Enabled bool `yaml:"enabled" toml:"enabled" env:"APP_NOTIFICATIONS_DIGEST_ENABLED"`
+	// Interval is how often the worker looks for digests to send
+	Interval Duration `yaml:"interval" toml:"interval" env:"APP_NOTIFICATIONS_DIGEST_INTERVAL"`
+	// DefaultFrequency is "daily", "weekly" or "off" for users who have not
+	// chosen
+	DefaultFrequency string `yaml:"default_frequency" toml:"default_frequency" env:"APP_NOTIFICATIONS_DIGEST_DEFAULT_FREQUENCY"`
+	// Hour is the hour of the day, in UTC, periods end at
+	Hour int `yaml:"hour" toml:"hour" env:"APP_NOTIFICATIONS_DIGEST_HOUR"`
+	// Weekday is the day weekly periods end on, such as "monday"
+	Weekday string `yaml:"weekday" toml:"weekday" env:"APP_NOTIFICATIONS_DIGEST_WEEKDAY"`
+	// MaxItems caps the notifications listed in one digest
+	MaxItems int `yaml:"max_items" toml:"max_items" env:"APP_NOTIFICATIONS_DIGEST_MAX_ITEMS"`
+	// URL is the page of the app the digest links to
+	URL string `yaml:"url" toml:"url" env:"APP_NOTIFICATIONS_DIGEST_URL"`
+	// UnsubscribeURL is the page the unsubscribe link opens; the token is
+	// appended as the token query parameter
+	UnsubscribeURL string `yaml:"unsubscribe_url" toml:"unsubscribe_url" env:"APP_NOTIFICATIONS_DIGEST_UNSUBSCRIBE_URL"`
+}
+
+// WebhooksConfig controls the background worker that delivers webhooks.
+// Failed deliveries are retried after InitialBackoff, doubling up to
+// MaxBackoff, until MaxAttempts have failed.
+type WebhooksConfig struct {
+	Enabled  bool     `yaml:"enabled" toml:"enabled" env:"APP_WEBHOOKS_ENABLED"`
+	Interval Duration `yaml:"interval" toml:"interval" env:"APP_WEBHOOKS_INTERVAL"`
+	// BatchSize is how many deliveries are attempted at once
+	BatchSize int `yaml:"batch_size" toml:"batch_size" env:"APP_WEBHOOKS_BATCH_SIZE"`
+	// Timeout bounds each delivery request
+	Timeout        Duration `yaml:"timeout" toml:"timeout" env:"APP_WEBHOOKS_TIMEOUT"`
+	MaxAttempts    int      `yaml:"max_attempts" toml:"max_attempts" env:"APP_WEBHOOKS_MAX_ATTEMPTS"`
+	InitialBackoff Duration `yaml:"initial_backoff" toml:"initial_backoff" env:"APP_WEBHOOKS_INITIAL_BACKOFF"`
+	MaxBackoff     Duration `yaml:"max_backoff" toml:"max_backoff" env:"APP_WEBHOOKS_MAX_BACKOFF"`
+	// AllowPrivateNetworks lets webhooks reach loopback, private and
+	// link-local addresses. Only for development: it lets users make the
+	// server send requests into its own network.
+	AllowPrivateNetworks bool `yaml:"allow_private_networks" toml:"allow_private_networks" env:"APP_WEBHOOKS_ALLOW_PRIVATE_NETWORKS"`
+}
+
+// OAuthConfig controls sign-in with OpenID Connect providers
+type OAuthConfig struct {
+	// CallbackURL is the redirect URI registered with the providers;
+	// {provider} is replaced with the provider name
+	CallbackURL string `yaml:"callback_url" toml:"callback_url" env:"APP_OAUTH_CALLBACK_URL"`
+	// StateTTL is how long a user has to come back from the provider
+	StateTTL Duration `yaml:"state_ttl" toml:"state_ttl" env:"APP_OAUTH_STATE_TTL"`
+	// Providers are keyed by the name used in the URLs. The "facebook"
+	// provider only needs a client ID and secret.
+	Providers map[string]OIDCProviderConfig `yaml:"providers" toml:"providers"`
+}
+
+// OIDCProviderConfig describes an OpenID Connect provider. The endpoints
+// are discovered from the issuer unless they are set.
+type OIDCProviderConfig struct {
+	Issuer           string   `yaml:"issuer" toml:"issuer"`
+	ClientID         string   `yaml:"client_id" toml:"client_id"`
+	ClientSecret     string   `yaml:"client_secret" toml:"client_secret"`
+	ClientSecretFile string   `yaml:"client_secret_file" toml:"client_secret_file"`
+	Scopes           []string `yaml:"scopes" toml:"scopes"`
+	AuthorizationURL string   `yaml:"authorization_url" toml:"authorization_url"`
+	TokenURL         string   `yaml:"token_url" toml:"token_url"`
+	JWKSURL          string   `yaml:"jwks_url" toml:"jwks_url"`
+	// TrustEmail treats the emails of the provider as verified even when
+	// its ID tokens have no email_verified claim
+	TrustEmail bool `yaml:"trust_email" toml:"trust_email"`
+}
+
+// CookieConfig sets the attributes of the cookies issued on login
+type CookieConfig struct {
+	Domain string `yaml:"domain" toml:"domain" env:"APP_AUTH_COOKIE_DOMAIN"`
+	Secure bool   `yaml:"secure" toml:"secure" env:"APP_AUTH_COOKIE_SECURE"`
+	// SameSite is one of lax, strict, none or default
+	SameSite string `yaml:"same_site" toml:"same_site" env:"APP_AUTH_COOKIE_SAME_SITE"`
+}
+
+// SameSiteMode converts SameSite to its net/http value
+func (c CookieConfig) SameSiteMode() http.SameSite {
+	switch strings.ToLower(c.SameSite) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	case "default":
+		return http.SameSiteDefaultMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+// EndWeekday converts Weekday to its time value
+func (c DigestConfig) EndWeekday() (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(c.Weekday, day.String()) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday %q", c.Weekday)
+}
+
+// Duration is a time.Duration written as "15m" or "168h" in config files
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Duration returns d as a time.Duration
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+// Default returns the settings used when nothing overrides them. There is
+// deliberately no default JWT secret.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr: ":8080",
+			Mode: "debug",
+		},
+		Database: DatabaseConfig{
+			Host:       "localhost",
+			Port:       5432,
+			Name:       "firstdb1",
+			SSLMode:    "disable",
+			Migrations: "auto",
+		},
+		Auth: AuthConfig{
+			AccessTokenTTL:  Duration(time.Minute * 15),
+			RefreshTokenTTL: Duration(time.Hour * 24 * 7),
+			TokenSources:    []string{"header", "cookie"},
+			CSRF:            true,
+			Cookie: CookieConfig{
+				Domain:   "localhost",
+				SameSite: "lax",
+			},
+			Signing: SigningConfig{
+				Algorithm:   "RS256",
+				KeyCacheTTL: Duration(time.Minute),
+			},
+			TwoFactor: TwoFactorConfig{
+				Issuer:        "firstProject",
+				ChallengeTTL:  Duration(time.Minute * 5),
+				RecoveryCodes: 10,
+			},
+			Lockout: LockoutConfig{
+				Enabled:             true,
+				Window:              Duration(time.Minute * 15),
+				BaseDelay:           Duration(time.Second),
+				MaxDelay:            Duration(time.Minute),
+				LockDuration:        Duration(time.Minute * 15),
+				AccountFreeAttempts: 3,
+				AccountMaxFailures:  10,
+				IPFreeAttempts:      20,
+				IPMaxFailures:       100,
+			},
+			Sessions: SessionsConfig{
+				FlushInterval: Duration(time.Minute),
+			},
+		},
+		Publisher: PublisherConfig{
+			Enabled:   true,
+			Interval:  Duration(time.Second * 30),
+			BatchSize: 100,
+		},
+		Feed: FeedConfig{
+			Strategy:    "pull",
+			PageSize:    20,
+			MaxPageSize: 100,
+		},
+		Mail: MailConfig{
+			Transport: "smtp",
+			From:      "no-reply@localhost",
+			Dir:       "mail",
+			SMTP:      SMTPConfig{Host: "localhost", Port: 587},
+		},
+		PasswordReset: PasswordResetConfig{
+			TokenTTL:        Duration(time.Hour),
+			MaxActiveTokens: 3,
+			URL:             "http://localhost:8080/password/reset",
+		},
+		EmailVerification: EmailVerificationConfig{
+			TokenTTL: Duration(time.Hour * 48),
+			URL:      "http://localhost:8080/email/verify",
+		},
+		OAuth: OAuthConfig{
+			CallbackURL: "http://localhost:8080/oauth/{provider}/callback",
+			StateTTL:    Duration(time.Minute * 10),
+		},
+		Account: AccountConfig{
+			DeletionGracePeriod: Duration(time.Hour * 24 * 30),
+			Erasure:             "anonymize",
+			ExportDir:           "exports",
+			ExportTTL:           Duration(time.Hour * 24 * 7),
+			WorkerInterval:      Duration(time.Minute),
+		},
+		Notifications: NotificationsConfig{
+			Broker:      "memory",
+			Heartbeat:   Duration(30 * time.Second),
+			ReplayLimit: 100,
+			Digest: DigestConfig{
+				Enabled:          true,
+				Interval:         Duration(10 * time.Minute),
+				DefaultFrequency: "weekly",
+				Hour:             8,
+				Weekday:          "monday",
+				MaxItems:         20,
+				URL:              "http://localhost:8080/notifications",
+				UnsubscribeURL:   "http://localhost:8080/notifications/digest/unsubscribe",
+			},
+		},
+		Webhooks: WebhooksConfig{
+			Enabled:        true,
+			Interval:       Duration(5 * time.Second),
+			BatchSize:      50,
+			Timeout:        Duration(10 * time.Second),
+			MaxAttempts:    8,
+			InitialBackoff: Duration(30 * time.Second),
+			MaxBackoff:     Duration(6 * time.Hour),
+		},
+	}
+}
+
+// Load reads the config file at path (if any) on top of the defaults, then
+// applies environment overrides and secret files, and validates the result.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(data, cfg)
+		case ".toml":
+			err = toml.Unmarshal(data, cfg)
+		default:
+			err = fmt.Errorf("unsupported config file extension %q", filepath.Ext(path))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+	if err := cfg.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// applyEnv overwrites every field tagged with `env` whose variable is set
+func applyEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := t.Field(i).Tag.Get("env")
+		if name == "" {
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	if u, ok := field.Addr().Interface().(interface{ UnmarshalText([]byte) error }); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Kind())
+	}
+	return nil
+}
+
+// resolveSecrets replaces secrets with the contents of their *_file
+// counterparts, so they can be mounted instead of written into the config.
+func (c *Config) resolveSecrets() error {
+	secrets := []struct {
+		file  string
+		value *string
+	}{
+		{c.Database.PasswordFile, &c.Database.Password},
+		{c.Auth.JWTSecretFile, &c.Auth.JWTSecret},
+		{c.Mail.SMTP.PasswordFile, &c.Mail.SMTP.Password},
+	}
+
+	for _, secret := range secrets {
+		if secret.file == "" {
+			continue
+		}
+		data, err := os.ReadFile(secret.file)
+		if err != nil {
+			return fmt.Errorf("reading secret file: %w", err)
+		}
+		*secret.value = strings.TrimSpace(string(data))
+	}
+
+	// Map values are copies, so provider secrets are written back
+	for name, provider := range c.OAuth.Providers {
+		if provider.ClientSecretFile == "" {
+			continue
+		}
+		data, err := os.ReadFile(provider.ClientSecretFile)
+		if err != nil {
+			return fmt.Errorf("reading secret file: %w", err)
+		}
+		provider.ClientSecret = strings.TrimSpace(string(data))
+		c.OAuth.Providers[name] = provider
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Server.Addr == "" {
+		errs = append(errs, errors.New("server.addr is required"))
+	}
+	switch c.Server.Mode {
+	case "debug", "release", "test":
+	default:
+		errs = append(errs, fmt.Errorf("server.mode must be debug, release or test, got %q", c.Server.Mode))
+	}
+
+	if c.Database.Host == "" {
+		errs = append(errs, errors.New("database.host is required"))
+	}
+	if c.Database.Port <= 0 || c.Database.Port > 65535 {
+		errs = append(errs, fmt.Errorf("database.port must be between 1 and 65535, got %d", c.Database.Port))
+	}
+	if c.Database.User == "" {
+		errs = append(errs, errors.New("database.user is required"))
+	}
+	if c.Database.Password == "" {
+		errs = append(errs, errors.New("database.password or database.password_file is required"))
+	}
+	if c.Database.Name == "" {
+		errs = append(errs, errors.New("database.name is required"))
+	}
+	switch c.Database.Migrations {
+	case "auto", "check", "off":
+	default:
+		errs = append(errs, fmt.Errorf("database.migrations must be auto, check or off, got %q", c.Database.Migrations))
+	}
+
+	if c.Auth.AccessTokenTTL <= 0 {
+		errs = append(errs, errors.New("auth.access_token_ttl must be positive"))
+	}
+	if c.Auth.RefreshTokenTTL <= 0 {
+		errs = append(errs, errors.New("auth.refresh_token_ttl must be positive"))
+	}
+	if len(c.Auth.TokenSources) == 0 {
+		errs = append(errs, errors.New("auth.token_sources must not be empty"))
+	}
+	for _, source := range c.Auth.TokenSources {
+		if source != "header" && source != "cookie" {
+			errs = append(errs, fmt.Errorf("auth.token_sources: unknown source %q", source))
+		}
+	}
+	switch strings.ToLower(c.Auth.Cookie.SameSite) {
+	case "lax", "strict", "default":
+	case "none":
+		if !c.Auth.Cookie.Secure {
+			errs = append(errs, errors.New("auth.cookie.same_site none requires auth.cookie.secure"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("auth.cookie.same_site must be lax, strict, none or default, got %q", c.Auth.Cookie.SameSite))
+	}
+	switch c.Auth.Signing.Algorithm {
+	case "RS256", "EdDSA":
+	default:
+		errs = append(errs, fmt.Errorf("auth.signing.algorithm must be RS256 or EdDSA, got %q", c.Auth.Signing.Algorithm))
+	}
+	if c.Auth.Signing.KeyCacheTTL <= 0 {
+		errs = append(errs, errors.New("auth.signing.key_cache_ttl must be positive"))
+	}
+	if c.Auth.TwoFactor.Issuer == "" {
+		errs = append(errs, errors.New("auth.two_factor.issuer is required"))
+	}
+	if c.Auth.TwoFactor.ChallengeTTL <= 0 {
+		errs = append(errs, errors.New("auth.two_factor.challenge_ttl must be positive"))
+	}
+	if c.Auth.TwoFactor.RecoveryCodes <= 0 {
+		errs = append(errs, errors.New("auth.two_factor.recovery_codes must be positive"))
+	}
+	if lockout := c.Auth.Lockout; lockout.Enabled {
+		if lockout.Window <= 0 || lockout.BaseDelay <= 0 || lockout.LockDuration <= 0 {
+			errs = append(errs, errors.New("auth.lockout.window, base_delay and lock_duration must be positive"))
+		}
+		if lockout.MaxDelay < lockout.BaseDelay {
+			errs = append(errs, errors.New("auth.lockout.max_delay must be at least auth.lockout.base_delay"))
+		}
+		if lockout.AccountFreeAttempts < 0 || lockout.AccountMaxFailures <= lockout.AccountFreeAttempts {
+			errs = append(errs, errors.New("auth.lockout.account_max_failures must be greater than auth.lockout.account_free_attempts"))
+		}
+		if lockout.IPFreeAttempts < 0 || lockout.IPMaxFailures <= lockout.IPFreeAttempts {
+			errs = append(errs, errors.New("auth.lockout.ip_max_failures must be greater than auth.lockout.ip_free_attempts"))
+		}
+	}
+
+	if c.Auth.Sessions.FlushInterval <= 0 {
+		errs = append(errs, errors.New("auth.sessions.flush_interval must be positive"))
+	}
+
+	if len(c.OAuth.Providers) > 0 {
+		if c.OAuth.CallbackURL == "" {
+			errs = append(errs, errors.New("oauth.callback_url is required"))
+		}
+		if c.OAuth.StateTTL <= 0 {
+			errs = append(errs, errors.New("oauth.state_ttl must be positive"))
+		}
+	}
+	for name, provider := range c.OAuth.Providers {
+		if provider.ClientID == "" {
+			errs = append(errs, fmt.Errorf("oauth.providers.%s.client_id is required", name))
+		}
+		if provider.Issuer == "" && name != "facebook" {
+			errs = append(errs, fmt.Errorf("oauth.providers.%s.issuer is required", name))
+		}
+	}
+
+	if c.Publisher.Enabled {
+		if c.Publisher.Interval <= 0 {
+			errs = append(errs, errors.New("publisher.interval must be positive"))
+		}
+		if c.Publisher.BatchSize <= 0 {
+			errs = append(errs, errors.New("publisher.batch_size must be positive"))
+		}
+	}
+
+	switch c.Feed.Strategy {
+	case "pull", "fanout":
+	default:
+		errs = append(errs, fmt.Errorf("feed.strategy must be pull or fanout, got %q", c.Feed.Strategy))
+	}
+	if c.Feed.PageSize <= 0 || c.Feed.PageSize > c.Feed.MaxPageSize {
+		errs = append(errs, errors.New("feed.page_size must be positive and at most feed.max_page_size"))
+	}
+
+	if c.Mail.From == "" {
+		errs = append(errs, errors.New("mail.from is required"))
+	}
+	switch c.Mail.Transport {
+	case "log":
+		if !c.Mail.AllowLog {
+			errs = append(errs, errors.New("mail.transport log prints reset links and must be enabled with mail.allow_log"))
+		}
+	case "file":
+		if c.Mail.Dir == "" {
+			errs = append(errs, errors.New("mail.dir is required by the file transport"))
+		}
+	case "smtp":
+		if c.Mail.SMTP.Host == "" {
+			errs = append(errs, errors.New("mail.smtp.host is required by the smtp transport"))
+		}
+		if c.Mail.SMTP.Port <= 0 || c.Mail.SMTP.Port > 65535 {
+			errs = append(errs, fmt.Errorf("mail.smtp.port must be between 1 and 65535, got %d", c.Mail.SMTP.Port))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("mail.transport must be smtp, file or log, got %q", c.Mail.Transport))
+	}
+
+	if c.PasswordReset.TokenTTL <= 0 {
+		errs = append(errs, errors.New("password_reset.token_ttl must be positive"))
+	}
+	if c.PasswordReset.MaxActiveTokens <= 0 {
+		errs = append(errs, errors.New("password_reset.max_active_tokens must be positive"))
+	}
+	if c.PasswordReset.URL == "" {
+		errs = append(errs, errors.New("password_reset.url is required"))
+	}
+	if c.EmailVerification.TokenTTL <= 0 {
+		errs = append(errs, errors.New("email_verification.token_ttl must be positive"))
+	}
+	if c.EmailVerification.URL == "" {
+		errs = append(errs, errors.New("email_verification.url is required"))
+	}
+
+	if c.Account.DeletionGracePeriod < 0 {
+		errs = append(errs, errors.New("account.deletion_grace_period must not be negative"))
+	}
+	if c.Account.Erasure != "anonymize" && c.Account.Erasure != "delete" {
+		errs = append(errs, fmt.Errorf("account.erasure must be anonymize or delete, got %q", c.Account.Erasure))
+	}
+	if c.Account.ExportDir == "" {
+		errs = append(errs, errors.New("account.export_dir is required"))
+	}
+	if c.Account.ExportTTL <= 0 || c.Account.WorkerInterval <= 0 {
+		errs = append(errs, errors.New("account.export_ttl and worker_interval must be positive"))
+	}
+
+	if c.Notifications.Broker != "memory" && c.Notifications.Broker != "postgres" {
+		errs = append(errs, fmt.Errorf("notifications.broker must be memory or postgres, got %q", c.Notifications.Broker))
+	}
+	if c.Notifications.Heartbeat <= 0 {
+		errs = append(errs, errors.New("notifications.heartbeat must be positive"))
+	}
+	if c.Notifications.ReplayLimit < 1 || c.Notifications.ReplayLimit > 1000 {
+		errs = append(errs, fmt.Errorf("notifications.replay_limit must be between 1 and 1000, got %d", c.Notifications.ReplayLimit))
+	}
+	digest := c.Notifications.Digest
+	if digest.Interval <= 0 {
+		errs = append(errs, errors.New("notifications.digest.interval must be positive"))
+	}
+	switch digest.DefaultFrequency {
+	case "daily", "weekly", "off":
+	default:
+		errs = append(errs, fmt.Errorf("notifications.digest.default_frequency must be daily, weekly or off, got %q", digest.DefaultFrequency))
+	}
+	if digest.Hour < 0 || digest.Hour > 23 {
+		errs = append(errs, fmt.Errorf("notifications.digest.hour must be between 0 and 23, got %d", digest.Hour))
+	}
+	if _, err := digest.EndWeekday(); err != nil {
+		errs = append(errs, fmt.Errorf("notifications.digest.weekday: %w", err))
+	}
+	if digest.MaxItems < 1 {
+		errs = append(errs, errors.New("notifications.digest.max_items must be positive"))
+	}
+	if digest.URL == "" || digest.UnsubscribeURL == "" {
+		errs = append(errs, errors.New("notifications.digest.url and unsubscribe_url are required"))
+	}
+
+	if c.Webhooks.Interval <= 0 || c.Webhooks.Timeout <= 0 {
+		errs = append(errs, errors.New("webhooks.interval and timeout must be positive"))
+	}
+	if c.Webhooks.BatchSize < 1 || c.Webhooks.MaxAttempts < 1 {
+		errs = append(errs, errors.New("webhooks.batch_size and max_attempts must be positive"))
+	}
+	if c.Webhooks.InitialBackoff <= 0 || c.Webhooks.MaxBackoff < c.Webhooks.InitialBackoff {
+		errs = append(errs, errors.New("webhooks.initial_backoff must be positive and no longer than max_backoff"))
+	}
+
+	return errors.Join(errs...)
+}
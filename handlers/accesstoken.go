@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scope limits what a personal access token may be used for. Scopes only
+// narrow a token: the user's permissions still apply on top of them.
+type Scope string
+
+const (
+	ScopePostsRead          Scope = "posts:read"
+	ScopePostsWrite         Scope = "posts:write"
+	ScopeEngagementsRead    Scope = "engagements:read"
+	ScopeEngagementsWrite   Scope = "engagements:write"
+	ScopeAnalyticsRead      Scope = "analytics:read"
+	ScopeAnalyticsWrite     Scope = "analytics:write"
+	ScopeNotificationsRead  Scope = "notifications:read"
+	ScopeNotificationsWrite Scope = "notifications:write"
+	ScopeFollowsRead        Scope = "follows:read"
+	ScopeFollowsWrite       Scope = "follows:write"
+	ScopeCompaniesRead      Scope = "companies:read"
+	ScopeCompaniesWrite     Scope = "companies:write"
+	ScopeUsersRead          Scope = "users:read"
+	ScopeUsersWrite         Scope = "users:write"
+	ScopeRolesRead          Scope = "roles:read"
+	ScopeRolesWrite         Scope = "roles:write"
+)
+
+// Scopes describes every scope a token can be given
+var Scopes = map[Scope]string{
+	ScopePostsRead:          "Read posts and the home feed",
+	ScopePostsWrite:         "Create, edit, schedule and delete posts",
+	ScopeEngagementsRead:    "Read likes and comments",
+	ScopeEngagementsWrite:   "Like and comment on posts",
+	ScopeAnalyticsRead:      "Read post analytics",
+	ScopeAnalyticsWrite:     "Track post views",
+	ScopeNotificationsRead:  "Read notifications",
+	ScopeNotificationsWrite: "Create notifications and mark them read",
+	ScopeFollowsRead:        "Read followers and followings",
+	ScopeFollowsWrite:       "Follow and unfollow users",
+	ScopeCompaniesRead:      "Read companies",
+	ScopeCompaniesWrite:     "Create, edit and delete companies",
+	ScopeUsersRead:          "Read the profile and search users",
+	ScopeUsersWrite:         "Edit the profile",
+	ScopeRolesRead:          "Read roles, permissions and role assignments",
+	ScopeRolesWrite:         "Manage roles and role assignments",
+}
+
+// scopeRoutes maps the routes usable with a personal access token to the
+// scope a read (GET or HEAD) or a write needs. Paths are gin route paths
+// and match by whole segments; the first match wins. Routes missing here,
+// such as the login, token and account management ones, need a real login.
+var scopeRoutes = []struct {
+	path        string
+	read, write Scope
+}{
+	{"/search/posts", ScopePostsRead, ScopePostsRead},
+	{"/search/users", ScopeUsersRead, ScopeUsersRead},
+	{"/posts", ScopePostsRead, ScopePostsWrite},
+	{"/create-post", ScopePostsWrite, ScopePostsWrite},
+	{"/edit-post", ScopePostsWrite, ScopePostsWrite},
+	{"/feed", ScopePostsRead, ScopePostsRead},
+	{"/engagements", ScopeEngagementsRead, ScopeEngagementsWrite},
+	{"/track-post-view", ScopeAnalyticsWrite, ScopeAnalyticsWrite},
+	{"/post-analytics", ScopeAnalyticsRead, ScopeAnalyticsRead},
+	{"/notifications", ScopeNotificationsRead, ScopeNotificationsWrite},
+	{"/follow", ScopeFollowsWrite, ScopeFollowsWrite},
+	{"/unfollow", ScopeFollowsWrite, ScopeFollowsWrite},
+	{"/followers", ScopeFollowsRead, ScopeFollowsRead},
+	{"/followings", ScopeFollowsRead, ScopeFollowsRead},
+	{"/create-company", ScopeCompaniesWrite, ScopeCompaniesWrite},
+	{"/companies", ScopeCompaniesRead, ScopeCompaniesWrite},
+	{"/profile", ScopeUsersRead, ScopeUsersWrite},
+	{"/update-profile", ScopeUsersWrite, ScopeUsersWrite},
+	{"/roles", ScopeRolesRead, ScopeRolesWrite},
+	{"/permissions", ScopeRolesRead, ScopeRolesRead},
+	{"/users/:userId/roles", ScopeRolesRead, ScopeRolesWrite},
+}
+
+// requiredScope returns the scope a request to the route path needs, or
+// false when the route cannot be used with a personal access token
+func requiredScope(method, path string) (Scope, bool) {
+	for _, route := range scopeRoutes {
+		if path != route.path && !strings.HasPrefix(path, route.path+"/") {
+			continue
+		}
+		if method == http.MethodGet || method == http.MethodHead {
+			return route.read, true
+		}
+		return route.write, true
+	}
+	return "", false
+}
+
+// accessTokenPrefix starts every personal access token, which tells them
+// apart from JWTs and makes leaked tokens easy to search for
+const accessTokenPrefix = "pat_"
+
+// accessTokenTouchInterval limits how often LastUsedAt is written, so busy
+// integrations do not cause a write per request
+const accessTokenTouchInterval = time.Minute
+
+// PersonalAccessToken lets scripts call the API on behalf of a user
+// without logging in. Only the hash of the token is stored; Prefix is the
+// start of the token, shown so users can tell their tokens apart.
+type PersonalAccessToken struct {
+	ID         int        `json:"id" db:"id"`
+	UserID     int        `json:"userId" db:"user_id"`
+	Name       string     `json:"name" db:"name"`
+	TokenHash  string     `json:"-" db:"token_hash"`
+	Prefix     string     `json:"prefix" db:"prefix"`
+	Scopes     []Scope    `json:"scopes" db:"scopes" gorm:"serializer:json"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty" db:"expires_at"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty" db:"last_used_at"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty" db:"revoked_at"`
+	CreatedAt  time.Time  `json:"createdAt" db:"created_at"`
+}
+
+// HasScope reports whether the token was given scope
+func (t PersonalAccessToken) HasScope(scope Scope) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateAccessToken resolves a personal access token for
+// AuthMiddleware. It writes the error response and returns false when the
+// token is unknown, expired or revoked, belongs to an account being
+// deleted, or lacks the scope of the route.
+func authenticateAccessToken(c *gin.Context, s *Stores, raw string) bool {
+	token, err := s.AccessTokens.GetByHash(hashToken(raw))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return false
+	}
+	now := time.Now()
+	if err != nil || token.RevokedAt != nil || (token.ExpiresAt != nil && !token.ExpiresAt.After(now)) {
+		log.Println("Invalid personal access token")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return false
+	}
+	// Automation stops with the account, until it is restored
+	user, err := s.Users.GetByID(token.UserID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return false
+	}
+	if err != nil || user.DeleteAfter != nil || user.DeletedAt != nil {
+		log.Println("Personal access token of a deleted account")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return false
+	}
+
+	scope, ok := requiredScope(c.Request.Method, c.FullPath())
+	if !ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This endpoint cannot be used with a personal access token"})
+		return false
+	}
+	if !token.HasScope(scope) {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("The token lacks the %s scope", scope)})
+		return false
+	}
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= accessTokenTouchInterval {
+		if err := s.AccessTokens.Touch(token.ID, now); err != nil {
+			log.Println("Error recording token use:", err)
+		}
+	}
+
+	c.Set("user_id", token.UserID)
+	c.Set("access_token_id", token.ID)
+	return true
+}
+
+// GetScopes lists the scopes personal access tokens can be given
+func GetScopes(c *gin.Context) {
+	c.JSON(http.StatusOK, Scopes)
+}
+
+// CreateAccessToken creates a personal access token for the caller. The
+// token itself is only ever returned by this response.
+func CreateAccessToken(c *gin.Context, s *Stores) {
+	var request struct {
+		Name      string     `json:"name" binding:"required,max=64"`
+		Scopes    []Scope    `json:"scopes" binding:"required,min=1"`
+		ExpiresAt *time.Time `json:"expiresAt"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, scope := range request.Scopes {
+		if _, ok := Scopes[scope]; !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown scope %q", scope)})
+			return
+		}
+	}
+	if request.ExpiresAt != nil && !request.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expiresAt must be in the future"})
+		return
+	}
+
+	secret, _, err := newSecretToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+	raw := accessTokenPrefix + secret
+
+	token := PersonalAccessToken{
+		UserID:    c.GetInt("user_id"),
+		Name:      request.Name,
+		TokenHash: hashToken(raw),
+		Prefix:    raw[:len(accessTokenPrefix)+6],
+		Scopes:    request.Scopes,
+		ExpiresAt: request.ExpiresAt,
+	}
+	if err := s.AccessTokens.Create(&token); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"token": raw, "accessToken": token})
+}
+
+// GetAccessTokens lists the unrevoked personal access tokens of the caller
+func GetAccessTokens(c *gin.Context, s *Stores) {
+	tokens, err := s.AccessTokens.ListByUser(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch tokens"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// RevokeAccessToken revokes one of the caller's personal access tokens
+func RevokeAccessToken(c *gin.Context, s *Stores) {
+	tokenID, err := strconv.Atoi(c.Param("tokenId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token ID"})
+		return
+	}
+
+	err = s.AccessTokens.Revoke(c.GetInt("user_id"), tokenID, time.Now())
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked successfully"})
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/mail"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Erasure modes of AccountConfig.Erasure
+const (
+	ErasureAnonymize = "anonymize"
+	ErasureDelete    = "delete"
+)
+
+// accountWorkerBatchSize is how many exports the account worker builds per
+// run
+const accountWorkerBatchSize = 10
+
+// DeleteAccount schedules the erasure of the caller's account once the
+// deletion grace period has passed and signs every session out. Accounts
+// with a password must confirm it.
+func DeleteAccount(c *gin.Context, s *Stores, cfg config.AccountConfig) {
+	user, err := s.Users.GetByID(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var request struct {
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil && user.Password != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if user.Password != "" && bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(request.Password)) != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid password"})
+		return
+	}
+	if user.DeleteAfter != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Account deletion is already scheduled", "deleteAfter": user.DeleteAfter})
+		return
+	}
+
+	deleteAfter := time.Now().Add(cfg.DeletionGracePeriod.Duration())
+	user.DeleteAfter = &deleteAfter
+	if err := s.Users.Update(user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	if err := revokeUserTokens(s, user.ID); err != nil {
+		log.Println("Error revoking user tokens:", err)
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":     "Account scheduled for deletion; sign in and restore it before then to keep it",
+		"deleteAfter": deleteAfter,
+	})
+}
+
+// RestoreAccount cancels the pending deletion of the caller's account
+func RestoreAccount(c *gin.Context, s *Stores) {
+	user, err := s.Users.GetByID(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	if user.DeleteAfter == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Account is not scheduled for deletion"})
+		return
+	}
+
+	user.DeleteAfter = nil
+	if err := s.Users.Update(user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore account"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account restored successfully"})
+}
+
+// anonymizedUser returns the placeholder an anonymized account leaves
+// behind: it keeps its ID for the content that points at it and nothing
+// that identifies its owner
+func anonymizedUser(user User, at time.Time) User {
+	return User{
+		ID:        user.ID,
+		Username:  fmt.Sprintf("deleted-%d", user.ID),
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: at,
+		DeletedAt: &at,
+	}
+}
+
+// eraseAccount removes everything stored about a user whose deletion is
+// due: their credentials and files here, their content through Accounts
+func eraseAccount(s *Stores, cfg config.AccountConfig, user User) error {
+	var errs []error
+	if err := revokeUserTokens(s, user.ID); err != nil {
+		errs = append(errs, err)
+	}
+	identities, err := s.Identities.ListByUser(user.ID)
+	errs = append(errs, err)
+	for _, identity := range identities {
+		errs = append(errs, s.Identities.Delete(user.ID, identity.ID))
+	}
+	assignments, err := s.Roles.Assignments(user.ID)
+	errs = append(errs, err)
+	for _, assignment := range assignments {
+		errs = append(errs, s.Roles.Unassign(user.ID, assignment.RoleID, assignment.CompanyID))
+	}
+	errs = append(errs, s.TwoFactor.Delete(user.ID))
+	errs = append(errs, s.NotificationPreferences.DeleteByUser(user.ID))
+	errs = append(errs, s.Digests.DeleteByUser(user.ID))
+	errs = append(errs, s.Webhooks.DeleteByUser(user.ID))
+
+	exports, err := s.AccountExports.DeleteByUser(user.ID)
+	errs = append(errs, err)
+	for _, export := range exports {
+		removeExportFile(export)
+	}
+
+	// Stop before erasing the account, so the next run tries again rather
+	// than leaving credentials behind
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	if err := s.Accounts.Erase(user.ID, cfg.Erasure == ErasureAnonymize); err != nil {
+		return err
+	}
+	if strings.HasPrefix(user.Avatar, "/avatars/") {
+		os.Remove(filepath.Join(uploadPath, "avatars", filepath.Base(user.Avatar)))
+	}
+	return nil
+}
+
+// AccountWorker builds requested data exports and erases the accounts
+// whose deletion grace period has passed
+type AccountWorker struct {
+	s      *Stores
+	mailer mail.Mailer
+	cfg    config.AccountConfig
+}
+
+// NewAccountWorker creates an AccountWorker
+func NewAccountWorker(s *Stores, mailer mail.Mailer, cfg config.AccountConfig) *AccountWorker {
+	return &AccountWorker{s: s, mailer: mailer, cfg: cfg}
+}
+
+// Run builds exports, erases due accounts and prunes expired exports every
+// interval until ctx is cancelled
+func (w *AccountWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.WorkerInterval.Duration())
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		if _, err := w.BuildExports(now); err != nil {
+			log.Println("Error building account exports:", err)
+		}
+		if _, err := w.EraseDue(now); err != nil {
+			log.Println("Error erasing deleted accounts:", err)
+		}
+		if err := w.PruneExports(now); err != nil {
+			log.Println("Error pruning account exports:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// EraseDue erases every account whose deletion was due at now and returns
+// how many were erased
+func (w *AccountWorker) EraseDue(now time.Time) (int, error) {
+	users, err := w.s.Accounts.DueForDeletion(now)
+	if err != nil {
+		return 0, err
+	}
+
+	erased := 0
+	var errs []error
+	for _, user := range users {
+		if err := eraseAccount(w.s, w.cfg, user); err != nil {
+			errs = append(errs, fmt.Errorf("user %d: %w", user.ID, err))
+			continue
+		}
+		log.Printf("Erased account %d", user.ID)
+		erased++
+	}
+	return erased, errors.Join(errs...)
+}
@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
 // PostView represents a post view entity
@@ -28,7 +27,7 @@ type EngagementMetrics struct {
 }
 
 // TrackPostView tracks a view for a post
-func TrackPostView(c *gin.Context, db *gorm.DB) {
+func TrackPostView(c *gin.Context, s *Stores) {
 	var postView PostView
 	if err := c.ShouldBindJSON(&postView); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -36,8 +35,7 @@ func TrackPostView(c *gin.Context, db *gorm.DB) {
 	}
 
 	// Check if the post with the specified ID exists
-	var existingPost Post
-	err := db.First(&existingPost, postView.PostID).Error
+	_, err := s.Posts.GetByID(postView.PostID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Post not found"})
 		return
@@ -48,7 +46,7 @@ func TrackPostView(c *gin.Context, db *gorm.DB) {
 	postView.UserID = userID.(int)
 	postView.Timestamp = time.Now()
 
-	err = db.Create(&postView).Error
+	err = s.Analytics.RecordView(&postView)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to track post view"})
 		log.Println("Error executing database query:", err)
@@ -59,40 +57,30 @@ func TrackPostView(c *gin.Context, db *gorm.DB) {
 }
 
 // GetPostAnalytics retrieves analytics data for a post
-func GetPostAnalytics(c *gin.Context, db *gorm.DB) {
+func GetPostAnalytics(c *gin.Context, s *Stores) {
 	postID, err := strconv.Atoi(c.Param("postId"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid post ID"})
 		return
 	}
 
-	// Assuming "likes" and "comments" are boolean fields in the "Engagement" table
 	var engagementMetrics EngagementMetrics
 
 	// Get the count of likes and comments for the specified PostID
-	err = db.Model(&Engagement{}).
-		Where("post_id = ? AND \"like\" = true", postID). // Corrected: use backticks around like
-		Count(&engagementMetrics.Like).
-		Error
+	engagementMetrics.Like, err = s.Engagements.CountLikes(postID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve likes count"})
 		log.Println("Error executing database query:", err)
 		return
 	}
 
-	err = db.Model(&Engagement{}).
-		Where("post_id = ? AND comment IS NOT NULL", postID).
-		Count(&engagementMetrics.Comment).
-		Error
+	engagementMetrics.Comment, err = s.Engagements.CountComments(postID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve comments count"})
 		log.Println("Error executing database query:", err)
 		return
 	}
-	err = db.Model(&PostView{}).
-		Where("post_id = ?", postID).
-		Count(&engagementMetrics.View).
-		Error
+	engagementMetrics.View, err = s.Analytics.CountViews(postID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve comments View"})
 		log.Println("Error executing database query:", err)
@@ -105,7 +93,7 @@ func GetPostAnalytics(c *gin.Context, db *gorm.DB) {
 	// Set user ID from the context (assuming user ID is available in the context)
 	userID, _ := c.Get("user_id")
 	engagementMetrics.UserID = userID.(int)
-	err = db.Create(&engagementMetrics).Error
+	err = s.Analytics.SaveMetrics(&engagementMetrics)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save analyse"})
 		log.Println("Error executing database query:", err)
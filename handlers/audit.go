@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Audit event types
+const (
+	AuditLoginFailed     = "login.failed"
+	AuditLoginThrottled  = "login.throttled"
+	AuditAccountLocked   = "account.locked"
+	AuditAccountUnlocked = "account.unlocked"
+	// The detail of identity events is the provider
+	AuditIdentityLinked   = "identity.linked"
+	AuditIdentityUnlinked = "identity.unlinked"
+)
+
+// AuditEvent is a security relevant event kept for administrators.
+// Username is the name that was given, which need not belong to an
+// account; UserID is set when it does.
+type AuditEvent struct {
+	ID        int       `json:"id" db:"id"`
+	Type      string    `json:"type" db:"type"`
+	UserID    *int      `json:"userId,omitempty" db:"user_id"`
+	Username  string    `json:"username,omitempty" db:"username"`
+	IP        string    `json:"ip,omitempty" db:"ip"`
+	Detail    string    `json:"detail,omitempty" db:"detail"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+// recordAudit stores an audit event. Failing to do so must not fail the
+// request it describes, so errors are only logged.
+func recordAudit(s *Stores, event AuditEvent) {
+	if err := s.Audit.Record(&event); err != nil {
+		log.Println("Error recording audit event:", err)
+	}
+}
+
+var auditListSpec = ListSpec{
+	Sorts: []string{"id", "created_at"},
+	Desc:  true,
+	Filters: map[string]FilterKind{
+		"type":     FilterString,
+		"user_id":  FilterInt,
+		"username": FilterString,
+		"ip":       FilterString,
+	},
+}
+
+// GetAuditEvents lists audit events, newest first
+func GetAuditEvents(c *gin.Context, s *Stores) {
+	query, ok := bindListQuery(c, auditListSpec)
+	if !ok {
+		return
+	}
+
+	events, err := s.Audit.List(query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch audit events"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, newPage(events, query))
+}
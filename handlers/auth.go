@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// TokenSourceHeader reads the access token from "Authorization: Bearer"
+	TokenSourceHeader = "header"
+	// TokenSourceCookie reads the access token from the access_token cookie
+	TokenSourceCookie = "cookie"
+
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// extractToken returns the access token of the request along with the
+// source it was read from, trying the sources in the configured order.
+func extractToken(c *gin.Context, cfg config.AuthConfig) (string, string) {
+	for _, source := range cfg.TokenSources {
+		switch source {
+		case TokenSourceHeader:
+			scheme, token, found := strings.Cut(c.GetHeader("Authorization"), " ")
+			if found && strings.EqualFold(scheme, "Bearer") && token != "" {
+				return strings.TrimSpace(token), source
+			}
+		case TokenSourceCookie:
+			if token, err := c.Cookie("access_token"); err == nil && token != "" {
+				return token, source
+			}
+		}
+	}
+	return "", ""
+}
+
+// checkCSRF validates the double-submit token: the X-CSRF-Token header must
+// match the csrf_token cookie on every request that can change state.
+func checkCSRF(c *gin.Context) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	cookie, err := c.Cookie(csrfCookieName)
+	if err != nil || cookie == "" {
+		return false
+	}
+	header := c.GetHeader(csrfHeaderName)
+	return subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) == 1
+}
+
+// setAuthCookies stores the access token in an HttpOnly cookie and, when
+// CSRF protection is on, a script-readable token for the double submit.
+func setAuthCookies(c *gin.Context, cfg config.AuthConfig, accessToken string) {
+	maxAge := int(cfg.AccessTokenTTL.Duration().Seconds())
+	c.SetSameSite(cfg.Cookie.SameSiteMode())
+	c.SetCookie("access_token", accessToken, maxAge, "/", cfg.Cookie.Domain, cfg.Cookie.Secure, true)
+
+	if cfg.CSRF {
+		csrfToken, err := newTokenID()
+		if err != nil {
+			log.Println("Error generating CSRF token:", err)
+			return
+		}
+		c.SetCookie(csrfCookieName, csrfToken, maxAge, "/", cfg.Cookie.Domain, cfg.Cookie.Secure, false)
+	}
+}
+
+func clearAuthCookies(c *gin.Context, cfg config.AuthConfig) {
+	c.SetSameSite(cfg.Cookie.SameSiteMode())
+	c.SetCookie("access_token", "", -1, "/", cfg.Cookie.Domain, cfg.Cookie.Secure, true)
+	c.SetCookie(csrfCookieName, "", -1, "/", cfg.Cookie.Domain, cfg.Cookie.Secure, false)
+}
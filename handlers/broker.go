@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+// subscriberBuffer is how many notifications a stream may fall behind
+// before it is disconnected
+const subscriberBuffer = 16
+
+// NotificationBroker hands stored notifications to the streams of their
+// users as they are created or grouped
+type NotificationBroker interface {
+	// Publish announces notification to the streams of its user
+	Publish(notification Notification) error
+	// Subscribe returns the notifications published for userID from now
+	// on and a function that ends the subscription. The channel is closed
+	// when the subscription ends, including when its reader falls behind.
+	Subscribe(userID int) (<-chan Notification, func())
+}
+
+// MemoryBroker delivers notifications to the streams of this process
+type MemoryBroker struct {
+	mu          sync.Mutex
+	subscribers map[int]map[chan Notification]bool
+}
+
+// NewMemoryBroker creates an empty MemoryBroker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subscribers: make(map[int]map[chan Notification]bool)}
+}
+
+func (b *MemoryBroker) Publish(notification Notification) error {
+	b.deliver(notification)
+	return nil
+}
+
+// deliver sends notification to every subscriber of its user. A subscriber
+// whose buffer is full is dropped: its stream ends and the client resumes
+// from its last event instead of missing notifications silently.
+func (b *MemoryBroker) deliver(notification Notification) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers[notification.UserID] {
+		select {
+		case ch <- notification:
+		default:
+			b.remove(notification.UserID, ch)
+		}
+	}
+}
+
+func (b *MemoryBroker) Subscribe(userID int) (<-chan Notification, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Notification, subscriberBuffer)
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = make(map[chan Notification]bool)
+	}
+	b.subscribers[userID][ch] = true
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.remove(userID, ch)
+	}
+}
+
+// remove ends a subscription if it is still active; the caller holds b.mu
+func (b *MemoryBroker) remove(userID int, ch chan Notification) {
+	if !b.subscribers[userID][ch] {
+		return
+	}
+	delete(b.subscribers[userID], ch)
+	if len(b.subscribers[userID]) == 0 {
+		delete(b.subscribers, userID)
+	}
+	close(ch)
+}
+
+// subscribed reports whether userID has a stream open in this process
+func (b *MemoryBroker) subscribed(userID int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.subscribers[userID]) > 0
+}
+
+// notificationChannel is the Postgres channel notifications are announced on
+const notificationChannel = "notifications"
+
+// brokerMessage is the payload of a notification announcement. The
+// notification itself is read back from the store, as NOTIFY payloads are
+// limited to 8000 bytes.
+type brokerMessage struct {
+	ID     int `json:"id"`
+	UserID int `json:"userId"`
+}
+
+// PostgresBroker fans notifications out to every replica with
+// LISTEN/NOTIFY. Each replica runs the listener and delivers to its own
+// streams; notifications announced while a listener reconnects reach
+// their streams when the clients resume.
+type PostgresBroker struct {
+	db            *gorm.DB
+	dsn           string
+	notifications NotificationStore
+	local         *MemoryBroker
+}
+
+// NewPostgresBroker creates a PostgresBroker that announces through db and
+// listens on a connection of its own to dsn. Run starts the listener.
+func NewPostgresBroker(db *gorm.DB, dsn string, notifications NotificationStore) *PostgresBroker {
+	return &PostgresBroker{db: db, dsn: dsn, notifications: notifications, local: NewMemoryBroker()}
+}
+
+func (b *PostgresBroker) Publish(notification Notification) error {
+	payload, err := json.Marshal(brokerMessage{ID: notification.ID, UserID: notification.UserID})
+	if err != nil {
+		return err
+	}
+	return b.db.Exec("SELECT pg_notify(?, ?)", notificationChannel, string(payload)).Error
+}
+
+func (b *PostgresBroker) Subscribe(userID int) (<-chan Notification, func()) {
+	return b.local.Subscribe(userID)
+}
+
+// Run listens for announcements until ctx is cancelled, reconnecting after
+// a failure
+func (b *PostgresBroker) Run(ctx context.Context) {
+	for {
+		err := b.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("Error listening for notifications:", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// listen delivers the announced notifications of the users with a stream
+// open here until the connection fails
+func (b *PostgresBroker) listen(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, b.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+notificationChannel); err != nil {
+		return err
+	}
+	for {
+		announcement, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var message brokerMessage
+		if err := json.Unmarshal([]byte(announcement.Payload), &message); err != nil {
+			log.Println("Error decoding notification announcement:", err)
+			continue
+		}
+		if !b.local.subscribed(message.UserID) {
+			continue
+		}
+		notification, err := b.notifications.GetByID(message.ID)
+		if err != nil {
+			log.Println("Error executing database query:", err)
+			continue
+		}
+		b.local.deliver(*notification)
+	}
+}
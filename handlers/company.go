@@ -1,29 +1,42 @@
 package handlers
 
 import (
+	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
 type Company struct {
-	ID          uint   `gorm:"primaryKey" json:"id"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Teams       []User `json:"teams" gorm:"foreignKey:CompanyID"`
+	ID          uint         `gorm:"primaryKey" json:"id"`
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Teams       []PublicUser `json:"teams" gorm:"foreignKey:CompanyID"`
 }
 
 // CreateCompany creates a new company
-func CreateCompany(c *gin.Context, db *gorm.DB) {
+func CreateCompany(c *gin.Context, s *Stores) {
 	var company Company
 	if err := c.ShouldBindJSON(&company); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// The store assigns the ID, and members join through their profiles
+	company.ID = 0
+	company.Teams = nil
 
-	if err := db.Create(&company).Error; err != nil {
+	if err := s.Companies.Create(&company); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create company"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	// The creator administers the new company
+	companyID := int(company.ID)
+	if err := assignRole(s, c.GetInt("user_id"), RoleCompanyAdmin, &companyID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create company"})
+		log.Println("Error executing database query:", err)
 		return
 	}
 
@@ -31,10 +44,15 @@ func CreateCompany(c *gin.Context, db *gorm.DB) {
 }
 
 // GetCompanyByID retrieves a company by ID
-func GetCompanyByID(c *gin.Context, db *gorm.DB) {
-	id := c.Param("id")
-	var company Company
-	if err := db.Preload("Teams").First(&company, id).Error; err != nil {
+func GetCompanyByID(c *gin.Context, s *Stores) {
+	id, err := strconv.Atoi(c.Param("companyId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid company ID"})
+		return
+	}
+
+	company, err := s.Companies.GetByID(uint(id))
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Company not found"})
 		return
 	}
@@ -42,21 +60,32 @@ func GetCompanyByID(c *gin.Context, db *gorm.DB) {
 }
 
 // UpdateCompany updates a company
-func UpdateCompany(c *gin.Context, db *gorm.DB) {
-	id := c.Param("id")
-	var company Company
-	if err := db.First(&company, id).Error; err != nil {
+func UpdateCompany(c *gin.Context, s *Stores) {
+	id, err := strconv.Atoi(c.Param("companyId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid company ID"})
+		return
+	}
+
+	company, err := s.Companies.GetByID(uint(id))
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Company not found"})
 		return
 	}
+	if !authorize(c, s, ActionUpdateCompany, company) {
+		return
+	}
 
-	if err := c.ShouldBindJSON(&company); err != nil {
+	if err := c.ShouldBindJSON(company); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// The body must not move the update to another company
+	company.ID = uint(id)
 
-	if err := db.Save(&company).Error; err != nil {
+	if err := s.Companies.Update(company); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update company"})
+		log.Println("Error executing database query:", err)
 		return
 	}
 
@@ -64,16 +93,25 @@ func UpdateCompany(c *gin.Context, db *gorm.DB) {
 }
 
 // DeleteCompany deletes a company
-func DeleteCompany(c *gin.Context, db *gorm.DB) {
-	id := c.Param("id")
-	var company Company
-	if err := db.First(&company, id).Error; err != nil {
+func DeleteCompany(c *gin.Context, s *Stores) {
+	id, err := strconv.Atoi(c.Param("companyId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid company ID"})
+		return
+	}
+
+	company, err := s.Companies.GetByID(uint(id))
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Company not found"})
 		return
 	}
+	if !authorize(c, s, ActionDeleteCompany, company) {
+		return
+	}
 
-	if err := db.Delete(&company).Error; err != nil {
+	if err := s.Companies.Delete(uint(id)); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete company"})
+		log.Println("Error executing database query:", err)
 		return
 	}
 
@@ -0,0 +1,390 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/mail"
+	"github.com/gin-gonic/gin"
+)
+
+// Digest frequencies
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+	DigestOff    = "off"
+)
+
+// DigestSubscription is how often a user receives the email digest of
+// their unread notifications. Secret signs the unsubscribe links of the
+// user; it is created with the first digest sent to them.
+type DigestSubscription struct {
+	UserID    int       `json:"-" db:"user_id" gorm:"primaryKey"`
+	Frequency string    `json:"frequency" db:"frequency"`
+	Secret    string    `json:"-" db:"secret"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty" db:"updated_at"`
+}
+
+// Digest is the digest of a user for one period. It is claimed before it is
+// sent, so a run that crashes or overlaps another never sends it twice.
+type Digest struct {
+	ID                int        `json:"id" db:"id"`
+	UserID            int        `json:"userId" db:"user_id"`
+	Frequency         string     `json:"frequency" db:"frequency"`
+	PeriodStart       time.Time  `json:"periodStart" db:"period_start"`
+	PeriodEnd         time.Time  `json:"periodEnd" db:"period_end"`
+	NotificationCount int        `json:"notificationCount" db:"notification_count"`
+	SentAt            *time.Time `json:"sentAt,omitempty" db:"sent_at"`
+	CreatedAt         time.Time  `json:"createdAt" db:"created_at"`
+}
+
+//go:embed templates/digest.*.tmpl
+var digestTemplateFS embed.FS
+
+var (
+	digestTextTemplate = texttemplate.Must(texttemplate.ParseFS(digestTemplateFS, "templates/digest.txt.tmpl"))
+	digestHTMLTemplate = htmltemplate.Must(htmltemplate.ParseFS(digestTemplateFS, "templates/digest.html.tmpl"))
+)
+
+// digestEmail is the data the digest templates are rendered with
+type digestEmail struct {
+	Username       string
+	Frequency      string
+	Period         string
+	Notifications  []Notification
+	More           int
+	URL            string
+	UnsubscribeURL string
+}
+
+// digestSubscription returns the subscription of userID, or the default one
+// when they have not chosen
+func digestSubscription(s *Stores, cfg config.DigestConfig, userID int) (*DigestSubscription, error) {
+	subscription, err := s.Digests.GetSubscription(userID)
+	if errors.Is(err, ErrNotFound) {
+		return &DigestSubscription{UserID: userID, Frequency: cfg.DefaultFrequency}, nil
+	}
+	return subscription, err
+}
+
+// digestPeriod returns the last day or week, by frequency, that ended by now
+func digestPeriod(cfg config.DigestConfig, frequency string, now time.Time) (from, to time.Time) {
+	now = now.UTC()
+	to = time.Date(now.Year(), now.Month(), now.Day(), cfg.Hour, 0, 0, 0, time.UTC)
+	if to.After(now) {
+		to = to.AddDate(0, 0, -1)
+	}
+	if frequency == DigestDaily {
+		return to.AddDate(0, 0, -1), to
+	}
+	weekday, _ := cfg.EndWeekday()
+	for to.Weekday() != weekday {
+		to = to.AddDate(0, 0, -1)
+	}
+	return to.AddDate(0, 0, -7), to
+}
+
+// unsubscribeToken returns the token of the unsubscribe links of a user. It
+// names the user and is signed with their secret.
+func unsubscribeToken(subscription *DigestSubscription) string {
+	mac := hmac.New(sha256.New, []byte(subscription.Secret))
+	fmt.Fprintf(mac, "unsubscribe:%d", subscription.UserID)
+	return strconv.Itoa(subscription.UserID) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyUnsubscribeToken returns the subscription a token from
+// unsubscribeToken was issued for, or ErrNotFound
+func verifyUnsubscribeToken(s *Stores, token string) (*DigestSubscription, error) {
+	id, _, ok := strings.Cut(token, ".")
+	userID, err := strconv.Atoi(id)
+	if !ok || err != nil {
+		return nil, ErrNotFound
+	}
+	subscription, err := s.Digests.GetSubscription(userID)
+	if err != nil {
+		return nil, err
+	}
+	if subscription.Secret == "" || !hmac.Equal([]byte(unsubscribeToken(subscription)), []byte(token)) {
+		return nil, ErrNotFound
+	}
+	return subscription, nil
+}
+
+// GetDigestSubscription returns how often the caller receives the digest
+func GetDigestSubscription(c *gin.Context, s *Stores, cfg config.DigestConfig) {
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	subscription, err := digestSubscription(s, cfg, userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch digest subscription"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	c.JSON(http.StatusOK, subscription)
+}
+
+// UpdateDigestSubscription sets how often the caller receives the digest:
+// daily, weekly or off
+func UpdateDigestSubscription(c *gin.Context, s *Stores, cfg config.DigestConfig) {
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var request struct {
+		Frequency string `json:"frequency" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !contains([]string{DigestDaily, DigestWeekly, DigestOff}, request.Frequency) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Frequency must be daily, weekly or off"})
+		return
+	}
+
+	subscription, err := digestSubscription(s, cfg, userID.(int))
+	if err == nil {
+		subscription.Frequency = request.Frequency
+		subscription.UpdatedAt = time.Now()
+		err = s.Digests.SaveSubscription(subscription)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update digest subscription"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	c.JSON(http.StatusOK, subscription)
+}
+
+// UnsubscribeDigest turns the digest off for the user named by the token of
+// an unsubscribe link. It needs no login, so the link works from any mail
+// client.
+func UnsubscribeDigest(c *gin.Context, s *Stores) {
+	var request struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	subscription, err := verifyUnsubscribeToken(s, request.Token)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid unsubscribe token"})
+		return
+	}
+	if err == nil {
+		subscription.Frequency = DigestOff
+		subscription.UpdatedAt = time.Now()
+		err = s.Digests.SaveSubscription(subscription)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unsubscribe"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Unsubscribed from the email digest"})
+}
+
+// DigestWorker emails users the digest of the notifications they have not
+// read when their daily or weekly period ends
+type DigestWorker struct {
+	s      *Stores
+	mailer mail.Mailer
+	cfg    config.DigestConfig
+}
+
+// NewDigestWorker creates a DigestWorker
+func NewDigestWorker(s *Stores, mailer mail.Mailer, cfg config.DigestConfig) *DigestWorker {
+	return &DigestWorker{s: s, mailer: mailer, cfg: cfg}
+}
+
+// Run sends the due digests every interval until ctx is cancelled
+func (w *DigestWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.Interval.Duration())
+	defer ticker.Stop()
+
+	for {
+		if _, err := w.SendDue(time.Now()); err != nil {
+			log.Println("Error sending digests:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SendDue sends the digest of the last period that ended by now to every
+// user who has one due and not sent yet, and returns how many were sent
+func (w *DigestWorker) SendDue(now time.Time) (int, error) {
+	// The last week starts before and ends no later than the last day
+	from, _ := digestPeriod(w.cfg, DigestWeekly, now)
+	_, to := digestPeriod(w.cfg, DigestDaily, now)
+	userIDs, err := w.s.Notifications.UpdatedUsers(from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	var errs []error
+	for _, userID := range userIDs {
+		ok, err := w.send(userID, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("user %d: %w", userID, err))
+			continue
+		}
+		if ok {
+			sent++
+		}
+	}
+	return sent, errors.Join(errs...)
+}
+
+// send emails userID their digest for the period that ended by now, unless
+// they have none, have turned it off, or it was claimed already
+func (w *DigestWorker) send(userID int, now time.Time) (bool, error) {
+	user, err := w.s.Users.GetByID(userID)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if user.Email == "" || !user.EmailVerified || user.DeleteAfter != nil || user.DeletedAt != nil {
+		return false, nil
+	}
+	subscription, err := digestSubscription(w.s, w.cfg, userID)
+	if err != nil || subscription.Frequency == DigestOff {
+		return false, err
+	}
+
+	from, to := digestPeriod(w.cfg, subscription.Frequency, now)
+	notifications, err := w.digestNotifications(userID, from, to)
+	if err != nil || len(notifications) == 0 {
+		return false, err
+	}
+
+	if subscription.Secret == "" {
+		if subscription.Secret, _, err = newSecretToken(); err != nil {
+			return false, err
+		}
+		subscription.UpdatedAt = now
+		if err := w.s.Digests.SaveSubscription(subscription); err != nil {
+			return false, err
+		}
+	}
+
+	digest := Digest{
+		UserID:            userID,
+		Frequency:         subscription.Frequency,
+		PeriodStart:       from,
+		PeriodEnd:         to,
+		NotificationCount: len(notifications),
+		CreatedAt:         now,
+	}
+	if err := w.s.Digests.Claim(&digest); errors.Is(err, ErrConflict) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	msg, err := w.render(user, subscription, notifications)
+	if err == nil {
+		err = w.mailer.Send(msg)
+	}
+	if err != nil {
+		// Nothing was sent, so the next run may try again
+		return false, errors.Join(err, w.s.Digests.Release(digest.ID))
+	}
+	return true, w.s.Digests.MarkSent(digest.ID, time.Now())
+}
+
+// digestNotifications returns the notifications of userID updated in the
+// period that belong in their digest: those still unread, and those they
+// only want by email, of the types they get the digest for
+func (w *DigestWorker) digestNotifications(userID int, from, to time.Time) ([]Notification, error) {
+	updated, err := w.s.Notifications.ListUpdated(userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	preferences := map[string]NotificationPreference{}
+	notifications := []Notification{}
+	for _, notification := range updated {
+		if notification.Type == NotificationSystem {
+			if !notification.IsRead {
+				notifications = append(notifications, notification)
+			}
+			continue
+		}
+		preference, ok := preferences[notification.Type]
+		if !ok {
+			if preference, err = notificationPreference(w.s, userID, notification.Type); err != nil {
+				return nil, err
+			}
+			preferences[notification.Type] = preference
+		}
+		if preference.EmailDigest && !preference.Muted && (!notification.IsRead || !preference.InApp) {
+			notifications = append(notifications, notification)
+		}
+	}
+	return notifications, nil
+}
+
+// render builds the digest email of user from the HTML and text templates
+func (w *DigestWorker) render(user *User, subscription *DigestSubscription, notifications []Notification) (mail.Message, error) {
+	email := digestEmail{
+		Username:       user.Username,
+		Frequency:      subscription.Frequency,
+		Period:         "day",
+		Notifications:  notifications,
+		URL:            w.cfg.URL,
+		UnsubscribeURL: w.cfg.UnsubscribeURL + "?" + url.Values{"token": {unsubscribeToken(subscription)}}.Encode(),
+	}
+	if subscription.Frequency == DigestWeekly {
+		email.Period = "week"
+	}
+	if len(notifications) > w.cfg.MaxItems {
+		email.Notifications = notifications[:w.cfg.MaxItems]
+		email.More = len(notifications) - w.cfg.MaxItems
+	}
+	describeNotifications(w.s, email.Notifications)
+
+	var text, html bytes.Buffer
+	if err := digestTextTemplate.Execute(&text, email); err != nil {
+		return mail.Message{}, err
+	}
+	if err := digestHTMLTemplate.Execute(&html, email); err != nil {
+		return mail.Message{}, err
+	}
+
+	subject := fmt.Sprintf("Your %s digest: %d unread notifications", subscription.Frequency, len(notifications))
+	if len(notifications) == 1 {
+		subject = fmt.Sprintf("Your %s digest: 1 unread notification", subscription.Frequency)
+	}
+	return mail.Message{To: user.Email, Subject: subject, Text: text.String(), HTML: html.String()}, nil
+}
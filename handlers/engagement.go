@@ -5,7 +5,6 @@ import (
 	"strconv"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
 type Engagement struct {
@@ -17,7 +16,7 @@ type Engagement struct {
 }
 
 // CreateEngagement creates an engagement for a post
-func CreateEngagement(c *gin.Context, db *gorm.DB) {
+func CreateEngagement(c *gin.Context, s *Stores) {
 	var engagement Engagement
 	if err := c.ShouldBindJSON(&engagement); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -28,17 +27,26 @@ func CreateEngagement(c *gin.Context, db *gorm.DB) {
 	userID, _ := c.Get("user_id")
 	engagement.UserID = userID.(int)
 
-	err := db.Create(&engagement).Error
+	// Scheduled posts only exist for their author, as in GetPostByID
+	post, err := s.Posts.GetByID(engagement.PostID)
+	if err != nil || (post.Status == PostStatusScheduled && post.UserID != engagement.UserID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Post not found"})
+		return
+	}
+
+	err = s.Engagements.Create(&engagement)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create engagement"})
 		return
 	}
+	notifyEngaged(s, engagement)
+	emitEngagementEvent(s, WebhookEngagementCreated, engagement)
 
 	c.JSON(http.StatusCreated, gin.H{"message": "Engagement created successfully"})
 }
 
 // UpdateEngagement updates an existing engagement
-func UpdateEngagement(c *gin.Context, db *gorm.DB) {
+func UpdateEngagement(c *gin.Context, s *Stores) {
 	// Extract engagementId from the URL parameters
 	engagementID, err := strconv.Atoi(c.Param("engagementId"))
 	if err != nil {
@@ -46,19 +54,15 @@ func UpdateEngagement(c *gin.Context, db *gorm.DB) {
 		return
 	}
 
-	// Check if db is nil
-	if db == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database connection is not initialized"})
-		return
-	}
-
 	// Check if the engagement exists
-	var existingEngagement Engagement
-	err = db.First(&existingEngagement, engagementID).Error
+	existingEngagement, err := s.Engagements.GetByID(engagementID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Engagement not found"})
 		return
 	}
+	if !authorize(c, s, ActionUpdateEngagement, existingEngagement) {
+		return
+	}
 
 	// Extract the updated data from the request body
 	var request struct {
@@ -76,17 +80,18 @@ func UpdateEngagement(c *gin.Context, db *gorm.DB) {
 	existingEngagement.Comment = request.Comment
 
 	// Save the updated engagement
-	err = db.Save(&existingEngagement).Error
+	err = s.Engagements.Update(existingEngagement)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update engagement"})
 		return
 	}
+	emitEngagementEvent(s, WebhookEngagementUpdated, *existingEngagement)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Engagement updated successfully"})
 }
 
 // DeleteEngagement deletes an engagement by ID
-func DeleteEngagement(c *gin.Context, db *gorm.DB) {
+func DeleteEngagement(c *gin.Context, s *Stores) {
 	// Extract engagementId from the URL parameters
 	engagementID, err := strconv.Atoi(c.Param("engagementId"))
 	if err != nil {
@@ -94,44 +99,50 @@ func DeleteEngagement(c *gin.Context, db *gorm.DB) {
 		return
 	}
 
-	// Check if db is nil
-	if db == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database connection is not initialized"})
-		return
-	}
-
 	// Check if the engagement exists
-	var existingEngagement Engagement
-	err = db.First(&existingEngagement, engagementID).Error
+	existingEngagement, err := s.Engagements.GetByID(engagementID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Engagement not found"})
 		return
 	}
+	if !authorize(c, s, ActionDeleteEngagement, existingEngagement) {
+		return
+	}
 
 	// Delete the engagement
-	err = db.Delete(&existingEngagement).Error
+	err = s.Engagements.Delete(existingEngagement.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete engagement"})
 		return
 	}
+	emitEngagementEvent(s, WebhookEngagementDeleted, *existingEngagement)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Engagement deleted successfully"})
 }
 
+var engagementListSpec = ListSpec{
+	Sorts:   []string{"id"},
+	Filters: map[string]FilterKind{"user_id": FilterInt, "like": FilterBool},
+}
+
 // GetEngagementsForPost retrieves all engagements for a specific post
-func GetEngagementsForPost(c *gin.Context, db *gorm.DB) {
+func GetEngagementsForPost(c *gin.Context, s *Stores) {
 	postID, err := strconv.Atoi(c.Param("postId"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid post ID"})
 		return
 	}
 
-	var engagements []Engagement
-	err = db.Where("post_id = ?", postID).Find(&engagements).Error
+	query, ok := bindListQuery(c, engagementListSpec)
+	if !ok {
+		return
+	}
+
+	engagements, err := s.Engagements.ListByPost(postID, query)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch engagements"})
 		return
 	}
 
-	c.JSON(http.StatusOK, engagements)
+	c.JSON(http.StatusOK, newPage(engagements, query))
 }
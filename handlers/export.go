@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/mail"
+	"github.com/gin-gonic/gin"
+)
+
+// Statuses of an AccountExport
+const (
+	ExportStatusPending = "pending"
+	ExportStatusRunning = "running"
+	ExportStatusReady   = "ready"
+	ExportStatusFailed  = "failed"
+)
+
+// exportStaleAfter is how long an export may run before another worker
+// takes it over
+const exportStaleAfter = time.Hour
+
+// AccountExport is a request for an archive of a user's personal data
+type AccountExport struct {
+	ID     int    `json:"id" db:"id"`
+	UserID int    `json:"userId" db:"user_id"`
+	Status string `json:"status" db:"status"`
+	// Path is the archive on disk once the export is ready
+	Path        string     `json:"-" db:"path"`
+	Error       string     `json:"error,omitempty" db:"error"`
+	StartedAt   *time.Time `json:"startedAt,omitempty" db:"started_at"`
+	CompletedAt *time.Time `json:"completedAt,omitempty" db:"completed_at"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty" db:"expires_at"`
+	CreatedAt   time.Time  `json:"createdAt" db:"created_at"`
+}
+
+// PersonalData is everything stored about a user, as written to the
+// data.json file of an export. Audit events are kept as a security record
+// and are not part of it.
+type PersonalData struct {
+	ExportedAt    time.Time             `json:"exportedAt"`
+	User          User                  `json:"user"`
+	Posts         []Post                `json:"posts"`
+	Engagements   []Engagement          `json:"engagements"`
+	Followers     []Follow              `json:"followers"`
+	Followings    []Follow              `json:"followings"`
+	Notifications []Notification        `json:"notifications"`
+	PostViews     []PostView            `json:"postViews"`
+	Sessions      []Session             `json:"sessions"`
+	Identities    []Identity            `json:"identities"`
+	AccessTokens  []PersonalAccessToken `json:"accessTokens"`
+	Roles         []UserRole            `json:"roles"`
+	// NotificationPreferences are the types the user configured
+	NotificationPreferences []NotificationPreference `json:"notificationPreferences"`
+	// DigestSubscription is the email digest frequency the user chose
+	DigestSubscription *DigestSubscription `json:"digestSubscription,omitempty"`
+	// Webhooks are the webhooks of the user, without their secrets
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// collectPersonalData gathers the records of userID from every store
+func collectPersonalData(s *Stores, userID int) (*PersonalData, error) {
+	user, err := s.Users.GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.Accounts.Collect(userID)
+	if err != nil {
+		return nil, err
+	}
+	data.User = *user
+	describeNotifications(s, data.Notifications)
+
+	if data.Sessions, err = s.Sessions.ListByUser(userID, time.Time{}); err != nil {
+		return nil, err
+	}
+	if data.Identities, err = s.Identities.ListByUser(userID); err != nil {
+		return nil, err
+	}
+	if data.AccessTokens, err = s.AccessTokens.ListByUser(userID); err != nil {
+		return nil, err
+	}
+	if data.Roles, err = s.Roles.Assignments(userID); err != nil {
+		return nil, err
+	}
+	if data.NotificationPreferences, err = s.NotificationPreferences.List(userID); err != nil {
+		return nil, err
+	}
+	if data.DigestSubscription, err = s.Digests.GetSubscription(userID); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if data.Webhooks, err = s.Webhooks.ListByUser(userID); err != nil {
+		return nil, err
+	}
+	data.ExportedAt = time.Now()
+	return data, nil
+}
+
+// writeExportArchive writes data.json and the user's uploaded files to a
+// zip archive at path
+func writeExportArchive(path string, data *PersonalData) (err error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	archive := zip.NewWriter(file)
+	w, err := archive.Create("data.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(data); err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(data.User.Avatar, "/avatars/") {
+		name := filepath.Base(data.User.Avatar)
+		if err := addExportFile(archive, filepath.Join(uploadPath, "avatars", name), "media/avatars/"+name); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// addExportFile copies the file at path into the archive as name. A file
+// that no longer exists is skipped.
+func addExportFile(archive *zip.Writer, path, name string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// removeExportFile deletes the archive of an export, if it has one
+func removeExportFile(export AccountExport) {
+	if export.Path == "" {
+		return
+	}
+	if err := os.Remove(export.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Println("Error removing export archive:", err)
+	}
+}
+
+// BuildExports builds the archives of pending exports and tells their
+// users they are ready. It returns how many were built.
+func (w *AccountWorker) BuildExports(now time.Time) (int, error) {
+	exports, err := w.s.AccountExports.ClaimPending(now, now.Add(-exportStaleAfter), accountWorkerBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	if len(exports) == 0 {
+		return 0, nil
+	}
+	if err := os.MkdirAll(w.cfg.ExportDir, 0o700); err != nil {
+		return 0, err
+	}
+
+	built := 0
+	var errs []error
+	for _, export := range exports {
+		if err := w.buildExport(&export); err != nil {
+			errs = append(errs, fmt.Errorf("export %d: %w", export.ID, err))
+			export.Status = ExportStatusFailed
+			export.Error = "The export could not be built, please request a new one"
+		} else {
+			built++
+		}
+		completedAt := time.Now()
+		export.CompletedAt = &completedAt
+		if err := w.s.AccountExports.Update(&export); err != nil {
+			errs = append(errs, fmt.Errorf("export %d: %w", export.ID, err))
+			continue
+		}
+		if export.Status == ExportStatusReady {
+			w.notifyExportReady(export)
+		}
+	}
+	return built, errors.Join(errs...)
+}
+
+// buildExport writes the archive of an export and marks it ready
+func (w *AccountWorker) buildExport(export *AccountExport) error {
+	data, err := collectPersonalData(w.s, export.UserID)
+	if err != nil {
+		return err
+	}
+	id, err := newTokenID()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(w.cfg.ExportDir, fmt.Sprintf("%d-%s.zip", export.UserID, id))
+	if err := writeExportArchive(path, data); err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(w.cfg.ExportTTL.Duration())
+	export.Status = ExportStatusReady
+	export.Path = path
+	export.ExpiresAt = &expiresAt
+	return nil
+}
+
+// notifyExportReady tells the owner of an export where to download it,
+// in the app and by email when their address is verified
+func (w *AccountWorker) notifyExportReady(export AccountExport) {
+	message := fmt.Sprintf("Your data export is ready. Download it from /account/export before %s.",
+		export.ExpiresAt.Format(time.RFC1123))
+	notification := Notification{UserID: export.UserID, Type: NotificationSystem, Message: message, CreatedAt: time.Now()}
+	if err := w.s.Notifications.Create(&notification); err != nil {
+		log.Println("Error notifying export owner:", err)
+	} else {
+		publishNotification(w.s, notification)
+	}
+
+	user, err := w.s.Users.GetByID(export.UserID)
+	if err != nil || user.Email == "" || !user.EmailVerified {
+		return
+	}
+	err = w.mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Your data export is ready",
+		Text:    fmt.Sprintf("Hi %s,\n\n%s\n", user.Username, message),
+	})
+	if err != nil {
+		log.Println("Error sending export email:", err)
+	}
+}
+
+// PruneExports deletes the exports that expired before now with their
+// archives
+func (w *AccountWorker) PruneExports(now time.Time) error {
+	exports, err := w.s.AccountExports.DeleteExpired(now)
+	for _, export := range exports {
+		removeExportFile(export)
+	}
+	return err
+}
+
+// GetAccountExport serves the caller's latest export once it is ready.
+// Until then it reports the export in progress, starting one when there is
+// none.
+func GetAccountExport(c *gin.Context, s *Stores) {
+	userID := c.GetInt("user_id")
+
+	export, err := s.AccountExports.Latest(userID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch export"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	if export != nil {
+		switch export.Status {
+		case ExportStatusPending, ExportStatusRunning:
+			c.JSON(http.StatusAccepted, export)
+			return
+		case ExportStatusReady:
+			if export.ExpiresAt != nil && time.Now().Before(*export.ExpiresAt) {
+				name := fmt.Sprintf("account-export-%s.zip", export.CompletedAt.Format("2006-01-02"))
+				c.FileAttachment(export.Path, name)
+				return
+			}
+		}
+	}
+
+	export = &AccountExport{UserID: userID, Status: ExportStatusPending}
+	if err := s.AccountExports.Create(export); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start export"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	c.JSON(http.StatusAccepted, export)
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/gin-gonic/gin"
+)
+
+// Feed strategies selectable with feed.strategy
+const (
+	FeedStrategyPull   = "pull"
+	FeedStrategyFanout = "fanout"
+)
+
+// Feed builds home timelines: the published posts of a user and of the users
+// they follow, newest first. The hooks keep materialized timelines in sync
+// and are called after the change they describe has been stored.
+type Feed interface {
+	// Timeline returns a page of the timeline of userID for a query from
+	// feedQuery
+	Timeline(userID int, query ListQuery) ([]Post, error)
+	PostPublished(post Post) error
+	Followed(followerID, followingID int) error
+	Unfollowed(followerID, followingID int) error
+}
+
+// NewFeed returns the feed strategy selected by cfg
+func NewFeed(cfg config.FeedConfig, timelines TimelineStore) Feed {
+	if cfg.Strategy == FeedStrategyFanout {
+		return &FanoutFeed{timelines: timelines}
+	}
+	return &PullFeed{timelines: timelines}
+}
+
+// PullFeed queries the follow graph on every read. Writes are free, reads
+// get slower as users follow more accounts.
+type PullFeed struct {
+	timelines TimelineStore
+}
+
+func (f *PullFeed) Timeline(userID int, query ListQuery) ([]Post, error) {
+	return f.timelines.Query(userID, query)
+}
+
+func (f *PullFeed) PostPublished(Post) error  { return nil }
+func (f *PullFeed) Followed(int, int) error   { return nil }
+func (f *PullFeed) Unfollowed(int, int) error { return nil }
+
+// FanoutFeed copies every post into the timeline of each follower when it
+// is published, so reads are a single indexed range scan whatever the size
+// of the follow graph.
+type FanoutFeed struct {
+	timelines TimelineStore
+}
+
+func (f *FanoutFeed) Timeline(userID int, query ListQuery) ([]Post, error) {
+	return f.timelines.Read(userID, query)
+}
+
+func (f *FanoutFeed) PostPublished(post Post) error {
+	return f.timelines.FanOut(post)
+}
+
+func (f *FanoutFeed) Followed(followerID, followingID int) error {
+	return f.timelines.Backfill(followerID, followingID)
+}
+
+func (f *FanoutFeed) Unfollowed(followerID, followingID int) error {
+	if followerID == followingID {
+		// Users always see their own posts
+		return nil
+	}
+	return f.timelines.Remove(followerID, followingID)
+}
+
+// feedQuery reads the limit and cursor of a timeline page. Timelines are
+// always newest first, so unlike other lists there is no sort parameter.
+func feedQuery(c *gin.Context, cfg config.FeedConfig) (ListQuery, error) {
+	limit, err := parseLimit(c, cfg.PageSize, cfg.MaxPageSize)
+	if err != nil {
+		return ListQuery{}, err
+	}
+	// One extra post tells newPage whether there is a next page
+	query := ListQuery{Limit: limit + 1, Sort: "published_at", Desc: true}
+
+	if raw := c.Query("cursor"); raw != "" {
+		cursor, err := DecodeCursor(raw)
+		if err != nil || cursor.Sort != query.Sort || cursor.Desc != query.Desc {
+			return ListQuery{}, errors.New("invalid cursor")
+		}
+		query.After = cursor
+	}
+	return query, nil
+}
+
+// GetFeed returns a page of the caller's home timeline in the same envelope
+// as the other list endpoints
+func GetFeed(c *gin.Context, feed Feed, cfg config.FeedConfig) {
+	query, err := feedQuery(c, cfg)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	posts, err := feed.Timeline(c.GetInt("user_id"), query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch feed"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, newPage(posts, query))
+}
+
+// notifyFeed runs a feed hook and logs its failure. The change the hook
+// reacts to is already stored, so the request still succeeds; the fanout
+// timelines can be repaired with the rebuild-timelines command.
+func notifyFeed(err error) {
+	if err != nil {
+		log.Println("Error updating timelines:", err)
+	}
+}
@@ -1,8 +1,13 @@
 package handlers
 
 import (
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -39,3 +44,79 @@ func GetUploadedFiles(c *gin.Context) {
 
 	c.JSON(http.StatusOK, files)
 }
+
+// MaxAvatarSize is the largest avatar image accepted, in bytes
+const MaxAvatarSize = 2 << 20
+
+// avatarTypes maps the image types accepted as avatars to their extension
+var avatarTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// UploadAvatar stores the image in the file form field as the avatar of the
+// caller and links it from their profile. The previous avatar is removed.
+func UploadAvatar(c *gin.Context, s *Stores) {
+	user, err := s.Users.GetByID(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File not provided"})
+		return
+	}
+	if header.Size > MaxAvatarSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Avatar must be at most 2 MB"})
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file"})
+		return
+	}
+	defer file.Close()
+
+	// The type is sniffed from the content; the client's claims are ignored
+	sniff := make([]byte, 512)
+	n, _ := io.ReadFull(file, sniff)
+	ext, ok := avatarTypes[http.DetectContentType(sniff[:n])]
+	if !ok {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Avatar must be a PNG, JPEG, GIF or WebP image"})
+		return
+	}
+
+	id, err := newTokenID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+	name := fmt.Sprintf("%d-%s%s", user.ID, id, ext)
+	dir := filepath.Join(uploadPath, "avatars")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+	if err := c.SaveUploadedFile(header, filepath.Join(dir, name)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+
+	previous := user.Avatar
+	user.Avatar = "/avatars/" + name
+	if err := s.Users.Update(user); err != nil {
+		os.Remove(filepath.Join(dir, name))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	if strings.HasPrefix(previous, "/avatars/") {
+		os.Remove(filepath.Join(dir, filepath.Base(previous)))
+	}
+
+	c.JSON(http.StatusOK, user)
+}
@@ -1,11 +1,11 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
 type Follow struct {
@@ -15,7 +15,7 @@ type Follow struct {
 }
 
 // FollowUser allows a user to follow another user
-func FollowUser(c *gin.Context, db *gorm.DB) {
+func FollowUser(c *gin.Context, s *Stores, feed Feed) {
 	var follow Follow
 	if err := c.ShouldBindJSON(&follow); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -26,17 +26,34 @@ func FollowUser(c *gin.Context, db *gorm.DB) {
 	followerID, _ := c.Get("user_id")
 	follow.FollowerID = followerID.(int)
 
-	err := db.Create(&follow).Error
+	if follow.FollowingID == follow.FollowerID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot follow yourself"})
+		return
+	}
+	if _, err := s.Users.GetByID(follow.FollowingID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	// A repeated follow must not notify the user or fire webhooks again
+	err := s.Follows.Create(&follow)
+	if errors.Is(err, ErrConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Already following this user"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to follow user"})
 		return
 	}
+	notifyFeed(feed.Followed(follow.FollowerID, follow.FollowingID))
+	notifyFollowed(s, follow)
+	emitWebhookEvent(s, WebhookFollowCreated, follow, follow.FollowerID, follow.FollowingID)
 
 	c.JSON(http.StatusCreated, gin.H{"message": "User followed successfully"})
 }
 
 // UnfollowUser allows a user to unfollow another user
-func UnfollowUser(c *gin.Context, db *gorm.DB) {
+func UnfollowUser(c *gin.Context, s *Stores, feed Feed) {
 	// Extract following ID from the URL parameters
 	followingID, err := strconv.Atoi(c.Param("followingId"))
 	if err != nil {
@@ -48,25 +65,28 @@ func UnfollowUser(c *gin.Context, db *gorm.DB) {
 	followerID, _ := c.Get("user_id")
 
 	// Check if the follow relationship exists
-	var existingFollow Follow
-	err = db.Where("follower_id = ? AND following_id = ?", followerID, followingID).First(&existingFollow).Error
+	existingFollow, err := s.Follows.Get(followerID.(int), followingID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Follow relationship not found"})
 		return
 	}
 
 	// Delete the follow relationship
-	err = db.Delete(&existingFollow).Error
+	err = s.Follows.Delete(existingFollow.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unfollow user"})
 		return
 	}
+	notifyFeed(feed.Unfollowed(existingFollow.FollowerID, existingFollow.FollowingID))
+	emitWebhookEvent(s, WebhookFollowDeleted, existingFollow, existingFollow.FollowerID, existingFollow.FollowingID)
 
 	c.JSON(http.StatusOK, gin.H{"message": "User unfollowed successfully"})
 }
 
+var followListSpec = ListSpec{Sorts: []string{"id"}}
+
 // GetFollowers retrieves followers for a user
-func GetFollowers(c *gin.Context, db *gorm.DB) {
+func GetFollowers(c *gin.Context, s *Stores) {
 	// Extract user ID from the URL parameters
 	userID, err := strconv.Atoi(c.Param("userId"))
 	if err != nil {
@@ -74,18 +94,22 @@ func GetFollowers(c *gin.Context, db *gorm.DB) {
 		return
 	}
 
-	var followers []Follow
-	err = db.Where("following_id = ?", userID).Find(&followers).Error
+	query, ok := bindListQuery(c, followListSpec)
+	if !ok {
+		return
+	}
+
+	followers, err := s.Follows.ListFollowers(userID, query)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch followers"})
 		return
 	}
 
-	c.JSON(http.StatusOK, followers)
+	c.JSON(http.StatusOK, newPage(followers, query))
 }
 
 // GetFollowings retrieves users that a user is following
-func GetFollowings(c *gin.Context, db *gorm.DB) {
+func GetFollowings(c *gin.Context, s *Stores) {
 	// Extract user ID from the URL parameters
 	userID, err := strconv.Atoi(c.Param("userId"))
 	if err != nil {
@@ -93,12 +117,16 @@ func GetFollowings(c *gin.Context, db *gorm.DB) {
 		return
 	}
 
-	var followings []Follow
-	err = db.Where("follower_id = ?", userID).Find(&followings).Error
+	query, ok := bindListQuery(c, followListSpec)
+	if !ok {
+		return
+	}
+
+	followings, err := s.Follows.ListFollowings(userID, query)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch followings"})
 		return
 	}
 
-	c.JSON(http.StatusOK, followings)
+	c.JSON(http.StatusOK, newPage(followings, query))
 }
@@ -0,0 +1,344 @@
+package handlers
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+// Signing algorithms a key can be generated for
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+// rsaKeyBits is the size of generated RSA keys
+const rsaKeyBits = 2048
+
+// keyringMissInterval limits how often a token with an unknown kid makes
+// the keyring reload, so forged kids cannot hammer the database
+const keyringMissInterval = time.Second
+
+// SigningKey is a private key that signs JWTs. The newest key that is not
+// retired signs new tokens; retired keys only verify the tokens they
+// signed until the longest-lived of those has expired.
+type SigningKey struct {
+	ID         string     `json:"id" db:"id" gorm:"primaryKey"`
+	Algorithm  string     `json:"algorithm" db:"algorithm"`
+	PrivateKey string     `json:"-" db:"private_key"`
+	CreatedAt  time.Time  `json:"createdAt" db:"created_at"`
+	RetiredAt  *time.Time `json:"retiredAt,omitempty" db:"retired_at"`
+}
+
+// VerifiesUntil returns when the key stops being accepted, or nil while it
+// is not retired
+func (k SigningKey) VerifiesUntil(cfg config.AuthConfig) *time.Time {
+	if k.RetiredAt == nil {
+		return nil
+	}
+	until := k.RetiredAt.Add(cfg.RefreshTokenTTL.Duration())
+	return &until
+}
+
+// GenerateSigningKey creates a key for algorithm with a random kid
+func GenerateSigningKey(algorithm string) (*SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch algorithm {
+	case AlgorithmRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case AlgorithmEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	kid, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{
+		ID:         kid,
+		Algorithm:  algorithm,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	}, nil
+}
+
+// loadedKey is a SigningKey with its private key parsed
+type loadedKey struct {
+	SigningKey
+	private crypto.Signer
+	method  jwt.SigningMethod
+}
+
+func loadKey(key SigningKey) (loadedKey, error) {
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return loadedKey{}, fmt.Errorf("key %s: invalid PEM", key.ID)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return loadedKey{}, fmt.Errorf("key %s: %w", key.ID, err)
+	}
+
+	loaded := loadedKey{SigningKey: key}
+	switch private := parsed.(type) {
+	case *rsa.PrivateKey:
+		loaded.private, loaded.method = private, jwt.SigningMethodRS256
+	case ed25519.PrivateKey:
+		loaded.private, loaded.method = private, signingMethodEdDSA
+	default:
+		return loadedKey{}, fmt.Errorf("key %s: unsupported key type %T", key.ID, parsed)
+	}
+	if loaded.method.Alg() != key.Algorithm {
+		return loadedKey{}, fmt.Errorf("key %s: %s key stored as %s", key.ID, loaded.method.Alg(), key.Algorithm)
+	}
+	return loaded, nil
+}
+
+// Keyring signs and verifies JWTs with the keys of a SigningKeyStore. Keys
+// are cached for auth.signing.key_cache_ttl, so a key generated by another
+// instance starts signing there within that time; an unknown kid reloads
+// them straight away.
+type Keyring struct {
+	store SigningKeyStore
+
+	mu       sync.Mutex
+	keys     []loadedKey
+	loadedAt time.Time
+}
+
+// NewKeyring creates a keyring over the keys in store
+func NewKeyring(store SigningKeyStore) *Keyring {
+	return &Keyring{store: store}
+}
+
+// load returns the cached keys, reloading them once they are older than
+// maxAge
+func (k *Keyring) load(maxAge time.Duration) ([]loadedKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.keys != nil && time.Since(k.loadedAt) < maxAge {
+		return k.keys, nil
+	}
+
+	stored, err := k.store.List()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]loadedKey, 0, len(stored))
+	for _, key := range stored {
+		loaded, err := loadKey(key)
+		if err != nil {
+			log.Println("Skipping signing key:", err)
+			continue
+		}
+		keys = append(keys, loaded)
+	}
+	k.keys, k.loadedAt = keys, time.Now()
+	return keys, nil
+}
+
+// invalidate makes the next load read the store
+func (k *Keyring) invalidate() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = nil
+}
+
+// signingKey returns the newest key that is not retired. When there is
+// none yet, as on a fresh install, one is generated for the configured
+// algorithm.
+func (k *Keyring) signingKey(cfg config.AuthConfig) (loadedKey, error) {
+	keys, err := k.load(cfg.Signing.KeyCacheTTL.Duration())
+	if err != nil {
+		return loadedKey{}, err
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		if keys[i].RetiredAt == nil {
+			return keys[i], nil
+		}
+	}
+
+	key, err := GenerateSigningKey(cfg.Signing.Algorithm)
+	if err != nil {
+		return loadedKey{}, err
+	}
+	if err := k.store.Create(key); err != nil {
+		return loadedKey{}, err
+	}
+	log.Printf("Generated %s signing key %s", key.Algorithm, key.ID)
+	k.invalidate()
+	return loadKey(*key)
+}
+
+// verificationKey returns the key with the given kid if it still verifies
+// tokens
+func (k *Keyring) verificationKey(cfg config.AuthConfig, kid string) (loadedKey, error) {
+	for _, maxAge := range []time.Duration{cfg.Signing.KeyCacheTTL.Duration(), keyringMissInterval} {
+		keys, err := k.load(maxAge)
+		if err != nil {
+			return loadedKey{}, err
+		}
+		for _, key := range keys {
+			if key.ID != kid {
+				continue
+			}
+			if until := key.VerifiesUntil(cfg); until != nil && time.Now().After(*until) {
+				return loadedKey{}, fmt.Errorf("key %s has expired", kid)
+			}
+			return key, nil
+		}
+	}
+	return loadedKey{}, fmt.Errorf("unknown key %q", kid)
+}
+
+// Sign signs claims with the current signing key and names it in the kid
+// header
+func (k *Keyring) Sign(cfg config.AuthConfig, claims jwt.Claims) (string, error) {
+	key, err := k.signingKey(cfg)
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.private)
+}
+
+// Parse verifies the signature and expiry of a token with the key its kid
+// names. Tokens without a kid are HS256 tokens from before key rotation and
+// are only accepted while auth.jwt_secret is still set.
+func (k *Keyring) Parse(cfg config.AuthConfig, tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok || cfg.JWTSecret == "" {
+				return nil, errors.New("token has no kid")
+			}
+			return []byte(cfg.JWTSecret), nil
+		}
+
+		key, err := k.verificationKey(cfg, kid)
+		if err != nil {
+			return nil, err
+		}
+		// Never let the token pick the algorithm its key is used with
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return key.private.Public(), nil
+	})
+}
+
+// JWK is the public half of a signing key in JSON Web Key form
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 and EC keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+func newJWK(key loadedKey) JWK {
+	jwk := JWK{KeyID: key.ID, Use: "sig", Algorithm: key.Algorithm}
+	switch public := key.private.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+	return jwk
+}
+
+// GetJWKS publishes the public keys that verify tokens, so other services
+// can check them without being able to sign any
+func GetJWKS(c *gin.Context, s *Stores, cfg config.AuthConfig) {
+	keys, err := s.Keys.load(cfg.Signing.KeyCacheTTL.Duration())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch keys"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	now := time.Now()
+	jwks := []JWK{}
+	for _, key := range keys {
+		if until := key.VerifiesUntil(cfg); until != nil && now.After(*until) {
+			continue
+		}
+		jwks = append(jwks, newJWK(key))
+	}
+
+	c.Header("Cache-Control", "public, max-age="+strconv.Itoa(int(cfg.Signing.KeyCacheTTL.Duration().Seconds())))
+	c.JSON(http.StatusOK, gin.H{"keys": jwks})
+}
+
+// signingMethodEdDSA adds Ed25519 signatures, which jwt-go v3 lacks
+var signingMethodEdDSA = &ed25519SigningMethod{}
+
+func init() {
+	jwt.RegisterSigningMethod(AlgorithmEdDSA, func() jwt.SigningMethod { return signingMethodEdDSA })
+}
+
+type ed25519SigningMethod struct{}
+
+func (m *ed25519SigningMethod) Alg() string {
+	return AlgorithmEdDSA
+}
+
+func (m *ed25519SigningMethod) Sign(signingString string, key interface{}) (string, error) {
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(private, []byte(signingString))), nil
+}
+
+func (m *ed25519SigningMethod) Verify(signingString, signature string, key interface{}) error {
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(public, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
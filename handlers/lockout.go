@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// LoginThrottle counts the recent failed logins of an account or a client
+// IP. Key is "account:<username>" or "ip:<address>".
+type LoginThrottle struct {
+	Key           string    `json:"key" db:"key" gorm:"primaryKey"`
+	Failures      int       `json:"failures" db:"failures"`
+	LastFailureAt time.Time `json:"lastFailureAt" db:"last_failure_at"`
+}
+
+func accountKey(username string) string {
+	return "account:" + strings.ToLower(username)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// throttleDelay returns how long after its last failure a key with the
+// given number of failures has to wait
+func throttleDelay(cfg config.LockoutConfig, failures, free, max int) time.Duration {
+	switch {
+	case failures >= max:
+		return cfg.LockDuration.Duration()
+	case failures <= free:
+		return 0
+	}
+	delay := float64(cfg.BaseDelay) * math.Pow(2, float64(failures-free-1))
+	if delay > float64(cfg.MaxDelay) {
+		return cfg.MaxDelay.Duration()
+	}
+	return time.Duration(delay)
+}
+
+// loginGuard applies the lockout policy to the login attempts for one
+// username from one client IP. Unknown usernames are tracked like real
+// ones, so the responses do not tell them apart.
+type loginGuard struct {
+	s        *Stores
+	cfg      config.LockoutConfig
+	username string
+	ip       string
+}
+
+func newLoginGuard(c *gin.Context, s *Stores, cfg config.LockoutConfig, username string) *loginGuard {
+	return &loginGuard{s: s, cfg: cfg, username: username, ip: c.ClientIP()}
+}
+
+// retryAfter returns how long the attempt has to wait, or 0 if it may go ahead
+func (g *loginGuard) retryAfter(now time.Time) (time.Duration, error) {
+	if !g.cfg.Enabled {
+		return 0, nil
+	}
+
+	var wait time.Duration
+	limits := []struct {
+		key       string
+		free, max int
+	}{
+		{accountKey(g.username), g.cfg.AccountFreeAttempts, g.cfg.AccountMaxFailures},
+		{ipKey(g.ip), g.cfg.IPFreeAttempts, g.cfg.IPMaxFailures},
+	}
+	for _, limit := range limits {
+		throttle, err := g.s.LoginThrottles.Get(limit.key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		until := throttle.LastFailureAt.Add(throttleDelay(g.cfg, throttle.Failures, limit.free, limit.max))
+		if remaining := until.Sub(now); remaining > wait {
+			wait = remaining
+		}
+	}
+	return wait, nil
+}
+
+// check responds 429 with a Retry-After header and returns false when the
+// attempt has to wait
+func (g *loginGuard) check(c *gin.Context, userID *int) bool {
+	wait, err := g.retryAfter(time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return false
+	}
+	if wait <= 0 {
+		return true
+	}
+
+	recordAudit(g.s, AuditEvent{Type: AuditLoginThrottled, UserID: userID, Username: g.username, IP: g.ip})
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed login attempts, try again later"})
+	return false
+}
+
+// fail counts a failed attempt against the account and the IP and records
+// it in the audit log. userID is nil when the username is unknown.
+func (g *loginGuard) fail(userID *int, reason string) {
+	recordAudit(g.s, AuditEvent{Type: AuditLoginFailed, UserID: userID, Username: g.username, IP: g.ip, Detail: reason})
+	if !g.cfg.Enabled {
+		return
+	}
+
+	now := time.Now()
+	account, err := g.s.LoginThrottles.RecordFailure(accountKey(g.username), now, g.cfg.Window.Duration())
+	if err != nil {
+		log.Println("Error recording failed login:", err)
+	} else if account.Failures == g.cfg.AccountMaxFailures {
+		recordAudit(g.s, AuditEvent{Type: AuditAccountLocked, UserID: userID, Username: g.username, IP: g.ip,
+			Detail: fmt.Sprintf("%d failed logins", account.Failures)})
+	}
+	if _, err := g.s.LoginThrottles.RecordFailure(ipKey(g.ip), now, g.cfg.Window.Duration()); err != nil {
+		log.Println("Error recording failed login:", err)
+	}
+}
+
+// succeed clears the failures of the account. Those of the IP stay, or an
+// attacker could reset them by logging into an account of their own.
+func (g *loginGuard) succeed() {
+	if err := g.s.LoginThrottles.Reset(accountKey(g.username)); err != nil {
+		log.Println("Error resetting failed logins:", err)
+	}
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// compareDummyPassword spends the time of a password check when the
+// username is unknown, so response times do not reveal which names exist
+func compareDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// UnlockUser clears the failed logins of an account so its owner can log in
+// again straight away
+func UnlockUser(c *gin.Context, s *Stores) {
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	user, err := s.Users.GetByID(userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if err := s.LoginThrottles.Reset(accountKey(user.Username)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock account"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	recordAudit(s, AuditEvent{Type: AuditAccountUnlocked, UserID: &user.ID, Username: user.Username, IP: c.ClientIP(),
+		Detail: fmt.Sprintf("unlocked by user %d", c.GetInt("user_id"))})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account unlocked"})
+}
@@ -1,68 +1,142 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
+// Notification types. System notifications carry a Message; the others are
+// described from their actors when they are read.
+const (
+	NotificationSystem  = "system"
+	NotificationFollow  = "follow"
+	NotificationLike    = "like"
+	NotificationComment = "comment"
+	NotificationMention = "mention"
+)
+
+// maxNotificationActors caps the actors a grouped notification remembers.
+// ActorCount keeps counting past it.
+const maxNotificationActors = 20
+
+// maxMentionsPerPost caps the users a single post can notify
+const maxMentionsPerPost = 10
+
+// mentionPattern matches @username where it is not part of a word or an
+// email address
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([A-Za-z0-9]{3,32})\b`)
+
 type Notification struct {
-	ID        int       `json:"notificationId,omitempty" db:"id"`
-	UserID    int       `json:"userId,omitempty" db:"user_id"`
+	ID     int    `json:"notificationId,omitempty" db:"id"`
+	UserID int    `json:"userId,omitempty" db:"user_id"`
+	Type   string `json:"type,omitempty" db:"type"`
+	// ActorIDs are the users who caused the notification, most recent first
+	ActorIDs   []int `json:"actorIds,omitempty" db:"actor_ids" gorm:"serializer:json"`
+	ActorCount int   `json:"actorCount,omitempty" db:"actor_count"`
+	PostID     *int  `json:"postId,omitempty" db:"post_id"`
+	// GroupKey identifies the events an unread notification collects, such
+	// as the likes of one post
+	GroupKey  string    `json:"-" db:"group_key"`
 	Message   string    `json:"message,omitempty" db:"message"`
 	IsRead    bool      `json:"isRead,omitempty" db:"is_read"`
 	CreatedAt time.Time `json:"createdAt,omitempty" db:"created_at"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty" db:"updated_at"`
 }
 
-// CreateNotification sends a notification to a user
-func CreateNotification(c *gin.Context, db *gorm.DB) {
-	var notification Notification
-	if err := c.ShouldBindJSON(&notification); err != nil {
+// CreateNotification sends a system notification to a user
+func CreateNotification(c *gin.Context, s *Stores) {
+	var request struct {
+		UserID  int    `json:"userId" binding:"required"`
+		Message string `json:"message" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if _, err := s.Users.GetByID(request.UserID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
 
-	err := db.Create(&notification).Error
+	notification := Notification{UserID: request.UserID, Type: NotificationSystem, Message: request.Message}
+	err := s.Notifications.Create(&notification)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send notification"})
 		return
 	}
+	publishNotification(s, notification)
 
 	c.JSON(http.StatusCreated, gin.H{"message": "Notification sent successfully"})
 }
 
+// NotificationFilter selects the notifications of a bulk action. Empty
+// fields match every notification.
+type NotificationFilter struct {
+	Type string
+	// Before matches the notifications last updated before it
+	Before *time.Time
+}
+
+// matches reports whether notification is selected by the filter
+func (f NotificationFilter) matches(notification Notification) bool {
+	if f.Type != "" && notification.Type != f.Type {
+		return false
+	}
+	return f.Before == nil || notification.UpdatedAt.Before(*f.Before)
+}
+
+// notificationListSpec lists notifications with the latest activity first
+var notificationListSpec = ListSpec{
+	Sorts:   []string{"updated_at", "created_at", "id"},
+	Desc:    true,
+	Filters: map[string]FilterKind{"is_read": FilterBool, "type": FilterString},
+}
+
 // GetNotifications retrieves notifications for a user
-func GetNotifications(c *gin.Context, db *gorm.DB) {
+func GetNotifications(c *gin.Context, s *Stores) {
 	userID, ok := c.Get("user_id")
 	if !ok {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	var notifications []Notification
-	err := db.Where("user_id = ?", userID).Order("created_at DESC").Find(&notifications).Error
+	query, ok := bindListQuery(c, notificationListSpec)
+	if !ok {
+		return
+	}
+
+	notifications, err := s.Notifications.ListByUser(userID.(int), query)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch notifications"})
 		return
 	}
 
-	c.JSON(http.StatusOK, notifications)
+	describeNotifications(s, notifications)
+	c.JSON(http.StatusOK, newPage(notifications, query))
 }
 
 // MarkNotificationAsRead marks a notification as read
-func MarkNotificationAsRead(c *gin.Context, db *gorm.DB) {
-	notificationID := c.Param("notificationId")
+func MarkNotificationAsRead(c *gin.Context, s *Stores) {
+	notificationID, err := strconv.Atoi(c.Param("notificationId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification ID"})
+		return
+	}
 	userID, ok := c.Get("user_id")
 	if !ok {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	var notification Notification
-	err := db.First(&notification, notificationID).Error
+	notification, err := s.Notifications.GetByID(notificationID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
 		return
@@ -75,7 +149,7 @@ func MarkNotificationAsRead(c *gin.Context, db *gorm.DB) {
 	}
 
 	// Mark the notification as read
-	err = db.Model(&notification).Update("is_read", true).Error
+	err = s.Notifications.MarkRead(notification.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark notification as read"})
 		return
@@ -83,3 +157,268 @@ func MarkNotificationAsRead(c *gin.Context, db *gorm.DB) {
 
 	c.JSON(http.StatusOK, gin.H{"message": "Notification marked as read successfully"})
 }
+
+// GetUnreadNotificationCount returns how many of the caller's notifications
+// are unread, for badges
+func GetUnreadNotificationCount(c *gin.Context, s *Stores) {
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	unread, err := s.Notifications.CountUnread(userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count notifications"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"unread": unread})
+}
+
+// MarkNotificationsAsRead marks the caller's unread notifications as read:
+// all of them, or those of a type and those last updated before a time
+func MarkNotificationsAsRead(c *gin.Context, s *Stores) {
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var request struct {
+		Type   string     `json:"type"`
+		Before *time.Time `json:"before"`
+	}
+	// The body is optional: without one every notification is marked
+	if err := c.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Type != "" && request.Type != NotificationSystem && !contains(PreferenceTypes, request.Type) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown notification type"})
+		return
+	}
+
+	marked, err := s.Notifications.MarkAllRead(userID.(int), NotificationFilter{Type: request.Type, Before: request.Before})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark notifications as read"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Notifications marked as read successfully", "marked": marked})
+}
+
+// DeleteNotification deletes one of the caller's notifications
+func DeleteNotification(c *gin.Context, s *Stores) {
+	notificationID, err := strconv.Atoi(c.Param("notificationId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification ID"})
+		return
+	}
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if err := s.Notifications.Delete(userID.(int), notificationID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete notification"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Notification deleted successfully"})
+}
+
+// notify records notification as its user prefers: merged into the unread
+// notification of its group, or already read and not streamed when they
+// only want it in their digest. Notifications follow an action that already
+// succeeded, so a failure is only logged.
+func notify(s *Stores, notification Notification) {
+	preference, err := notificationPreference(s, notification.UserID, notification.Type)
+	if err != nil {
+		log.Println("Error executing database query:", err)
+		return
+	}
+	if preference.Muted || (!preference.InApp && !preference.EmailDigest) {
+		return
+	}
+
+	if notification.ActorCount == 0 {
+		notification.ActorCount = len(notification.ActorIDs)
+	}
+	if !preference.InApp {
+		notification.IsRead = true
+		notification.GroupKey = ""
+	}
+	if err := s.Notifications.Group(&notification); err != nil {
+		log.Println("Error creating notification:", err)
+		return
+	}
+	if preference.InApp {
+		publishNotification(s, notification)
+	}
+}
+
+// publishNotification streams a stored notification to its user
+func publishNotification(s *Stores, notification Notification) {
+	if err := s.Broker.Publish(notification); err != nil {
+		log.Println("Error publishing notification:", err)
+	}
+}
+
+// notifyFollowed tells a user they have a new follower. Follows are grouped
+// until the user reads them.
+func notifyFollowed(s *Stores, follow Follow) {
+	if follow.FollowerID == follow.FollowingID {
+		return
+	}
+	notify(s, Notification{
+		UserID:   follow.FollowingID,
+		Type:     NotificationFollow,
+		ActorIDs: []int{follow.FollowerID},
+		GroupKey: NotificationFollow,
+	})
+}
+
+// notifyEngaged tells the author of a post that it was liked or commented
+// on, grouped per post
+func notifyEngaged(s *Stores, engagement Engagement) {
+	post, err := s.Posts.GetByID(engagement.PostID)
+	if err != nil || post.UserID == engagement.UserID {
+		return
+	}
+
+	var types []string
+	if engagement.Like {
+		types = append(types, NotificationLike)
+	}
+	if engagement.Comment != "" {
+		types = append(types, NotificationComment)
+	}
+	for _, typ := range types {
+		notify(s, Notification{
+			UserID:   post.UserID,
+			Type:     typ,
+			ActorIDs: []int{engagement.UserID},
+			PostID:   &post.ID,
+			GroupKey: fmt.Sprintf("%s:post:%d", typ, post.ID),
+		})
+	}
+}
+
+// notifyMentions tells the users mentioned in a post it was published.
+// Users already mentioned in previous, the content before an edit, were told
+// then and are skipped.
+func notifyMentions(s *Stores, post Post, previous string) {
+	notified := mentionedUsernames(previous)
+	for _, username := range mentionedUsernames(post.Content) {
+		if contains(notified, username) {
+			continue
+		}
+		user, err := s.Users.GetByUsername(username)
+		if err != nil || user.ID == post.UserID || user.DeletedAt != nil {
+			continue
+		}
+		notify(s, Notification{
+			UserID:   user.ID,
+			Type:     NotificationMention,
+			ActorIDs: []int{post.UserID},
+			PostID:   &post.ID,
+		})
+	}
+}
+
+// mentionedUsernames returns the distinct usernames mentioned in content,
+// at most maxMentionsPerPost of them
+func mentionedUsernames(content string) []string {
+	var usernames []string
+	seen := map[string]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		if seen[match[1]] {
+			continue
+		}
+		seen[match[1]] = true
+		usernames = append(usernames, match[1])
+		if len(usernames) == maxMentionsPerPost {
+			break
+		}
+	}
+	return usernames
+}
+
+// mergeNotificationActors adds actorIDs to a grouped notification, most
+// recent first. Actors already in the group move to the front without being
+// counted again.
+func mergeNotificationActors(notification *Notification, actorIDs []int) {
+	merged := append([]int{}, actorIDs...)
+	for _, id := range actorIDs {
+		if !containsInt(notification.ActorIDs, id) {
+			notification.ActorCount++
+		}
+	}
+	for _, id := range notification.ActorIDs {
+		if !containsInt(merged, id) {
+			merged = append(merged, id)
+		}
+	}
+	if len(merged) > maxNotificationActors {
+		merged = merged[:maxNotificationActors]
+	}
+	notification.ActorIDs = merged
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// notificationVerbs completes the description of each typed notification
+var notificationVerbs = map[string]string{
+	NotificationFollow:  "followed you",
+	NotificationLike:    "liked your post",
+	NotificationComment: "commented on your post",
+	NotificationMention: "mentioned you in a post",
+}
+
+// describeNotifications fills in the Message of typed notifications from
+// the current usernames of their actors, such as "alice and 4 others liked
+// your post"
+func describeNotifications(s *Stores, notifications []Notification) {
+	usernames := map[int]string{}
+	username := func(id int) string {
+		if name, ok := usernames[id]; ok {
+			return name
+		}
+		name := "Someone"
+		if user, err := s.Users.GetByID(id); err == nil {
+			name = user.Username
+		}
+		usernames[id] = name
+		return name
+	}
+
+	for i, notification := range notifications {
+		verb, ok := notificationVerbs[notification.Type]
+		if !ok || len(notification.ActorIDs) == 0 {
+			continue
+		}
+		actors := username(notification.ActorIDs[0])
+		switch {
+		case notification.ActorCount == 2 && len(notification.ActorIDs) > 1:
+			actors += " and " + username(notification.ActorIDs[1])
+		case notification.ActorCount == 2:
+			actors += " and 1 other"
+		case notification.ActorCount > 2:
+			actors += fmt.Sprintf(" and %d others", notification.ActorCount-1)
+		}
+		notifications[i].Message = actors + " " + verb
+	}
+}
@@ -0,0 +1,368 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/gin-gonic/gin"
+)
+
+// Identity links an account at an identity provider to a user. Subject is
+// the stable ID the provider gives the account.
+type Identity struct {
+	ID        int       `json:"id" db:"id"`
+	UserID    int       `json:"userId" db:"user_id"`
+	Provider  string    `json:"provider" db:"provider"`
+	Subject   string    `json:"subject" db:"subject"`
+	Email     string    `json:"email,omitempty" db:"email"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+// OAuthState remembers a sign-in sent to a provider until it comes back.
+// Only the hash of the state parameter is stored. UserID is set when a
+// logged-in user is linking the provider rather than signing in.
+type OAuthState struct {
+	StateHash    string    `json:"-" db:"state_hash" gorm:"primaryKey"`
+	Provider     string    `json:"provider" db:"provider"`
+	Nonce        string    `json:"-" db:"nonce"`
+	CodeVerifier string    `json:"-" db:"code_verifier"`
+	UserID       *int      `json:"userId,omitempty" db:"user_id"`
+	ExpiresAt    time.Time `json:"expiresAt" db:"expires_at"`
+	CreatedAt    time.Time `json:"createdAt" db:"created_at"`
+}
+
+// TableName keeps gorm from naming the table o_auth_states
+func (OAuthState) TableName() string {
+	return "oauth_states"
+}
+
+// GetOAuthProviders lists the providers users can sign in with
+func GetOAuthProviders(c *gin.Context, oauth *OAuth) {
+	c.JSON(http.StatusOK, gin.H{"providers": oauth.Names()})
+}
+
+// startOAuth stores a new state for provider and returns the URL of its
+// sign-in page
+func startOAuth(c *gin.Context, s *Stores, oauth *OAuth, userID *int) (string, bool) {
+	provider, ok := oauth.Provider(c.Param("provider"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown provider"})
+		return "", false
+	}
+
+	state, stateHash, err := newSecretToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return "", false
+	}
+	nonce, _, err := newSecretToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return "", false
+	}
+	verifier, _, err := newSecretToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return "", false
+	}
+
+	authURL, err := provider.AuthorizationURL(c.Request.Context(), oauth.redirectURI(provider.Name), state, nonce, verifier)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Provider unavailable"})
+		log.Println("Error contacting identity provider:", err)
+		return "", false
+	}
+
+	record := OAuthState{
+		StateHash:    stateHash,
+		Provider:     provider.Name,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		UserID:       userID,
+		ExpiresAt:    time.Now().Add(oauth.cfg.StateTTL.Duration()),
+	}
+	if err := s.OAuthStates.Create(&record); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return "", false
+	}
+	return authURL, true
+}
+
+// OAuthLogin sends the browser to the sign-in page of a provider
+func OAuthLogin(c *gin.Context, s *Stores, oauth *OAuth) {
+	authURL, ok := startOAuth(c, s, oauth, nil)
+	if !ok {
+		return
+	}
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// LinkIdentity starts linking a provider to the caller's account. It
+// returns the URL to open rather than redirecting, since the request needs
+// the caller's token.
+func LinkIdentity(c *gin.Context, s *Stores, oauth *OAuth) {
+	userID := c.GetInt("user_id")
+	authURL, ok := startOAuth(c, s, oauth, &userID)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"authorization_url": authURL})
+}
+
+// OAuthCallback completes a sign-in or a link when the provider sends the
+// user back. Sign-ins use the linked user, link to the user with the same
+// verified email, or create a new user.
+func OAuthCallback(c *gin.Context, s *Stores, oauth *OAuth, cfg config.AuthConfig) {
+	provider, ok := oauth.Provider(c.Param("provider"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown provider"})
+		return
+	}
+	if providerError := c.Query("error"); providerError != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Sign-in was not completed: " + providerError})
+		return
+	}
+
+	// The state is used up even when the rest fails, so a code cannot be
+	// tried twice
+	state, err := s.OAuthStates.Consume(hashToken(c.Query("state")))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	if err != nil || state.Provider != provider.Name || time.Now().After(state.ExpiresAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired state"})
+		return
+	}
+
+	code := c.Query("code")
+	if code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing authorization code"})
+		return
+	}
+	rawIDToken, err := provider.Exchange(c.Request.Context(), oauth.redirectURI(provider.Name), code, state.CodeVerifier)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to complete sign-in with the provider"})
+		log.Println("Error exchanging authorization code:", err)
+		return
+	}
+	claims, err := provider.VerifyIDToken(c.Request.Context(), rawIDToken, state.Nonce)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid ID token"})
+		log.Println("Invalid ID token:", err)
+		return
+	}
+
+	identity, err := s.Identities.Get(provider.Name, claims.Subject)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	if state.UserID != nil {
+		linkIdentity(c, s, provider.Name, claims, identity, *state.UserID)
+		return
+	}
+
+	if identity == nil {
+		user, ok := socialUser(c, s, provider.Name, claims)
+		if !ok {
+			return
+		}
+		identity = &Identity{UserID: user.ID, Provider: provider.Name, Subject: claims.Subject, Email: claims.Email}
+		if err := s.Identities.Create(identity); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+			log.Println("Error executing database query:", err)
+			return
+		}
+		recordAudit(s, AuditEvent{Type: AuditIdentityLinked, UserID: &user.ID, Username: user.Username, IP: c.ClientIP(), Detail: provider.Name})
+	}
+
+	completeLogin(c, s, cfg, identity.UserID)
+}
+
+// linkIdentity finishes LinkIdentity for userID
+func linkIdentity(c *gin.Context, s *Stores, provider string, claims *IDTokenClaims, existing *Identity, userID int) {
+	if existing != nil {
+		if existing.UserID != userID {
+			c.JSON(http.StatusConflict, gin.H{"error": "This account is already linked to another user"})
+			return
+		}
+		c.JSON(http.StatusOK, existing)
+		return
+	}
+
+	identity := Identity{UserID: userID, Provider: provider, Subject: claims.Subject, Email: claims.Email}
+	err := s.Identities.Create(&identity)
+	if errors.Is(err, ErrConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "This account is already linked to another user"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link account"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	recordAudit(s, AuditEvent{Type: AuditIdentityLinked, UserID: &userID, IP: c.ClientIP(), Detail: provider})
+
+	c.JSON(http.StatusOK, identity)
+}
+
+// socialUser returns the user a first sign-in with a provider belongs to.
+// An existing user is only matched by email when both sides have verified
+// it; otherwise anyone could claim an account by registering its email at
+// a provider.
+func socialUser(c *gin.Context, s *Stores, provider string, claims *IDTokenClaims) (*User, bool) {
+	email := NormalizeEmail(claims.Email)
+	if email != "" {
+		user, err := s.Users.GetByEmail(email)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+			log.Println("Error executing database query:", err)
+			return nil, false
+		}
+		if user != nil {
+			if claims.EmailVerified && user.EmailVerified {
+				return user, true
+			}
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("An account with this email already exists; log in and link %s from it", provider)})
+			return nil, false
+		}
+	}
+
+	username, err := socialUsername(s, claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return nil, false
+	}
+	// No password: the user signs in with the provider or sets one through
+	// the forgot password flow
+	user := User{
+		Username:      username,
+		Email:         email,
+		EmailVerified: email != "" && claims.EmailVerified,
+		DisplayName:   claims.Name,
+	}
+	if err := s.Users.Create(&user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
+		log.Println("Error executing database query:", err)
+		return nil, false
+	}
+	if err := assignRole(s, user.ID, RoleUser, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
+		log.Println("Error executing database query:", err)
+		return nil, false
+	}
+	return &user, true
+}
+
+// socialUsername derives a free username from the claims, following the
+// rules Register applies to chosen ones
+func socialUsername(s *Stores, claims *IDTokenClaims) (string, error) {
+	base := ""
+	for _, candidate := range []string{claims.PreferredUsername, strings.Split(claims.Email, "@")[0], claims.Name} {
+		base = strings.Map(func(r rune) rune {
+			if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+				return r
+			}
+			return -1
+		}, candidate)
+		if len(base) >= 3 {
+			break
+		}
+	}
+	if len(base) < 3 {
+		base = "user"
+	}
+	if len(base) > 24 {
+		base = base[:24]
+	}
+
+	username := base
+	for attempt := 0; attempt < 10; attempt++ {
+		_, err := s.Users.GetByUsername(username)
+		if errors.Is(err, ErrNotFound) {
+			return username, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		suffix, err := rand.Int(rand.Reader, big.NewInt(100000000))
+		if err != nil {
+			return "", err
+		}
+		username = base + suffix.String()
+	}
+	return "", errors.New("no free username found")
+}
+
+// GetIdentities lists the providers linked to the caller's account
+func GetIdentities(c *gin.Context, s *Stores) {
+	identities, err := s.Identities.ListByUser(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch linked accounts"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, identities)
+}
+
+// UnlinkIdentity removes a provider from the caller's account, unless it
+// is the only way left to sign in
+func UnlinkIdentity(c *gin.Context, s *Stores) {
+	identityID, err := strconv.Atoi(c.Param("identityId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid identity ID"})
+		return
+	}
+	userID := c.GetInt("user_id")
+
+	user, err := s.Users.GetByID(userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	identities, err := s.Identities.ListByUser(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlink account"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	var identity *Identity
+	for i := range identities {
+		if identities[i].ID == identityID {
+			identity = &identities[i]
+		}
+	}
+	if identity == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Linked account not found"})
+		return
+	}
+	if user.Password == "" && len(identities) == 1 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Set a password before unlinking your last linked account"})
+		return
+	}
+
+	if err := s.Identities.Delete(userID, identityID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlink account"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	recordAudit(s, AuditEvent{Type: AuditIdentityUnlinked, UserID: &userID, Username: user.Username, IP: c.ClientIP(), Detail: identity.Provider})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account unlinked"})
+}
@@ -0,0 +1,416 @@
+package handlers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// providerPresets fill in what is known about well-known providers, so
+// their config only needs the client credentials
+var providerPresets = map[string]config.OIDCProviderConfig{
+	// Facebook has no discovery document for the code flow, and only ever
+	// hands out confirmed email addresses
+	"facebook": {
+		Issuer:           "https://www.facebook.com",
+		Scopes:           []string{"openid", "email", "public_profile"},
+		AuthorizationURL: "https://www.facebook.com/v18.0/dialog/oauth",
+		TokenURL:         "https://graph.facebook.com/v18.0/oauth/access_token",
+		JWKSURL:          "https://www.facebook.com/.well-known/oauth/openid/jwks/",
+		TrustEmail:       true,
+	},
+}
+
+// oidcKeysMissInterval limits how often an unknown kid refetches the JWKS
+// of a provider
+const oidcKeysMissInterval = time.Minute
+
+// OIDCProvider is an OpenID Connect provider users can sign in with, using
+// the authorization code flow with PKCE
+type OIDCProvider struct {
+	Name   string
+	cfg    config.OIDCProviderConfig
+	client *http.Client
+
+	mu           sync.Mutex
+	discovered   bool
+	keys         map[string]interface{}
+	keysLoadedAt time.Time
+}
+
+func newOIDCProvider(name string, cfg config.OIDCProviderConfig, client *http.Client) *OIDCProvider {
+	if preset, ok := providerPresets[name]; ok {
+		if cfg.Issuer == "" {
+			cfg.Issuer = preset.Issuer
+		}
+		if len(cfg.Scopes) == 0 {
+			cfg.Scopes = preset.Scopes
+		}
+		if cfg.AuthorizationURL == "" && cfg.TokenURL == "" && cfg.JWKSURL == "" {
+			cfg.AuthorizationURL, cfg.TokenURL, cfg.JWKSURL = preset.AuthorizationURL, preset.TokenURL, preset.JWKSURL
+		}
+		cfg.TrustEmail = cfg.TrustEmail || preset.TrustEmail
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &OIDCProvider{Name: name, cfg: cfg, client: client}
+}
+
+// discover fills in the endpoints that are not configured from the
+// discovery document of the issuer. It is retried until it succeeds.
+func (p *OIDCProvider) discover(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovered {
+		return nil
+	}
+	if p.cfg.AuthorizationURL == "" || p.cfg.TokenURL == "" || p.cfg.JWKSURL == "" {
+		var doc struct {
+			Issuer                string `json:"issuer"`
+			AuthorizationEndpoint string `json:"authorization_endpoint"`
+			TokenEndpoint         string `json:"token_endpoint"`
+			JWKSURI               string `json:"jwks_uri"`
+		}
+		wellKnown := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+		if err := p.getJSON(ctx, wellKnown, &doc); err != nil {
+			return fmt.Errorf("discovering %s: %w", p.Name, err)
+		}
+		if doc.Issuer != p.cfg.Issuer {
+			return fmt.Errorf("discovering %s: issuer %q does not match %q", p.Name, doc.Issuer, p.cfg.Issuer)
+		}
+		if p.cfg.AuthorizationURL == "" {
+			p.cfg.AuthorizationURL = doc.AuthorizationEndpoint
+		}
+		if p.cfg.TokenURL == "" {
+			p.cfg.TokenURL = doc.TokenEndpoint
+		}
+		if p.cfg.JWKSURL == "" {
+			p.cfg.JWKSURL = doc.JWKSURI
+		}
+	}
+	p.discovered = true
+	return nil
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// pkceChallenge derives the S256 code challenge of a code verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthorizationURL returns the provider page that asks the user to sign in
+func (p *OIDCProvider) AuthorizationURL(ctx context.Context, redirectURI, state, nonce, verifier string) (string, error) {
+	if err := p.discover(ctx); err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {redirectURI},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(p.cfg.AuthorizationURL, "?") {
+		separator = "&"
+	}
+	return p.cfg.AuthorizationURL + separator + query.Encode(), nil
+}
+
+// Exchange trades an authorization code for the ID token of the user
+func (p *OIDCProvider) Exchange(ctx context.Context, redirectURI, code, verifier string) (string, error) {
+	if err := p.discover(ctx); err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {p.cfg.ClientID},
+		"client_secret": {p.cfg.ClientSecret},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("token response: %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("token response: %s: %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return body.IDToken, nil
+}
+
+// IDTokenClaims are the claims of a verified ID token that sign-in uses
+type IDTokenClaims struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce
+// of an ID token
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, raw, nonce string) (*IDTokenClaims, error) {
+	token, err := jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := p.verificationKey(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		// The key, not the token, decides the algorithm
+		var ok bool
+		switch key.(type) {
+		case *rsa.PublicKey:
+			_, ok = token.Method.(*jwt.SigningMethodRSA)
+		case *ecdsa.PublicKey:
+			_, ok = token.Method.(*jwt.SigningMethodECDSA)
+		case ed25519.PublicKey:
+			ok = token.Method == signingMethodEdDSA
+		}
+		if !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid ID token")
+	}
+
+	if claims["iss"] != p.cfg.Issuer {
+		return nil, fmt.Errorf("ID token issued by %v", claims["iss"])
+	}
+	if !audienceContains(claims["aud"], p.cfg.ClientID) {
+		return nil, errors.New("ID token is for another client")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.cfg.ClientID {
+		return nil, errors.New("ID token is for another client")
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("ID token has no expiry")
+	}
+	if claims["nonce"] != nonce {
+		return nil, errors.New("ID token nonce does not match")
+	}
+
+	result := &IDTokenClaims{}
+	result.Subject, _ = claims["sub"].(string)
+	if result.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	result.Email, _ = claims["email"].(string)
+	result.Name, _ = claims["name"].(string)
+	result.PreferredUsername, _ = claims["preferred_username"].(string)
+	// Some providers send email_verified as a string
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		result.EmailVerified = verified
+	case string:
+		result.EmailVerified = verified == "true"
+	default:
+		result.EmailVerified = p.cfg.TrustEmail && result.Email != ""
+	}
+	return result, nil
+}
+
+// audienceContains reports whether an aud claim, a string or an array of
+// them, names clientID
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verificationKey returns the provider key with the given kid, refetching
+// the JWKS when the kid is unknown since providers rotate their keys
+func (p *OIDCProvider) verificationKey(ctx context.Context, kid string) (interface{}, error) {
+	if err := p.discover(ctx); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if p.keys != nil && time.Since(p.keysLoadedAt) < oidcKeysMissInterval {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	var jwks struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.cfg.JWKSURL, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]interface{}, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.KeyID] = key
+		}
+	}
+	p.keys, p.keysLoadedAt = keys, time.Now()
+
+	// A provider with a single key may leave out the kid
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// publicKey decodes the public key of an RSA, P-256 or Ed25519 JWK
+func (k JWK) publicKey() (interface{}, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b), err
+	}
+	switch {
+	case k.KeyType == "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case k.KeyType == "EC" && k.Curve == "P-256":
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case k.KeyType == "OKP" && k.Curve == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.KeyType)
+}
+
+// OAuth holds the configured identity providers
+type OAuth struct {
+	cfg       config.OAuthConfig
+	providers map[string]*OIDCProvider
+}
+
+// NewOAuth sets up the providers in cfg. client makes the requests to the
+// providers; nil uses a client with a short timeout.
+func NewOAuth(cfg config.OAuthConfig, client *http.Client) *OAuth {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	providers := make(map[string]*OIDCProvider, len(cfg.Providers))
+	for name, providerCfg := range cfg.Providers {
+		providers[name] = newOIDCProvider(name, providerCfg, client)
+	}
+	return &OAuth{cfg: cfg, providers: providers}
+}
+
+// Provider returns the provider with the given name
+func (o *OAuth) Provider(name string) (*OIDCProvider, bool) {
+	provider, ok := o.providers[name]
+	return provider, ok
+}
+
+// Names lists the configured providers in alphabetical order
+func (o *OAuth) Names() []string {
+	names := make([]string, 0, len(o.providers))
+	for name := range o.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// redirectURI returns the callback URL registered with a provider
+func (o *OAuth) redirectURI(provider string) string {
+	return strings.ReplaceAll(o.cfg.CallbackURL, "{provider}", provider)
+}
@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Page sizes accepted by every list endpoint
+const (
+	DefaultPageLimit = 20
+	MaxPageLimit     = 100
+)
+
+// ListQuery selects one page of a list. Stores return at most Limit items
+// (all of them when Limit is 0) matching Filters, ordered by Sort and then
+// by id, starting after the After cursor. Sort and Filters name columns by
+// the db tag of the model; the zero value lists everything by ascending id.
+type ListQuery struct {
+	Limit   int
+	Sort    string
+	Desc    bool
+	After   *Cursor
+	Filters map[string]interface{}
+}
+
+// sortColumn returns the column the list is ordered by
+func (q ListQuery) sortColumn() string {
+	if q.Sort == "" {
+		return "id"
+	}
+	return q.Sort
+}
+
+// Cursor is the position of the last item of a page. It remembers the sort
+// it was issued for so it cannot be replayed against another order.
+type Cursor struct {
+	Sort  string          `json:"s"`
+	Desc  bool            `json:"d,omitempty"`
+	Value json.RawMessage `json:"v,omitempty"`
+	ID    int64           `json:"i"`
+}
+
+// Encode returns the opaque form of the cursor handed to clients
+func (c Cursor) Encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// DecodeCursor parses a cursor produced by Encode
+func DecodeCursor(encoded string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var cursor Cursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
+// FilterKind is the type of a filter value in the query string
+type FilterKind int
+
+const (
+	FilterString FilterKind = iota
+	FilterInt
+	FilterBool
+)
+
+// ListSpec declares how a list endpoint can be sorted and filtered. Sorts
+// and Filters are column names; the first sort is the default, in the
+// direction given by Desc.
+type ListSpec struct {
+	Sorts   []string
+	Desc    bool
+	Filters map[string]FilterKind
+}
+
+// Page is the envelope every list endpoint responds with. NextCursor is
+// passed back as the cursor query parameter to fetch the next page.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+// parseLimit reads the limit query parameter
+func parseLimit(c *gin.Context, def, max int) (int, error) {
+	raw := c.Query("limit")
+	if raw == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 || limit > max {
+		return 0, fmt.Errorf("limit must be between 1 and %d", max)
+	}
+	return limit, nil
+}
+
+// parseListQuery reads limit, cursor, sort and the filters of spec from the
+// query string. sort is a column name, prefixed with "-" for descending
+// order. The returned Limit asks for one extra item, which newPage uses to
+// tell whether there is a next page.
+func parseListQuery(c *gin.Context, spec ListSpec) (ListQuery, error) {
+	limit, err := parseLimit(c, DefaultPageLimit, MaxPageLimit)
+	if err != nil {
+		return ListQuery{}, err
+	}
+	query := ListQuery{Limit: limit + 1, Sort: spec.Sorts[0], Desc: spec.Desc}
+
+	if raw := c.Query("sort"); raw != "" {
+		query.Desc = strings.HasPrefix(raw, "-")
+		query.Sort = strings.TrimPrefix(raw, "-")
+		if !contains(spec.Sorts, query.Sort) {
+			return ListQuery{}, fmt.Errorf("sort must be one of %s", strings.Join(spec.Sorts, ", "))
+		}
+	}
+
+	if raw := c.Query("cursor"); raw != "" {
+		cursor, err := DecodeCursor(raw)
+		if err != nil {
+			return ListQuery{}, errors.New("invalid cursor")
+		}
+		if cursor.Sort != query.Sort || cursor.Desc != query.Desc {
+			return ListQuery{}, errors.New("cursor does not match sort")
+		}
+		query.After = cursor
+	}
+
+	for name, kind := range spec.Filters {
+		raw, ok := c.GetQuery(name)
+		if !ok {
+			continue
+		}
+		var value interface{} = raw
+		switch kind {
+		case FilterInt:
+			value, err = strconv.ParseInt(raw, 10, 64)
+		case FilterBool:
+			value, err = strconv.ParseBool(raw)
+		}
+		if err != nil {
+			return ListQuery{}, fmt.Errorf("invalid value for filter %s", name)
+		}
+		if query.Filters == nil {
+			query.Filters = make(map[string]interface{})
+		}
+		query.Filters[name] = value
+	}
+
+	return query, nil
+}
+
+// bindListQuery parses the list query of the request and responds with 400
+// when it is invalid
+func bindListQuery(c *gin.Context, spec ListSpec) (ListQuery, bool) {
+	query, err := parseListQuery(c, spec)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return ListQuery{}, false
+	}
+	return query, true
+}
+
+// newPage wraps items fetched with a query from parseListQuery, dropping
+// the extra item and turning it into a next cursor
+func newPage[T any](items []T, query ListQuery) Page[T] {
+	page := Page[T]{Items: items}
+	if page.Items == nil {
+		page.Items = []T{}
+	}
+	if query.Limit == 0 || len(items) < query.Limit {
+		return page
+	}
+
+	page.Items = items[:query.Limit-1]
+	page.HasMore = true
+	if len(page.Items) > 0 {
+		last := reflect.ValueOf(page.Items[len(page.Items)-1])
+		value, _ := json.Marshal(columnValue(last, query.sortColumn()).Interface())
+		page.NextCursor = Cursor{
+			Sort:  query.Sort,
+			Desc:  query.Desc,
+			Value: value,
+			ID:    intValue(columnValue(last, "id")),
+		}.Encode()
+	}
+	return page
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// columnField returns the struct field of model whose db tag is column
+func columnField(model reflect.Type, column string) (reflect.StructField, bool) {
+	for model.Kind() == reflect.Pointer {
+		model = model.Elem()
+	}
+	for i := 0; i < model.NumField(); i++ {
+		if field := model.Field(i); field.Tag.Get("db") == column {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// columnValue returns the field of item whose db tag is column
+func columnValue(item reflect.Value, column string) reflect.Value {
+	for item.Kind() == reflect.Pointer {
+		item = item.Elem()
+	}
+	field, ok := columnField(item.Type(), column)
+	if !ok {
+		return reflect.Value{}
+	}
+	return item.FieldByIndex(field.Index)
+}
+
+// intValue returns an integer field of any width as an int64
+func intValue(v reflect.Value) int64 {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint())
+	}
+	return 0
+}
+
+// cursorValue decodes the sort value of cursor into the Go type of the
+// column it was taken from, so stores can compare it with their rows
+func cursorValue(model reflect.Type, cursor *Cursor) (interface{}, error) {
+	column := cursor.Sort
+	if column == "" {
+		column = "id"
+	}
+	field, ok := columnField(model, column)
+	if !ok {
+		return nil, fmt.Errorf("unknown sort column %q", column)
+	}
+	value := reflect.New(field.Type)
+	if err := json.Unmarshal(cursor.Value, value.Interface()); err != nil {
+		return nil, err
+	}
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return nil, errors.New("cursor has no sort value")
+		}
+		value = value.Elem()
+	}
+	return value.Interface(), nil
+}
+
+// compareValues orders two field values of the same column. Integers of
+// different widths compare by value and nil pointers sort first.
+func compareValues(a, b reflect.Value) int {
+	for a.Kind() == reflect.Pointer || a.Kind() == reflect.Interface {
+		if a.IsNil() {
+			return -1
+		}
+		a = a.Elem()
+	}
+	for b.Kind() == reflect.Pointer || b.Kind() == reflect.Interface {
+		if b.IsNil() {
+			return 1
+		}
+		b = b.Elem()
+	}
+
+	if at, ok := a.Interface().(time.Time); ok {
+		bt, _ := b.Interface().(time.Time)
+		return at.Compare(bt)
+	}
+	switch a.Kind() {
+	case reflect.String:
+		return strings.Compare(a.String(), b.String())
+	case reflect.Bool:
+		switch {
+		case a.Bool() == b.Bool():
+			return 0
+		case b.Bool():
+			return -1
+		default:
+			return 1
+		}
+	default:
+		x, y := intValue(a), intValue(b)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+}
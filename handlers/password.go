@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/mail"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordResetToken is a single-use token mailed to a user who forgot
+// their password. Only the hash of the token is stored.
+type PasswordResetToken struct {
+	ID        int        `json:"id,omitempty" db:"id"`
+	UserID    int        `json:"userId,omitempty" db:"user_id"`
+	TokenHash string     `json:"-" db:"token_hash"`
+	ExpiresAt time.Time  `json:"expiresAt,omitempty" db:"expires_at"`
+	UsedAt    *time.Time `json:"usedAt,omitempty" db:"used_at"`
+	CreatedAt time.Time  `json:"createdAt,omitempty" db:"created_at"`
+}
+
+// ForgotPassword mails a password reset link to the user with the given
+// email. The response is the same whether or not the address is known, so
+// it cannot be used to find out who has an account: the link is issued and
+// mailed after responding, which keeps the timing the same too.
+func ForgotPassword(c *gin.Context, s *Stores, mailer mail.Mailer, cfg config.PasswordResetConfig) {
+	var request struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	accepted := gin.H{"message": "If the address belongs to an account, a reset link has been sent to it"}
+	user, err := s.Users.GetByEmail(request.Email)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusAccepted, accepted)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	go func() {
+		if err := sendPasswordReset(s, mailer, cfg, *user); err != nil {
+			log.Println("Error sending password reset email:", err)
+		}
+	}()
+
+	c.JSON(http.StatusAccepted, accepted)
+}
+
+// sendPasswordReset issues a reset token for user and mails them the link,
+// unless they already have cfg.MaxActiveTokens links outstanding
+func sendPasswordReset(s *Stores, mailer mail.Mailer, cfg config.PasswordResetConfig, user User) error {
+	now := time.Now()
+	active, err := s.PasswordResets.CountActive(user.ID, now)
+	if err != nil {
+		return err
+	}
+	if active >= cfg.MaxActiveTokens {
+		log.Printf("Password reset for user %d skipped: %d links outstanding", user.ID, active)
+		return nil
+	}
+
+	token, hash, err := newSecretToken()
+	if err != nil {
+		return err
+	}
+	record := PasswordResetToken{
+		UserID:    user.ID,
+		TokenHash: hash,
+		ExpiresAt: now.Add(cfg.TokenTTL.Duration()),
+	}
+	if err := s.PasswordResets.Create(&record); err != nil {
+		return err
+	}
+
+	link := cfg.URL + "?" + url.Values{"token": {token}}.Encode()
+	return mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Text: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your account. "+
+			"Open the link below within %s to choose a new one:\n\n%s\n\n"+
+			"If it was not you, ignore this email; your password stays the same.\n",
+			user.Username, cfg.TokenTTL.Duration(), link),
+	})
+}
+
+// ResetPassword sets a new password with a token from ForgotPassword. The
+// token is used up, and every session of the user is logged out.
+func ResetPassword(c *gin.Context, s *Stores) {
+	var request struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required,min=8"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	token, err := s.PasswordResets.Claim(hashToken(request.Token), now)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	user, err := s.Users.GetByID(token.UserID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+	user.Password = string(hashedPassword)
+	if err := s.Users.Update(user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	// Other links that were mailed out must not work after the password
+	// changed, and whoever knew the old password is logged out
+	if err := s.PasswordResets.InvalidateUser(user.ID, now); err != nil {
+		log.Println("Error invalidating password reset tokens:", err)
+	}
+	if err := revokeUserTokens(s, user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		log.Println("Error revoking user tokens:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset successfully"})
+}
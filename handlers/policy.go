@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Action is something an actor does to a resource. Actions double as the
+// names of the permissions that allow them.
+type Action string
+
+const (
+	ActionCreatePost        Action = "posts:create"
+	ActionUpdatePost        Action = "posts:update"
+	ActionDeletePost        Action = "posts:delete"
+	ActionCreateEngagement  Action = "engagements:create"
+	ActionUpdateEngagement  Action = "engagements:update"
+	ActionDeleteEngagement  Action = "engagements:delete"
+	ActionCreateCompany     Action = "companies:create"
+	ActionUpdateCompany     Action = "companies:update"
+	ActionDeleteCompany     Action = "companies:delete"
+	ActionManageRoles       Action = "roles:manage"
+	ActionGrantRoles        Action = "roles:grant"
+	ActionUnlockUsers       Action = "users:unlock"
+	ActionReadAudit         Action = "audit:read"
+	ActionSendNotifications Action = "notifications:send"
+	ActionManageWebhooks    Action = "webhooks:manage"
+	// ActionAll is granted to global admins and allows every action
+	ActionAll Action = "*"
+)
+
+// ownerActions may be performed by the owner of a resource without holding
+// the permission
+var ownerActions = map[Action]bool{
+	ActionUpdatePost:       true,
+	ActionDeletePost:       true,
+	ActionUpdateEngagement: true,
+	ActionDeleteEngagement: true,
+}
+
+// Grant is a permission held by a user through one of their roles. A grant
+// without CompanyID applies everywhere; otherwise only to that company.
+type Grant struct {
+	Permission Action `json:"permission" db:"permission"`
+	CompanyID  *int   `json:"companyId,omitempty" db:"company_id"`
+}
+
+// Actor is the user a policy decision is made for
+type Actor struct {
+	UserID int
+	Grants []Grant
+}
+
+// Can reports whether the actor holds permission globally or, when
+// companyID is not nil, within that company
+func (a Actor) Can(permission Action, companyID *int) bool {
+	for _, grant := range a.Grants {
+		if grant.Permission != permission && grant.Permission != ActionAll {
+			continue
+		}
+		if grant.CompanyID == nil || (companyID != nil && *grant.CompanyID == *companyID) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForbiddenError is returned by Authorize when the policy denies an action
+type ForbiddenError struct {
+	Action Action
+	Reason string
+}
+
+func (e *ForbiddenError) Error() string {
+	return fmt.Sprintf("%s denied: %s", e.Action, e.Reason)
+}
+
+// Authorize decides whether actor may perform action on resource, which may
+// be nil for actions that do not target one. Owners may change and delete
+// their posts and engagements; everything else needs a grant of the action,
+// scoped to the company when resource is a *Company. A denial is reported
+// as a *ForbiddenError.
+func Authorize(actor Actor, action Action, resource interface{}) error {
+	var companyID *int
+	switch r := resource.(type) {
+	case *Post:
+		if ownerActions[action] && r.UserID == actor.UserID {
+			return nil
+		}
+	case *Engagement:
+		if ownerActions[action] && r.UserID == actor.UserID {
+			return nil
+		}
+	case *Company:
+		id := int(r.ID)
+		companyID = &id
+	}
+
+	if actor.Can(action, companyID) {
+		return nil
+	}
+	reason := fmt.Sprintf("requires the %s permission", action)
+	if ownerActions[action] {
+		reason = fmt.Sprintf("only the owner or a user with the %s permission can do this", action)
+	}
+	return &ForbiddenError{Action: action, Reason: reason}
+}
+
+// currentActor loads the authenticated user and their grants as an Actor,
+// so role changes take effect without waiting for new tokens. The actor is
+// kept on the context for the rest of the request.
+func currentActor(c *gin.Context, s *Stores) (Actor, error) {
+	if actor, ok := c.Get("actor"); ok {
+		return actor.(Actor), nil
+	}
+
+	user, err := s.Users.GetByID(c.GetInt("user_id"))
+	if err != nil {
+		return Actor{}, err
+	}
+	grants, err := s.Roles.Grants(user.ID)
+	if err != nil {
+		return Actor{}, err
+	}
+	actor := Actor{UserID: user.ID, Grants: grants}
+	c.Set("actor", actor)
+	return actor, nil
+}
+
+// loadActor is currentActor for handlers. It writes the error response and
+// returns false when the actor cannot be loaded.
+func loadActor(c *gin.Context, s *Stores) (Actor, bool) {
+	actor, err := currentActor(c, s)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return Actor{}, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return Actor{}, false
+	}
+	return actor, true
+}
+
+// authorize checks that the caller may perform action on resource. It
+// writes the error response and returns false when they may not; every
+// denial has the same 403 payload.
+func authorize(c *gin.Context, s *Stores, action Action, resource interface{}) bool {
+	actor, ok := loadActor(c, s)
+	if !ok {
+		return false
+	}
+	return authorizeActor(c, actor, action, resource)
+}
+
+// authorizeActor is authorize for an actor the handler has already loaded
+func authorizeActor(c *gin.Context, actor Actor, action Action, resource interface{}) bool {
+	var forbidden *ForbiddenError
+	if errors.As(Authorize(actor, action, resource), &forbidden) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":  "Forbidden",
+			"action": forbidden.Action,
+			"reason": forbidden.Reason,
+		})
+		return false
+	}
+	return true
+}
+
+// RequirePermission only lets requests through when the authenticated user
+// holds permission. On routes with a companyId parameter, a grant scoped to
+// that company is enough. It must run after AuthMiddleware.
+func RequirePermission(s *Stores, permission Action) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		actor, ok := loadActor(c, s)
+		if !ok {
+			c.Abort()
+			return
+		}
+
+		var resource interface{}
+		if id, err := strconv.Atoi(c.Param("companyId")); err == nil {
+			resource = &Company{ID: uint(id)}
+		}
+		if !authorizeActor(c, actor, permission, resource) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -1,43 +1,79 @@
 package handlers
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
+// Post statuses. A post created with a future ScheduleTime stays scheduled,
+// and visible only to its author, until the Publisher publishes it.
+const (
+	PostStatusScheduled = "scheduled"
+	PostStatusPublished = "published"
+)
+
+// setPublishDefaults marks a post without a status as published and stamps
+// published posts that have no publication time
+func setPublishDefaults(post *Post) {
+	if post.Status == "" {
+		post.Status = PostStatusPublished
+	}
+	if post.Status == PostStatusPublished && post.PublishedAt == nil {
+		now := time.Now()
+		post.PublishedAt = &now
+	}
+}
+
 type Post struct {
-	ID           int       `json:"postId,omitempty" db:"id"`
-	Content      string    `json:"content,omitempty" db:"content"`
-	ScheduleTime time.Time `json:"scheduleTime,omitempty" db:"schedule_time"`
-	UserID       int       `json:"userId,omitempty" db:"user_id"`
+	ID           int        `json:"postId,omitempty" db:"id"`
+	Content      string     `json:"content,omitempty" db:"content"`
+	ScheduleTime time.Time  `json:"scheduleTime,omitempty" db:"schedule_time"`
+	UserID       int        `json:"userId,omitempty" db:"user_id"`
+	Status       string     `json:"status,omitempty" db:"status"`
+	PublishedAt  *time.Time `json:"publishedAt,omitempty" db:"published_at"`
 }
 
-func CreatePost(c *gin.Context, db *gorm.DB) {
+func CreatePost(c *gin.Context, s *Stores, feed Feed) {
 	var post Post
 	if err := c.ShouldBindJSON(&post); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Set user ID from the context (assuming user ID is available in the context)
+	// The store assigns the ID; the author is the caller
+	post.ID = 0
 	userID, _ := c.Get("user_id")
 	post.UserID = userID.(int)
 
-	err := db.Create(&post).Error
+	now := time.Now()
+	if post.ScheduleTime.After(now) {
+		post.Status = PostStatusScheduled
+		post.PublishedAt = nil
+	} else {
+		post.Status = PostStatusPublished
+		post.PublishedAt = &now
+	}
+
+	err := s.Posts.Create(&post)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create post"})
 		log.Println("Error executing database query:", err)
 		return
 	}
+	if post.Status == PostStatusPublished {
+		notifyFeed(feed.PostPublished(post))
+		notifyMentions(s, post, "")
+		emitWebhookEvent(s, WebhookPostCreated, post, post.UserID)
+	}
 
-	c.JSON(http.StatusCreated, gin.H{"message": "Post created successfully"})
+	c.JSON(http.StatusCreated, gin.H{"message": "Post created successfully", "postId": post.ID, "status": post.Status})
 }
-func EditPost(c *gin.Context, db *gorm.DB) {
+func EditPost(c *gin.Context, s *Stores) {
 	// Extract postId from the URL parameters
 	postID, err := strconv.Atoi(c.Param("postId"))
 	if err != nil {
@@ -45,19 +81,15 @@ func EditPost(c *gin.Context, db *gorm.DB) {
 		return
 	}
 
-	// Check if db is nil
-	if db == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database connection is not initialized"})
-		return
-	}
-
 	// Check if the post exists
-	var existingPost Post
-	err = db.First(&existingPost, postID).Error
+	existingPost, err := s.Posts.GetByID(postID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Post not found"})
 		return
 	}
+	if !authorize(c, s, ActionUpdatePost, existingPost) {
+		return
+	}
 
 	// Extract the new content from the request body
 	var request struct {
@@ -70,21 +102,26 @@ func EditPost(c *gin.Context, db *gorm.DB) {
 	}
 
 	// Update the post content
+	previous := existingPost.Content
 	existingPost.Content = request.Content
 
 	// Save the updated post
-	err = db.Save(&existingPost).Error
+	err = s.Posts.Update(existingPost)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to edit post"})
 		log.Println("Error executing database query:", err)
 		return
 	}
+	if existingPost.Status == PostStatusPublished {
+		notifyMentions(s, *existingPost, previous)
+		emitWebhookEvent(s, WebhookPostUpdated, existingPost, existingPost.UserID)
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Post content edited successfully"})
 }
 
 // DeletePost deletes a post by ID
-func DeletePost(c *gin.Context, db *gorm.DB) {
+func DeletePost(c *gin.Context, s *Stores) {
 	// Extract postId from the URL parameters
 	postID, err := strconv.Atoi(c.Param("postId"))
 	if err != nil {
@@ -92,33 +129,32 @@ func DeletePost(c *gin.Context, db *gorm.DB) {
 		return
 	}
 
-	// Check if db is nil
-	if db == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database connection is not initialized"})
-		return
-	}
-
 	// Check if the post exists
-	var existingPost Post
-	err = db.First(&existingPost, postID).Error
+	existingPost, err := s.Posts.GetByID(postID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Post not found"})
 		return
 	}
+	if !authorize(c, s, ActionDeletePost, existingPost) {
+		return
+	}
 
 	// Delete the post
-	err = db.Delete(&existingPost).Error
+	err = s.Posts.Delete(existingPost.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete post"})
 		log.Println("Error executing database query:", err)
 		return
 	}
+	if existingPost.Status == PostStatusPublished {
+		emitWebhookEvent(s, WebhookPostDeleted, existingPost, existingPost.UserID)
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Post deleted successfully"})
 }
 
 // GetPostByID gets a post by ID
-func GetPostByID(c *gin.Context, db *gorm.DB) {
+func GetPostByID(c *gin.Context, s *Stores) {
 	// Extract postId from the URL parameters
 	postID, err := strconv.Atoi(c.Param("postId"))
 	if err != nil {
@@ -126,39 +162,132 @@ func GetPostByID(c *gin.Context, db *gorm.DB) {
 		return
 	}
 
-	// Check if db is nil
-	if db == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database connection is not initialized"})
+	// Check if the post exists; scheduled posts only exist for their author
+	post, err := s.Posts.GetByID(postID)
+	if err != nil || (post.Status == PostStatusScheduled && post.UserID != c.GetInt("user_id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Post not found"})
 		return
 	}
 
-	// Check if the post exists
-	var post Post
-	err = db.First(&post, postID).Error
+	c.JSON(http.StatusOK, post)
+}
+
+// postListSpec lists posts newest first
+var postListSpec = ListSpec{
+	Sorts:   []string{"published_at", "id"},
+	Desc:    true,
+	Filters: map[string]FilterKind{"user_id": FilterInt},
+}
+
+// GetAllPosts gets a page of published posts
+func GetAllPosts(c *gin.Context, s *Stores) {
+	query, ok := bindListQuery(c, postListSpec)
+	if !ok {
+		return
+	}
+
+	posts, err := s.Posts.List(query)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Post not found"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch posts"})
+		log.Println("Error executing database query:", err)
 		return
 	}
 
-	c.JSON(http.StatusOK, post)
+	c.JSON(http.StatusOK, newPage(posts, query))
 }
 
-// GetAllPosts gets all posts
-func GetAllPosts(c *gin.Context, db *gorm.DB) {
-	// Check if db is nil
-	if db == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database connection is not initialized"})
+// scheduledPostListSpec lists scheduled posts soonest first
+var scheduledPostListSpec = ListSpec{Sorts: []string{"schedule_time", "id"}}
+
+// GetScheduledPosts lists the caller's posts that are waiting to be published
+func GetScheduledPosts(c *gin.Context, s *Stores) {
+	query, ok := bindListQuery(c, scheduledPostListSpec)
+	if !ok {
 		return
 	}
 
-	// Get all posts
-	var posts []Post
-	err := db.Find(&posts).Error
+	posts, err := s.Posts.ListScheduled(c.GetInt("user_id"), query)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch posts"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch scheduled posts"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, newPage(posts, query))
+}
+
+// ReschedulePost moves one of the caller's scheduled posts to a new time
+func ReschedulePost(c *gin.Context, s *Stores) {
+	postID, err := strconv.Atoi(c.Param("postId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid post ID"})
+		return
+	}
+
+	var request struct {
+		ScheduleTime time.Time `json:"scheduleTime" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !request.ScheduleTime.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Schedule time must be in the future"})
+		return
+	}
+
+	if !ownsScheduledPost(c, s, postID) {
+		return
+	}
+
+	err = s.Posts.Reschedule(postID, request.ScheduleTime)
+	if errors.Is(err, ErrNotFound) {
+		// Published between the lookup and the update
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled post not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reschedule post"})
 		log.Println("Error executing database query:", err)
 		return
 	}
 
-	c.JSON(http.StatusOK, posts)
+	c.JSON(http.StatusOK, gin.H{"message": "Post rescheduled successfully"})
+}
+
+// CancelScheduledPost deletes one of the caller's posts before it is published
+func CancelScheduledPost(c *gin.Context, s *Stores) {
+	postID, err := strconv.Atoi(c.Param("postId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid post ID"})
+		return
+	}
+
+	if !ownsScheduledPost(c, s, postID) {
+		return
+	}
+
+	err = s.Posts.CancelScheduled(postID)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled post not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel post"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Scheduled post cancelled successfully"})
+}
+
+// ownsScheduledPost reports whether postID is a scheduled post of the caller,
+// writing a 404 response when it is not
+func ownsScheduledPost(c *gin.Context, s *Stores, postID int) bool {
+	post, err := s.Posts.GetByID(postID)
+	if err != nil || post.Status != PostStatusScheduled || post.UserID != c.GetInt("user_id") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled post not found"})
+		return false
+	}
+	return true
 }
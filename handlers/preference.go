@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PreferenceTypes are the notification types users can configure. System
+// notifications are always delivered.
+var PreferenceTypes = []string{NotificationFollow, NotificationLike, NotificationComment, NotificationMention}
+
+// NotificationPreference is how a user wants to hear about one type of
+// notification. Muted drops the notifications altogether; otherwise InApp
+// shows them in the list and streams, unread, and EmailDigest includes them
+// in the email digest.
+type NotificationPreference struct {
+	UserID      int       `json:"-" db:"user_id" gorm:"primaryKey"`
+	Type        string    `json:"type" db:"type" gorm:"primaryKey"`
+	InApp       bool      `json:"inApp" db:"in_app"`
+	EmailDigest bool      `json:"emailDigest" db:"email_digest"`
+	Muted       bool      `json:"muted" db:"muted"`
+	UpdatedAt   time.Time `json:"updatedAt,omitempty" db:"updated_at"`
+}
+
+// defaultPreference applies to the types a user has not configured
+func defaultPreference(userID int, typ string) NotificationPreference {
+	return NotificationPreference{UserID: userID, Type: typ, InApp: true, EmailDigest: true}
+}
+
+// notificationPreference returns the preference of userID for typ, or the
+// default when they have none
+func notificationPreference(s *Stores, userID int, typ string) (NotificationPreference, error) {
+	preference, err := s.NotificationPreferences.Get(userID, typ)
+	if errors.Is(err, ErrNotFound) {
+		return defaultPreference(userID, typ), nil
+	}
+	if err != nil {
+		return NotificationPreference{}, err
+	}
+	return *preference, nil
+}
+
+// GetNotificationPreferences lists the caller's preference for every
+// configurable notification type
+func GetNotificationPreferences(c *gin.Context, s *Stores) {
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	stored, err := s.NotificationPreferences.List(userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch notification preferences"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	byType := map[string]NotificationPreference{}
+	for _, preference := range stored {
+		byType[preference.Type] = preference
+	}
+
+	preferences := make([]NotificationPreference, 0, len(PreferenceTypes))
+	for _, typ := range PreferenceTypes {
+		preference, ok := byType[typ]
+		if !ok {
+			preference = defaultPreference(userID.(int), typ)
+		}
+		preferences = append(preferences, preference)
+	}
+	c.JSON(http.StatusOK, preferences)
+}
+
+// UpdateNotificationPreference changes how the caller hears about one type
+// of notification. Fields left out keep their current value.
+func UpdateNotificationPreference(c *gin.Context, s *Stores) {
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	typ := c.Param("type")
+	if !contains(PreferenceTypes, typ) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown notification type"})
+		return
+	}
+
+	var request struct {
+		InApp       *bool `json:"inApp"`
+		EmailDigest *bool `json:"emailDigest"`
+		Muted       *bool `json:"muted"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	preference, err := notificationPreference(s, userID.(int), typ)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notification preference"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	if request.InApp != nil {
+		preference.InApp = *request.InApp
+	}
+	if request.EmailDigest != nil {
+		preference.EmailDigest = *request.EmailDigest
+	}
+	if request.Muted != nil {
+		preference.Muted = *request.Muted
+	}
+	preference.UpdatedAt = time.Now()
+
+	if err := s.NotificationPreferences.Save(&preference); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notification preference"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	c.JSON(http.StatusOK, preference)
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+)
+
+// Publisher publishes scheduled posts once their ScheduleTime has passed.
+// PostStore.PublishDue claims posts atomically, so every replica can run
+// its own Publisher.
+type Publisher struct {
+	s         *Stores
+	feed      Feed
+	interval  time.Duration
+	batchSize int
+}
+
+// NewPublisher returns a Publisher for the posts of s configured by cfg.
+// Published posts are handed to feed, notify the users they mention and
+// are sent to webhooks.
+func NewPublisher(s *Stores, feed Feed, cfg config.PublisherConfig) *Publisher {
+	return &Publisher{
+		s:         s,
+		feed:      feed,
+		interval:  cfg.Interval.Duration(),
+		batchSize: cfg.BatchSize,
+	}
+}
+
+// Run publishes due posts every interval until ctx is cancelled
+func (p *Publisher) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := p.PublishDue(time.Now()); err != nil {
+			log.Println("Error publishing scheduled posts:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PublishDue publishes every post due at now, one batch at a time, and
+// returns them
+func (p *Publisher) PublishDue(now time.Time) ([]Post, error) {
+	var published []Post
+	for {
+		posts, err := p.s.Posts.PublishDue(now, p.batchSize)
+		if err != nil {
+			return published, err
+		}
+		for _, post := range posts {
+			notifyFeed(p.feed.PostPublished(post))
+			notifyMentions(p.s, post, "")
+			emitWebhookEvent(p.s, WebhookPostCreated, post, post.UserID)
+		}
+		published = append(published, posts...)
+		if len(posts) < p.batchSize {
+			return published, nil
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RevocationStore keeps track of access tokens that must be rejected before
+// they expire, either one at a time by jti, by session, or all at once for
+// a user.
+type RevocationStore interface {
+	// Revoke rejects the token with the given jti, or every token of the
+	// session with that ID, until expiresAt
+	Revoke(jti string, userID int, expiresAt time.Time) error
+	// RevokeUser rejects every token issued to userID before the given time
+	RevokeUser(userID int, before time.Time) error
+	// IsRevoked reports whether a token of the given session issued at
+	// issuedAt has been revoked
+	IsRevoked(jti, sessionID string, userID int, issuedAt time.Time) (bool, error)
+}
+
+// MemoryRevocationStore is a RevocationStore for a single process. It is
+// lost on restart, so it is meant for tests and local development.
+type MemoryRevocationStore struct {
+	mu     sync.RWMutex
+	tokens map[string]time.Time
+	users  map[int]time.Time
+}
+
+// NewMemoryRevocationStore creates an empty in-memory revocation store
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{
+		tokens: make(map[string]time.Time),
+		users:  make(map[int]time.Time),
+	}
+}
+
+func (s *MemoryRevocationStore) Revoke(jti string, userID int, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop entries whose tokens would be rejected as expired anyway
+	now := time.Now()
+	for id, exp := range s.tokens {
+		if exp.Before(now) {
+			delete(s.tokens, id)
+		}
+	}
+	s.tokens[jti] = expiresAt
+	return nil
+}
+
+func (s *MemoryRevocationStore) RevokeUser(userID int, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if before.After(s.users[userID]) {
+		s.users[userID] = before
+	}
+	return nil
+}
+
+func (s *MemoryRevocationStore) IsRevoked(jti, sessionID string, userID int, issuedAt time.Time) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.tokens[jti]; ok {
+		return true, nil
+	}
+	if _, ok := s.tokens[sessionID]; ok && sessionID != "" {
+		return true, nil
+	}
+	if before, ok := s.users[userID]; ok && issuedAt.Before(before) {
+		return true, nil
+	}
+	return false, nil
+}
+
+// RevokedToken is a revoked access token persisted by PostgresRevocationStore
+type RevokedToken struct {
+	JTI       string    `json:"jti,omitempty" db:"jti" gorm:"primaryKey"`
+	UserID    int       `json:"userId,omitempty" db:"user_id"`
+	ExpiresAt time.Time `json:"expiresAt,omitempty" db:"expires_at" gorm:"index"`
+}
+
+// UserRevocation invalidates every token issued to a user before RevokedBefore
+type UserRevocation struct {
+	UserID        int       `json:"userId,omitempty" db:"user_id" gorm:"primaryKey;autoIncrement:false"`
+	RevokedBefore time.Time `json:"revokedBefore,omitempty" db:"revoked_before"`
+}
+
+// PostgresRevocationStore is a RevocationStore shared by every instance
+// connected to the same database.
+type PostgresRevocationStore struct {
+	db *gorm.DB
+}
+
+// NewPostgresRevocationStore creates a revocation store backed by db
+func NewPostgresRevocationStore(db *gorm.DB) *PostgresRevocationStore {
+	return &PostgresRevocationStore{db: db}
+}
+
+func (s *PostgresRevocationStore) Revoke(jti string, userID int, expiresAt time.Time) error {
+	// Drop entries whose tokens would be rejected as expired anyway
+	if err := s.db.Where("expires_at < ?", time.Now()).Delete(&RevokedToken{}).Error; err != nil {
+		return err
+	}
+
+	token := RevokedToken{JTI: jti, UserID: userID, ExpiresAt: expiresAt}
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&token).Error
+}
+
+func (s *PostgresRevocationStore) RevokeUser(userID int, before time.Time) error {
+	revocation := UserRevocation{UserID: userID, RevokedBefore: before}
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"revoked_before"}),
+	}).Create(&revocation).Error
+}
+
+func (s *PostgresRevocationStore) IsRevoked(jti, sessionID string, userID int, issuedAt time.Time) (bool, error) {
+	var count int64
+	err := s.db.Model(&RevokedToken{}).Where("jti IN ?", []string{jti, sessionID}).Count(&count).Error
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+
+	err = s.db.Model(&UserRevocation{}).
+		Where("user_id = ? AND revoked_before > ?", userID, issuedAt).
+		Count(&count).
+		Error
+	return count > 0, err
+}
@@ -2,44 +2,149 @@ package handlers
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
+// Names of the seeded roles
+const (
+	RoleAdmin        = "admin"
+	RoleModerator    = "moderator"
+	RoleCompanyAdmin = "company_admin"
+	RoleUser         = "user"
+)
+
+// Permission is an entry of the permission catalogue
+type Permission struct {
+	Name        Action `json:"name" db:"name" gorm:"primaryKey"`
+	Description string `json:"description" db:"description"`
+}
+
+// Role is a named set of permissions. System roles are seeded and cannot be
+// deleted.
 type Role struct {
-	ID     uint   `json:"id,omitempty" db:"id"`
-	UserID uint   `json:"user_id,omitempty" db:"user_id"`
-	Type   string `json:"type,omitempty" db:"type"`
+	ID          uint      `json:"id,omitempty" db:"id"`
+	Name        string    `json:"name" db:"name"`
+	Description string    `json:"description" db:"description"`
+	System      bool      `json:"system" db:"system"`
+	Permissions []Action  `json:"permissions" db:"-" gorm:"-"`
+	CreatedAt   time.Time `json:"createdAt" db:"created_at"`
+}
+
+// RolePermission grants a permission to a role
+type RolePermission struct {
+	RoleID     uint   `db:"role_id" gorm:"primaryKey"`
+	Permission Action `db:"permission" gorm:"primaryKey"`
+}
+
+// UserRole assigns a role to a user, globally or within a company
+type UserRole struct {
+	ID        uint      `json:"id" db:"id"`
+	UserID    int       `json:"userId" db:"user_id"`
+	RoleID    uint      `json:"roleId" db:"role_id"`
+	RoleName  string    `json:"role" db:"role_name" gorm:"->"`
+	CompanyID *int      `json:"companyId,omitempty" db:"company_id"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+// Permissions is the catalogue of every permission a role can grant
+var Permissions = []Permission{
+	{Name: ActionAll, Description: "Every permission"},
+	{Name: ActionCreatePost, Description: "Publish posts"},
+	{Name: ActionUpdatePost, Description: "Edit posts of other users"},
+	{Name: ActionDeletePost, Description: "Delete posts of other users"},
+	{Name: ActionCreateEngagement, Description: "Like and comment on posts"},
+	{Name: ActionUpdateEngagement, Description: "Edit engagements of other users"},
+	{Name: ActionDeleteEngagement, Description: "Delete engagements of other users"},
+	{Name: ActionCreateCompany, Description: "Create companies"},
+	{Name: ActionUpdateCompany, Description: "Edit companies"},
+	{Name: ActionDeleteCompany, Description: "Delete companies"},
+	{Name: ActionManageRoles, Description: "Create, edit and delete roles"},
+	{Name: ActionGrantRoles, Description: "Grant and revoke roles"},
+	{Name: ActionUnlockUsers, Description: "Unlock accounts locked after failed logins"},
+	{Name: ActionReadAudit, Description: "Read the audit log"},
+	{Name: ActionSendNotifications, Description: "Send system notifications to any user"},
+	{Name: ActionManageWebhooks, Description: "Manage the webhooks of companies"},
+}
+
+// DefaultRoles are the system roles every store is seeded with
+var DefaultRoles = []Role{
+	{Name: RoleAdmin, Description: "Can do everything", System: true,
+		Permissions: []Action{ActionAll}},
+	{Name: RoleModerator, Description: "Removes posts and engagements of other users", System: true,
+		Permissions: []Action{ActionDeletePost, ActionDeleteEngagement}},
+	{Name: RoleCompanyAdmin, Description: "Manages a company and the roles of its members", System: true,
+		Permissions: []Action{ActionUpdateCompany, ActionDeleteCompany, ActionGrantRoles, ActionManageWebhooks}},
+	{Name: RoleUser, Description: "Default role of every registered user", System: true,
+		Permissions: []Action{ActionCreatePost, ActionCreateEngagement, ActionCreateCompany}},
+}
+
+// validatePermissions checks that every permission is in the catalogue
+func validatePermissions(permissions []Action) error {
+	for _, permission := range permissions {
+		known := false
+		for _, p := range Permissions {
+			known = known || p.Name == permission
+		}
+		if !known {
+			return fmt.Errorf("unknown permission %q", permission)
+		}
+	}
+	return nil
+}
+
+// assignRole gives the role named roleName to userID, within companyID when
+// it is not nil. It is not an error when the user already has the role.
+func assignRole(s *Stores, userID int, roleName string, companyID *int) error {
+	role, err := s.Roles.GetByName(roleName)
+	if err != nil {
+		return err
+	}
+	err = s.Roles.Assign(&UserRole{UserID: userID, RoleID: role.ID, CompanyID: companyID})
+	if errors.Is(err, ErrConflict) {
+		return nil
+	}
+	return err
 }
 
 // CreateRole creates a new role
-func CreateRole(c *gin.Context, db *gorm.DB) {
-	var role Role
-	if err := c.ShouldBindJSON(&role); err != nil {
+func CreateRole(c *gin.Context, s *Stores) {
+	var request struct {
+		Name        string   `json:"name" binding:"required"`
+		Description string   `json:"description"`
+		Permissions []Action `json:"permissions"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validatePermissions(request.Permissions); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Set user ID from the context (assuming user ID is available)
-	userID, _ := c.Get("user_id")
-	role.UserID = userID.(uint)
-
-	err := db.Create(&role).Error
+	role := Role{Name: request.Name, Description: request.Description, Permissions: request.Permissions}
+	err := s.Roles.Create(&role)
+	if errors.Is(err, ErrConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Role already exists"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create role"})
 		log.Println("Error executing database query:", err)
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"message": "Role created successfully"})
+	c.JSON(http.StatusCreated, role)
 }
 
-// EditRole edits an existing role
-func EditRole(c *gin.Context, db *gorm.DB) {
+// EditRole changes the description and the permissions of a role
+func EditRole(c *gin.Context, s *Stores) {
 	// Extract roleID from the URL parameters
 	roleID, err := strconv.Atoi(c.Param("roleId"))
 	if err != nil {
@@ -47,15 +152,8 @@ func EditRole(c *gin.Context, db *gorm.DB) {
 		return
 	}
 
-	// Check if db is nil
-	if db == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database connection is not initialized"})
-		return
-	}
-
 	// Check if the role exists
-	var existingRole Role
-	err = db.First(&existingRole, roleID).Error
+	existingRole, err := s.Roles.GetByID(uint(roleID))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
 		return
@@ -63,8 +161,8 @@ func EditRole(c *gin.Context, db *gorm.DB) {
 
 	// Extract the new data from the request body
 	var request struct {
-		UserID uint   `json:"userId"`
-		Type   string `json:"type"`
+		Description *string   `json:"description"`
+		Permissions *[]Action `json:"permissions"`
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -73,26 +171,30 @@ func EditRole(c *gin.Context, db *gorm.DB) {
 	}
 
 	// Update the role data
-	if request.UserID != 0 {
-		existingRole.UserID = request.UserID
+	if request.Description != nil {
+		existingRole.Description = *request.Description
 	}
-	if request.Type != "" {
-		existingRole.Type = request.Type
+	if request.Permissions != nil {
+		if err := validatePermissions(*request.Permissions); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		existingRole.Permissions = *request.Permissions
 	}
 
 	// Save the updated role
-	err = db.Save(&existingRole).Error
+	err = s.Roles.Update(existingRole)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to edit role"})
 		log.Println("Error executing database query:", err)
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Role edited successfully"})
+	c.JSON(http.StatusOK, existingRole)
 }
 
-// DeleteRole deletes a role by ID
-func DeleteRole(c *gin.Context, db *gorm.DB) {
+// DeleteRole deletes a role by ID, together with its assignments
+func DeleteRole(c *gin.Context, s *Stores) {
 	// Extract roleID from the URL parameters
 	roleID, err := strconv.Atoi(c.Param("roleId"))
 	if err != nil {
@@ -100,22 +202,19 @@ func DeleteRole(c *gin.Context, db *gorm.DB) {
 		return
 	}
 
-	// Check if db is nil
-	if db == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database connection is not initialized"})
-		return
-	}
-
 	// Check if the role exists
-	var existingRole Role
-	err = db.First(&existingRole, roleID).Error
+	existingRole, err := s.Roles.GetByID(uint(roleID))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
 		return
 	}
+	if existingRole.System {
+		c.JSON(http.StatusConflict, gin.H{"error": "System roles cannot be deleted"})
+		return
+	}
 
 	// Delete the role
-	err = db.Delete(&existingRole).Error
+	err = s.Roles.Delete(existingRole.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete role"})
 		log.Println("Error executing database query:", err)
@@ -125,31 +224,39 @@ func DeleteRole(c *gin.Context, db *gorm.DB) {
 	c.JSON(http.StatusOK, gin.H{"message": "Role deleted successfully"})
 }
 
+var roleListSpec = ListSpec{
+	Sorts:   []string{"id", "name"},
+	Filters: map[string]FilterKind{"name": FilterString, "system": FilterBool},
+}
+
 // GetAllRoles fetches all roles
-func GetAllRoles(c *gin.Context, db *gorm.DB) {
-	var roles []Role
-	err := db.Find(&roles).Error
+func GetAllRoles(c *gin.Context, s *Stores) {
+	query, ok := bindListQuery(c, roleListSpec)
+	if !ok {
+		return
+	}
+
+	roles, err := s.Roles.List(query)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch all roles"})
 		log.Println("Error executing database query:", err)
 		return
 	}
 
-	c.JSON(http.StatusOK, roles)
+	c.JSON(http.StatusOK, newPage(roles, query))
 }
 
 // GetRoleByID fetches a role by its ID
-func GetRoleByID(c *gin.Context, db *gorm.DB) {
+func GetRoleByID(c *gin.Context, s *Stores) {
 	roleID, err := strconv.Atoi(c.Param("roleId"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role ID"})
 		return
 	}
 
-	var role Role
-	err = db.First(&role, roleID).Error
+	role, err := s.Roles.GetByID(uint(roleID))
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
+		if errors.Is(err, ErrNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
 			return
 		}
@@ -160,3 +267,164 @@ func GetRoleByID(c *gin.Context, db *gorm.DB) {
 
 	c.JSON(http.StatusOK, role)
 }
+
+// GetPermissions lists the permission catalogue
+func GetPermissions(c *gin.Context, s *Stores) {
+	permissions, err := s.Roles.Permissions()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch permissions"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, permissions)
+}
+
+// GetUserRoles lists the roles assigned to a user. Users can see their own
+// roles; anyone else needs the roles:grant permission.
+func GetUserRoles(c *gin.Context, s *Stores) {
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	if userID != c.GetInt("user_id") && !authorize(c, s, ActionGrantRoles, nil) {
+		return
+	}
+
+	assignments, err := s.Roles.Assignments(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch roles"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, assignments)
+}
+
+// authorizeGrant checks that the caller may grant or revoke role within
+// companyID. Besides roles:grant in that scope they must hold every
+// permission of the role, so nobody hands out more than they have.
+func authorizeGrant(c *gin.Context, s *Stores, role *Role, companyID *int) bool {
+	actor, ok := loadActor(c, s)
+	if !ok {
+		return false
+	}
+
+	var scope interface{}
+	if companyID != nil {
+		scope = &Company{ID: uint(*companyID)}
+	}
+	if !authorizeActor(c, actor, ActionGrantRoles, scope) {
+		return false
+	}
+	for _, permission := range role.Permissions {
+		if !actor.Can(permission, companyID) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":  "Forbidden",
+				"action": ActionGrantRoles,
+				"reason": fmt.Sprintf("cannot grant the %s permission without holding it", permission),
+			})
+			return false
+		}
+	}
+	return true
+}
+
+// GrantRole assigns a role to a user, globally or within the company given
+// in the body
+func GrantRole(c *gin.Context, s *Stores) {
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var request struct {
+		RoleID    uint `json:"roleId" binding:"required"`
+		CompanyID *int `json:"companyId"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := s.Users.GetByID(userID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	role, err := s.Roles.GetByID(request.RoleID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		return
+	}
+	if request.CompanyID != nil {
+		if _, err := s.Companies.GetByID(uint(*request.CompanyID)); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Company not found"})
+			return
+		}
+	}
+	if !authorizeGrant(c, s, role, request.CompanyID) {
+		return
+	}
+
+	assignment := UserRole{UserID: userID, RoleID: role.ID, RoleName: role.Name, CompanyID: request.CompanyID}
+	err = s.Roles.Assign(&assignment)
+	if errors.Is(err, ErrConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "User already has this role"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to grant role"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, assignment)
+}
+
+// RevokeRole takes a role away from a user. The companyId query parameter
+// selects a company assignment instead of the global one.
+func RevokeRole(c *gin.Context, s *Stores) {
+	userID, err := strconv.Atoi(c.Param("userId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	roleID, err := strconv.Atoi(c.Param("roleId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role ID"})
+		return
+	}
+	var companyID *int
+	if raw := c.Query("companyId"); raw != "" {
+		id, err := strconv.Atoi(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid company ID"})
+			return
+		}
+		companyID = &id
+	}
+
+	role, err := s.Roles.GetByID(uint(roleID))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role not found"})
+		return
+	}
+	if !authorizeGrant(c, s, role, companyID) {
+		return
+	}
+
+	err = s.Roles.Unassign(userID, role.ID, companyID)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Role assignment not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke role"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role revoked successfully"})
+}
@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/mail"
+	"github.com/gin-contrib/static"
+	"github.com/gin-gonic/gin"
+)
+
+// NewRouter wires every route of the API with its middleware. Background
+// workers are not started; the caller runs the ones cfg enables.
+func NewRouter(s *Stores, cfg *config.Config, mailer mail.Mailer, feed Feed, oauth *OAuth) (*gin.Engine, error) {
+	router := gin.Default()
+	if err := router.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	auth := AuthMiddleware(s, cfg.Auth)
+	verified := RequireVerifiedEmail(s)
+
+	router.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		GetJWKS(c, s, cfg.Auth)
+	})
+	// user routes
+	router.POST("/register", func(c *gin.Context) {
+		Register(c, s, mailer, cfg.EmailVerification)
+	})
+	router.POST("/login", func(c *gin.Context) {
+		Login(c, s, cfg.Auth)
+	})
+	router.POST("/login/2fa", func(c *gin.Context) {
+		LoginTwoFactor(c, s, cfg.Auth)
+	})
+	router.POST("/password/forgot", func(c *gin.Context) {
+		ForgotPassword(c, s, mailer, cfg.PasswordReset)
+	})
+	router.POST("/password/reset", func(c *gin.Context) {
+		ResetPassword(c, s)
+	})
+	router.POST("/token/refresh", func(c *gin.Context) {
+		RefreshTokens(c, s, cfg.Auth)
+	})
+	router.POST("/logout", auth, func(c *gin.Context) {
+		Logout(c, s, cfg.Auth)
+	})
+	router.POST("/logout-all", auth, func(c *gin.Context) {
+		LogoutAll(c, s, cfg.Auth)
+	})
+	router.GET("/profile", auth, func(c *gin.Context) {
+		Profile(c, s)
+	})
+	router.DELETE("/account", auth, func(c *gin.Context) {
+		DeleteAccount(c, s, cfg.Account)
+	})
+	router.POST("/account/restore", auth, func(c *gin.Context) {
+		RestoreAccount(c, s)
+	})
+	router.GET("/account/export", auth, func(c *gin.Context) {
+		GetAccountExport(c, s)
+	})
+	router.GET("/sessions", auth, func(c *gin.Context) {
+		GetSessions(c, s, cfg.Auth)
+	})
+	router.DELETE("/sessions", auth, func(c *gin.Context) {
+		RevokeOtherSessions(c, s, cfg.Auth)
+	})
+	router.DELETE("/sessions/:sessionId", auth, func(c *gin.Context) {
+		RevokeSession(c, s, cfg.Auth)
+	})
+
+	router.PUT("/update-profile", auth, func(c *gin.Context) {
+		UpdateProfile(c, s, mailer, cfg.EmailVerification)
+	})
+	router.PUT("/profile/avatar", auth, func(c *gin.Context) {
+		UploadAvatar(c, s)
+	})
+	router.POST("/email/verify", func(c *gin.Context) {
+		VerifyEmail(c, s)
+	})
+	router.POST("/email/verification", auth, func(c *gin.Context) {
+		ResendVerification(c, s, mailer, cfg.EmailVerification)
+	})
+	// Two-factor authentication
+	router.GET("/2fa", auth, func(c *gin.Context) {
+		TwoFactorStatus(c, s)
+	})
+	router.POST("/2fa/enroll", auth, func(c *gin.Context) {
+		EnrollTwoFactor(c, s, cfg.Auth.TwoFactor)
+	})
+	router.POST("/2fa/confirm", auth, func(c *gin.Context) {
+		ConfirmTwoFactor(c, s, cfg.Auth.TwoFactor)
+	})
+	router.POST("/2fa/disable", auth, func(c *gin.Context) {
+		DisableTwoFactor(c, s)
+	})
+	router.POST("/2fa/recovery-codes", auth, func(c *gin.Context) {
+		RegenerateRecoveryCodes(c, s, cfg.Auth.TwoFactor)
+	})
+	// Sign-in with identity providers
+	router.GET("/oauth/providers", func(c *gin.Context) {
+		GetOAuthProviders(c, oauth)
+	})
+	router.GET("/oauth/:provider/login", func(c *gin.Context) {
+		OAuthLogin(c, s, oauth)
+	})
+	router.GET("/oauth/:provider/callback", func(c *gin.Context) {
+		OAuthCallback(c, s, oauth, cfg.Auth)
+	})
+	router.POST("/oauth/:provider/link", auth, func(c *gin.Context) {
+		LinkIdentity(c, s, oauth)
+	})
+	router.GET("/identities", auth, func(c *gin.Context) {
+		GetIdentities(c, s)
+	})
+	router.DELETE("/identities/:identityId", auth, func(c *gin.Context) {
+		UnlinkIdentity(c, s)
+	})
+	// Personal access tokens
+	router.GET("/access-tokens/scopes", auth, GetScopes)
+	router.POST("/access-tokens", auth, func(c *gin.Context) {
+		CreateAccessToken(c, s)
+	})
+	router.GET("/access-tokens", auth, func(c *gin.Context) {
+		GetAccessTokens(c, s)
+	})
+	router.DELETE("/access-tokens/:tokenId", auth, func(c *gin.Context) {
+		RevokeAccessToken(c, s)
+	})
+	//Router of post
+	router.POST("/create-post", auth, verified, RequirePermission(s, ActionCreatePost), func(c *gin.Context) {
+		CreatePost(c, s, feed)
+	})
+
+	router.PUT("/edit-post/:postId", auth, func(c *gin.Context) {
+		EditPost(c, s)
+	})
+	router.DELETE("/posts/:postId", auth, func(c *gin.Context) {
+		DeletePost(c, s)
+	})
+	router.GET("/posts/scheduled", auth, func(c *gin.Context) {
+		GetScheduledPosts(c, s)
+	})
+	router.PUT("/posts/:postId/schedule", auth, func(c *gin.Context) {
+		ReschedulePost(c, s)
+	})
+	router.DELETE("/posts/:postId/schedule", auth, func(c *gin.Context) {
+		CancelScheduledPost(c, s)
+	})
+	router.GET("/posts/:postId", auth, func(c *gin.Context) {
+		GetPostByID(c, s)
+	})
+	router.GET("/posts", auth, func(c *gin.Context) {
+		GetAllPosts(c, s)
+	})
+	router.GET("/feed", auth, func(c *gin.Context) {
+		GetFeed(c, feed, cfg.Feed)
+	})
+	//Engagement router
+	router.POST("/engagements", auth, verified, RequirePermission(s, ActionCreateEngagement), func(c *gin.Context) {
+		CreateEngagement(c, s)
+	})
+	router.PUT("/engagements/:engagementId", auth, func(c *gin.Context) {
+		UpdateEngagement(c, s)
+	})
+	router.DELETE("/engagements/:engagementId", auth, func(c *gin.Context) {
+		DeleteEngagement(c, s)
+	})
+	router.GET("/engagements/:postId", auth, func(c *gin.Context) {
+		GetEngagementsForPost(c, s)
+	})
+	// Notification routes
+	router.POST("/notifications", auth, RequirePermission(s, ActionSendNotifications), func(c *gin.Context) {
+		CreateNotification(c, s)
+	})
+	router.GET("/notifications", auth, func(c *gin.Context) {
+		GetNotifications(c, s)
+	})
+	router.GET("/notifications/unread-count", auth, func(c *gin.Context) {
+		GetUnreadNotificationCount(c, s)
+	})
+	router.POST("/notifications/read", auth, func(c *gin.Context) {
+		MarkNotificationsAsRead(c, s)
+	})
+	router.DELETE("/notifications/:notificationId", auth, func(c *gin.Context) {
+		DeleteNotification(c, s)
+	})
+	router.GET("/notifications/preferences", auth, func(c *gin.Context) {
+		GetNotificationPreferences(c, s)
+	})
+	router.PUT("/notifications/preferences/:type", auth, func(c *gin.Context) {
+		UpdateNotificationPreference(c, s)
+	})
+	router.GET("/notifications/digest", auth, func(c *gin.Context) {
+		GetDigestSubscription(c, s, cfg.Notifications.Digest)
+	})
+	router.PUT("/notifications/digest", auth, func(c *gin.Context) {
+		UpdateDigestSubscription(c, s, cfg.Notifications.Digest)
+	})
+	router.POST("/notifications/digest/unsubscribe", func(c *gin.Context) {
+		UnsubscribeDigest(c, s)
+	})
+	router.GET("/notifications/stream", auth, func(c *gin.Context) {
+		StreamNotifications(c, s, cfg.Notifications)
+	})
+	router.GET("/notifications/ws", auth, func(c *gin.Context) {
+		NotificationsWebSocket(c, s, cfg.Notifications)
+	})
+	router.PATCH("/notifications/:notificationId/read", auth, func(c *gin.Context) {
+		MarkNotificationAsRead(c, s)
+	})
+	// Webhook routes
+	router.GET("/webhooks/events", auth, GetWebhookEvents)
+	router.POST("/webhooks", auth, func(c *gin.Context) {
+		CreateWebhook(c, s, cfg.Webhooks)
+	})
+	router.GET("/webhooks", auth, func(c *gin.Context) {
+		GetWebhooks(c, s)
+	})
+	router.GET("/webhooks/:webhookId", auth, func(c *gin.Context) {
+		GetWebhook(c, s)
+	})
+	router.PUT("/webhooks/:webhookId", auth, func(c *gin.Context) {
+		UpdateWebhook(c, s, cfg.Webhooks)
+	})
+	router.DELETE("/webhooks/:webhookId", auth, func(c *gin.Context) {
+		DeleteWebhook(c, s)
+	})
+	router.GET("/webhooks/:webhookId/deliveries", auth, func(c *gin.Context) {
+		GetWebhookDeliveries(c, s)
+	})
+	router.POST("/webhooks/:webhookId/test", auth, func(c *gin.Context) {
+		SendTestWebhook(c, s)
+	})
+	// Follow/Unfollow routes
+	router.POST("/follow", auth, verified, func(c *gin.Context) {
+		FollowUser(c, s, feed)
+	})
+
+	router.DELETE("/unfollow/:followingId", auth, func(c *gin.Context) {
+		UnfollowUser(c, s, feed)
+	})
+
+	router.GET("/followers/:userId", auth, func(c *gin.Context) {
+		GetFollowers(c, s)
+	})
+
+	router.GET("/followings/:userId", auth, func(c *gin.Context) {
+		GetFollowings(c, s)
+	})
+	// Add these search routes
+	router.POST("/search/posts", auth, func(c *gin.Context) {
+		SearchPosts(c, s)
+	})
+
+	router.POST("/search/users", auth, func(c *gin.Context) {
+		SearchUsers(c, s)
+	})
+	// New routes for Analytics
+	router.POST("/track-post-view", auth, func(c *gin.Context) {
+		TrackPostView(c, s)
+	})
+	router.GET("/post-analytics/:postId", auth, func(c *gin.Context) {
+		GetPostAnalytics(c, s)
+	})
+	// Serve uploaded files
+	router.Use(static.Serve("/", static.LocalFile("./uploads", true)))
+
+	// File upload endpoints
+	router.POST("/upload", UploadFile)
+	router.GET("/files", GetUploadedFiles)
+	//company router
+	router.POST("/create-company", auth, verified, RequirePermission(s, ActionCreateCompany), func(c *gin.Context) {
+		CreateCompany(c, s)
+	})
+	router.GET("/companies/:companyId", auth, func(c *gin.Context) {
+		GetCompanyByID(c, s)
+	})
+	router.PUT("/companies/:companyId", auth, func(c *gin.Context) {
+		UpdateCompany(c, s)
+	})
+	router.DELETE("/companies/:companyId", auth, func(c *gin.Context) {
+		DeleteCompany(c, s)
+	})
+	// Role routes
+	manageRoles := RequirePermission(s, ActionManageRoles)
+	router.POST("/roles", auth, manageRoles, func(c *gin.Context) {
+		CreateRole(c, s)
+	})
+
+	router.PUT("/roles/:roleId", auth, manageRoles, func(c *gin.Context) {
+		EditRole(c, s)
+	})
+
+	router.DELETE("/roles/:roleId", auth, manageRoles, func(c *gin.Context) {
+		DeleteRole(c, s)
+	})
+
+	router.GET("/roles", auth, func(c *gin.Context) {
+		GetAllRoles(c, s)
+	})
+
+	router.GET("/roles/:roleId", auth, func(c *gin.Context) {
+		GetRoleByID(c, s)
+	})
+	router.GET("/permissions", auth, func(c *gin.Context) {
+		GetPermissions(c, s)
+	})
+	// Role assignments. GrantRole and RevokeRole check the caller against the
+	// role and company themselves, so there is no route-level permission.
+	router.GET("/users/:userId/roles", auth, func(c *gin.Context) {
+		GetUserRoles(c, s)
+	})
+	router.POST("/users/:userId/roles", auth, func(c *gin.Context) {
+		GrantRole(c, s)
+	})
+	router.DELETE("/users/:userId/roles/:roleId", auth, func(c *gin.Context) {
+		RevokeRole(c, s)
+	})
+	router.POST("/users/:userId/unlock", auth, RequirePermission(s, ActionUnlockUsers), func(c *gin.Context) {
+		UnlockUser(c, s)
+	})
+	router.GET("/audit-events", auth, RequirePermission(s, ActionReadAudit), func(c *gin.Context) {
+		GetAuditEvents(c, s)
+	})
+	// Debugging route
+	router.GET("/debug/routes", func(c *gin.Context) {
+		fmt.Println("yes")
+		c.JSON(http.StatusOK, router.Routes())
+	})
+
+	return router, nil
+}
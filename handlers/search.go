@@ -5,56 +5,61 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
+var userListSpec = ListSpec{
+	Sorts:   []string{"id", "username"},
+	Filters: map[string]FilterKind{"company_id": FilterInt},
+}
+
 type Search struct {
 	Keyword string `json:"keyword" binding:"required"`
-	// Add other fields for filters and sorting options
 }
 
-// SearchPosts searches for posts based on keywords, filters, and sorting options
-func SearchPosts(c *gin.Context, db *gorm.DB) {
+// SearchPosts searches for posts based on keywords. Paging, filters and sorting
+// come from the query string as for GetAllPosts.
+func SearchPosts(c *gin.Context, s *Stores) {
 	var search Search
 	if err := c.ShouldBindJSON(&search); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Implement your search logic here based on the search.Keyword and other filters
-	// Example: You can use db.Where to filter posts based on the search criteria
+	query, ok := bindListQuery(c, postListSpec)
+	if !ok {
+		return
+	}
 
-	// For simplicity, let's assume posts are stored in a "Post" table
-	var posts []Post
-	err := db.Where("content LIKE ?", "%"+search.Keyword+"%").Find(&posts).Error
+	posts, err := s.Posts.Search(search.Keyword, query)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch posts"})
 		log.Println("Error executing database query:", err)
 		return
 	}
 
-	c.JSON(http.StatusOK, posts)
+	c.JSON(http.StatusOK, newPage(posts, query))
 }
 
-// SearchUsers searches for users based on keywords, filters, and sorting options
-func SearchUsers(c *gin.Context, db *gorm.DB) {
+// SearchUsers searches for users based on keywords. Paging, filters and sorting
+// come from the query string.
+func SearchUsers(c *gin.Context, s *Stores) {
 	var search Search
 	if err := c.ShouldBindJSON(&search); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Implement your search logic here based on the search.Keyword and other filters
-	// Example: You can use db.Where to filter users based on the search criteria
+	query, ok := bindListQuery(c, userListSpec)
+	if !ok {
+		return
+	}
 
-	// For simplicity, let's assume users are stored in a "User" table
-	var users []User
-	err := db.Where("username LIKE ?", "%"+search.Keyword+"%").Find(&users).Error
+	users, err := s.Users.Search(search.Keyword, query)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
 		log.Println("Error executing database query:", err)
 		return
 	}
 
-	c.JSON(http.StatusOK, users)
+	c.JSON(http.StatusOK, newPage(publicUsers(users), query))
 }
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/gin-gonic/gin"
+)
+
+// maxUserAgentLength caps the user agent stored with a session
+const maxUserAgentLength = 512
+
+// Session is a device signed in to an account: one login and the refresh
+// tokens rotated from it. Its ID is the family claim of those tokens.
+type Session struct {
+	ID         string     `json:"id" db:"id" gorm:"primaryKey"`
+	UserID     int        `json:"userId" db:"user_id"`
+	UserAgent  string     `json:"userAgent" db:"user_agent"`
+	IP         string     `json:"ip" db:"ip"`
+	CreatedAt  time.Time  `json:"createdAt" db:"created_at"`
+	LastSeenAt time.Time  `json:"lastSeenAt" db:"last_seen_at"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty" db:"revoked_at"`
+	// Current marks the session of the request listing the sessions
+	Current bool `json:"current" gorm:"-"`
+}
+
+// SessionActivity collects the last-seen times of sessions in memory so
+// that authenticating a request does not write to the database. Run writes
+// them out in one batch every interval.
+type SessionActivity struct {
+	store SessionStore
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewSessionActivity creates a SessionActivity that writes to store
+func NewSessionActivity(store SessionStore) *SessionActivity {
+	return &SessionActivity{store: store, seen: make(map[string]time.Time)}
+}
+
+// Seen records that session id was used at the given time
+func (a *SessionActivity) Seen(id string, at time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if at.After(a.seen[id]) {
+		a.seen[id] = at
+	}
+}
+
+// lastSeen returns the pending last-seen time of session id, if any
+func (a *SessionActivity) lastSeen(id string) (time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	at, ok := a.seen[id]
+	return at, ok
+}
+
+// Flush writes the pending last-seen times. On failure they are kept for
+// the next flush.
+func (a *SessionActivity) Flush() error {
+	a.mu.Lock()
+	seen := a.seen
+	a.seen = make(map[string]time.Time)
+	a.mu.Unlock()
+
+	if err := a.store.Touch(seen); err != nil {
+		for id, at := range seen {
+			a.Seen(id, at)
+		}
+		return err
+	}
+	return nil
+}
+
+// Run flushes every interval until ctx is cancelled, then flushes once more
+func (a *SessionActivity) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := a.Flush(); err != nil {
+				log.Println("Error recording session activity:", err)
+			}
+			return
+		case <-ticker.C:
+			if err := a.Flush(); err != nil {
+				log.Println("Error recording session activity:", err)
+			}
+		}
+	}
+}
+
+// createSession records the session a login starts
+func createSession(c *gin.Context, s *Stores, userID int, id string) error {
+	userAgent := c.Request.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	return s.Sessions.Create(&Session{
+		ID:         id,
+		UserID:     userID,
+		UserAgent:  userAgent,
+		IP:         c.ClientIP(),
+		LastSeenAt: time.Now(),
+	})
+}
+
+// revokeSessionTokens invalidates the refresh tokens of the given sessions
+// and the access tokens issued from them
+func revokeSessionTokens(s *Stores, cfg config.AuthConfig, userID int, ids []string) error {
+	now := time.Now()
+	// Access tokens name their session in the family claim, so revoking the
+	// session ID rejects all of them until the last one has expired
+	expiresAt := now.Add(cfg.AccessTokenTTL.Duration())
+	for _, id := range ids {
+		if err := s.RefreshTokens.RevokeFamily(id, now); err != nil {
+			return err
+		}
+		if err := s.Revocations.Revoke(id, userID, expiresAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetSessions lists the devices signed in to the caller's account
+func GetSessions(c *gin.Context, s *Stores, cfg config.AuthConfig) {
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// A session whose refresh token has expired cannot be used any more
+	seenSince := time.Now().Add(-cfg.RefreshTokenTTL.Duration())
+	sessions, err := s.Sessions.ListByUser(userID.(int), seenSince)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	current := c.GetString("token_family")
+	for i := range sessions {
+		if at, ok := s.SessionActivity.lastSeen(sessions[i].ID); ok && at.After(sessions[i].LastSeenAt) {
+			sessions[i].LastSeenAt = at
+		}
+		sessions[i].Current = sessions[i].ID == current
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// RevokeSession signs one of the caller's devices out
+func RevokeSession(c *gin.Context, s *Stores, cfg config.AuthConfig) {
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	sessionID := c.Param("sessionId")
+	if err := s.Sessions.Revoke(userID.(int), sessionID, time.Now()); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	if err := revokeSessionTokens(s, cfg, userID.(int), []string{sessionID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		log.Println("Error revoking session tokens:", err)
+		return
+	}
+
+	if sessionID == c.GetString("token_family") {
+		clearAuthCookies(c, cfg)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked successfully"})
+}
+
+// RevokeOtherSessions signs out every device of the caller but the one
+// making the request
+func RevokeOtherSessions(c *gin.Context, s *Stores, cfg config.AuthConfig) {
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	current := c.GetString("token_family")
+	if current == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The request is not made from a session"})
+		return
+	}
+
+	revoked, err := s.Sessions.RevokeOthers(userID.(int), current, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	if err := revokeSessionTokens(s, cfg, userID.(int), revoked); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		log.Println("Error revoking session tokens:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Other sessions revoked successfully", "revoked": len(revoked)})
+}
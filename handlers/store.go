@@ -0,0 +1,432 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by every store when the requested record does not exist
+var ErrNotFound = errors.New("record not found")
+
+// ErrConflict is returned by stores when a record would duplicate a unique one
+var ErrConflict = errors.New("record already exists")
+
+// UserStore persists user accounts. Create and Update return ErrConflict
+// when the email belongs to another user.
+type UserStore interface {
+	Create(user *User) error
+	GetByID(id int) (*User, error)
+	GetByUsername(username string) (*User, error)
+	// GetByEmail looks the user up by their normalized email
+	GetByEmail(email string) (*User, error)
+	Update(user *User) error
+	// Search returns the users whose username contains keyword
+	Search(keyword string, query ListQuery) ([]User, error)
+}
+
+// PostStore persists posts. List and Search only return published posts.
+type PostStore interface {
+	// Create stores post, marking it published when Status is empty and
+	// stamping PublishedAt when a published post has none
+	Create(post *Post) error
+	GetByID(id int) (*Post, error)
+	// Update saves every field but Status and PublishedAt, which only
+	// PublishDue changes
+	Update(post *Post) error
+	Delete(id int) error
+	List(query ListQuery) ([]Post, error)
+	// Search returns the published posts whose content contains keyword
+	Search(keyword string, query ListQuery) ([]Post, error)
+	// ListScheduled returns the scheduled posts of userID
+	ListScheduled(userID int, query ListQuery) ([]Post, error)
+	// Reschedule moves a scheduled post to at. It returns ErrNotFound when
+	// the post does not exist or was already published.
+	Reschedule(id int, at time.Time) error
+	// CancelScheduled deletes a post that has not been published yet
+	CancelScheduled(id int) error
+	// PublishDue publishes up to limit scheduled posts whose ScheduleTime is
+	// not after now and returns them. A post is only ever returned once,
+	// even when several callers race.
+	PublishDue(now time.Time, limit int) ([]Post, error)
+}
+
+// EngagementStore persists likes and comments on posts
+type EngagementStore interface {
+	Create(engagement *Engagement) error
+	GetByID(id int) (*Engagement, error)
+	Update(engagement *Engagement) error
+	Delete(id int) error
+	ListByPost(postID int, query ListQuery) ([]Engagement, error)
+	CountLikes(postID int) (int64, error)
+	// CountComments counts the engagements of a post with a non-empty comment
+	CountComments(postID int) (int64, error)
+}
+
+// FollowStore persists the follow graph
+type FollowStore interface {
+	// Create reports ErrConflict when the follower already follows the user
+	Create(follow *Follow) error
+	Get(followerID, followingID int) (*Follow, error)
+	Delete(id int) error
+	// ListFollowers returns the follows pointing at userID
+	ListFollowers(userID int, query ListQuery) ([]Follow, error)
+	// ListFollowings returns the follows made by userID
+	ListFollowings(userID int, query ListQuery) ([]Follow, error)
+}
+
+// NotificationStore persists user notifications
+type NotificationStore interface {
+	Create(notification *Notification) error
+	// Group creates notification or, when it has a GroupKey, merges its
+	// actors into the unread notification of the user with the same key and
+	// marks that one updated. notification is set to the stored result.
+	Group(notification *Notification) error
+	GetByID(id int) (*Notification, error)
+	MarkRead(id int) error
+	// MarkAllRead marks the unread notifications of userID that match
+	// filter as read and returns how many there were
+	MarkAllRead(userID int, filter NotificationFilter) (int64, error)
+	// CountUnread returns how many notifications of userID are unread
+	CountUnread(userID int) (int64, error)
+	// Delete removes notification id of userID, or reports ErrNotFound
+	Delete(userID, id int) error
+	ListByUser(userID int, query ListQuery) ([]Notification, error)
+	// ListUpdated returns the notifications of userID last updated at or
+	// after from and before to, newest first
+	ListUpdated(userID int, from, to time.Time) ([]Notification, error)
+	// UpdatedUsers returns the users with notifications last updated at or
+	// after from and before to
+	UpdatedUsers(from, to time.Time) ([]int, error)
+}
+
+// NotificationPreferenceStore persists the notification settings of users.
+// Types a user has not configured have no preference stored.
+type NotificationPreferenceStore interface {
+	List(userID int) ([]NotificationPreference, error)
+	// Get returns the preference of userID for typ, or ErrNotFound
+	Get(userID int, typ string) (*NotificationPreference, error)
+	// Save creates or replaces a preference
+	Save(preference *NotificationPreference) error
+	DeleteByUser(userID int) error
+}
+
+// DigestStore persists the email digest subscriptions of users and the
+// digests sent to them
+type DigestStore interface {
+	// GetSubscription returns the subscription of userID, or ErrNotFound
+	GetSubscription(userID int) (*DigestSubscription, error)
+	// SaveSubscription creates or replaces a subscription
+	SaveSubscription(subscription *DigestSubscription) error
+	// Claim records digest before it is sent. It reports ErrConflict when
+	// the digest of that user for that period was claimed already.
+	Claim(digest *Digest) error
+	// MarkSent records that digest id was sent at at
+	MarkSent(id int, at time.Time) error
+	// Release removes the claim of digest id so it can be sent again
+	Release(id int) error
+	// DeleteByUser removes the subscription and digests of userID
+	DeleteByUser(userID int) error
+}
+
+// WebhookStore persists webhooks and the deliveries queued for them
+type WebhookStore interface {
+	Create(webhook *Webhook) error
+	// GetByID returns the webhook with id, or ErrNotFound
+	GetByID(id int) (*Webhook, error)
+	Update(webhook *Webhook) error
+	// Delete removes a webhook with its deliveries
+	Delete(id int) error
+	ListByUser(userID int) ([]Webhook, error)
+	ListByCompany(companyID int) ([]Webhook, error)
+	// Subscribed returns the active webhooks subscribed to event that
+	// belong to one of userIDs or companyIDs
+	Subscribed(event string, userIDs, companyIDs []int) ([]Webhook, error)
+	// DeleteByUser removes the webhooks of userID with their deliveries
+	DeleteByUser(userID int) error
+	CreateDelivery(delivery *WebhookDelivery) error
+	ListDeliveries(webhookID int, query ListQuery) ([]WebhookDelivery, error)
+	// ClaimDue marks up to limit pending deliveries due at now as
+	// delivering from now and returns them, each only once. Deliveries left
+	// delivering since before staleBefore, by a worker that stopped, are
+	// claimed again.
+	ClaimDue(now, staleBefore time.Time, limit int) ([]WebhookDelivery, error)
+	UpdateDelivery(delivery *WebhookDelivery) error
+}
+
+// CompanyStore persists companies
+type CompanyStore interface {
+	Create(company *Company) error
+	// GetByID returns the company with its Teams loaded
+	GetByID(id uint) (*Company, error)
+	Update(company *Company) error
+	Delete(id uint) error
+}
+
+// RoleStore persists roles with their permissions and the assignment of
+// roles to users. Roles are returned with Permissions loaded.
+type RoleStore interface {
+	// Create stores a role and its permissions, or returns ErrConflict when
+	// the name is taken
+	Create(role *Role) error
+	GetByID(id uint) (*Role, error)
+	GetByName(name string) (*Role, error)
+	// Update saves the description and replaces the permissions of a role
+	Update(role *Role) error
+	// Delete removes a role together with its assignments
+	Delete(id uint) error
+	List(query ListQuery) ([]Role, error)
+	// Permissions returns the permission catalogue
+	Permissions() ([]Permission, error)
+	// Seed adds the catalogue and the DefaultRoles that are missing. Roles
+	// that already exist are left as they are.
+	Seed() error
+	// Assign stores an assignment, or returns ErrConflict when the user
+	// already has the role in that scope
+	Assign(assignment *UserRole) error
+	// Unassign removes the assignment of roleID to userID within companyID,
+	// or the global one when companyID is nil
+	Unassign(userID int, roleID uint, companyID *int) error
+	// Assignments returns the roles assigned to userID with RoleName set
+	Assignments(userID int) ([]UserRole, error)
+	// Grants returns the permissions userID holds through their roles
+	Grants(userID int) ([]Grant, error)
+}
+
+// AnalyticsStore persists post views and computed engagement metrics
+type AnalyticsStore interface {
+	RecordView(view *PostView) error
+	CountViews(postID int) (int64, error)
+	SaveMetrics(metrics *EngagementMetrics) error
+}
+
+// RefreshTokenStore persists refresh token families
+type RefreshTokenStore interface {
+	Create(token *RefreshToken) error
+	Get(id string) (*RefreshToken, error)
+	// Claim marks an unused, unrevoked and unexpired token as used. It
+	// reports false when the token could not be claimed.
+	Claim(id string, now time.Time) (bool, error)
+	RevokeFamily(familyID string, at time.Time) error
+	RevokeUser(userID int, at time.Time) error
+}
+
+// PasswordResetStore persists password reset tokens by hash
+type PasswordResetStore interface {
+	Create(token *PasswordResetToken) error
+	// Claim marks the unused and unexpired token with the given hash as used
+	// and returns it, or returns ErrNotFound when there is none
+	Claim(hash string, now time.Time) (*PasswordResetToken, error)
+	// InvalidateUser uses up every outstanding token of userID
+	InvalidateUser(userID int, at time.Time) error
+	// CountActive returns how many tokens of userID are unused and
+	// unexpired at now
+	CountActive(userID int, now time.Time) (int, error)
+}
+
+// EmailVerificationStore persists email verification tokens by hash
+type EmailVerificationStore interface {
+	Create(token *EmailVerificationToken) error
+	// Claim marks the unused and unexpired token with the given hash as used
+	// and returns it, or returns ErrNotFound when there is none
+	Claim(hash string, now time.Time) (*EmailVerificationToken, error)
+}
+
+// TwoFactorStore persists TOTP enrollments and recovery codes
+type TwoFactorStore interface {
+	// Get returns the enrollment of userID, or ErrNotFound when there is none
+	Get(userID int) (*TwoFactor, error)
+	// Save creates or replaces the enrollment of tf.UserID
+	Save(tf *TwoFactor) error
+	// Delete removes the enrollment and the recovery codes of userID
+	Delete(userID int) error
+	// UseStep records that a code of step was accepted for userID. It
+	// reports false when a code of that step or a later one already was.
+	UseStep(userID int, step int64) (bool, error)
+	// ReplaceRecoveryCodes discards the recovery codes of userID in favour
+	// of the given hashes
+	ReplaceRecoveryCodes(userID int, hashes []string) error
+	// UseRecoveryCode marks the unused code of userID with the given hash as
+	// used, or returns ErrNotFound when there is none
+	UseRecoveryCode(userID int, hash string, now time.Time) error
+	// RemainingRecoveryCodes counts the unused recovery codes of userID
+	RemainingRecoveryCodes(userID int) (int, error)
+}
+
+// LoginThrottleStore counts failed logins per account and per client IP
+type LoginThrottleStore interface {
+	// Get returns the record of key, or ErrNotFound when it has none
+	Get(key string) (*LoginThrottle, error)
+	// RecordFailure counts a failure of key at now and returns the updated
+	// record. A last failure older than window restarts the count.
+	RecordFailure(key string, now time.Time, window time.Duration) (*LoginThrottle, error)
+	// Reset forgets the failures of key
+	Reset(key string) error
+}
+
+// AuditStore persists audit events
+type AuditStore interface {
+	Record(event *AuditEvent) error
+	List(query ListQuery) ([]AuditEvent, error)
+}
+
+// AccessTokenStore persists personal access tokens by hash
+type AccessTokenStore interface {
+	Create(token *PersonalAccessToken) error
+	// GetByHash returns the token with the given hash, revoked and expired
+	// ones included, or ErrNotFound
+	GetByHash(hash string) (*PersonalAccessToken, error)
+	// ListByUser returns the unrevoked tokens of userID, oldest first
+	ListByUser(userID int) ([]PersonalAccessToken, error)
+	// Revoke revokes the unrevoked token id of userID, or returns
+	// ErrNotFound when there is none
+	Revoke(userID, id int, at time.Time) error
+	// RevokeUser revokes every unrevoked token of userID
+	RevokeUser(userID int, at time.Time) error
+	// Touch records that token id was used at the given time
+	Touch(id int, at time.Time) error
+}
+
+// SigningKeyStore persists the keys that sign JWTs
+type SigningKeyStore interface {
+	Create(key *SigningKey) error
+	// List returns every key, retired ones included, oldest first
+	List() ([]SigningKey, error)
+	// Retire stops key id from signing, or returns ErrNotFound when there
+	// is no such key that is not retired yet
+	Retire(id string, at time.Time) error
+}
+
+// IdentityStore persists the provider accounts linked to users
+type IdentityStore interface {
+	// Create returns ErrConflict when the provider account is already linked
+	Create(identity *Identity) error
+	// Get returns the identity of a provider account, or ErrNotFound
+	Get(provider, subject string) (*Identity, error)
+	ListByUser(userID int) ([]Identity, error)
+	// Delete removes identity id of userID, or returns ErrNotFound
+	Delete(userID, id int) error
+}
+
+// OAuthStateStore keeps provider sign-ins in progress by state hash
+type OAuthStateStore interface {
+	Create(state *OAuthState) error
+	// Consume removes and returns the state with the given hash, or
+	// returns ErrNotFound, so that each state is used once
+	Consume(stateHash string) (*OAuthState, error)
+}
+
+// SessionStore persists the session each login starts. A session shares
+// its ID with the refresh token family of the login.
+type SessionStore interface {
+	Create(session *Session) error
+	// ListByUser returns the unrevoked sessions of userID last seen after
+	// seenSince, most recently seen first
+	ListByUser(userID int, seenSince time.Time) ([]Session, error)
+	// Revoke revokes the unrevoked session id of userID, or returns
+	// ErrNotFound when there is none
+	Revoke(userID int, id string, at time.Time) error
+	// RevokeOthers revokes every unrevoked session of userID but keep and
+	// returns their IDs
+	RevokeOthers(userID int, keep string, at time.Time) ([]string, error)
+	// Touch moves the last-seen time of each session forward to the time
+	// given for it, in one write
+	Touch(seen map[string]time.Time) error
+}
+
+// AccountStore reads and erases the records of a user kept across the
+// post, engagement, follow, notification and analytics stores
+type AccountStore interface {
+	// Collect returns the posts, engagements, follows, notifications and
+	// post views of userID
+	Collect(userID int) (*PersonalData, error)
+	// DueForDeletion returns the users whose deletion was due before now
+	DueForDeletion(now time.Time) ([]User, error)
+	// Erase removes the account of userID with its follows, notifications
+	// and scheduled posts. With anonymize the published posts, comments and
+	// likes stay under the account, which is stripped of everything that
+	// identifies its owner, and its post views are detached from it;
+	// otherwise they are removed too, with the engagements and views of
+	// the posts.
+	Erase(userID int, anonymize bool) error
+}
+
+// AccountExportStore persists personal data export jobs
+type AccountExportStore interface {
+	Create(export *AccountExport) error
+	// Latest returns the newest export of userID, or ErrNotFound
+	Latest(userID int) (*AccountExport, error)
+	// ClaimPending marks up to limit pending exports as running from now
+	// and returns them, each only once. Exports left running since before
+	// staleBefore, by a worker that stopped, are claimed again.
+	ClaimPending(now, staleBefore time.Time, limit int) ([]AccountExport, error)
+	Update(export *AccountExport) error
+	// DeleteExpired removes the exports that expired before now and
+	// returns them
+	DeleteExpired(now time.Time) ([]AccountExport, error)
+	// DeleteByUser removes the exports of userID and returns them
+	DeleteByUser(userID int) ([]AccountExport, error)
+}
+
+// TimelineStore reads home timelines and maintains their materialized copy.
+// Timelines hold published posts ordered by PublishedAt then ID, newest
+// first; reads take the limit and cursor of a query from feedQuery.
+type TimelineStore interface {
+	// Query builds the timeline of userID from the posts of userID and of
+	// the users they follow
+	Query(userID int, query ListQuery) ([]Post, error)
+	// Read returns the materialized timeline of userID
+	Read(userID int, query ListQuery) ([]Post, error)
+	// FanOut adds a published post to the timelines of its author and of
+	// their followers
+	FanOut(post Post) error
+	// Backfill adds the published posts of followingID to the timeline of
+	// followerID
+	Backfill(followerID, followingID int) error
+	// Remove takes the posts of followingID out of the timeline of
+	// followerID, unless followerID still follows them
+	Remove(followerID, followingID int) error
+	// Rebuild adds every missing entry to every materialized timeline
+	Rebuild() error
+}
+
+// Stores groups the storage of every domain so handlers can be wired to
+// PostgreSQL in production and to memory in tests. Every method taking a
+// ListQuery applies it as documented on ListQuery.
+type Stores struct {
+	Users              UserStore
+	Posts              PostStore
+	Engagements        EngagementStore
+	Follows            FollowStore
+	Notifications      NotificationStore
+	Companies          CompanyStore
+	Roles              RoleStore
+	Analytics          AnalyticsStore
+	Timelines          TimelineStore
+	RefreshTokens      RefreshTokenStore
+	Revocations        RevocationStore
+	PasswordResets     PasswordResetStore
+	EmailVerifications EmailVerificationStore
+	TwoFactor          TwoFactorStore
+	LoginThrottles     LoginThrottleStore
+	Audit              AuditStore
+	AccessTokens       AccessTokenStore
+	SigningKeys        SigningKeyStore
+	Identities         IdentityStore
+	OAuthStates        OAuthStateStore
+	Sessions           SessionStore
+	Accounts           AccountStore
+	AccountExports     AccountExportStore
+	// SessionActivity batches the last-seen updates of Sessions
+	SessionActivity *SessionActivity
+	// Keys signs and verifies tokens with the keys in SigningKeys
+	Keys *Keyring
+	// Broker streams new notifications to their users. It delivers within
+	// the process unless replaced with a broker shared by every replica.
+	Broker NotificationBroker
+	// NotificationPreferences holds what users want to be notified about
+	NotificationPreferences NotificationPreferenceStore
+	// Digests holds the email digest subscriptions and what was sent
+	Digests DigestStore
+	// Webhooks holds the outgoing webhooks and their delivery log
+	Webhooks WebhookStore
+}
@@ -0,0 +1,2271 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewMemoryStores returns empty stores that keep everything in process
+// memory. They are safe for concurrent use and meant for tests and local
+// development.
+func NewMemoryStores() *Stores {
+	users := &MemoryUserStore{users: make(map[int]User)}
+	posts := &MemoryPostStore{posts: make(map[int]Post)}
+	engagements := &MemoryEngagementStore{engagements: make(map[int]Engagement)}
+	follows := &MemoryFollowStore{follows: make(map[int]Follow)}
+	signingKeys := &MemorySigningKeyStore{keys: make(map[string]SigningKey)}
+	sessions := &MemorySessionStore{sessions: make(map[string]Session)}
+	notifications := &MemoryNotificationStore{notifications: make(map[int]Notification)}
+	analytics := &MemoryAnalyticsStore{}
+	timelines := &MemoryTimelineStore{posts: posts, follows: follows, entries: make(map[int]map[int]bool)}
+	return &Stores{
+		Users:              users,
+		Posts:              posts,
+		Engagements:        engagements,
+		Follows:            follows,
+		Notifications:      notifications,
+		Companies:          &MemoryCompanyStore{companies: make(map[uint]Company), users: users},
+		Roles:              NewMemoryRoleStore(),
+		Analytics:          analytics,
+		Timelines:          timelines,
+		RefreshTokens:      &MemoryRefreshTokenStore{tokens: make(map[string]RefreshToken)},
+		Revocations:        NewMemoryRevocationStore(),
+		PasswordResets:     &MemoryPasswordResetStore{tokens: make(map[int]PasswordResetToken)},
+		EmailVerifications: &MemoryEmailVerificationStore{tokens: make(map[int]EmailVerificationToken)},
+		TwoFactor:          &MemoryTwoFactorStore{enrollments: make(map[int]TwoFactor), codes: make(map[int]RecoveryCode)},
+		LoginThrottles:     &MemoryLoginThrottleStore{throttles: make(map[string]LoginThrottle)},
+		Audit:              &MemoryAuditStore{events: make(map[int]AuditEvent)},
+		AccessTokens:       &MemoryAccessTokenStore{tokens: make(map[int]PersonalAccessToken)},
+		SigningKeys:        signingKeys,
+		Identities:         &MemoryIdentityStore{identities: make(map[int]Identity)},
+		OAuthStates:        &MemoryOAuthStateStore{states: make(map[string]OAuthState)},
+		Sessions:           sessions,
+		SessionActivity:    NewSessionActivity(sessions),
+		Accounts: &MemoryAccountStore{
+			users:         users,
+			posts:         posts,
+			engagements:   engagements,
+			follows:       follows,
+			notifications: notifications,
+			analytics:     analytics,
+			timelines:     timelines,
+		},
+		AccountExports: &MemoryAccountExportStore{exports: make(map[int]AccountExport)},
+		Keys:           NewKeyring(signingKeys),
+		Broker:         NewMemoryBroker(),
+		NotificationPreferences: &MemoryNotificationPreferenceStore{
+			preferences: make(map[int]map[string]NotificationPreference),
+		},
+		Digests: &MemoryDigestStore{
+			subscriptions: make(map[int]DigestSubscription),
+			digests:       make(map[int]Digest),
+		},
+		Webhooks: &MemoryWebhookStore{
+			webhooks:   make(map[int]Webhook),
+			deliveries: make(map[int]WebhookDelivery),
+		},
+	}
+}
+
+// sortedIDs returns the keys of m in ascending order so listings are stable
+func sortedIDs[K int | uint, V any](m map[K]V) []K {
+	ids := make([]K, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// applyListQuery filters, sorts and pages items the way the Postgres stores
+// do in SQL, reading columns through the db tags of T
+func applyListQuery[T any](items []T, query ListQuery) ([]T, error) {
+	model := reflect.TypeOf((*T)(nil)).Elem()
+	column := query.sortColumn()
+	if _, ok := columnField(model, column); !ok {
+		return nil, fmt.Errorf("unknown sort column %q", column)
+	}
+
+	// compare orders a before b: by the sort column, then by id
+	compare := func(a, b reflect.Value) int {
+		if order := compareValues(columnValue(a, column), columnValue(b, column)); order != 0 {
+			return order
+		}
+		return compareValues(columnValue(a, "id"), columnValue(b, "id"))
+	}
+	if query.Desc {
+		ascending := compare
+		compare = func(a, b reflect.Value) int { return -ascending(a, b) }
+	}
+
+	var after reflect.Value
+	if query.After != nil {
+		value, err := cursorValue(model, query.After)
+		if err != nil {
+			return nil, err
+		}
+		// A zero item carrying the cursor position, compared like any other
+		after = reflect.New(model).Elem()
+		setColumn(after, column, value)
+		setColumn(after, "id", query.After.ID)
+	}
+
+	matched := []T{}
+	for _, item := range items {
+		v := reflect.ValueOf(item)
+		keep := true
+		for name, want := range query.Filters {
+			field := columnValue(v, name)
+			if !field.IsValid() || compareValues(field, reflect.ValueOf(want)) != 0 {
+				keep = false
+				break
+			}
+		}
+		if keep && after.IsValid() && compare(v, after) <= 0 {
+			keep = false
+		}
+		if keep {
+			matched = append(matched, item)
+		}
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		return compare(reflect.ValueOf(matched[i]), reflect.ValueOf(matched[j])) < 0
+	})
+	if query.Limit > 0 && len(matched) > query.Limit {
+		matched = matched[:query.Limit]
+	}
+	return matched, nil
+}
+
+// setColumn stores value, converted to the field type, in the field of item
+// whose db tag is column
+func setColumn(item reflect.Value, column string, value interface{}) {
+	field := columnValue(item, column)
+	v := reflect.ValueOf(value)
+	if field.Kind() == reflect.Pointer {
+		ptr := reflect.New(field.Type().Elem())
+		ptr.Elem().Set(v.Convert(field.Type().Elem()))
+		field.Set(ptr)
+		return
+	}
+	field.Set(v.Convert(field.Type()))
+}
+
+type MemoryUserStore struct {
+	mu     sync.RWMutex
+	users  map[int]User
+	nextID int
+}
+
+func (s *MemoryUserStore) Create(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user.Email = NormalizeEmail(user.Email)
+	if s.emailTaken(user) {
+		return ErrConflict
+	}
+	s.nextID++
+	user.ID = s.nextID
+	now := time.Now()
+	user.CreatedAt, user.UpdatedAt = now, now
+	s.users[user.ID] = *user
+	return nil
+}
+
+// emailTaken reports whether another user has the email of user
+func (s *MemoryUserStore) emailTaken(user *User) bool {
+	if user.Email == "" {
+		return false
+	}
+	for id, other := range s.users {
+		if id != user.ID && other.Email == user.Email {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryUserStore) GetByID(id int) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+func (s *MemoryUserStore) GetByEmail(email string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, id := range sortedIDs(s.users) {
+		if user := s.users[id]; user.Email != "" && user.Email == NormalizeEmail(email) {
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryUserStore) GetByUsername(username string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, id := range sortedIDs(s.users) {
+		if user := s.users[id]; user.Username == username {
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryUserStore) Update(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.users[user.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	user.Email = NormalizeEmail(user.Email)
+	if s.emailTaken(user) {
+		return ErrConflict
+	}
+	user.CreatedAt = existing.CreatedAt
+	user.UpdatedAt = time.Now()
+	s.users[user.ID] = *user
+	return nil
+}
+
+func (s *MemoryUserStore) Search(keyword string, query ListQuery) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := []User{}
+	for _, id := range sortedIDs(s.users) {
+		if user := s.users[id]; strings.Contains(user.Username, keyword) {
+			users = append(users, user)
+		}
+	}
+	return applyListQuery(users, query)
+}
+
+// byCompany returns the users that belong to companyID
+func (s *MemoryUserStore) byCompany(companyID uint) []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := []User{}
+	for _, id := range sortedIDs(s.users) {
+		user := s.users[id]
+		if user.CompanyID != nil && uint(*user.CompanyID) == companyID {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+type MemoryPostStore struct {
+	mu     sync.RWMutex
+	posts  map[int]Post
+	nextID int
+}
+
+func (s *MemoryPostStore) Create(post *Post) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	setPublishDefaults(post)
+	s.nextID++
+	post.ID = s.nextID
+	s.posts[post.ID] = *post
+	return nil
+}
+
+func (s *MemoryPostStore) GetByID(id int) (*Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	post, ok := s.posts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &post, nil
+}
+
+func (s *MemoryPostStore) Update(post *Post) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.posts[post.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	updated := *post
+	updated.Status = existing.Status
+	updated.PublishedAt = existing.PublishedAt
+	s.posts[post.ID] = updated
+	return nil
+}
+
+func (s *MemoryPostStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.posts[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.posts, id)
+	return nil
+}
+
+func (s *MemoryPostStore) List(query ListQuery) ([]Post, error) {
+	return s.Search("", query)
+}
+
+func (s *MemoryPostStore) Search(keyword string, query ListQuery) ([]Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	posts := []Post{}
+	for _, id := range sortedIDs(s.posts) {
+		post := s.posts[id]
+		if post.Status == PostStatusPublished && strings.Contains(post.Content, keyword) {
+			posts = append(posts, post)
+		}
+	}
+	return applyListQuery(posts, query)
+}
+
+// scheduled returns the scheduled posts matching keep, soonest first.
+// Callers must hold s.mu.
+func (s *MemoryPostStore) scheduled(keep func(Post) bool) []Post {
+	posts := []Post{}
+	for _, id := range sortedIDs(s.posts) {
+		if post := s.posts[id]; post.Status == PostStatusScheduled && keep(post) {
+			posts = append(posts, post)
+		}
+	}
+	sort.SliceStable(posts, func(i, j int) bool {
+		return posts[i].ScheduleTime.Before(posts[j].ScheduleTime)
+	})
+	return posts
+}
+
+func (s *MemoryPostStore) ListScheduled(userID int, query ListQuery) ([]Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return applyListQuery(s.scheduled(func(post Post) bool { return post.UserID == userID }), query)
+}
+
+func (s *MemoryPostStore) Reschedule(id int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	post, ok := s.posts[id]
+	if !ok || post.Status != PostStatusScheduled {
+		return ErrNotFound
+	}
+	post.ScheduleTime = at
+	s.posts[id] = post
+	return nil
+}
+
+func (s *MemoryPostStore) CancelScheduled(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	post, ok := s.posts[id]
+	if !ok || post.Status != PostStatusScheduled {
+		return ErrNotFound
+	}
+	delete(s.posts, id)
+	return nil
+}
+
+func (s *MemoryPostStore) PublishDue(now time.Time, limit int) ([]Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := s.scheduled(func(post Post) bool { return !post.ScheduleTime.After(now) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for i := range due {
+		publishedAt := due[i].ScheduleTime
+		due[i].Status = PostStatusPublished
+		due[i].PublishedAt = &publishedAt
+		s.posts[due[i].ID] = due[i]
+	}
+	return due, nil
+}
+
+// published returns the published posts matching keep. Callers must not
+// hold s.mu.
+func (s *MemoryPostStore) published(keep func(Post) bool) []Post {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	posts := []Post{}
+	for _, post := range s.posts {
+		if post.Status == PostStatusPublished && keep(post) {
+			posts = append(posts, post)
+		}
+	}
+	return posts
+}
+
+// MemoryTimelineStore reads posts and follows from the memory stores it was
+// built with. Deleted posts drop out of materialized timelines because
+// entries are resolved against the post store on every read.
+type MemoryTimelineStore struct {
+	mu      sync.RWMutex
+	posts   *MemoryPostStore
+	follows *MemoryFollowStore
+	// entries maps a user to the set of post ids in their timeline
+	entries map[int]map[int]bool
+}
+
+func (s *MemoryTimelineStore) Query(userID int, query ListQuery) ([]Post, error) {
+	authors := map[int]bool{userID: true}
+	for _, follow := range s.follows.filter(func(follow Follow) bool { return follow.FollowerID == userID }) {
+		authors[follow.FollowingID] = true
+	}
+
+	posts := s.posts.published(func(post Post) bool { return authors[post.UserID] })
+	return applyListQuery(posts, query)
+}
+
+func (s *MemoryTimelineStore) Read(userID int, query ListQuery) ([]Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := s.entries[userID]
+	posts := s.posts.published(func(post Post) bool { return entries[post.ID] })
+	return applyListQuery(posts, query)
+}
+
+// add puts postIDs into the timeline of userID. Callers must hold s.mu.
+func (s *MemoryTimelineStore) add(userID int, posts []Post) {
+	if s.entries[userID] == nil {
+		s.entries[userID] = make(map[int]bool)
+	}
+	for _, post := range posts {
+		s.entries[userID][post.ID] = true
+	}
+}
+
+func (s *MemoryTimelineStore) FanOut(post Post) error {
+	followers := s.follows.filter(func(follow Follow) bool { return follow.FollowingID == post.UserID })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.add(post.UserID, []Post{post})
+	for _, follow := range followers {
+		s.add(follow.FollowerID, []Post{post})
+	}
+	return nil
+}
+
+func (s *MemoryTimelineStore) Backfill(followerID, followingID int) error {
+	posts := s.posts.published(func(post Post) bool { return post.UserID == followingID })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.add(followerID, posts)
+	return nil
+}
+
+func (s *MemoryTimelineStore) Remove(followerID, followingID int) error {
+	if _, err := s.follows.Get(followerID, followingID); err == nil {
+		return nil
+	}
+	posts := s.posts.published(func(post Post) bool { return post.UserID == followingID })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, post := range posts {
+		delete(s.entries[followerID], post.ID)
+	}
+	return nil
+}
+
+func (s *MemoryTimelineStore) Rebuild() error {
+	for _, post := range s.posts.published(func(Post) bool { return true }) {
+		if err := s.FanOut(post); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type MemoryEngagementStore struct {
+	mu          sync.RWMutex
+	engagements map[int]Engagement
+	nextID      int
+}
+
+func (s *MemoryEngagementStore) Create(engagement *Engagement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	engagement.ID = s.nextID
+	s.engagements[engagement.ID] = *engagement
+	return nil
+}
+
+func (s *MemoryEngagementStore) GetByID(id int) (*Engagement, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	engagement, ok := s.engagements[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &engagement, nil
+}
+
+func (s *MemoryEngagementStore) Update(engagement *Engagement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.engagements[engagement.ID]; !ok {
+		return ErrNotFound
+	}
+	s.engagements[engagement.ID] = *engagement
+	return nil
+}
+
+func (s *MemoryEngagementStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.engagements[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.engagements, id)
+	return nil
+}
+
+func (s *MemoryEngagementStore) ListByPost(postID int, query ListQuery) ([]Engagement, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	engagements := []Engagement{}
+	for _, id := range sortedIDs(s.engagements) {
+		if engagement := s.engagements[id]; engagement.PostID == postID {
+			engagements = append(engagements, engagement)
+		}
+	}
+	return applyListQuery(engagements, query)
+}
+
+func (s *MemoryEngagementStore) CountLikes(postID int) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var count int64
+	for _, engagement := range s.engagements {
+		if engagement.PostID == postID && engagement.Like {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryEngagementStore) CountComments(postID int) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var count int64
+	for _, engagement := range s.engagements {
+		if engagement.PostID == postID && engagement.Comment != "" {
+			count++
+		}
+	}
+	return count, nil
+}
+
+type MemoryFollowStore struct {
+	mu      sync.RWMutex
+	follows map[int]Follow
+	nextID  int
+}
+
+func (s *MemoryFollowStore) Create(follow *Follow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.follows {
+		if existing.FollowerID == follow.FollowerID && existing.FollowingID == follow.FollowingID {
+			return ErrConflict
+		}
+	}
+	s.nextID++
+	follow.ID = s.nextID
+	s.follows[follow.ID] = *follow
+	return nil
+}
+
+func (s *MemoryFollowStore) Get(followerID, followingID int) (*Follow, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, id := range sortedIDs(s.follows) {
+		if follow := s.follows[id]; follow.FollowerID == followerID && follow.FollowingID == followingID {
+			return &follow, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryFollowStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.follows[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.follows, id)
+	return nil
+}
+
+func (s *MemoryFollowStore) ListFollowers(userID int, query ListQuery) ([]Follow, error) {
+	return applyListQuery(s.filter(func(follow Follow) bool { return follow.FollowingID == userID }), query)
+}
+
+func (s *MemoryFollowStore) ListFollowings(userID int, query ListQuery) ([]Follow, error) {
+	return applyListQuery(s.filter(func(follow Follow) bool { return follow.FollowerID == userID }), query)
+}
+
+func (s *MemoryFollowStore) filter(match func(Follow) bool) []Follow {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	follows := []Follow{}
+	for _, id := range sortedIDs(s.follows) {
+		if follow := s.follows[id]; match(follow) {
+			follows = append(follows, follow)
+		}
+	}
+	return follows
+}
+
+type MemoryNotificationStore struct {
+	mu            sync.RWMutex
+	notifications map[int]Notification
+	nextID        int
+}
+
+func (s *MemoryNotificationStore) Create(notification *Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.insert(notification)
+	return nil
+}
+
+// insert stores a new notification; the caller holds s.mu
+func (s *MemoryNotificationStore) insert(notification *Notification) {
+	s.nextID++
+	notification.ID = s.nextID
+	if notification.CreatedAt.IsZero() {
+		notification.CreatedAt = time.Now()
+	}
+	if notification.UpdatedAt.IsZero() {
+		notification.UpdatedAt = notification.CreatedAt
+	}
+	s.notifications[notification.ID] = *notification
+}
+
+func (s *MemoryNotificationStore) Group(notification *Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if notification.GroupKey != "" {
+		for id, existing := range s.notifications {
+			if existing.UserID != notification.UserID || existing.GroupKey != notification.GroupKey || existing.IsRead {
+				continue
+			}
+			mergeNotificationActors(&existing, notification.ActorIDs)
+			existing.UpdatedAt = time.Now()
+			s.notifications[id] = existing
+			*notification = existing
+			return nil
+		}
+	}
+	s.insert(notification)
+	return nil
+}
+
+func (s *MemoryNotificationStore) GetByID(id int) (*Notification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	notification, ok := s.notifications[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &notification, nil
+}
+
+func (s *MemoryNotificationStore) MarkRead(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	notification, ok := s.notifications[id]
+	if !ok {
+		return ErrNotFound
+	}
+	notification.IsRead = true
+	s.notifications[id] = notification
+	return nil
+}
+
+func (s *MemoryNotificationStore) MarkAllRead(userID int, filter NotificationFilter) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var marked int64
+	for id, notification := range s.notifications {
+		if notification.UserID != userID || notification.IsRead || !filter.matches(notification) {
+			continue
+		}
+		notification.IsRead = true
+		s.notifications[id] = notification
+		marked++
+	}
+	return marked, nil
+}
+
+func (s *MemoryNotificationStore) CountUnread(userID int) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var unread int64
+	for _, notification := range s.notifications {
+		if notification.UserID == userID && !notification.IsRead {
+			unread++
+		}
+	}
+	return unread, nil
+}
+
+func (s *MemoryNotificationStore) Delete(userID, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if notification, ok := s.notifications[id]; !ok || notification.UserID != userID {
+		return ErrNotFound
+	}
+	delete(s.notifications, id)
+	return nil
+}
+
+func (s *MemoryNotificationStore) ListByUser(userID int, query ListQuery) ([]Notification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	notifications := []Notification{}
+	for _, id := range sortedIDs(s.notifications) {
+		if notification := s.notifications[id]; notification.UserID == userID {
+			notifications = append(notifications, notification)
+		}
+	}
+	return applyListQuery(notifications, query)
+}
+
+func (s *MemoryNotificationStore) ListUpdated(userID int, from, to time.Time) ([]Notification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	notifications := []Notification{}
+	for _, notification := range s.notifications {
+		if notification.UserID == userID && !notification.UpdatedAt.Before(from) && notification.UpdatedAt.Before(to) {
+			notifications = append(notifications, notification)
+		}
+	}
+	sort.Slice(notifications, func(i, j int) bool {
+		a, b := notifications[i], notifications[j]
+		if !a.UpdatedAt.Equal(b.UpdatedAt) {
+			return a.UpdatedAt.After(b.UpdatedAt)
+		}
+		return a.ID > b.ID
+	})
+	return notifications, nil
+}
+
+func (s *MemoryNotificationStore) UpdatedUsers(from, to time.Time) ([]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := map[int]bool{}
+	userIDs := []int{}
+	for _, id := range sortedIDs(s.notifications) {
+		notification := s.notifications[id]
+		if seen[notification.UserID] || notification.UpdatedAt.Before(from) || !notification.UpdatedAt.Before(to) {
+			continue
+		}
+		seen[notification.UserID] = true
+		userIDs = append(userIDs, notification.UserID)
+	}
+	sort.Ints(userIDs)
+	return userIDs, nil
+}
+
+type MemoryNotificationPreferenceStore struct {
+	mu          sync.RWMutex
+	preferences map[int]map[string]NotificationPreference
+}
+
+func (s *MemoryNotificationPreferenceStore) List(userID int) ([]NotificationPreference, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	preferences := []NotificationPreference{}
+	for _, preference := range s.preferences[userID] {
+		preferences = append(preferences, preference)
+	}
+	sort.Slice(preferences, func(i, j int) bool { return preferences[i].Type < preferences[j].Type })
+	return preferences, nil
+}
+
+func (s *MemoryNotificationPreferenceStore) Get(userID int, typ string) (*NotificationPreference, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	preference, ok := s.preferences[userID][typ]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &preference, nil
+}
+
+func (s *MemoryNotificationPreferenceStore) Save(preference *NotificationPreference) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.preferences[preference.UserID] == nil {
+		s.preferences[preference.UserID] = make(map[string]NotificationPreference)
+	}
+	s.preferences[preference.UserID][preference.Type] = *preference
+	return nil
+}
+
+func (s *MemoryNotificationPreferenceStore) DeleteByUser(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.preferences, userID)
+	return nil
+}
+
+type MemoryDigestStore struct {
+	mu            sync.RWMutex
+	subscriptions map[int]DigestSubscription
+	digests       map[int]Digest
+	nextID        int
+}
+
+func (s *MemoryDigestStore) GetSubscription(userID int) (*DigestSubscription, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	subscription, ok := s.subscriptions[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &subscription, nil
+}
+
+func (s *MemoryDigestStore) SaveSubscription(subscription *DigestSubscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.subscriptions[subscription.UserID] = *subscription
+	return nil
+}
+
+func (s *MemoryDigestStore) Claim(digest *Digest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, claimed := range s.digests {
+		if claimed.UserID == digest.UserID && claimed.PeriodEnd.Equal(digest.PeriodEnd) {
+			return ErrConflict
+		}
+	}
+	s.nextID++
+	digest.ID = s.nextID
+	if digest.CreatedAt.IsZero() {
+		digest.CreatedAt = time.Now()
+	}
+	s.digests[digest.ID] = *digest
+	return nil
+}
+
+func (s *MemoryDigestStore) MarkSent(id int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	digest, ok := s.digests[id]
+	if !ok {
+		return ErrNotFound
+	}
+	digest.SentAt = &at
+	s.digests[id] = digest
+	return nil
+}
+
+func (s *MemoryDigestStore) Release(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.digests[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.digests, id)
+	return nil
+}
+
+func (s *MemoryDigestStore) DeleteByUser(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.subscriptions, userID)
+	for id, digest := range s.digests {
+		if digest.UserID == userID {
+			delete(s.digests, id)
+		}
+	}
+	return nil
+}
+
+type MemoryWebhookStore struct {
+	mu             sync.RWMutex
+	webhooks       map[int]Webhook
+	deliveries     map[int]WebhookDelivery
+	nextID         int
+	nextDeliveryID int
+}
+
+func (s *MemoryWebhookStore) Create(webhook *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	webhook.ID = s.nextID
+	now := time.Now()
+	webhook.CreatedAt = now
+	webhook.UpdatedAt = now
+	s.webhooks[webhook.ID] = *webhook
+	return nil
+}
+
+func (s *MemoryWebhookStore) GetByID(id int) (*Webhook, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	webhook, ok := s.webhooks[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &webhook, nil
+}
+
+func (s *MemoryWebhookStore) Update(webhook *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.webhooks[webhook.ID]; !ok {
+		return ErrNotFound
+	}
+	webhook.UpdatedAt = time.Now()
+	s.webhooks[webhook.ID] = *webhook
+	return nil
+}
+
+func (s *MemoryWebhookStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.webhooks[id]; !ok {
+		return ErrNotFound
+	}
+	s.delete(id)
+	return nil
+}
+
+// delete removes webhook id with its deliveries; the caller holds mu
+func (s *MemoryWebhookStore) delete(id int) {
+	delete(s.webhooks, id)
+	for deliveryID, delivery := range s.deliveries {
+		if delivery.WebhookID == id {
+			delete(s.deliveries, deliveryID)
+		}
+	}
+}
+
+// list returns the webhooks matching keep in ascending id order
+func (s *MemoryWebhookStore) list(keep func(Webhook) bool) []Webhook {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	webhooks := []Webhook{}
+	for _, id := range sortedIDs(s.webhooks) {
+		if webhook := s.webhooks[id]; keep(webhook) {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	return webhooks
+}
+
+func (s *MemoryWebhookStore) ListByUser(userID int) ([]Webhook, error) {
+	return s.list(func(webhook Webhook) bool {
+		return webhook.UserID != nil && *webhook.UserID == userID
+	}), nil
+}
+
+func (s *MemoryWebhookStore) ListByCompany(companyID int) ([]Webhook, error) {
+	return s.list(func(webhook Webhook) bool {
+		return webhook.CompanyID != nil && *webhook.CompanyID == companyID
+	}), nil
+}
+
+func (s *MemoryWebhookStore) Subscribed(event string, userIDs, companyIDs []int) ([]Webhook, error) {
+	return s.list(func(webhook Webhook) bool {
+		if !webhook.Active || !contains(webhook.Events, event) {
+			return false
+		}
+		return (webhook.UserID != nil && containsInt(userIDs, *webhook.UserID)) ||
+			(webhook.CompanyID != nil && containsInt(companyIDs, *webhook.CompanyID))
+	}), nil
+}
+
+func (s *MemoryWebhookStore) DeleteByUser(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, webhook := range s.webhooks {
+		if webhook.UserID != nil && *webhook.UserID == userID {
+			s.delete(id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryWebhookStore) CreateDelivery(delivery *WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.webhooks[delivery.WebhookID]; !ok {
+		return ErrNotFound
+	}
+	s.nextDeliveryID++
+	delivery.ID = s.nextDeliveryID
+	if delivery.CreatedAt.IsZero() {
+		delivery.CreatedAt = time.Now()
+	}
+	s.deliveries[delivery.ID] = *delivery
+	return nil
+}
+
+func (s *MemoryWebhookStore) ListDeliveries(webhookID int, query ListQuery) ([]WebhookDelivery, error) {
+	s.mu.RLock()
+	deliveries := []WebhookDelivery{}
+	for _, delivery := range s.deliveries {
+		if delivery.WebhookID == webhookID {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	s.mu.RUnlock()
+	return applyListQuery(deliveries, query)
+}
+
+func (s *MemoryWebhookStore) ClaimDue(now, staleBefore time.Time, limit int) ([]WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	claimed := []WebhookDelivery{}
+	for _, id := range sortedIDs(s.deliveries) {
+		if len(claimed) == limit {
+			break
+		}
+		delivery := s.deliveries[id]
+		due := delivery.Status == DeliveryStatusPending && !delivery.NextAttemptAt.After(now)
+		stale := delivery.Status == DeliveryStatusDelivering && delivery.LastAttemptAt != nil && delivery.LastAttemptAt.Before(staleBefore)
+		if !due && !stale {
+			continue
+		}
+		delivery.Status = DeliveryStatusDelivering
+		delivery.LastAttemptAt = &now
+		s.deliveries[id] = delivery
+		claimed = append(claimed, delivery)
+	}
+	return claimed, nil
+}
+
+func (s *MemoryWebhookStore) UpdateDelivery(delivery *WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.deliveries[delivery.ID]; !ok {
+		return ErrNotFound
+	}
+	s.deliveries[delivery.ID] = *delivery
+	return nil
+}
+
+type MemoryCompanyStore struct {
+	mu        sync.RWMutex
+	companies map[uint]Company
+	nextID    uint
+	users     *MemoryUserStore
+}
+
+func (s *MemoryCompanyStore) Create(company *Company) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	company.ID = s.nextID
+	stored := *company
+	stored.Teams = nil
+	s.companies[company.ID] = stored
+	return nil
+}
+
+func (s *MemoryCompanyStore) GetByID(id uint) (*Company, error) {
+	s.mu.RLock()
+	company, ok := s.companies[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	company.Teams = publicUsers(s.users.byCompany(id))
+	return &company, nil
+}
+
+func (s *MemoryCompanyStore) Update(company *Company) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.companies[company.ID]; !ok {
+		return ErrNotFound
+	}
+	stored := *company
+	stored.Teams = nil
+	s.companies[company.ID] = stored
+	return nil
+}
+
+func (s *MemoryCompanyStore) Delete(id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.companies[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.companies, id)
+	return nil
+}
+
+type MemoryRoleStore struct {
+	mu               sync.RWMutex
+	roles            map[uint]Role
+	assignments      map[uint]UserRole
+	nextID           uint
+	nextAssignmentID uint
+}
+
+// NewMemoryRoleStore returns a role store seeded with the DefaultRoles
+func NewMemoryRoleStore() *MemoryRoleStore {
+	s := &MemoryRoleStore{roles: make(map[uint]Role), assignments: make(map[uint]UserRole)}
+	s.Seed()
+	return s
+}
+
+// copyRole detaches the permissions of role from the caller's slice
+func copyRole(role Role) Role {
+	role.Permissions = append([]Action{}, role.Permissions...)
+	return role
+}
+
+func (s *MemoryRoleStore) Create(role *Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.create(role)
+}
+
+func (s *MemoryRoleStore) create(role *Role) error {
+	for _, existing := range s.roles {
+		if existing.Name == role.Name {
+			return ErrConflict
+		}
+	}
+	s.nextID++
+	role.ID = s.nextID
+	role.CreatedAt = time.Now()
+	s.roles[role.ID] = copyRole(*role)
+	return nil
+}
+
+func (s *MemoryRoleStore) GetByID(id uint) (*Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	role, ok := s.roles[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	role = copyRole(role)
+	return &role, nil
+}
+
+func (s *MemoryRoleStore) GetByName(name string) (*Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, role := range s.roles {
+		if role.Name == name {
+			role = copyRole(role)
+			return &role, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryRoleStore) Update(role *Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.roles[role.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	existing.Description = role.Description
+	existing.Permissions = append([]Action{}, role.Permissions...)
+	s.roles[role.ID] = existing
+	return nil
+}
+
+func (s *MemoryRoleStore) Delete(id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.roles[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.roles, id)
+	for assignmentID, assignment := range s.assignments {
+		if assignment.RoleID == id {
+			delete(s.assignments, assignmentID)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryRoleStore) List(query ListQuery) ([]Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	roles := []Role{}
+	for _, id := range sortedIDs(s.roles) {
+		roles = append(roles, copyRole(s.roles[id]))
+	}
+	return applyListQuery(roles, query)
+}
+
+func (s *MemoryRoleStore) Permissions() ([]Permission, error) {
+	permissions := append([]Permission{}, Permissions...)
+	sort.Slice(permissions, func(i, j int) bool { return permissions[i].Name < permissions[j].Name })
+	return permissions, nil
+}
+
+func (s *MemoryRoleStore) Seed() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, role := range DefaultRoles {
+		if err := s.create(&role); err != nil && !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameScope reports whether two assignments apply to the same company
+func sameScope(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+func (s *MemoryRoleStore) Assign(assignment *UserRole) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	role, ok := s.roles[assignment.RoleID]
+	if !ok {
+		return ErrNotFound
+	}
+	for _, existing := range s.assignments {
+		if existing.UserID == assignment.UserID && existing.RoleID == assignment.RoleID &&
+			sameScope(existing.CompanyID, assignment.CompanyID) {
+			return ErrConflict
+		}
+	}
+	s.nextAssignmentID++
+	assignment.ID = s.nextAssignmentID
+	assignment.RoleName = role.Name
+	assignment.CreatedAt = time.Now()
+	s.assignments[assignment.ID] = *assignment
+	return nil
+}
+
+func (s *MemoryRoleStore) Unassign(userID int, roleID uint, companyID *int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, assignment := range s.assignments {
+		if assignment.UserID == userID && assignment.RoleID == roleID && sameScope(assignment.CompanyID, companyID) {
+			delete(s.assignments, id)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryRoleStore) Assignments(userID int) ([]UserRole, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	assignments := []UserRole{}
+	for _, id := range sortedIDs(s.assignments) {
+		if assignment := s.assignments[id]; assignment.UserID == userID {
+			assignment.RoleName = s.roles[assignment.RoleID].Name
+			assignments = append(assignments, assignment)
+		}
+	}
+	return assignments, nil
+}
+
+func (s *MemoryRoleStore) Grants(userID int) ([]Grant, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	grants := []Grant{}
+	for _, id := range sortedIDs(s.assignments) {
+		assignment := s.assignments[id]
+		if assignment.UserID != userID {
+			continue
+		}
+		for _, permission := range s.roles[assignment.RoleID].Permissions {
+			grants = append(grants, Grant{Permission: permission, CompanyID: assignment.CompanyID})
+		}
+	}
+	return grants, nil
+}
+
+type MemoryAnalyticsStore struct {
+	mu      sync.RWMutex
+	views   []PostView
+	metrics []EngagementMetrics
+}
+
+func (s *MemoryAnalyticsStore) RecordView(view *PostView) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	view.ID = len(s.views) + 1
+	s.views = append(s.views, *view)
+	return nil
+}
+
+func (s *MemoryAnalyticsStore) CountViews(postID int) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var count int64
+	for _, view := range s.views {
+		if view.PostID == postID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryAnalyticsStore) SaveMetrics(metrics *EngagementMetrics) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metrics = append(s.metrics, *metrics)
+	return nil
+}
+
+type MemoryRefreshTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]RefreshToken
+}
+
+func (s *MemoryRefreshTokenStore) Create(token *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = time.Now()
+	}
+	s.tokens[token.ID] = *token
+	return nil
+}
+
+func (s *MemoryRefreshTokenStore) Get(id string) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &token, nil
+}
+
+func (s *MemoryRefreshTokenStore) Claim(id string, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok || token.UsedAt != nil || token.RevokedAt != nil || !token.ExpiresAt.After(now) {
+		return false, nil
+	}
+	token.UsedAt = &now
+	s.tokens[id] = token
+	return true, nil
+}
+
+func (s *MemoryRefreshTokenStore) RevokeFamily(familyID string, at time.Time) error {
+	return s.revoke(func(token RefreshToken) bool { return token.FamilyID == familyID }, at)
+}
+
+func (s *MemoryRefreshTokenStore) RevokeUser(userID int, at time.Time) error {
+	return s.revoke(func(token RefreshToken) bool { return token.UserID == userID }, at)
+}
+
+func (s *MemoryRefreshTokenStore) revoke(match func(RefreshToken) bool, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, token := range s.tokens {
+		if token.RevokedAt == nil && match(token) {
+			token.RevokedAt = &at
+			s.tokens[id] = token
+		}
+	}
+	return nil
+}
+
+type MemoryPasswordResetStore struct {
+	mu     sync.Mutex
+	tokens map[int]PasswordResetToken
+	nextID int
+}
+
+func (s *MemoryPasswordResetStore) Create(token *PasswordResetToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	token.ID = s.nextID
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = time.Now()
+	}
+	s.tokens[token.ID] = *token
+	return nil
+}
+
+func (s *MemoryPasswordResetStore) Claim(hash string, now time.Time) (*PasswordResetToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, token := range s.tokens {
+		if token.TokenHash == hash && token.UsedAt == nil && token.ExpiresAt.After(now) {
+			token.UsedAt = &now
+			s.tokens[id] = token
+			return &token, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryPasswordResetStore) InvalidateUser(userID int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, token := range s.tokens {
+		if token.UserID == userID && token.UsedAt == nil {
+			token.UsedAt = &at
+			s.tokens[id] = token
+		}
+	}
+	return nil
+}
+
+func (s *MemoryPasswordResetStore) CountActive(userID int, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, token := range s.tokens {
+		if token.UserID == userID && token.UsedAt == nil && token.ExpiresAt.After(now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+type MemoryEmailVerificationStore struct {
+	mu     sync.Mutex
+	tokens map[int]EmailVerificationToken
+	nextID int
+}
+
+func (s *MemoryEmailVerificationStore) Create(token *EmailVerificationToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	token.ID = s.nextID
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = time.Now()
+	}
+	s.tokens[token.ID] = *token
+	return nil
+}
+
+func (s *MemoryEmailVerificationStore) Claim(hash string, now time.Time) (*EmailVerificationToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, token := range s.tokens {
+		if token.TokenHash == hash && token.UsedAt == nil && token.ExpiresAt.After(now) {
+			token.UsedAt = &now
+			s.tokens[id] = token
+			return &token, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+type MemoryTwoFactorStore struct {
+	mu          sync.Mutex
+	enrollments map[int]TwoFactor
+	codes       map[int]RecoveryCode
+	nextID      int
+}
+
+func (s *MemoryTwoFactorStore) Get(userID int) (*TwoFactor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	enrollment, ok := s.enrollments[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &enrollment, nil
+}
+
+func (s *MemoryTwoFactorStore) Save(tf *TwoFactor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.enrollments[tf.UserID]; ok {
+		tf.CreatedAt = existing.CreatedAt
+	} else {
+		tf.CreatedAt = time.Now()
+	}
+	s.enrollments[tf.UserID] = *tf
+	return nil
+}
+
+func (s *MemoryTwoFactorStore) Delete(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.enrollments, userID)
+	for id, code := range s.codes {
+		if code.UserID == userID {
+			delete(s.codes, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryTwoFactorStore) UseStep(userID int, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	enrollment, ok := s.enrollments[userID]
+	if !ok || enrollment.LastStep >= step {
+		return false, nil
+	}
+	enrollment.LastStep = step
+	s.enrollments[userID] = enrollment
+	return true, nil
+}
+
+func (s *MemoryTwoFactorStore) ReplaceRecoveryCodes(userID int, hashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, code := range s.codes {
+		if code.UserID == userID {
+			delete(s.codes, id)
+		}
+	}
+	for _, hash := range hashes {
+		s.nextID++
+		s.codes[s.nextID] = RecoveryCode{ID: s.nextID, UserID: userID, CodeHash: hash, CreatedAt: time.Now()}
+	}
+	return nil
+}
+
+func (s *MemoryTwoFactorStore) UseRecoveryCode(userID int, hash string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, code := range s.codes {
+		if code.UserID == userID && code.CodeHash == hash && code.UsedAt == nil {
+			code.UsedAt = &now
+			s.codes[id] = code
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *MemoryTwoFactorStore) RemainingRecoveryCodes(userID int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	remaining := 0
+	for _, code := range s.codes {
+		if code.UserID == userID && code.UsedAt == nil {
+			remaining++
+		}
+	}
+	return remaining, nil
+}
+
+type MemoryLoginThrottleStore struct {
+	mu        sync.Mutex
+	throttles map[string]LoginThrottle
+}
+
+func (s *MemoryLoginThrottleStore) Get(key string) (*LoginThrottle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	throttle, ok := s.throttles[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &throttle, nil
+}
+
+func (s *MemoryLoginThrottleStore) RecordFailure(key string, now time.Time, window time.Duration) (*LoginThrottle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	throttle, ok := s.throttles[key]
+	if !ok || !throttle.LastFailureAt.After(now.Add(-window)) {
+		throttle = LoginThrottle{Key: key}
+	}
+	throttle.Failures++
+	throttle.LastFailureAt = now
+	s.throttles[key] = throttle
+	return &throttle, nil
+}
+
+func (s *MemoryLoginThrottleStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.throttles, key)
+	return nil
+}
+
+type MemoryAuditStore struct {
+	mu     sync.RWMutex
+	events map[int]AuditEvent
+	nextID int
+}
+
+func (s *MemoryAuditStore) Record(event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	event.ID = s.nextID
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	s.events[event.ID] = *event
+	return nil
+}
+
+func (s *MemoryAuditStore) List(query ListQuery) ([]AuditEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	events := make([]AuditEvent, 0, len(s.events))
+	for _, id := range sortedIDs(s.events) {
+		events = append(events, s.events[id])
+	}
+	return applyListQuery(events, query)
+}
+
+type MemoryAccessTokenStore struct {
+	mu     sync.Mutex
+	tokens map[int]PersonalAccessToken
+	nextID int
+}
+
+func (s *MemoryAccessTokenStore) Create(token *PersonalAccessToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	token.ID = s.nextID
+	token.CreatedAt = time.Now()
+	s.tokens[token.ID] = *token
+	return nil
+}
+
+func (s *MemoryAccessTokenStore) GetByHash(hash string) (*PersonalAccessToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, token := range s.tokens {
+		if token.TokenHash == hash {
+			return &token, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryAccessTokenStore) ListByUser(userID int) ([]PersonalAccessToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens := []PersonalAccessToken{}
+	for _, id := range sortedIDs(s.tokens) {
+		if token := s.tokens[id]; token.UserID == userID && token.RevokedAt == nil {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+func (s *MemoryAccessTokenStore) Revoke(userID, id int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[id]
+	if !ok || token.UserID != userID || token.RevokedAt != nil {
+		return ErrNotFound
+	}
+	token.RevokedAt = &at
+	s.tokens[id] = token
+	return nil
+}
+
+func (s *MemoryAccessTokenStore) RevokeUser(userID int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, token := range s.tokens {
+		if token.UserID == userID && token.RevokedAt == nil {
+			token.RevokedAt = &at
+			s.tokens[id] = token
+		}
+	}
+	return nil
+}
+
+func (s *MemoryAccessTokenStore) Touch(id int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if token, ok := s.tokens[id]; ok {
+		token.LastUsedAt = &at
+		s.tokens[id] = token
+	}
+	return nil
+}
+
+type MemorySigningKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]SigningKey
+}
+
+func (s *MemorySigningKeyStore) Create(key *SigningKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[key.ID]; ok {
+		return ErrConflict
+	}
+	key.CreatedAt = time.Now()
+	s.keys[key.ID] = *key
+	return nil
+}
+
+func (s *MemorySigningKeyStore) List() ([]SigningKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]SigningKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+func (s *MemorySigningKeyStore) Retire(id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok || key.RetiredAt != nil {
+		return ErrNotFound
+	}
+	key.RetiredAt = &at
+	s.keys[id] = key
+	return nil
+}
+
+type MemoryIdentityStore struct {
+	mu         sync.Mutex
+	identities map[int]Identity
+	nextID     int
+}
+
+func (s *MemoryIdentityStore) Create(identity *Identity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.identities {
+		if existing.Provider == identity.Provider && existing.Subject == identity.Subject {
+			return ErrConflict
+		}
+	}
+	s.nextID++
+	identity.ID = s.nextID
+	identity.CreatedAt = time.Now()
+	s.identities[identity.ID] = *identity
+	return nil
+}
+
+func (s *MemoryIdentityStore) Get(provider, subject string) (*Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, identity := range s.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return &identity, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryIdentityStore) ListByUser(userID int) ([]Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	identities := []Identity{}
+	for _, id := range sortedIDs(s.identities) {
+		if identity := s.identities[id]; identity.UserID == userID {
+			identities = append(identities, identity)
+		}
+	}
+	return identities, nil
+}
+
+func (s *MemoryIdentityStore) Delete(userID, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if identity, ok := s.identities[id]; !ok || identity.UserID != userID {
+		return ErrNotFound
+	}
+	delete(s.identities, id)
+	return nil
+}
+
+type MemoryOAuthStateStore struct {
+	mu     sync.Mutex
+	states map[string]OAuthState
+}
+
+func (s *MemoryOAuthStateStore) Create(state *OAuthState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop sign-ins that were abandoned
+	now := time.Now()
+	for hash, existing := range s.states {
+		if existing.ExpiresAt.Before(now) {
+			delete(s.states, hash)
+		}
+	}
+	state.CreatedAt = now
+	s.states[state.StateHash] = *state
+	return nil
+}
+
+func (s *MemoryOAuthStateStore) Consume(stateHash string) (*OAuthState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.states[stateHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	delete(s.states, stateHash)
+	return &state, nil
+}
+
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+func (s *MemorySessionStore) Create(session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.sessions[session.ID]; ok {
+		return ErrConflict
+	}
+	session.CreatedAt = time.Now()
+	s.sessions[session.ID] = *session
+	return nil
+}
+
+func (s *MemorySessionStore) ListByUser(userID int, seenSince time.Time) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := []Session{}
+	for _, session := range s.sessions {
+		if session.UserID == userID && session.RevokedAt == nil && session.LastSeenAt.After(seenSince) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastSeenAt.Equal(sessions[j].LastSeenAt) {
+			return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions, nil
+}
+
+func (s *MemorySessionStore) Revoke(userID int, id string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || session.UserID != userID || session.RevokedAt != nil {
+		return ErrNotFound
+	}
+	session.RevokedAt = &at
+	s.sessions[id] = session
+	return nil
+}
+
+func (s *MemorySessionStore) RevokeOthers(userID int, keep string, at time.Time) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revoked := []string{}
+	for id, session := range s.sessions {
+		if session.UserID == userID && id != keep && session.RevokedAt == nil {
+			session.RevokedAt = &at
+			s.sessions[id] = session
+			revoked = append(revoked, id)
+		}
+	}
+	sort.Strings(revoked)
+	return revoked, nil
+}
+
+func (s *MemorySessionStore) Touch(seen map[string]time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, at := range seen {
+		if session, ok := s.sessions[id]; ok && at.After(session.LastSeenAt) {
+			session.LastSeenAt = at
+			s.sessions[id] = session
+		}
+	}
+	return nil
+}
+
+// MemoryAccountStore reaches into the memory stores it was built with. It
+// locks them one at a time, so an erasure is not atomic.
+type MemoryAccountStore struct {
+	users         *MemoryUserStore
+	posts         *MemoryPostStore
+	engagements   *MemoryEngagementStore
+	follows       *MemoryFollowStore
+	notifications *MemoryNotificationStore
+	analytics     *MemoryAnalyticsStore
+	timelines     *MemoryTimelineStore
+}
+
+func (s *MemoryAccountStore) Collect(userID int) (*PersonalData, error) {
+	data := &PersonalData{
+		Posts:         []Post{},
+		Engagements:   []Engagement{},
+		Notifications: []Notification{},
+		PostViews:     []PostView{},
+	}
+
+	s.posts.mu.RLock()
+	for _, id := range sortedIDs(s.posts.posts) {
+		if post := s.posts.posts[id]; post.UserID == userID {
+			data.Posts = append(data.Posts, post)
+		}
+	}
+	s.posts.mu.RUnlock()
+
+	s.engagements.mu.RLock()
+	for _, id := range sortedIDs(s.engagements.engagements) {
+		if engagement := s.engagements.engagements[id]; engagement.UserID == userID {
+			data.Engagements = append(data.Engagements, engagement)
+		}
+	}
+	s.engagements.mu.RUnlock()
+
+	data.Followers = s.follows.filter(func(follow Follow) bool { return follow.FollowingID == userID })
+	data.Followings = s.follows.filter(func(follow Follow) bool { return follow.FollowerID == userID })
+
+	s.notifications.mu.RLock()
+	for _, id := range sortedIDs(s.notifications.notifications) {
+		if notification := s.notifications.notifications[id]; notification.UserID == userID {
+			data.Notifications = append(data.Notifications, notification)
+		}
+	}
+	s.notifications.mu.RUnlock()
+
+	s.analytics.mu.RLock()
+	for _, view := range s.analytics.views {
+		if view.UserID == userID {
+			data.PostViews = append(data.PostViews, view)
+		}
+	}
+	s.analytics.mu.RUnlock()
+
+	return data, nil
+}
+
+func (s *MemoryAccountStore) DueForDeletion(now time.Time) ([]User, error) {
+	s.users.mu.RLock()
+	defer s.users.mu.RUnlock()
+
+	users := []User{}
+	for _, id := range sortedIDs(s.users.users) {
+		if user := s.users.users[id]; user.DeleteAfter != nil && user.DeleteAfter.Before(now) {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (s *MemoryAccountStore) Erase(userID int, anonymize bool) error {
+	// Posts that go away take the engagements and views they received along
+	removed := map[int]bool{}
+	s.posts.mu.Lock()
+	for id, post := range s.posts.posts {
+		if post.UserID == userID && (!anonymize || post.Status != PostStatusPublished) {
+			removed[id] = true
+			delete(s.posts.posts, id)
+		}
+	}
+	s.posts.mu.Unlock()
+
+	if !anonymize {
+		s.engagements.mu.Lock()
+		for id, engagement := range s.engagements.engagements {
+			if engagement.UserID == userID || removed[engagement.PostID] {
+				delete(s.engagements.engagements, id)
+			}
+		}
+		s.engagements.mu.Unlock()
+	}
+
+	s.analytics.mu.Lock()
+	views := s.analytics.views[:0]
+	for _, view := range s.analytics.views {
+		if removed[view.PostID] || (!anonymize && view.UserID == userID) {
+			continue
+		}
+		if view.UserID == userID {
+			view.UserID = 0
+		}
+		views = append(views, view)
+	}
+	s.analytics.views = views
+	metrics := s.analytics.metrics[:0]
+	for _, metric := range s.analytics.metrics {
+		if !removed[metric.PostID] {
+			metrics = append(metrics, metric)
+		}
+	}
+	s.analytics.metrics = metrics
+	s.analytics.mu.Unlock()
+
+	s.follows.mu.Lock()
+	for id, follow := range s.follows.follows {
+		if follow.FollowerID == userID || follow.FollowingID == userID {
+			delete(s.follows.follows, id)
+		}
+	}
+	s.follows.mu.Unlock()
+
+	s.timelines.mu.Lock()
+	delete(s.timelines.entries, userID)
+	s.timelines.mu.Unlock()
+
+	s.notifications.mu.Lock()
+	for id, notification := range s.notifications.notifications {
+		if notification.UserID == userID || (notification.PostID != nil && removed[*notification.PostID]) {
+			delete(s.notifications.notifications, id)
+		}
+	}
+	s.notifications.mu.Unlock()
+
+	s.users.mu.Lock()
+	defer s.users.mu.Unlock()
+	user, ok := s.users.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	if anonymize {
+		s.users.users[userID] = anonymizedUser(user, time.Now())
+	} else {
+		delete(s.users.users, userID)
+	}
+	return nil
+}
+
+type MemoryAccountExportStore struct {
+	mu      sync.Mutex
+	exports map[int]AccountExport
+	nextID  int
+}
+
+func (s *MemoryAccountExportStore) Create(export *AccountExport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	export.ID = s.nextID
+	export.CreatedAt = time.Now()
+	s.exports[export.ID] = *export
+	return nil
+}
+
+func (s *MemoryAccountExportStore) Latest(userID int) (*AccountExport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := sortedIDs(s.exports)
+	for i := len(ids) - 1; i >= 0; i-- {
+		if export := s.exports[ids[i]]; export.UserID == userID {
+			return &export, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryAccountExportStore) ClaimPending(now, staleBefore time.Time, limit int) ([]AccountExport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	claimed := []AccountExport{}
+	for _, id := range sortedIDs(s.exports) {
+		if len(claimed) == limit {
+			break
+		}
+		export := s.exports[id]
+		stale := export.Status == ExportStatusRunning && export.StartedAt != nil && export.StartedAt.Before(staleBefore)
+		if export.Status != ExportStatusPending && !stale {
+			continue
+		}
+		export.Status = ExportStatusRunning
+		export.StartedAt = &now
+		s.exports[id] = export
+		claimed = append(claimed, export)
+	}
+	return claimed, nil
+}
+
+func (s *MemoryAccountExportStore) Update(export *AccountExport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.exports[export.ID]; !ok {
+		return ErrNotFound
+	}
+	s.exports[export.ID] = *export
+	return nil
+}
+
+func (s *MemoryAccountExportStore) DeleteExpired(now time.Time) ([]AccountExport, error) {
+	return s.deleteWhere(func(export AccountExport) bool {
+		return export.ExpiresAt != nil && export.ExpiresAt.Before(now)
+	}), nil
+}
+
+func (s *MemoryAccountExportStore) DeleteByUser(userID int) ([]AccountExport, error) {
+	return s.deleteWhere(func(export AccountExport) bool { return export.UserID == userID }), nil
+}
+
+func (s *MemoryAccountExportStore) deleteWhere(match func(AccountExport) bool) []AccountExport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := []AccountExport{}
+	for _, id := range sortedIDs(s.exports) {
+		if export := s.exports[id]; match(export) {
+			deleted = append(deleted, export)
+			delete(s.exports, id)
+		}
+	}
+	return deleted
+}
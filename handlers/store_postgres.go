@@ -0,0 +1,1463 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// NewPostgresStores returns stores backed by the PostgreSQL database behind db
+func NewPostgresStores(db *gorm.DB) *Stores {
+	signingKeys := &PostgresSigningKeyStore{db: db}
+	sessions := &PostgresSessionStore{db: db}
+	return &Stores{
+		Users:                   &PostgresUserStore{db: db},
+		Posts:                   &PostgresPostStore{db: db},
+		Engagements:             &PostgresEngagementStore{db: db},
+		Follows:                 &PostgresFollowStore{db: db},
+		Notifications:           &PostgresNotificationStore{db: db},
+		Companies:               &PostgresCompanyStore{db: db},
+		Roles:                   &PostgresRoleStore{db: db},
+		Analytics:               &PostgresAnalyticsStore{db: db},
+		Timelines:               &PostgresTimelineStore{db: db},
+		RefreshTokens:           &PostgresRefreshTokenStore{db: db},
+		Revocations:             NewPostgresRevocationStore(db),
+		PasswordResets:          &PostgresPasswordResetStore{db: db},
+		EmailVerifications:      &PostgresEmailVerificationStore{db: db},
+		TwoFactor:               &PostgresTwoFactorStore{db: db},
+		LoginThrottles:          &PostgresLoginThrottleStore{db: db},
+		Audit:                   &PostgresAuditStore{db: db},
+		AccessTokens:            &PostgresAccessTokenStore{db: db},
+		SigningKeys:             signingKeys,
+		Identities:              &PostgresIdentityStore{db: db},
+		OAuthStates:             &PostgresOAuthStateStore{db: db},
+		Sessions:                sessions,
+		SessionActivity:         NewSessionActivity(sessions),
+		Accounts:                &PostgresAccountStore{db: db},
+		AccountExports:          &PostgresAccountExportStore{db: db},
+		Keys:                    NewKeyring(signingKeys),
+		Broker:                  NewMemoryBroker(),
+		NotificationPreferences: &PostgresNotificationPreferenceStore{db: db},
+		Digests:                 &PostgresDigestStore{db: db},
+		Webhooks:                &PostgresWebhookStore{db: db},
+	}
+}
+
+// notFound maps gorm's missing-record error to ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// conflict maps a unique constraint violation to ErrConflict
+func conflict(err error) error {
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) && pgErr.SQLState() == "23505" {
+		return ErrConflict
+	}
+	return err
+}
+
+// deleteByID deletes the record of model with the given primary key and
+// reports ErrNotFound when there was none
+func deleteByID(db *gorm.DB, model interface{}, id interface{}) error {
+	result := db.Delete(model, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// listScope applies query to db, which selects rows of modelType. Column
+// names are checked against its db tags before they reach the SQL.
+func listScope(db *gorm.DB, modelType reflect.Type, query ListQuery) (*gorm.DB, error) {
+	column := query.sortColumn()
+	if _, ok := columnField(modelType, column); !ok {
+		return nil, fmt.Errorf("unknown sort column %q", column)
+	}
+
+	for name, value := range query.Filters {
+		if _, ok := columnField(modelType, name); !ok {
+			return nil, fmt.Errorf("unknown filter column %q", name)
+		}
+		db = db.Where(quoteColumn(name)+" = ?", value)
+	}
+
+	direction, after := " ASC", " > "
+	if query.Desc {
+		direction, after = " DESC", " < "
+	}
+	if query.After != nil {
+		if column == "id" {
+			db = db.Where(`"id"`+after+"?", query.After.ID)
+		} else {
+			value, err := cursorValue(modelType, query.After)
+			if err != nil {
+				return nil, err
+			}
+			db = db.Where("("+quoteColumn(column)+`, "id")`+after+"(?, ?)", value, query.After.ID)
+		}
+	}
+
+	db = db.Order(quoteColumn(column) + direction)
+	if column != "id" {
+		db = db.Order(`"id"` + direction)
+	}
+	if query.Limit > 0 {
+		db = db.Limit(query.Limit)
+	}
+	return db, nil
+}
+
+// quoteColumn quotes a column name, some of which ("like") are keywords
+func quoteColumn(column string) string {
+	return `"` + column + `"`
+}
+
+// findList runs query on db and stores the rows in dest, a pointer to a
+// slice of models
+func findList(db *gorm.DB, dest interface{}, query ListQuery) error {
+	scoped, err := listScope(db, reflect.TypeOf(dest).Elem().Elem(), query)
+	if err != nil {
+		return err
+	}
+	return scoped.Find(dest).Error
+}
+
+type PostgresUserStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresUserStore) Create(user *User) error {
+	user.Email = NormalizeEmail(user.Email)
+	return conflict(s.db.Create(user).Error)
+}
+
+func (s *PostgresUserStore) GetByID(id int) (*User, error) {
+	var user User
+	if err := s.db.First(&user, id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (s *PostgresUserStore) GetByUsername(username string) (*User, error) {
+	var user User
+	if err := s.db.Where("username = ?", username).First(&user).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (s *PostgresUserStore) GetByEmail(email string) (*User, error) {
+	var user User
+	if err := s.db.Where("email = ? AND email <> ''", NormalizeEmail(email)).First(&user).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (s *PostgresUserStore) Update(user *User) error {
+	user.Email = NormalizeEmail(user.Email)
+	return conflict(s.db.Omit("CreatedAt").Save(user).Error)
+}
+
+func (s *PostgresUserStore) Search(keyword string, query ListQuery) ([]User, error) {
+	var users []User
+	err := findList(s.db.Where("username LIKE ?", "%"+keyword+"%"), &users, query)
+	return users, err
+}
+
+type PostgresPostStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresPostStore) Create(post *Post) error {
+	// IDs come from the sequence, never from the caller
+	post.ID = 0
+	setPublishDefaults(post)
+	return s.db.Create(post).Error
+}
+
+func (s *PostgresPostStore) GetByID(id int) (*Post, error) {
+	var post Post
+	if err := s.db.First(&post, id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &post, nil
+}
+
+func (s *PostgresPostStore) Update(post *Post) error {
+	return s.db.Omit("Status", "PublishedAt").Save(post).Error
+}
+
+func (s *PostgresPostStore) Delete(id int) error {
+	return deleteByID(s.db, &Post{}, id)
+}
+
+func (s *PostgresPostStore) List(query ListQuery) ([]Post, error) {
+	var posts []Post
+	err := findList(s.db.Where("status = ?", PostStatusPublished), &posts, query)
+	return posts, err
+}
+
+func (s *PostgresPostStore) Search(keyword string, query ListQuery) ([]Post, error) {
+	var posts []Post
+	err := findList(s.db.Where("status = ? AND content LIKE ?", PostStatusPublished, "%"+keyword+"%"), &posts, query)
+	return posts, err
+}
+
+func (s *PostgresPostStore) ListScheduled(userID int, query ListQuery) ([]Post, error) {
+	var posts []Post
+	err := findList(s.db.Where("user_id = ? AND status = ?", userID, PostStatusScheduled), &posts, query)
+	return posts, err
+}
+
+func (s *PostgresPostStore) Reschedule(id int, at time.Time) error {
+	result := s.db.Model(&Post{}).
+		Where("id = ? AND status = ?", id, PostStatusScheduled).
+		Update("schedule_time", at)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresPostStore) CancelScheduled(id int) error {
+	return deleteByID(s.db.Where("status = ?", PostStatusScheduled), &Post{}, id)
+}
+
+func (s *PostgresPostStore) PublishDue(now time.Time, limit int) ([]Post, error) {
+	// SKIP LOCKED hands each concurrent publisher a disjoint batch, and the
+	// status check is re-evaluated on the locked rows so a post cancelled or
+	// published in the meantime is left alone
+	var posts []Post
+	err := s.db.Raw(`UPDATE posts SET status = ?, published_at = schedule_time
+		WHERE id IN (
+			SELECT id FROM posts
+			WHERE status = ? AND schedule_time <= ?
+			ORDER BY schedule_time
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`, PostStatusPublished, PostStatusScheduled, now, limit).
+		Scan(&posts).
+		Error
+	return posts, err
+}
+
+type PostgresEngagementStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresEngagementStore) Create(engagement *Engagement) error {
+	return s.db.Create(engagement).Error
+}
+
+func (s *PostgresEngagementStore) GetByID(id int) (*Engagement, error) {
+	var engagement Engagement
+	if err := s.db.First(&engagement, id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &engagement, nil
+}
+
+func (s *PostgresEngagementStore) Update(engagement *Engagement) error {
+	return s.db.Save(engagement).Error
+}
+
+func (s *PostgresEngagementStore) Delete(id int) error {
+	return deleteByID(s.db, &Engagement{}, id)
+}
+
+func (s *PostgresEngagementStore) ListByPost(postID int, query ListQuery) ([]Engagement, error) {
+	var engagements []Engagement
+	err := findList(s.db.Where("post_id = ?", postID), &engagements, query)
+	return engagements, err
+}
+
+func (s *PostgresEngagementStore) CountLikes(postID int) (int64, error) {
+	var count int64
+	err := s.db.Model(&Engagement{}).
+		Where("post_id = ? AND \"like\" = true", postID).
+		Count(&count).
+		Error
+	return count, err
+}
+
+func (s *PostgresEngagementStore) CountComments(postID int) (int64, error) {
+	var count int64
+	err := s.db.Model(&Engagement{}).
+		Where("post_id = ? AND comment IS NOT NULL AND comment <> ''", postID).
+		Count(&count).
+		Error
+	return count, err
+}
+
+type PostgresFollowStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresFollowStore) Create(follow *Follow) error {
+	return conflict(s.db.Create(follow).Error)
+}
+
+func (s *PostgresFollowStore) Get(followerID, followingID int) (*Follow, error) {
+	var follow Follow
+	err := s.db.Where("follower_id = ? AND following_id = ?", followerID, followingID).First(&follow).Error
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &follow, nil
+}
+
+func (s *PostgresFollowStore) Delete(id int) error {
+	return deleteByID(s.db, &Follow{}, id)
+}
+
+func (s *PostgresFollowStore) ListFollowers(userID int, query ListQuery) ([]Follow, error) {
+	var followers []Follow
+	err := findList(s.db.Where("following_id = ?", userID), &followers, query)
+	return followers, err
+}
+
+func (s *PostgresFollowStore) ListFollowings(userID int, query ListQuery) ([]Follow, error) {
+	var followings []Follow
+	err := findList(s.db.Where("follower_id = ?", userID), &followings, query)
+	return followings, err
+}
+
+type PostgresNotificationStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresNotificationStore) Create(notification *Notification) error {
+	return s.db.Create(notification).Error
+}
+
+func (s *PostgresNotificationStore) Group(notification *Notification) error {
+	if notification.GroupKey == "" {
+		return s.Create(notification)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			var existing Notification
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				Where("user_id = ? AND group_key = ? AND is_read IS NOT TRUE", notification.UserID, notification.GroupKey).
+				First(&existing).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return tx.Create(notification).Error
+			}
+			if err != nil {
+				return err
+			}
+			mergeNotificationActors(&existing, notification.ActorIDs)
+			if err := tx.Save(&existing).Error; err != nil {
+				return err
+			}
+			*notification = existing
+			return nil
+		})
+		// The unique index on unread groups lets one of two concurrent first
+		// events create the group; the other joins it on the next attempt
+		if err = conflict(err); errors.Is(err, ErrConflict) && attempt == 0 {
+			notification.ID = 0
+			continue
+		}
+		return err
+	}
+}
+
+func (s *PostgresNotificationStore) GetByID(id int) (*Notification, error) {
+	var notification Notification
+	if err := s.db.First(&notification, id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &notification, nil
+}
+
+func (s *PostgresNotificationStore) MarkRead(id int) error {
+	result := s.db.Model(&Notification{}).Where("id = ?", id).Update("is_read", true)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresNotificationStore) MarkAllRead(userID int, filter NotificationFilter) (int64, error) {
+	query := s.db.Model(&Notification{}).Where("user_id = ? AND is_read IS NOT TRUE", userID)
+	if filter.Type != "" {
+		query = query.Where("type = ?", filter.Type)
+	}
+	if filter.Before != nil {
+		query = query.Where("updated_at < ?", *filter.Before)
+	}
+	result := query.Update("is_read", true)
+	return result.RowsAffected, result.Error
+}
+
+func (s *PostgresNotificationStore) CountUnread(userID int) (int64, error) {
+	var unread int64
+	err := s.db.Model(&Notification{}).Where("user_id = ? AND is_read IS NOT TRUE", userID).Count(&unread).Error
+	return unread, err
+}
+
+func (s *PostgresNotificationStore) Delete(userID, id int) error {
+	return deleteByID(s.db.Where("user_id = ?", userID), &Notification{}, id)
+}
+
+func (s *PostgresNotificationStore) ListByUser(userID int, query ListQuery) ([]Notification, error) {
+	var notifications []Notification
+	err := findList(s.db.Where("user_id = ?", userID), &notifications, query)
+	return notifications, err
+}
+
+func (s *PostgresNotificationStore) ListUpdated(userID int, from, to time.Time) ([]Notification, error) {
+	notifications := []Notification{}
+	err := s.db.Where("user_id = ? AND updated_at >= ? AND updated_at < ?", userID, from, to).
+		Order("updated_at DESC, id DESC").Find(&notifications).Error
+	return notifications, err
+}
+
+func (s *PostgresNotificationStore) UpdatedUsers(from, to time.Time) ([]int, error) {
+	userIDs := []int{}
+	err := s.db.Model(&Notification{}).Where("updated_at >= ? AND updated_at < ?", from, to).
+		Distinct().Order("user_id").Pluck("user_id", &userIDs).Error
+	return userIDs, err
+}
+
+type PostgresNotificationPreferenceStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresNotificationPreferenceStore) List(userID int) ([]NotificationPreference, error) {
+	preferences := []NotificationPreference{}
+	err := s.db.Where("user_id = ?", userID).Order("type").Find(&preferences).Error
+	return preferences, err
+}
+
+func (s *PostgresNotificationPreferenceStore) Get(userID int, typ string) (*NotificationPreference, error) {
+	var preference NotificationPreference
+	if err := s.db.Where("user_id = ? AND type = ?", userID, typ).First(&preference).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &preference, nil
+}
+
+func (s *PostgresNotificationPreferenceStore) Save(preference *NotificationPreference) error {
+	return s.db.Save(preference).Error
+}
+
+func (s *PostgresNotificationPreferenceStore) DeleteByUser(userID int) error {
+	return s.db.Where("user_id = ?", userID).Delete(&NotificationPreference{}).Error
+}
+
+type PostgresDigestStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresDigestStore) GetSubscription(userID int) (*DigestSubscription, error) {
+	var subscription DigestSubscription
+	if err := s.db.Where("user_id = ?", userID).First(&subscription).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &subscription, nil
+}
+
+func (s *PostgresDigestStore) SaveSubscription(subscription *DigestSubscription) error {
+	return s.db.Save(subscription).Error
+}
+
+// Claim relies on the unique index on user_id and period_end
+func (s *PostgresDigestStore) Claim(digest *Digest) error {
+	return conflict(s.db.Create(digest).Error)
+}
+
+func (s *PostgresDigestStore) MarkSent(id int, at time.Time) error {
+	result := s.db.Model(&Digest{}).Where("id = ?", id).Update("sent_at", at)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresDigestStore) Release(id int) error {
+	return deleteByID(s.db, &Digest{}, id)
+}
+
+func (s *PostgresDigestStore) DeleteByUser(userID int) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&Digest{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&DigestSubscription{}).Error
+	})
+}
+
+type PostgresWebhookStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresWebhookStore) Create(webhook *Webhook) error {
+	return s.db.Create(webhook).Error
+}
+
+func (s *PostgresWebhookStore) GetByID(id int) (*Webhook, error) {
+	var webhook Webhook
+	if err := s.db.First(&webhook, id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &webhook, nil
+}
+
+func (s *PostgresWebhookStore) Update(webhook *Webhook) error {
+	return s.db.Omit("CreatedAt").Save(webhook).Error
+}
+
+// Delete relies on the cascade to remove the deliveries
+func (s *PostgresWebhookStore) Delete(id int) error {
+	return deleteByID(s.db, &Webhook{}, id)
+}
+
+func (s *PostgresWebhookStore) ListByUser(userID int) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	err := s.db.Where("user_id = ?", userID).Order("id").Find(&webhooks).Error
+	return webhooks, err
+}
+
+func (s *PostgresWebhookStore) ListByCompany(companyID int) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	err := s.db.Where("company_id = ?", companyID).Order("id").Find(&webhooks).Error
+	return webhooks, err
+}
+
+func (s *PostgresWebhookStore) Subscribed(event string, userIDs, companyIDs []int) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	if len(userIDs) == 0 && len(companyIDs) == 0 {
+		return webhooks, nil
+	}
+	events, err := json.Marshal([]string{event})
+	if err != nil {
+		return nil, err
+	}
+	// An empty IN () is a syntax error, a list holding only 0 matches nothing
+	err = s.db.Where("active AND events @> ?::jsonb", string(events)).
+		Where("user_id IN ? OR company_id IN ?", append([]int{0}, userIDs...), append([]int{0}, companyIDs...)).
+		Order("id").Find(&webhooks).Error
+	return webhooks, err
+}
+
+func (s *PostgresWebhookStore) DeleteByUser(userID int) error {
+	return s.db.Where("user_id = ?", userID).Delete(&Webhook{}).Error
+}
+
+func (s *PostgresWebhookStore) CreateDelivery(delivery *WebhookDelivery) error {
+	return s.db.Create(delivery).Error
+}
+
+func (s *PostgresWebhookStore) ListDeliveries(webhookID int, query ListQuery) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	err := findList(s.db.Where("webhook_id = ?", webhookID), &deliveries, query)
+	return deliveries, err
+}
+
+func (s *PostgresWebhookStore) ClaimDue(now, staleBefore time.Time, limit int) ([]WebhookDelivery, error) {
+	// SKIP LOCKED lets several workers claim disjoint batches
+	deliveries := []WebhookDelivery{}
+	err := s.db.Raw(`UPDATE webhook_deliveries SET status = ?, last_attempt_at = ?
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE (status = ? AND next_attempt_at <= ?) OR (status = ? AND last_attempt_at < ?)
+			ORDER BY id
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		DeliveryStatusDelivering, now, DeliveryStatusPending, now, DeliveryStatusDelivering, staleBefore, limit,
+	).Scan(&deliveries).Error
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID < deliveries[j].ID })
+	return deliveries, err
+}
+
+func (s *PostgresWebhookStore) UpdateDelivery(delivery *WebhookDelivery) error {
+	return s.db.Omit("CreatedAt").Save(delivery).Error
+}
+
+// PostgresCompanyStore never writes Teams: membership is owned by the users
+type PostgresCompanyStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresCompanyStore) Create(company *Company) error {
+	company.ID = 0
+	return s.db.Omit("Teams").Create(company).Error
+}
+
+func (s *PostgresCompanyStore) GetByID(id uint) (*Company, error) {
+	var company Company
+	if err := s.db.Preload("Teams").First(&company, id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &company, nil
+}
+
+func (s *PostgresCompanyStore) Update(company *Company) error {
+	return s.db.Omit("Teams").Save(company).Error
+}
+
+func (s *PostgresCompanyStore) Delete(id uint) error {
+	return deleteByID(s.db, &Company{}, id)
+}
+
+type PostgresRoleStore struct {
+	db *gorm.DB
+}
+
+// loadPermissions sets the Permissions of every role in roles
+func (s *PostgresRoleStore) loadPermissions(roles []Role) error {
+	if len(roles) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(roles))
+	for i, role := range roles {
+		ids[i] = role.ID
+	}
+	var grants []RolePermission
+	if err := s.db.Where("role_id IN ?", ids).Order("permission").Find(&grants).Error; err != nil {
+		return err
+	}
+	for i := range roles {
+		roles[i].Permissions = []Action{}
+		for _, grant := range grants {
+			if grant.RoleID == roles[i].ID {
+				roles[i].Permissions = append(roles[i].Permissions, grant.Permission)
+			}
+		}
+	}
+	return nil
+}
+
+// setPermissions replaces the permissions of roleID within tx
+func setPermissions(tx *gorm.DB, roleID uint, permissions []Action) error {
+	if err := tx.Where("role_id = ?", roleID).Delete(&RolePermission{}).Error; err != nil {
+		return err
+	}
+	if len(permissions) == 0 {
+		return nil
+	}
+	grants := make([]RolePermission, len(permissions))
+	for i, permission := range permissions {
+		grants[i] = RolePermission{RoleID: roleID, Permission: permission}
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&grants).Error
+}
+
+// createRole inserts role within tx unless its name is taken
+func createRole(tx *gorm.DB, role *Role) error {
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(role)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrConflict
+	}
+	return setPermissions(tx, role.ID, role.Permissions)
+}
+
+func (s *PostgresRoleStore) Create(role *Role) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return createRole(tx, role)
+	})
+}
+
+func (s *PostgresRoleStore) find(where ...interface{}) (*Role, error) {
+	var role Role
+	if err := s.db.Where(where[0], where[1:]...).First(&role).Error; err != nil {
+		return nil, notFound(err)
+	}
+	roles := []Role{role}
+	if err := s.loadPermissions(roles); err != nil {
+		return nil, err
+	}
+	return &roles[0], nil
+}
+
+func (s *PostgresRoleStore) GetByID(id uint) (*Role, error) {
+	return s.find("id = ?", id)
+}
+
+func (s *PostgresRoleStore) GetByName(name string) (*Role, error) {
+	return s.find("name = ?", name)
+}
+
+func (s *PostgresRoleStore) Update(role *Role) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Role{}).Where("id = ?", role.ID).Update("description", role.Description)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return setPermissions(tx, role.ID, role.Permissions)
+	})
+}
+
+func (s *PostgresRoleStore) Delete(id uint) error {
+	return deleteByID(s.db, &Role{}, id)
+}
+
+func (s *PostgresRoleStore) List(query ListQuery) ([]Role, error) {
+	var roles []Role
+	if err := findList(s.db, &roles, query); err != nil {
+		return nil, err
+	}
+	return roles, s.loadPermissions(roles)
+}
+
+func (s *PostgresRoleStore) Permissions() ([]Permission, error) {
+	var permissions []Permission
+	err := s.db.Order("name").Find(&permissions).Error
+	return permissions, err
+}
+
+func (s *PostgresRoleStore) Seed() error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		catalogue := clause.OnConflict{
+			Columns:   []clause.Column{{Name: "name"}},
+			DoUpdates: clause.AssignmentColumns([]string{"description"}),
+		}
+		if err := tx.Clauses(catalogue).Create(&Permissions).Error; err != nil {
+			return err
+		}
+		for _, role := range DefaultRoles {
+			if err := createRole(tx, &role); err != nil && !errors.Is(err, ErrConflict) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *PostgresRoleStore) Assign(assignment *UserRole) error {
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(assignment)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrConflict
+	}
+	return s.db.Model(&Role{}).Where("id = ?", assignment.RoleID).Pluck("name", &assignment.RoleName).Error
+}
+
+func (s *PostgresRoleStore) Unassign(userID int, roleID uint, companyID *int) error {
+	db := s.db.Where("user_id = ? AND role_id = ?", userID, roleID)
+	if companyID == nil {
+		db = db.Where("company_id IS NULL")
+	} else {
+		db = db.Where("company_id = ?", *companyID)
+	}
+	result := db.Delete(&UserRole{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresRoleStore) Assignments(userID int) ([]UserRole, error) {
+	var assignments []UserRole
+	err := s.db.Table("user_roles").
+		Select("user_roles.*, roles.name AS role_name").
+		Joins("JOIN roles ON roles.id = user_roles.role_id").
+		Where("user_roles.user_id = ?", userID).
+		Order("user_roles.id").
+		Find(&assignments).Error
+	return assignments, err
+}
+
+func (s *PostgresRoleStore) Grants(userID int) ([]Grant, error) {
+	var grants []Grant
+	err := s.db.Raw(`SELECT DISTINCT rp.permission, ur.company_id
+		FROM user_roles ur JOIN role_permissions rp ON rp.role_id = ur.role_id
+		WHERE ur.user_id = ?
+		ORDER BY rp.permission, ur.company_id`, userID).Scan(&grants).Error
+	return grants, err
+}
+
+type PostgresAnalyticsStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresAnalyticsStore) RecordView(view *PostView) error {
+	return s.db.Create(view).Error
+}
+
+func (s *PostgresAnalyticsStore) CountViews(postID int) (int64, error) {
+	var count int64
+	err := s.db.Model(&PostView{}).Where("post_id = ?", postID).Count(&count).Error
+	return count, err
+}
+
+func (s *PostgresAnalyticsStore) SaveMetrics(metrics *EngagementMetrics) error {
+	return s.db.Create(metrics).Error
+}
+
+type PostgresTimelineStore struct {
+	db *gorm.DB
+}
+
+// page applies the cursor and limit of a timeline query to db, whose rows
+// are ordered by the given published_at and post id columns. They are named
+// here rather than by listScope because Read joins two tables that have both.
+func page(db *gorm.DB, publishedAt, postID string, query ListQuery) (*gorm.DB, error) {
+	if query.After != nil {
+		value, err := cursorValue(reflect.TypeOf(Post{}), query.After)
+		if err != nil {
+			return nil, err
+		}
+		db = db.Where("("+publishedAt+", "+postID+") < (?, ?)", value, query.After.ID)
+	}
+	db = db.Order(publishedAt + " DESC").Order(postID + " DESC")
+	if query.Limit > 0 {
+		db = db.Limit(query.Limit)
+	}
+	return db, nil
+}
+
+func (s *PostgresTimelineStore) Query(userID int, query ListQuery) ([]Post, error) {
+	db := s.db.Where("status = ?", PostStatusPublished).
+		Where("user_id = ? OR user_id IN (SELECT following_id FROM follows WHERE follower_id = ?)", userID, userID)
+	db, err := page(db, "published_at", "id", query)
+	if err != nil {
+		return nil, err
+	}
+	var posts []Post
+	err = db.Find(&posts).Error
+	return posts, err
+}
+
+func (s *PostgresTimelineStore) Read(userID int, query ListQuery) ([]Post, error) {
+	db := s.db.Select("posts.*").
+		Joins("JOIN timeline_entries ON timeline_entries.post_id = posts.id").
+		Where("timeline_entries.user_id = ?", userID)
+	db, err := page(db, "timeline_entries.published_at", "timeline_entries.post_id", query)
+	if err != nil {
+		return nil, err
+	}
+	var posts []Post
+	err = db.Find(&posts).Error
+	return posts, err
+}
+
+func (s *PostgresTimelineStore) FanOut(post Post) error {
+	// One statement however many followers there are
+	return s.db.Exec(`INSERT INTO timeline_entries (user_id, post_id, author_id, published_at)
+		SELECT follower_id, ?::bigint, ?::bigint, ?::timestamptz FROM follows WHERE following_id = ?
+		UNION SELECT ?::bigint, ?::bigint, ?::bigint, ?::timestamptz
+		ON CONFLICT DO NOTHING`,
+		post.ID, post.UserID, post.PublishedAt, post.UserID,
+		post.UserID, post.ID, post.UserID, post.PublishedAt).
+		Error
+}
+
+func (s *PostgresTimelineStore) Backfill(followerID, followingID int) error {
+	return s.db.Exec(`INSERT INTO timeline_entries (user_id, post_id, author_id, published_at)
+		SELECT ?::bigint, id, user_id, published_at FROM posts WHERE user_id = ? AND status = ?
+		ON CONFLICT DO NOTHING`,
+		followerID, followingID, PostStatusPublished).
+		Error
+}
+
+func (s *PostgresTimelineStore) Remove(followerID, followingID int) error {
+	return s.db.Exec(`DELETE FROM timeline_entries
+		WHERE user_id = ? AND author_id = ?
+		AND NOT EXISTS (SELECT 1 FROM follows WHERE follower_id = ? AND following_id = ?)`,
+		followerID, followingID, followerID, followingID).
+		Error
+}
+
+func (s *PostgresTimelineStore) Rebuild() error {
+	return s.db.Exec(`INSERT INTO timeline_entries (user_id, post_id, author_id, published_at)
+		SELECT user_id, id, user_id, published_at FROM posts WHERE status = ?
+		UNION
+		SELECT follows.follower_id, posts.id, posts.user_id, posts.published_at
+		FROM posts JOIN follows ON follows.following_id = posts.user_id
+		WHERE posts.status = ?
+		ON CONFLICT DO NOTHING`,
+		PostStatusPublished, PostStatusPublished).
+		Error
+}
+
+type PostgresRefreshTokenStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresRefreshTokenStore) Create(token *RefreshToken) error {
+	return s.db.Create(token).Error
+}
+
+func (s *PostgresRefreshTokenStore) Get(id string) (*RefreshToken, error) {
+	var token RefreshToken
+	if err := s.db.First(&token, "id = ?", id).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &token, nil
+}
+
+func (s *PostgresRefreshTokenStore) Claim(id string, now time.Time) (bool, error) {
+	// A single conditional UPDATE, so two concurrent refreshes cannot both win
+	result := s.db.Model(&RefreshToken{}).
+		Where("id = ? AND used_at IS NULL AND revoked_at IS NULL AND expires_at > ?", id, now).
+		Update("used_at", now)
+	return result.RowsAffected == 1, result.Error
+}
+
+func (s *PostgresRefreshTokenStore) RevokeFamily(familyID string, at time.Time) error {
+	return s.db.Model(&RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", at).
+		Error
+}
+
+func (s *PostgresRefreshTokenStore) RevokeUser(userID int, at time.Time) error {
+	return s.db.Model(&RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", at).
+		Error
+}
+
+type PostgresPasswordResetStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresPasswordResetStore) Create(token *PasswordResetToken) error {
+	return s.db.Create(token).Error
+}
+
+func (s *PostgresPasswordResetStore) Claim(hash string, now time.Time) (*PasswordResetToken, error) {
+	// A single conditional UPDATE, so a token cannot be redeemed twice
+	var tokens []PasswordResetToken
+	err := s.db.Raw(`UPDATE password_reset_tokens SET used_at = ?
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?
+		RETURNING *`, now, hash, now).
+		Scan(&tokens).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, ErrNotFound
+	}
+	return &tokens[0], nil
+}
+
+func (s *PostgresPasswordResetStore) InvalidateUser(userID int, at time.Time) error {
+	return s.db.Model(&PasswordResetToken{}).
+		Where("user_id = ? AND used_at IS NULL", userID).
+		Update("used_at", at).
+		Error
+}
+
+func (s *PostgresPasswordResetStore) CountActive(userID int, now time.Time) (int, error) {
+	var count int64
+	err := s.db.Model(&PasswordResetToken{}).
+		Where("user_id = ? AND used_at IS NULL AND expires_at > ?", userID, now).
+		Count(&count).
+		Error
+	return int(count), err
+}
+
+type PostgresEmailVerificationStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresEmailVerificationStore) Create(token *EmailVerificationToken) error {
+	return s.db.Create(token).Error
+}
+
+func (s *PostgresEmailVerificationStore) Claim(hash string, now time.Time) (*EmailVerificationToken, error) {
+	var tokens []EmailVerificationToken
+	err := s.db.Raw(`UPDATE email_verification_tokens SET used_at = ?
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?
+		RETURNING *`, now, hash, now).
+		Scan(&tokens).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, ErrNotFound
+	}
+	return &tokens[0], nil
+}
+
+type PostgresTwoFactorStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresTwoFactorStore) Get(userID int) (*TwoFactor, error) {
+	var enrollment TwoFactor
+	if err := s.db.Where("user_id = ?", userID).First(&enrollment).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &enrollment, nil
+}
+
+func (s *PostgresTwoFactorStore) Save(tf *TwoFactor) error {
+	// Re-enrolling replaces the pending secret but keeps created_at
+	return s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"secret", "last_step", "confirmed_at"}),
+	}).Create(tf).Error
+}
+
+func (s *PostgresTwoFactorStore) Delete(userID int) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&TwoFactor{}).Error
+	})
+}
+
+func (s *PostgresTwoFactorStore) UseStep(userID int, step int64) (bool, error) {
+	// Conditional on the stored step, so concurrent logins cannot both
+	// spend the same code
+	result := s.db.Model(&TwoFactor{}).
+		Where("user_id = ? AND last_step < ?", userID, step).
+		Update("last_step", step)
+	return result.RowsAffected == 1, result.Error
+}
+
+func (s *PostgresTwoFactorStore) ReplaceRecoveryCodes(userID int, hashes []string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		codes := make([]RecoveryCode, len(hashes))
+		for i, hash := range hashes {
+			codes[i] = RecoveryCode{UserID: userID, CodeHash: hash}
+		}
+		if len(codes) == 0 {
+			return nil
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+func (s *PostgresTwoFactorStore) UseRecoveryCode(userID int, hash string, now time.Time) error {
+	result := s.db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hash).
+		Update("used_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresTwoFactorStore) RemainingRecoveryCodes(userID int) (int, error) {
+	var count int64
+	err := s.db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND used_at IS NULL", userID).
+		Count(&count).
+		Error
+	return int(count), err
+}
+
+type PostgresLoginThrottleStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresLoginThrottleStore) Get(key string) (*LoginThrottle, error) {
+	var throttle LoginThrottle
+	if err := s.db.Where("key = ?", key).First(&throttle).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &throttle, nil
+}
+
+func (s *PostgresLoginThrottleStore) RecordFailure(key string, now time.Time, window time.Duration) (*LoginThrottle, error) {
+	// One upsert, so concurrent failures are all counted
+	var throttle LoginThrottle
+	err := s.db.Raw(`INSERT INTO login_throttles (key, failures, last_failure_at) VALUES (?, 1, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_throttles.last_failure_at > ? THEN login_throttles.failures + 1 ELSE 1 END,
+			last_failure_at = EXCLUDED.last_failure_at
+		RETURNING *`, key, now, now.Add(-window)).
+		Scan(&throttle).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return &throttle, nil
+}
+
+func (s *PostgresLoginThrottleStore) Reset(key string) error {
+	return s.db.Where("key = ?", key).Delete(&LoginThrottle{}).Error
+}
+
+type PostgresAuditStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresAuditStore) Record(event *AuditEvent) error {
+	return s.db.Create(event).Error
+}
+
+func (s *PostgresAuditStore) List(query ListQuery) ([]AuditEvent, error) {
+	var events []AuditEvent
+	err := findList(s.db, &events, query)
+	return events, err
+}
+
+type PostgresAccessTokenStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresAccessTokenStore) Create(token *PersonalAccessToken) error {
+	return s.db.Create(token).Error
+}
+
+func (s *PostgresAccessTokenStore) GetByHash(hash string) (*PersonalAccessToken, error) {
+	var token PersonalAccessToken
+	if err := s.db.Where("token_hash = ?", hash).First(&token).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &token, nil
+}
+
+func (s *PostgresAccessTokenStore) ListByUser(userID int) ([]PersonalAccessToken, error) {
+	tokens := []PersonalAccessToken{}
+	err := s.db.Where("user_id = ? AND revoked_at IS NULL", userID).Order("id").Find(&tokens).Error
+	return tokens, err
+}
+
+func (s *PostgresAccessTokenStore) Revoke(userID, id int, at time.Time) error {
+	result := s.db.Model(&PersonalAccessToken{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userID).
+		Update("revoked_at", at)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresAccessTokenStore) RevokeUser(userID int, at time.Time) error {
+	return s.db.Model(&PersonalAccessToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", at).
+		Error
+}
+
+func (s *PostgresAccessTokenStore) Touch(id int, at time.Time) error {
+	return s.db.Model(&PersonalAccessToken{}).Where("id = ?", id).Update("last_used_at", at).Error
+}
+
+type PostgresSigningKeyStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresSigningKeyStore) Create(key *SigningKey) error {
+	return conflict(s.db.Create(key).Error)
+}
+
+func (s *PostgresSigningKeyStore) List() ([]SigningKey, error) {
+	keys := []SigningKey{}
+	err := s.db.Order("created_at, id").Find(&keys).Error
+	return keys, err
+}
+
+func (s *PostgresSigningKeyStore) Retire(id string, at time.Time) error {
+	result := s.db.Model(&SigningKey{}).
+		Where("id = ? AND retired_at IS NULL", id).
+		Update("retired_at", at)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type PostgresIdentityStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresIdentityStore) Create(identity *Identity) error {
+	return conflict(s.db.Create(identity).Error)
+}
+
+func (s *PostgresIdentityStore) Get(provider, subject string) (*Identity, error) {
+	var identity Identity
+	if err := s.db.Where("provider = ? AND subject = ?", provider, subject).First(&identity).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &identity, nil
+}
+
+func (s *PostgresIdentityStore) ListByUser(userID int) ([]Identity, error) {
+	identities := []Identity{}
+	err := s.db.Where("user_id = ?", userID).Order("id").Find(&identities).Error
+	return identities, err
+}
+
+func (s *PostgresIdentityStore) Delete(userID, id int) error {
+	result := s.db.Where("id = ? AND user_id = ?", id, userID).Delete(&Identity{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type PostgresOAuthStateStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresOAuthStateStore) Create(state *OAuthState) error {
+	// Drop sign-ins that were abandoned
+	if err := s.db.Where("expires_at < ?", time.Now()).Delete(&OAuthState{}).Error; err != nil {
+		return err
+	}
+	return s.db.Create(state).Error
+}
+
+func (s *PostgresOAuthStateStore) Consume(stateHash string) (*OAuthState, error) {
+	// A single DELETE, so a state cannot be used twice
+	var states []OAuthState
+	err := s.db.Raw(`DELETE FROM oauth_states WHERE state_hash = ? RETURNING *`, stateHash).
+		Scan(&states).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	if len(states) == 0 {
+		return nil, ErrNotFound
+	}
+	return &states[0], nil
+}
+
+type PostgresSessionStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresSessionStore) Create(session *Session) error {
+	return conflict(s.db.Create(session).Error)
+}
+
+func (s *PostgresSessionStore) ListByUser(userID int, seenSince time.Time) ([]Session, error) {
+	sessions := []Session{}
+	err := s.db.Where("user_id = ? AND revoked_at IS NULL AND last_seen_at > ?", userID, seenSince).
+		Order("last_seen_at DESC, id").
+		Find(&sessions).
+		Error
+	return sessions, err
+}
+
+func (s *PostgresSessionStore) Revoke(userID int, id string, at time.Time) error {
+	result := s.db.Model(&Session{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userID).
+		Update("revoked_at", at)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresSessionStore) RevokeOthers(userID int, keep string, at time.Time) ([]string, error) {
+	revoked := []string{}
+	err := s.db.Raw(
+		`UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND id <> ? AND revoked_at IS NULL RETURNING id`,
+		at, userID, keep,
+	).Scan(&revoked).Error
+	return revoked, err
+}
+
+func (s *PostgresSessionStore) Touch(seen map[string]time.Time) error {
+	if len(seen) == 0 {
+		return nil
+	}
+
+	// One UPDATE joined against a VALUES list of every session in the batch
+	rows := make([]string, 0, len(seen))
+	args := make([]interface{}, 0, 2*len(seen))
+	for id, at := range seen {
+		rows = append(rows, "(?, ?::timestamptz)")
+		args = append(args, id, at)
+	}
+	return s.db.Exec(
+		`UPDATE sessions SET last_seen_at = seen.at
+		FROM (VALUES `+strings.Join(rows, ", ")+`) AS seen (id, at)
+		WHERE sessions.id = seen.id AND sessions.last_seen_at < seen.at`,
+		args...,
+	).Error
+}
+
+type PostgresAccountStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresAccountStore) Collect(userID int) (*PersonalData, error) {
+	data := &PersonalData{}
+	queries := []struct {
+		dest  interface{}
+		where string
+	}{
+		{&data.Posts, "user_id = ?"},
+		{&data.Engagements, "user_id = ?"},
+		{&data.Followers, "following_id = ?"},
+		{&data.Followings, "follower_id = ?"},
+		{&data.Notifications, "user_id = ?"},
+		{&data.PostViews, "user_id = ?"},
+	}
+	for _, query := range queries {
+		if err := s.db.Where(query.where, userID).Order("id").Find(query.dest).Error; err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func (s *PostgresAccountStore) DueForDeletion(now time.Time) ([]User, error) {
+	users := []User{}
+	err := s.db.Where("delete_after < ?", now).Order("id").Find(&users).Error
+	return users, err
+}
+
+func (s *PostgresAccountStore) Erase(userID int, anonymize bool) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var user User
+		if err := tx.First(&user, userID).Error; err != nil {
+			return notFound(err)
+		}
+
+		// Posts that go away take the engagements and views they received
+		// along; timeline entries follow them through their foreign key
+		removed := tx.Model(&Post{}).Select("id").Where("user_id = ?", userID)
+		if anonymize {
+			removed = removed.Where("status <> ?", PostStatusPublished)
+		}
+		statements := []*gorm.DB{
+			tx.Where("post_id IN (?)", removed).Delete(&Engagement{}),
+			tx.Where("post_id IN (?)", removed).Delete(&PostView{}),
+			tx.Where("post_id IN (?)", removed).Delete(&EngagementMetrics{}),
+			tx.Where("post_id IN (?)", removed).Delete(&Notification{}),
+		}
+		if anonymize {
+			statements = append(statements,
+				tx.Model(&PostView{}).Where("user_id = ?", userID).Update("user_id", 0),
+				tx.Where("user_id = ? AND status <> ?", userID, PostStatusPublished).Delete(&Post{}),
+			)
+		} else {
+			statements = append(statements,
+				tx.Where("user_id = ?", userID).Delete(&Engagement{}),
+				tx.Where("user_id = ?", userID).Delete(&PostView{}),
+				tx.Where("user_id = ?", userID).Delete(&Post{}),
+			)
+		}
+		statements = append(statements,
+			tx.Where("follower_id = ? OR following_id = ?", userID, userID).Delete(&Follow{}),
+			tx.Exec("DELETE FROM timeline_entries WHERE user_id = ?", userID),
+			tx.Where("user_id = ?", userID).Delete(&Notification{}),
+		)
+		for _, statement := range statements {
+			if statement.Error != nil {
+				return statement.Error
+			}
+		}
+
+		if !anonymize {
+			// Everything else keyed by the user goes with it by cascade
+			return tx.Delete(&User{}, userID).Error
+		}
+		placeholder := anonymizedUser(user, time.Now())
+		return tx.Omit("CreatedAt").Save(&placeholder).Error
+	})
+}
+
+type PostgresAccountExportStore struct {
+	db *gorm.DB
+}
+
+func (s *PostgresAccountExportStore) Create(export *AccountExport) error {
+	return s.db.Create(export).Error
+}
+
+func (s *PostgresAccountExportStore) Latest(userID int) (*AccountExport, error) {
+	var export AccountExport
+	if err := s.db.Where("user_id = ?", userID).Order("id DESC").First(&export).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &export, nil
+}
+
+func (s *PostgresAccountExportStore) ClaimPending(now, staleBefore time.Time, limit int) ([]AccountExport, error) {
+	// SKIP LOCKED lets several workers claim disjoint batches
+	exports := []AccountExport{}
+	err := s.db.Raw(`UPDATE account_exports SET status = ?, started_at = ?
+		WHERE id IN (
+			SELECT id FROM account_exports
+			WHERE status = ? OR (status = ? AND started_at < ?)
+			ORDER BY id
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`,
+		ExportStatusRunning, now, ExportStatusPending, ExportStatusRunning, staleBefore, limit,
+	).Scan(&exports).Error
+	sort.Slice(exports, func(i, j int) bool { return exports[i].ID < exports[j].ID })
+	return exports, err
+}
+
+func (s *PostgresAccountExportStore) Update(export *AccountExport) error {
+	return s.db.Omit("CreatedAt").Save(export).Error
+}
+
+func (s *PostgresAccountExportStore) DeleteExpired(now time.Time) ([]AccountExport, error) {
+	exports := []AccountExport{}
+	err := s.db.Raw(`DELETE FROM account_exports WHERE expires_at < ? RETURNING *`, now).Scan(&exports).Error
+	return exports, err
+}
+
+func (s *PostgresAccountExportStore) DeleteByUser(userID int) ([]AccountExport, error) {
+	exports := []AccountExport{}
+	err := s.db.Raw(`DELETE FROM account_exports WHERE user_id = ? RETURNING *`, userID).Scan(&exports).Error
+	return exports, err
+}
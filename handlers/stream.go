@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// errInvalidEventID is returned for a Last-Event-ID this server did not
+// issue
+var errInvalidEventID = errors.New("invalid last event ID")
+
+// notificationEventID identifies the state of a notification a stream has
+// sent. It is a list cursor in the order notifications were last updated,
+// so a resuming stream replays whatever changed after it.
+func notificationEventID(notification Notification) string {
+	value, _ := json.Marshal(notification.UpdatedAt)
+	return Cursor{Sort: "updated_at", Value: value, ID: int64(notification.ID)}.Encode()
+}
+
+// notificationStream feeds one client the notifications of a user: first
+// those missed since the last event it received, then the live ones from
+// the broker
+type notificationStream struct {
+	s      *Stores
+	userID int
+	live   <-chan Notification
+	cancel func()
+	// sent remembers the last update of every notification sent, so the
+	// live notifications that were also replayed are sent only once
+	sent map[int]time.Time
+}
+
+// openNotificationStream subscribes to the notifications of userID and
+// returns the stream with the notifications to replay after lastEventID.
+// The subscription starts before the replay is read, so nothing published
+// in between is lost.
+func openNotificationStream(s *Stores, userID int, lastEventID string, replayLimit int) (*notificationStream, []Notification, error) {
+	var after *Cursor
+	if lastEventID != "" {
+		cursor, err := DecodeCursor(lastEventID)
+		if err != nil || cursor.Sort != "updated_at" || cursor.Desc {
+			return nil, nil, errInvalidEventID
+		}
+		after = cursor
+	}
+
+	live, cancel := s.Broker.Subscribe(userID)
+	stream := &notificationStream{s: s, userID: userID, live: live, cancel: cancel, sent: map[int]time.Time{}}
+	if after == nil {
+		return stream, nil, nil
+	}
+
+	missed, err := s.Notifications.ListByUser(userID, ListQuery{Sort: "updated_at", After: after, Limit: replayLimit})
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return stream, stream.filter(missed), nil
+}
+
+// filter drops the notifications the stream has sent already and describes
+// the others
+func (st *notificationStream) filter(notifications []Notification) []Notification {
+	fresh := notifications[:0]
+	for _, notification := range notifications {
+		if sent, ok := st.sent[notification.ID]; ok && !notification.UpdatedAt.After(sent) {
+			continue
+		}
+		st.sent[notification.ID] = notification.UpdatedAt
+		fresh = append(fresh, notification)
+	}
+	describeNotifications(st.s, fresh)
+	return fresh
+}
+
+// openStreamOrFail opens the notification stream of the request and
+// responds with the error when it cannot
+func openStreamOrFail(c *gin.Context, s *Stores, lastEventID string, cfg config.NotificationsConfig) (*notificationStream, []Notification, bool) {
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, nil, false
+	}
+
+	stream, missed, err := openNotificationStream(s, userID.(int), lastEventID, cfg.ReplayLimit)
+	if errors.Is(err, errInvalidEventID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch notifications"})
+		log.Println("Error executing database query:", err)
+		return nil, nil, false
+	}
+	return stream, missed, true
+}
+
+// StreamNotifications pushes the caller's notifications as Server-Sent
+// Events named "notification", with a "heartbeat" event when the stream is
+// idle. A client reconnecting with Last-Event-ID first receives what it
+// missed.
+func StreamNotifications(c *gin.Context, s *Stores, cfg config.NotificationsConfig) {
+	stream, missed, ok := openStreamOrFail(c, s, c.GetHeader("Last-Event-ID"), cfg)
+	if !ok {
+		return
+	}
+	defer stream.cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	send := func(notification Notification) {
+		c.Render(-1, sse.Event{Id: notificationEventID(notification), Event: "notification", Data: notification})
+	}
+	for _, notification := range missed {
+		send(notification)
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(cfg.Heartbeat.Duration())
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case notification, open := <-stream.live:
+			if !open {
+				return
+			}
+			for _, notification := range stream.filter([]Notification{notification}) {
+				send(notification)
+			}
+		case at := <-heartbeat.C:
+			c.Render(-1, sse.Event{Event: "heartbeat", Data: at.Unix()})
+		}
+		c.Writer.Flush()
+	}
+}
+
+// streamMessage is a message of the notification WebSocket
+type streamMessage struct {
+	Type         string        `json:"type"`
+	ID           string        `json:"id,omitempty"`
+	Notification *Notification `json:"notification,omitempty"`
+	Time         int64         `json:"time,omitempty"`
+}
+
+// NotificationsWebSocket offers the stream of StreamNotifications over a
+// WebSocket. Each message is a JSON object of type "notification", with
+// the event ID to resume from in the last_event_id query parameter, or
+// "heartbeat". Browsers may only connect from the server's own origin or
+// an allowed one.
+func NotificationsWebSocket(c *gin.Context, s *Stores, cfg config.NotificationsConfig) {
+	lastEventID := c.Query("last_event_id")
+	if lastEventID == "" {
+		lastEventID = c.GetHeader("Last-Event-ID")
+	}
+	if origin := c.GetHeader("Origin"); origin != "" && !allowedOrigin(origin, c.Request.Host, cfg.AllowedOrigins) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Origin not allowed"})
+		return
+	}
+	stream, missed, ok := openStreamOrFail(c, s, lastEventID, cfg)
+	if !ok {
+		return
+	}
+	defer stream.cancel()
+
+	server := websocket.Server{
+		// The origin was checked above, and clients without one are not
+		// browsers
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			// Nothing is expected from the client; reading notices it left
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				var discard []byte
+				for websocket.Message.Receive(ws, &discard) == nil {
+				}
+			}()
+
+			send := func(notification Notification) error {
+				return websocket.JSON.Send(ws, streamMessage{
+					Type:         "notification",
+					ID:           notificationEventID(notification),
+					Notification: &notification,
+				})
+			}
+			for _, notification := range missed {
+				if send(notification) != nil {
+					return
+				}
+			}
+
+			heartbeat := time.NewTicker(cfg.Heartbeat.Duration())
+			defer heartbeat.Stop()
+			for {
+				var err error
+				select {
+				case <-closed:
+					return
+				case notification, open := <-stream.live:
+					if !open {
+						return
+					}
+					for _, notification := range stream.filter([]Notification{notification}) {
+						err = errors.Join(err, send(notification))
+					}
+				case at := <-heartbeat.C:
+					err = websocket.JSON.Send(ws, streamMessage{Type: "heartbeat", Time: at.Unix()})
+				}
+				if err != nil {
+					return
+				}
+			}
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+// allowedOrigin reports whether a browser at origin may open a WebSocket to
+// host
+func allowedOrigin(origin, host string, allowed []string) bool {
+	for _, a := range allowed {
+		if strings.EqualFold(strings.TrimSuffix(a, "/"), origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, host)
+}
@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+// RefreshToken is the server-side record of an issued refresh token.
+// Every token minted from the same login shares a FamilyID, so a replayed
+// token can take down the whole chain of rotations it belongs to.
+type RefreshToken struct {
+	ID        string     `json:"id,omitempty" db:"id" gorm:"primaryKey"`
+	FamilyID  string     `json:"familyId,omitempty" db:"family_id" gorm:"index"`
+	UserID    int        `json:"userId,omitempty" db:"user_id" gorm:"index"`
+	ExpiresAt time.Time  `json:"expiresAt,omitempty" db:"expires_at"`
+	UsedAt    *time.Time `json:"usedAt,omitempty" db:"used_at"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty" db:"revoked_at"`
+	CreatedAt time.Time  `json:"createdAt,omitempty" db:"created_at"`
+}
+
+// newTokenID returns a random identifier for token families and jti claims
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newSecretToken returns a random token to hand out once together with the
+// hash to store in its place
+func newSecretToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+// hashToken returns the stored form of a token from newSecretToken. The
+// tokens are random enough that a plain SHA-256 cannot be brute-forced.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens mints an access/refresh pair for the user and stores the
+// refresh token as the newest member of familyID.
+func issueTokens(s *Stores, cfg config.AuthConfig, userID int, familyID string) (string, string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", "", err
+	}
+
+	accessToken, refreshToken, err := generateTokens(s, cfg, userID, familyID, jti)
+	if err != nil {
+		return "", "", err
+	}
+
+	record := RefreshToken{
+		ID:        jti,
+		FamilyID:  familyID,
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(cfg.RefreshTokenTTL.Duration()),
+	}
+	if err := s.RefreshTokens.Create(&record); err != nil {
+		return "", "", err
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// signToken signs claims with the current signing key
+func signToken(s *Stores, cfg config.AuthConfig, claims jwt.MapClaims) (string, error) {
+	return s.Keys.Sign(cfg, claims)
+}
+
+// parseToken verifies the signature and expiry of a token with the key
+// named by its kid
+func parseToken(s *Stores, cfg config.AuthConfig, tokenString string) (*jwt.Token, error) {
+	return s.Keys.Parse(cfg, tokenString)
+}
+
+// RefreshTokens exchanges a refresh token for a new access/refresh pair.
+// Each refresh token is accepted once; presenting one that was already
+// rotated revokes its whole family.
+func RefreshTokens(c *gin.Context, s *Stores, cfg config.AuthConfig) {
+	var request struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := parseToken(s, cfg, request.RefreshToken)
+	if err != nil || !token.Valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["type"] != "refresh" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	jti, _ := claims["jti"].(string)
+	userID, _ := claims["user_id"].(float64)
+
+	claimed, err := s.RefreshTokens.Claim(jti, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error claiming refresh token:", err)
+		return
+	}
+
+	stored, err := s.RefreshTokens.Get(jti)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	if !claimed {
+		// The token exists but was already rotated or revoked: treat it as
+		// stolen and kill every token descended from the same login.
+		if stored.UsedAt != nil || stored.RevokedAt != nil {
+			if err := s.RefreshTokens.RevokeFamily(stored.FamilyID, time.Now()); err != nil {
+				log.Println("Error revoking token family:", err)
+			}
+			log.Println("Refresh token reuse detected for family", stored.FamilyID)
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	if stored.UserID != int(userID) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	accessToken, refreshToken, err := issueTokens(s, cfg, stored.UserID, stored.FamilyID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error issuing tokens:", err)
+		return
+	}
+
+	s.SessionActivity.Seen(stored.FamilyID, time.Now())
+
+	setAuthCookies(c, cfg, accessToken)
+	c.JSON(http.StatusOK, gin.H{"access_token": accessToken, "refresh_token": refreshToken})
+}
+
+// Logout revokes the access token used for the request together with the
+// session it was issued from: its refresh token family and every other
+// access token of the family.
+func Logout(c *gin.Context, s *Stores, cfg config.AuthConfig) {
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	jti := c.GetString("token_id")
+	expiresAt := c.GetTime("token_expires_at")
+	if err := s.Revocations.Revoke(jti, userID.(int), expiresAt); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		log.Println("Error revoking access token:", err)
+		return
+	}
+
+	if family := c.GetString("token_family"); family != "" {
+		// Other access tokens refreshed in the same session go with it
+		if err := revokeSessionTokens(s, cfg, userID.(int), []string{family}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+			log.Println("Error revoking session tokens:", err)
+			return
+		}
+		// Logins from before sessions were recorded have none to revoke
+		if err := s.Sessions.Revoke(userID.(int), family, time.Now()); err != nil && !errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+			log.Println("Error revoking session:", err)
+			return
+		}
+	}
+
+	clearAuthCookies(c, cfg)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// LogoutAll revokes every access and refresh token issued to the caller
+func LogoutAll(c *gin.Context, s *Stores, cfg config.AuthConfig) {
+	userID, ok := c.Get("user_id")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if err := revokeUserTokens(s, userID.(int)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		log.Println("Error revoking user tokens:", err)
+		return
+	}
+
+	clearAuthCookies(c, cfg)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out of all sessions successfully"})
+}
+
+// revokeUserTokens invalidates every session, access, refresh and personal
+// access token of a user
+func revokeUserTokens(s *Stores, userID int) error {
+	if err := s.Revocations.RevokeUser(userID, time.Now()); err != nil {
+		return err
+	}
+	if err := s.RefreshTokens.RevokeUser(userID, time.Now()); err != nil {
+		return err
+	}
+	if err := s.AccessTokens.RevokeUser(userID, time.Now()); err != nil {
+		return err
+	}
+	_, err := s.Sessions.RevokeOthers(userID, "", time.Now())
+	return err
+}
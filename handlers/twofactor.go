@@ -0,0 +1,398 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/totp"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TwoFactor is the TOTP enrollment of a user. ConfirmedAt stays nil until
+// the user proves their authenticator works; only then does login ask for
+// a code.
+type TwoFactor struct {
+	UserID int    `json:"userId" db:"user_id" gorm:"primaryKey;autoIncrement:false"`
+	Secret string `json:"-" db:"secret"`
+	// LastStep is the time step of the last accepted code. Codes of that
+	// step or earlier are refused, so an observed code cannot be replayed.
+	LastStep    int64      `json:"-" db:"last_step"`
+	ConfirmedAt *time.Time `json:"confirmedAt,omitempty" db:"confirmed_at"`
+	CreatedAt   time.Time  `json:"createdAt,omitempty" db:"created_at"`
+}
+
+// RecoveryCode is a one-time code that stands in for a TOTP code when the
+// authenticator is lost. Only the hash of the code is stored.
+type RecoveryCode struct {
+	ID        int        `json:"id,omitempty" db:"id"`
+	UserID    int        `json:"userId,omitempty" db:"user_id"`
+	CodeHash  string     `json:"-" db:"code_hash"`
+	UsedAt    *time.Time `json:"usedAt,omitempty" db:"used_at"`
+	CreatedAt time.Time  `json:"createdAt,omitempty" db:"created_at"`
+}
+
+// twoFactorEnabled reports whether userID has a confirmed enrollment
+func twoFactorEnabled(s *Stores, userID int) (*TwoFactor, bool, error) {
+	enrollment, err := s.TwoFactor.Get(userID)
+	if errors.Is(err, ErrNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return enrollment, enrollment.ConfirmedAt != nil, nil
+}
+
+// newRecoveryCodes replaces the recovery codes of userID and returns the
+// new codes, which are shown to the user once
+func newRecoveryCodes(s *Stores, cfg config.TwoFactorConfig, userID int) ([]string, error) {
+	codes := make([]string, cfg.RecoveryCodes)
+	hashes := make([]string, cfg.RecoveryCodes)
+	for i := range codes {
+		// 80 random bits, written as four groups of four characters
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	if err := s.TwoFactor.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode hashes a recovery code the way it was typed, ignoring
+// case, spaces and dashes
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return hashToken(code)
+}
+
+// checkPassword re-authenticates the caller with the password in a
+// sensitive request. It writes the error response and returns false when
+// the password is wrong.
+func checkPassword(c *gin.Context, user *User, password string) bool {
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid password"})
+		return false
+	}
+	return true
+}
+
+// TwoFactorStatus reports whether the caller has 2FA enabled and how many
+// recovery codes they have left
+func TwoFactorStatus(c *gin.Context, s *Stores) {
+	userID := c.GetInt("user_id")
+	_, enabled, err := twoFactorEnabled(s, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	remaining := 0
+	if enabled {
+		if remaining, err = s.TwoFactor.RemainingRecoveryCodes(userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+			log.Println("Error executing database query:", err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"enabled": enabled, "recovery_codes_remaining": remaining})
+}
+
+// EnrollTwoFactor starts enrolling the caller in 2FA with a new TOTP
+// secret. 2FA is only enforced once ConfirmTwoFactor accepts a code, and
+// enrolling again before that replaces the secret.
+func EnrollTwoFactor(c *gin.Context, s *Stores, cfg config.TwoFactorConfig) {
+	user, err := s.Users.GetByID(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	_, enabled, err := twoFactorEnabled(s, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	if enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+	if err := s.TwoFactor.Save(&TwoFactor{UserID: user.ID, Secret: secret}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"secret": secret, "uri": totp.URI(cfg.Issuer, user.Username, secret)})
+}
+
+// ConfirmTwoFactor enables 2FA once the caller proves their authenticator
+// produces valid codes, and returns their recovery codes
+func ConfirmTwoFactor(c *gin.Context, s *Stores, cfg config.TwoFactorConfig) {
+	var request struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.GetInt("user_id")
+	enrollment, enabled, err := twoFactorEnabled(s, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	if enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if enrollment == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor enrollment has not been started"})
+		return
+	}
+
+	step, ok := totp.Verify(enrollment.Secret, request.Code, time.Now())
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	now := time.Now()
+	enrollment.LastStep = step
+	enrollment.ConfirmedAt = &now
+	if err := s.TwoFactor.Save(enrollment); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	codes, err := newRecoveryCodes(s, cfg, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error creating recovery codes:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled", "recovery_codes": codes})
+}
+
+// DisableTwoFactor turns 2FA off for the caller after checking their
+// password, and discards their recovery codes
+func DisableTwoFactor(c *gin.Context, s *Stores) {
+	var request struct {
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := s.Users.GetByID(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	if !checkPassword(c, user, request.Password) {
+		return
+	}
+
+	if err := s.TwoFactor.Delete(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the caller after
+// checking their password. The old codes stop working.
+func RegenerateRecoveryCodes(c *gin.Context, s *Stores, cfg config.TwoFactorConfig) {
+	var request struct {
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := s.Users.GetByID(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	if !checkPassword(c, user, request.Password) {
+		return
+	}
+
+	_, enabled, err := twoFactorEnabled(s, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	if !enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	codes, err := newRecoveryCodes(s, cfg, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error creating recovery codes:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// generateChallengeToken returns the token that stands for a correct
+// password while Login waits for the second factor
+func generateChallengeToken(s *Stores, cfg config.AuthConfig, userID int) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{}
+	claims["type"] = "2fa"
+	claims["jti"] = jti
+	claims["user_id"] = userID
+	claims["iat"] = float64(now.UnixMilli()) / 1000
+	claims["exp"] = now.Add(cfg.TwoFactor.ChallengeTTL.Duration()).Unix()
+
+	return signToken(s, cfg, claims)
+}
+
+// LoginTwoFactor completes a login that Login answered with a challenge
+// token, using either a TOTP code or a recovery code
+func LoginTwoFactor(c *gin.Context, s *Stores, cfg config.AuthConfig) {
+	var request struct {
+		ChallengeToken string `json:"challenge_token" binding:"required"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (request.Code == "") == (request.RecoveryCode == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Provide either code or recovery_code"})
+		return
+	}
+
+	token, err := parseToken(s, cfg, request.ChallengeToken)
+	if err != nil || !token.Valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge token"})
+		return
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["type"] != "2fa" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge token"})
+		return
+	}
+	userID, _ := claims["user_id"].(float64)
+
+	// A challenge is good for one login, and password resets or logging out
+	// everywhere cancel the ones still pending
+	jti, _ := claims["jti"].(string)
+	iat, _ := claims["iat"].(float64)
+	exp, _ := claims["exp"].(float64)
+	revoked, err := s.Revocations.IsRevoked(jti, "", int(userID), time.UnixMilli(int64(iat*1000)))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error checking token revocation:", err)
+		return
+	}
+	if revoked {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge token"})
+		return
+	}
+
+	enrollment, enabled, err := twoFactorEnabled(s, int(userID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	if !enabled {
+		// 2FA was turned off after the challenge was issued
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge token"})
+		return
+	}
+
+	// Codes are short enough to guess, so wrong ones count against the
+	// account like wrong passwords
+	user, err := s.Users.GetByID(enrollment.UserID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge token"})
+		return
+	}
+	guard := newLoginGuard(c, s, cfg.Lockout, user.Username)
+	if !guard.check(c, &user.ID) {
+		return
+	}
+
+	if request.Code != "" {
+		step, ok := totp.Verify(enrollment.Secret, request.Code, time.Now())
+		if ok {
+			ok, err = s.TwoFactor.UseStep(enrollment.UserID, step)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+			log.Println("Error executing database query:", err)
+			return
+		}
+		if !ok {
+			guard.fail(&user.ID, "wrong two-factor code")
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+			return
+		}
+	} else {
+		err := s.TwoFactor.UseRecoveryCode(enrollment.UserID, hashRecoveryCode(request.RecoveryCode), time.Now())
+		if errors.Is(err, ErrNotFound) {
+			guard.fail(&user.ID, "wrong recovery code")
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+			log.Println("Error executing database query:", err)
+			return
+		}
+	}
+
+	if err := s.Revocations.Revoke(jti, enrollment.UserID, time.Unix(int64(exp), 0)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error revoking challenge token:", err)
+		return
+	}
+
+	guard.succeed()
+	startSession(c, s, cfg, enrollment.UserID)
+}
@@ -1,110 +1,269 @@
 package handlers
 
 import (
+	"errors"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/mail"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
-	"gorm.io/gorm"
 )
 
-var secretKey = "Z23adN12*"
-
 type User struct {
-	ID        int    `json:"id,omitempty" db:"id"`
-	Username  string `json:"username,omitempty" db:"username"`
-	Password  string `json:"password,omitempty" db:"password"`
-	CompanyID *int   `json:"companyId,omitempty" db:"company_id"`
-	Role      string `json:"role,omitempty" db:"role"`
+	ID       int    `json:"id,omitempty" db:"id"`
+	Username string `json:"username,omitempty" db:"username"`
+	// Password is the bcrypt hash and never leaves the server
+	Password string `json:"-" db:"password"`
+	// Email is stored normalized by NormalizeEmail
+	Email         string `json:"email,omitempty" db:"email"`
+	EmailVerified bool   `json:"emailVerified" db:"email_verified"`
+	DisplayName   string `json:"displayName,omitempty" db:"display_name"`
+	Bio           string `json:"bio,omitempty" db:"bio"`
+	// Avatar is the URL path of the uploaded avatar image
+	Avatar    string    `json:"avatar,omitempty" db:"avatar"`
+	CompanyID *int      `json:"companyId,omitempty" db:"company_id"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+	UpdatedAt time.Time `json:"updatedAt" db:"updated_at"`
+	// DeleteAfter is when a pending deletion erases the account
+	DeleteAfter *time.Time `json:"deleteAfter,omitempty" db:"delete_after"`
+	// DeletedAt marks the placeholder an anonymized account leaves behind
+	DeletedAt *time.Time `json:"deletedAt,omitempty" db:"deleted_at"`
+}
+
+// PublicUser is what other users may see of an account. Only the profile of
+// the caller carries the email and account state.
+type PublicUser struct {
+	ID          int    `json:"id" db:"id"`
+	Username    string `json:"username" db:"username"`
+	DisplayName string `json:"displayName,omitempty" db:"display_name"`
+	Bio         string `json:"bio,omitempty" db:"bio"`
+	Avatar      string `json:"avatar,omitempty" db:"avatar"`
+	CompanyID   *int   `json:"companyId,omitempty" db:"company_id"`
+}
+
+// TableName loads public users from the users table
+func (PublicUser) TableName() string {
+	return "users"
+}
+
+// Public returns the public view of u
+func (u User) Public() PublicUser {
+	return PublicUser{
+		ID:          u.ID,
+		Username:    u.Username,
+		DisplayName: u.DisplayName,
+		Bio:         u.Bio,
+		Avatar:      u.Avatar,
+		CompanyID:   u.CompanyID,
+	}
+}
+
+// publicUsers returns the public views of users
+func publicUsers(users []User) []PublicUser {
+	public := make([]PublicUser, len(users))
+	for i, user := range users {
+		public[i] = user.Public()
+	}
+	return public
 }
 
-func Register(c *gin.Context, db *gorm.DB) {
-	var user User
-	if err := c.ShouldBindJSON(&user); err != nil {
+// NormalizeEmail returns the form emails are stored and compared in
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Register creates an account with the default role and mails a link to
+// verify its email address
+func Register(c *gin.Context, s *Stores, mailer mail.Mailer, cfg config.EmailVerificationConfig) {
+	var request struct {
+		Username    string `json:"username" binding:"required,min=3,max=32,alphanum"`
+		Email       string `json:"email" binding:"required,email,max=254"`
+		Password    string `json:"password" binding:"required,min=8,max=72"`
+		DisplayName string `json:"displayName" binding:"omitempty,max=64"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	// Check if db is nil
-	if db == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database connection is not initialized"})
+
+	if _, err := s.Users.GetByUsername(request.Username); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Username already taken"})
 		return
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
 		return
 	}
 
-	user.Password = string(hashedPassword)
-
-	// Assign default role during registration
-	user.Role = "user"
+	user := User{
+		Username:    request.Username,
+		Password:    string(hashedPassword),
+		Email:       NormalizeEmail(request.Email),
+		DisplayName: request.DisplayName,
+	}
 
 	// Check for errors during query execution
-	err = db.Create(&user).Error
+	err = s.Users.Create(&user)
+	if errors.Is(err, ErrConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already registered"})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
 		log.Println("Error executing database query:", err)
 		return
 	}
 
+	// Assign default role during registration
+	if err := assignRole(s, user.ID, RoleUser, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	// The account exists either way; a lost email can be sent again
+	if err := sendVerificationEmail(s, mailer, cfg, &user); err != nil {
+		log.Println("Error sending verification email:", err)
+	}
+
 	c.JSON(http.StatusCreated, gin.H{"message": "User registered successfully"})
 }
 
-func Login(c *gin.Context, db *gorm.DB) {
-	var inputUser User
+func Login(c *gin.Context, s *Stores, cfg config.AuthConfig) {
+	var inputUser struct {
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
 	if err := c.ShouldBindJSON(&inputUser); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	var existingUser User
-	err := db.Where("username = ?", inputUser.Username).First(&existingUser).Error
-	if err != nil {
+	// Every failure gets the same response and is counted the same way, so
+	// the response does not reveal whether the username exists
+	guard := newLoginGuard(c, s, cfg.Lockout, inputUser.Username)
+	existingUser, err := s.Users.GetByUsername(inputUser.Username)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	var userID *int
+	if existingUser != nil {
+		userID = &existingUser.ID
+	}
+	if !guard.check(c, userID) {
+		return
+	}
+
+	if existingUser == nil {
+		compareDummyPassword(inputUser.Password)
+		guard.fail(nil, "unknown username")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(existingUser.Password), []byte(inputUser.Password))
 	if err != nil {
+		guard.fail(userID, "wrong password")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
-	accessToken, refreshToken, err := generateTokens(existingUser.ID)
+	if completeLogin(c, s, cfg, existingUser.ID) {
+		guard.succeed()
+	}
+}
+
+// completeLogin starts a session for a user who proved their identity, or
+// with 2FA on, responds with a challenge that LoginTwoFactor exchanges for
+// tokens. It reports whether the session was started.
+func completeLogin(c *gin.Context, s *Stores, cfg config.AuthConfig, userID int) bool {
+	_, enabled, err := twoFactorEnabled(s, userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
-		return
+		log.Println("Error executing database query:", err)
+		return false
+	}
+	if enabled {
+		challenge, err := generateChallengeToken(s, cfg, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+			log.Println("Error issuing tokens:", err)
+			return false
+		}
+		c.JSON(http.StatusOK, gin.H{"two_factor_required": true, "challenge_token": challenge})
+		return false
+	}
+
+	return startSession(c, s, cfg, userID)
+}
+
+// startSession issues the tokens of a completed login and responds with them
+func startSession(c *gin.Context, s *Stores, cfg config.AuthConfig, userID int) bool {
+	// Every login starts a new session and refresh token family
+	familyID, err := newTokenID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return false
+	}
+	if err := createSession(c, s, userID, familyID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error creating session:", err)
+		return false
+	}
+
+	accessToken, refreshToken, err := issueTokens(s, cfg, userID, familyID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error issuing tokens:", err)
+		return false
 	}
 
 	// Set the access token as a cookie
-	c.SetCookie("access_token", accessToken, int((time.Minute * 15).Seconds()), "/", "localhost", false, true)
+	setAuthCookies(c, cfg, accessToken)
 	c.JSON(http.StatusOK, gin.H{"access_token": accessToken, "refresh_token": refreshToken})
+	return true
 }
 
-func generateTokens(userID int) (string, string, error) {
+func generateTokens(s *Stores, cfg config.AuthConfig, userID int, familyID, refreshID string) (string, string, error) {
+	accessID, err := newTokenID()
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
 	claims := jwt.MapClaims{}
 	claims["authorized"] = true
+	claims["type"] = "access"
+	claims["jti"] = accessID
+	claims["family"] = familyID
 	claims["user_id"] = userID
-	claims["exp"] = time.Now().Add(time.Minute * 15).Unix() // Access token expiration time
+	// Millisecond precision so logout-all does not reject a login made in the same second
+	claims["iat"] = float64(now.UnixMilli()) / 1000
+	claims["exp"] = now.Add(cfg.AccessTokenTTL.Duration()).Unix() // Access token expiration time
 
-	at := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	accessToken, err := at.SignedString([]byte(secretKey))
+	accessToken, err := signToken(s, cfg, claims)
 	if err != nil {
 		return "", "", err
 	}
 
 	rtClaims := jwt.MapClaims{}
 	rtClaims["authorized"] = true
+	rtClaims["type"] = "refresh"
+	rtClaims["jti"] = refreshID
+	rtClaims["family"] = familyID
 	rtClaims["user_id"] = userID
-	rtClaims["exp"] = time.Now().Add(time.Hour * 24 * 7).Unix() // Refresh token expiration time
+	rtClaims["exp"] = time.Now().Add(cfg.RefreshTokenTTL.Duration()).Unix() // Refresh token expiration time
 
-	rt := jwt.NewWithClaims(jwt.SigningMethodHS256, rtClaims)
-	refreshToken, err := rt.SignedString([]byte(secretKey))
+	refreshToken, err := signToken(s, cfg, rtClaims)
 	if err != nil {
 		return "", "", err
 	}
@@ -112,73 +271,144 @@ func generateTokens(userID int) (string, string, error) {
 	return accessToken, refreshToken, nil
 }
 
-func Profile(c *gin.Context, db *gorm.DB) {
+// Profile returns the account of the caller
+func Profile(c *gin.Context, s *Stores) {
 	userID, ok := c.Get("user_id")
 	if !ok {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"user_id": userID})
+	user, err := s.Users.GetByID(userID.(int))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
 }
 
-func UpdateProfile(c *gin.Context, db *gorm.DB) {
+// UpdateProfile changes the fields present in the body. A new email has to
+// be verified again.
+func UpdateProfile(c *gin.Context, s *Stores, mailer mail.Mailer, cfg config.EmailVerificationConfig) {
 	userID, _ := c.Get("user_id")
-	var user User
-	if err := db.First(&user, userID).Error; err != nil {
+	user, err := s.Users.GetByID(userID.(int))
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
-	var updatedUser User
-	if err := c.ShouldBindJSON(&updatedUser); err != nil {
+	var request struct {
+		Username    *string `json:"username" binding:"omitempty,min=3,max=32,alphanum"`
+		Email       *string `json:"email" binding:"omitempty,email,max=254"`
+		Password    *string `json:"password" binding:"omitempty,min=8,max=72"`
+		DisplayName *string `json:"displayName" binding:"omitempty,max=64"`
+		Bio         *string `json:"bio" binding:"omitempty,max=500"`
+		CompanyID   *int    `json:"companyId"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// Joining a company routes the user's activity to its webhooks and
+	// lists them among its members, so only those managing it may move in
+	if request.CompanyID != nil && (user.CompanyID == nil || *user.CompanyID != *request.CompanyID) {
+		if _, err := s.Companies.GetByID(uint(*request.CompanyID)); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Company not found"})
+			return
+		}
+		if !authorize(c, s, ActionUpdateCompany, &Company{ID: uint(*request.CompanyID)}) {
+			return
+		}
+	}
 
 	// Update user fields
-	if updatedUser.Username != "" {
-		user.Username = updatedUser.Username
+	if request.Username != nil && *request.Username != "" && *request.Username != user.Username {
+		if _, err := s.Users.GetByUsername(*request.Username); err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Username already taken"})
+			return
+		}
+		user.Username = *request.Username
 	}
-	if updatedUser.Password != "" {
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(updatedUser.Password), bcrypt.DefaultCost)
+	emailChanged := false
+	if request.Email != nil && *request.Email != "" && NormalizeEmail(*request.Email) != user.Email {
+		user.Email = NormalizeEmail(*request.Email)
+		user.EmailVerified = false
+		emailChanged = true
+	}
+	if request.Password != nil && *request.Password != "" {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(*request.Password), bcrypt.DefaultCost)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
 			return
 		}
 		user.Password = string(hashedPassword)
 	}
-	if updatedUser.Role != "" {
-		user.Role = updatedUser.Role
+	if request.DisplayName != nil {
+		user.DisplayName = *request.DisplayName
+	}
+	if request.Bio != nil {
+		user.Bio = *request.Bio
 	}
-	if updatedUser.CompanyID != nil {
-		user.CompanyID = updatedUser.CompanyID
+	// Roles are granted through /users/:userId/roles; company admin rights
+	// are scoped to their company and do not follow a user who moves
+	if request.CompanyID != nil {
+		user.CompanyID = request.CompanyID
 	}
-	// Update other fields as needed
 
-	if err := db.Save(&user).Error; err != nil {
+	err = s.Users.Update(user)
+	if errors.Is(err, ErrConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already registered"})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
 		return
 	}
 
+	if emailChanged {
+		if err := sendVerificationEmail(s, mailer, cfg, user); err != nil {
+			log.Println("Error sending verification email:", err)
+		}
+	}
+
 	c.JSON(http.StatusOK, user)
 }
 
-func AuthMiddleware() gin.HandlerFunc {
+// AuthMiddleware authenticates the request from its access token, read from
+// the configured sources, and rejects revoked tokens. Personal access
+// tokens are accepted from the Authorization header and limited to the
+// routes their scopes allow.
+func AuthMiddleware(s *Stores, cfg config.AuthConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Find the "access_token" cookie
-		tokenString, err := c.Cookie("access_token")
-		if err != nil {
-			log.Println("Access token cookie not present")
+		tokenString, source := extractToken(c, cfg)
+		if tokenString == "" {
+			log.Println("Access token not present")
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			c.Abort()
 			return
 		}
 
+		if source == TokenSourceHeader && strings.HasPrefix(tokenString, accessTokenPrefix) {
+			if !authenticateAccessToken(c, s, tokenString) {
+				c.Abort()
+				return
+			}
+			c.Next()
+			return
+		}
+
+		// Browsers attach cookies on their own, so cookie-authenticated
+		// requests must also prove they can read the CSRF cookie
+		if source == TokenSourceCookie && cfg.CSRF && !checkCSRF(c) {
+			log.Println("Missing or invalid CSRF token")
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid CSRF token"})
+			c.Abort()
+			return
+		}
+
 		// Parse and validate the token
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return []byte(secretKey), nil
-		})
+		token, err := parseToken(s, cfg, tokenString)
 
 		if err != nil || !token.Valid {
 			log.Println("Invalid access token")
@@ -188,7 +418,8 @@ func AuthMiddleware() gin.HandlerFunc {
 		}
 
 		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
+		// Refresh and 2FA challenge tokens are signed with the same key
+		if !ok || claims["type"] != "access" {
 			log.Println("Invalid token claims")
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			c.Abort()
@@ -203,7 +434,33 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		jti, _ := claims["jti"].(string)
+		family, _ := claims["family"].(string)
+		iat, _ := claims["iat"].(float64)
+		issuedAt := time.UnixMilli(int64(iat * 1000))
+		revoked, err := s.Revocations.IsRevoked(jti, family, int(userID), issuedAt)
+		if err != nil {
+			log.Println("Error checking token revocation:", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+			c.Abort()
+			return
+		}
+		if revoked {
+			log.Println("Revoked access token")
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			c.Abort()
+			return
+		}
+
+		exp, _ := claims["exp"].(float64)
+		if family != "" {
+			s.SessionActivity.Seen(family, time.Now())
+		}
+
 		c.Set("user_id", int(userID))
+		c.Set("token_id", jti)
+		c.Set("token_family", family)
+		c.Set("token_expires_at", time.Unix(int64(exp), 0))
 		c.Next()
 	}
 }
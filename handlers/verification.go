@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/mail"
+	"github.com/gin-gonic/gin"
+)
+
+// EmailVerificationToken is a single-use token mailed to prove that a user
+// owns Email. Only the hash of the token is stored.
+type EmailVerificationToken struct {
+	ID        int        `json:"id,omitempty" db:"id"`
+	UserID    int        `json:"userId,omitempty" db:"user_id"`
+	Email     string     `json:"email,omitempty" db:"email"`
+	TokenHash string     `json:"-" db:"token_hash"`
+	ExpiresAt time.Time  `json:"expiresAt,omitempty" db:"expires_at"`
+	UsedAt    *time.Time `json:"usedAt,omitempty" db:"used_at"`
+	CreatedAt time.Time  `json:"createdAt,omitempty" db:"created_at"`
+}
+
+// sendVerificationEmail mails user a link that verifies their current email
+func sendVerificationEmail(s *Stores, mailer mail.Mailer, cfg config.EmailVerificationConfig, user *User) error {
+	token, hash, err := newSecretToken()
+	if err != nil {
+		return err
+	}
+	record := EmailVerificationToken{
+		UserID:    user.ID,
+		Email:     user.Email,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(cfg.TokenTTL.Duration()),
+	}
+	if err := s.EmailVerifications.Create(&record); err != nil {
+		return err
+	}
+
+	link := cfg.URL + "?" + url.Values{"token": {token}}.Encode()
+	return mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Text: fmt.Sprintf("Hi %s,\n\nOpen the link below within %s to confirm that this is your email address:\n\n%s\n",
+			user.Username, cfg.TokenTTL.Duration(), link),
+	})
+}
+
+// VerifyEmail marks the email of a user as verified with a token from the
+// verification email. Tokens sent to an address the user has since changed
+// are rejected.
+func VerifyEmail(c *gin.Context, s *Stores) {
+	var request struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := s.EmailVerifications.Claim(hashToken(request.Token), time.Now())
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	user, err := s.Users.GetByID(token.UserID)
+	if err != nil || user.Email != token.Email {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification token"})
+		return
+	}
+	user.EmailVerified = true
+	if err := s.Users.Update(user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified successfully"})
+}
+
+// ResendVerification mails the caller a new verification link
+func ResendVerification(c *gin.Context, s *Stores, mailer mail.Mailer, cfg config.EmailVerificationConfig) {
+	user, err := s.Users.GetByID(c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	if user.Email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No email address to verify"})
+		return
+	}
+	if user.EmailVerified {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already verified"})
+		return
+	}
+
+	if err := sendVerificationEmail(s, mailer, cfg, user); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+		log.Println("Error sending verification email:", err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Verification email sent"})
+}
+
+// RequireVerifiedEmail keeps accounts that have not verified their email
+// away from the routes it guards. It must run after AuthMiddleware.
+func RequireVerifiedEmail(s *Stores) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := s.Users.GetByID(c.GetInt("user_id"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			c.Abort()
+			return
+		}
+		if !user.EmailVerified {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Email not verified"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,666 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/gin-gonic/gin"
+)
+
+// Webhook events
+const (
+	WebhookPostCreated       = "post.created"
+	WebhookPostUpdated       = "post.updated"
+	WebhookPostDeleted       = "post.deleted"
+	WebhookEngagementCreated = "engagement.created"
+	WebhookEngagementUpdated = "engagement.updated"
+	WebhookEngagementDeleted = "engagement.deleted"
+	WebhookFollowCreated     = "follow.created"
+	WebhookFollowDeleted     = "follow.deleted"
+	// WebhookTest is only sent by the test endpoint and cannot be
+	// subscribed to
+	WebhookTest = "webhook.test"
+)
+
+// WebhookEvents describes every event a webhook can subscribe to
+var WebhookEvents = map[string]string{
+	WebhookPostCreated:       "A post was published",
+	WebhookPostUpdated:       "A post was edited",
+	WebhookPostDeleted:       "A post was deleted",
+	WebhookEngagementCreated: "A post was liked or commented on",
+	WebhookEngagementUpdated: "A like or comment was changed",
+	WebhookEngagementDeleted: "A like or comment was removed",
+	WebhookFollowCreated:     "A user followed another",
+	WebhookFollowDeleted:     "A user unfollowed another",
+}
+
+// Webhook delivery statuses
+const (
+	DeliveryStatusPending    = "pending"
+	DeliveryStatusDelivering = "delivering"
+	DeliveryStatusSucceeded  = "succeeded"
+	// DeliveryStatusDead marks deliveries given up after the last attempt
+	DeliveryStatusDead = "dead"
+)
+
+// Webhook subscribes a URL to the events of a user or, when CompanyID is
+// set, of every member of a company. Secret signs the deliveries and is
+// only returned when the webhook is created.
+type Webhook struct {
+	ID        int       `json:"id" db:"id"`
+	UserID    *int      `json:"userId,omitempty" db:"user_id"`
+	CompanyID *int      `json:"companyId,omitempty" db:"company_id"`
+	URL       string    `json:"url" db:"url"`
+	Events    []string  `json:"events" db:"events" gorm:"serializer:json"`
+	Secret    string    `json:"-" db:"secret"`
+	Active    bool      `json:"active" db:"active"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+	UpdatedAt time.Time `json:"updatedAt" db:"updated_at"`
+}
+
+// WebhookEvent is the body of a delivery. ID is shared by the deliveries of
+// one event, so receivers can drop the ones they have seen.
+type WebhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// WebhookDelivery is one event queued for a webhook, with the outcome of
+// its last attempt
+type WebhookDelivery struct {
+	ID             int             `json:"id" db:"id"`
+	WebhookID      int             `json:"webhookId" db:"webhook_id"`
+	EventID        string          `json:"eventId" db:"event_id"`
+	Event          string          `json:"event" db:"event"`
+	Payload        json.RawMessage `json:"payload" db:"payload" gorm:"serializer:json"`
+	Status         string          `json:"status" db:"status"`
+	Attempts       int             `json:"attempts" db:"attempts"`
+	NextAttemptAt  time.Time       `json:"nextAttemptAt" db:"next_attempt_at"`
+	LastAttemptAt  *time.Time      `json:"lastAttemptAt,omitempty" db:"last_attempt_at"`
+	ResponseStatus int             `json:"responseStatus,omitempty" db:"response_status"`
+	LastError      string          `json:"lastError,omitempty" db:"last_error"`
+	DeliveredAt    *time.Time      `json:"deliveredAt,omitempty" db:"delivered_at"`
+	CreatedAt      time.Time       `json:"createdAt" db:"created_at"`
+}
+
+var webhookDeliveryListSpec = ListSpec{
+	Sorts:   []string{"id"},
+	Desc:    true,
+	Filters: map[string]FilterKind{"status": FilterString, "event": FilterString},
+}
+
+// Errors recorded as the LastError of deliveries. The underlying network
+// errors are not recorded: they would tell users what answers at addresses
+// they cannot otherwise reach.
+var (
+	errWebhookAddressBlocked = errors.New("destination address not allowed")
+	errWebhookTimeout        = errors.New("request timed out")
+	errWebhookRequestFailed  = errors.New("request failed")
+)
+
+// blockedWebhookIP reports whether ip is in a range webhooks may not reach:
+// loopback, private, link-local, multicast or unspecified
+func blockedWebhookIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified()
+}
+
+// validWebhookURL reports whether raw is an absolute http or https URL and,
+// unless allowPrivate, whether its host is not an IP in a blocked range.
+// Host names are checked again when delivering, once resolved.
+func validWebhookURL(raw string, allowPrivate bool) bool {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return false
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !allowPrivate && blockedWebhookIP(ip) {
+		return false
+	}
+	return true
+}
+
+// webhookDialContext resolves the host of addr and dials one of its
+// addresses, refusing to connect when any of them is in a blocked range.
+// Dialing the addresses it checked, rather than the name, means a second
+// DNS answer cannot point the connection elsewhere.
+func webhookDialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			if blockedWebhookIP(ip.IP) {
+				return nil, errWebhookAddressBlocked
+			}
+		}
+
+		for _, ip := range ips {
+			var conn net.Conn
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// webhookRequestError returns the error recorded for a request that got no
+// response
+func webhookRequestError(err error) error {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errWebhookAddressBlocked):
+		return errWebhookAddressBlocked
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errWebhookTimeout
+	default:
+		return errWebhookRequestFailed
+	}
+}
+
+// unknownWebhookEvent returns the first of events that cannot be
+// subscribed to, or ""
+func unknownWebhookEvent(events []string) string {
+	for _, event := range events {
+		if _, ok := WebhookEvents[event]; !ok {
+			return event
+		}
+	}
+	return ""
+}
+
+// newWebhookDelivery builds the delivery of an event to a webhook, due now
+func newWebhookDelivery(webhookID int, event WebhookEvent) (*WebhookDelivery, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookDelivery{
+		WebhookID:     webhookID,
+		EventID:       event.ID,
+		Event:         event.Type,
+		Payload:       payload,
+		Status:        DeliveryStatusPending,
+		NextAttemptAt: event.CreatedAt,
+		CreatedAt:     event.CreatedAt,
+	}, nil
+}
+
+// emitWebhookEvent queues event for every active webhook subscribed to it
+// by one of userIDs or by their companies. The WebhookWorker delivers it;
+// failures are logged and never fail the request that caused the event.
+func emitWebhookEvent(s *Stores, event string, data interface{}, userIDs ...int) {
+	var companyIDs []int
+	for _, userID := range userIDs {
+		user, err := s.Users.GetByID(userID)
+		if err == nil && user.CompanyID != nil {
+			companyIDs = append(companyIDs, *user.CompanyID)
+		}
+	}
+	webhooks, err := s.Webhooks.Subscribed(event, userIDs, companyIDs)
+	if err != nil {
+		log.Println("Error executing database query:", err)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	id, err := newTokenID()
+	if err != nil {
+		log.Println("Error queueing webhook event:", err)
+		return
+	}
+	payload := WebhookEvent{ID: id, Type: event, CreatedAt: time.Now(), Data: data}
+	for _, webhook := range webhooks {
+		delivery, err := newWebhookDelivery(webhook.ID, payload)
+		if err == nil {
+			err = s.Webhooks.CreateDelivery(delivery)
+		}
+		if err != nil {
+			log.Println("Error queueing webhook event:", err)
+		}
+	}
+}
+
+// emitEngagementEvent queues event for the author of an engagement and the
+// author of the post it is on
+func emitEngagementEvent(s *Stores, event string, engagement Engagement) {
+	userIDs := []int{engagement.UserID}
+	if post, err := s.Posts.GetByID(engagement.PostID); err == nil && post.UserID != engagement.UserID {
+		userIDs = append(userIDs, post.UserID)
+	}
+	emitWebhookEvent(s, event, engagement, userIDs...)
+}
+
+// GetWebhookEvents lists the events webhooks can subscribe to
+func GetWebhookEvents(c *gin.Context) {
+	c.JSON(http.StatusOK, WebhookEvents)
+}
+
+// CreateWebhook subscribes a URL to events of the caller or, with a
+// companyId, of the members of a company the caller manages webhooks for.
+// The signing secret is only ever returned by this response.
+func CreateWebhook(c *gin.Context, s *Stores, cfg config.WebhooksConfig) {
+	var request struct {
+		URL       string   `json:"url" binding:"required"`
+		Events    []string `json:"events" binding:"required,min=1"`
+		CompanyID *int     `json:"companyId"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !validWebhookURL(request.URL, cfg.AllowPrivateNetworks) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an absolute http or https URL to a public address"})
+		return
+	}
+	if event := unknownWebhookEvent(request.Events); event != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown event %q", event)})
+		return
+	}
+
+	webhook := Webhook{URL: request.URL, Events: request.Events, Active: true}
+	if request.CompanyID != nil {
+		if _, err := s.Companies.GetByID(uint(*request.CompanyID)); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Company not found"})
+			return
+		}
+		if !authorize(c, s, ActionManageWebhooks, &Company{ID: uint(*request.CompanyID)}) {
+			return
+		}
+		webhook.CompanyID = request.CompanyID
+	} else {
+		userID := c.GetInt("user_id")
+		webhook.UserID = &userID
+	}
+
+	secret, _, err := newSecretToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+	webhook.Secret = secret
+	if err := s.Webhooks.Create(&webhook); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"secret": secret, "webhook": webhook})
+}
+
+// GetWebhooks lists the webhooks of the caller or, with the companyId query
+// parameter, of a company the caller manages webhooks for
+func GetWebhooks(c *gin.Context, s *Stores) {
+	var webhooks []Webhook
+	var err error
+	if raw := c.Query("companyId"); raw != "" {
+		companyID, convErr := strconv.Atoi(raw)
+		if convErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid company ID"})
+			return
+		}
+		if !authorize(c, s, ActionManageWebhooks, &Company{ID: uint(companyID)}) {
+			return
+		}
+		webhooks, err = s.Webhooks.ListByCompany(companyID)
+	} else {
+		webhooks, err = s.Webhooks.ListByUser(c.GetInt("user_id"))
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhooks"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// loadWebhook returns the webhook of the webhookId parameter when the
+// caller owns it or manages the webhooks of its company. Otherwise it
+// responds 404, so webhooks of others cannot be discovered, and returns
+// false.
+func loadWebhook(c *gin.Context, s *Stores) (*Webhook, bool) {
+	webhookID, err := strconv.Atoi(c.Param("webhookId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return nil, false
+	}
+	webhook, err := s.Webhooks.GetByID(webhookID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch webhook"})
+		log.Println("Error executing database query:", err)
+		return nil, false
+	}
+	if err == nil {
+		if webhook.UserID != nil && *webhook.UserID == c.GetInt("user_id") {
+			return webhook, true
+		}
+		if webhook.CompanyID != nil {
+			actor, ok := loadActor(c, s)
+			if !ok {
+				return nil, false
+			}
+			if actor.Can(ActionManageWebhooks, webhook.CompanyID) {
+				return webhook, true
+			}
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+	return nil, false
+}
+
+// GetWebhook returns one webhook
+func GetWebhook(c *gin.Context, s *Stores) {
+	webhook, ok := loadWebhook(c, s)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, webhook)
+}
+
+// UpdateWebhook changes the URL, events or active state of a webhook.
+// Fields left out keep their current value.
+func UpdateWebhook(c *gin.Context, s *Stores, cfg config.WebhooksConfig) {
+	webhook, ok := loadWebhook(c, s)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		URL    *string  `json:"url"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.URL != nil {
+		if !validWebhookURL(*request.URL, cfg.AllowPrivateNetworks) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "url must be an absolute http or https URL to a public address"})
+			return
+		}
+		webhook.URL = *request.URL
+	}
+	if request.Events != nil {
+		if len(request.Events) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "events must not be empty"})
+			return
+		}
+		if event := unknownWebhookEvent(request.Events); event != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown event %q", event)})
+			return
+		}
+		webhook.Events = request.Events
+	}
+	if request.Active != nil {
+		webhook.Active = *request.Active
+	}
+
+	if err := s.Webhooks.Update(webhook); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update webhook"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	c.JSON(http.StatusOK, webhook)
+}
+
+// DeleteWebhook removes a webhook with its delivery log
+func DeleteWebhook(c *gin.Context, s *Stores) {
+	webhook, ok := loadWebhook(c, s)
+	if !ok {
+		return
+	}
+	if err := s.Webhooks.Delete(webhook.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+}
+
+// GetWebhookDeliveries pages through the delivery log of a webhook, newest
+// first, optionally filtered by status or event
+func GetWebhookDeliveries(c *gin.Context, s *Stores) {
+	webhook, ok := loadWebhook(c, s)
+	if !ok {
+		return
+	}
+	query, ok := bindListQuery(c, webhookDeliveryListSpec)
+	if !ok {
+		return
+	}
+
+	deliveries, err := s.Webhooks.ListDeliveries(webhook.ID, query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch deliveries"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	c.JSON(http.StatusOK, newPage(deliveries, query))
+}
+
+// SendTestWebhook queues a webhook.test event for a webhook, whatever its
+// events and even when it is inactive, so receivers can be checked
+func SendTestWebhook(c *gin.Context, s *Stores) {
+	webhook, ok := loadWebhook(c, s)
+	if !ok {
+		return
+	}
+
+	id, err := newTokenID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+	delivery, err := newWebhookDelivery(webhook.ID, WebhookEvent{
+		ID:        id,
+		Type:      WebhookTest,
+		CreatedAt: time.Now(),
+		Data:      gin.H{"webhookId": webhook.ID},
+	})
+	if err == nil {
+		err = s.Webhooks.CreateDelivery(delivery)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue test event"})
+		log.Println("Error executing database query:", err)
+		return
+	}
+	c.JSON(http.StatusAccepted, delivery)
+}
+
+// signWebhook returns the signature of a delivery body sent at timestamp:
+// the hex HMAC-SHA256, keyed with the webhook secret, of the timestamp, a
+// dot and the body
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookWorker delivers queued webhook events. Each delivery is a POST of
+// the event as JSON with the headers X-Webhook-Event, X-Webhook-Delivery,
+// X-Webhook-Timestamp (Unix seconds) and X-Webhook-Signature; any 2xx
+// response is a success. Redirects are not followed, and unless
+// AllowPrivateNetworks is set neither are addresses in the ranges of
+// blockedWebhookIP.
+type WebhookWorker struct {
+	s      *Stores
+	client *http.Client
+	cfg    config.WebhooksConfig
+}
+
+// NewWebhookWorker creates a WebhookWorker
+func NewWebhookWorker(s *Stores, cfg config.WebhooksConfig) *WebhookWorker {
+	dialer := &net.Dialer{Timeout: cfg.Timeout.Duration()}
+	// No Proxy: a proxy, not the checking dialer, would reach the webhook
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: cfg.Timeout.Duration(),
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if !cfg.AllowPrivateNetworks {
+		transport.DialContext = webhookDialContext(dialer)
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   cfg.Timeout.Duration(),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &WebhookWorker{s: s, client: client, cfg: cfg}
+}
+
+// Run delivers due events every interval until ctx is cancelled
+func (w *WebhookWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.Interval.Duration())
+	defer ticker.Stop()
+
+	for {
+		if _, err := w.DeliverDue(time.Now()); err != nil {
+			log.Println("Error delivering webhooks:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverDue attempts a batch of the deliveries due at now, concurrently,
+// and returns how many succeeded. Deliveries a stopped worker left
+// delivering for twice the timeout are attempted again.
+func (w *WebhookWorker) DeliverDue(now time.Time) (int, error) {
+	staleBefore := now.Add(-2 * w.cfg.Timeout.Duration())
+	deliveries, err := w.s.Webhooks.ClaimDue(now, staleBefore, w.cfg.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	var errs []error
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery WebhookDelivery) {
+			defer wg.Done()
+			ok, err := w.deliver(&delivery, now)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("delivery %d: %w", delivery.ID, err))
+			}
+			if ok {
+				succeeded++
+			}
+		}(delivery)
+	}
+	wg.Wait()
+	return succeeded, errors.Join(errs...)
+}
+
+// deliver attempts delivery and records the outcome: success, a retry
+// after the backoff, or dead after the last attempt. The error is only
+// about recording it.
+func (w *WebhookWorker) deliver(delivery *WebhookDelivery, now time.Time) (bool, error) {
+	webhook, err := w.s.Webhooks.GetByID(delivery.WebhookID)
+	if errors.Is(err, ErrNotFound) {
+		// The webhook was deleted with its deliveries meanwhile
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	delivery.Attempts++
+	delivery.LastAttemptAt = &now
+	delivery.ResponseStatus, err = w.post(webhook, delivery)
+	switch {
+	case err == nil:
+		delivery.Status = DeliveryStatusSucceeded
+		delivery.LastError = ""
+		delivered := time.Now()
+		delivery.DeliveredAt = &delivered
+	case delivery.Attempts >= w.cfg.MaxAttempts:
+		delivery.Status = DeliveryStatusDead
+		delivery.LastError = err.Error()
+	default:
+		delivery.Status = DeliveryStatusPending
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = now.Add(w.backoff(delivery.Attempts))
+	}
+	return err == nil, w.s.Webhooks.UpdateDelivery(delivery)
+}
+
+// backoff returns how long to wait after the given number of failed
+// attempts
+func (w *WebhookWorker) backoff(attempts int) time.Duration {
+	wait := w.cfg.InitialBackoff.Duration()
+	for i := 1; i < attempts && wait < w.cfg.MaxBackoff.Duration(); i++ {
+		wait *= 2
+	}
+	if wait > w.cfg.MaxBackoff.Duration() {
+		wait = w.cfg.MaxBackoff.Duration()
+	}
+	return wait
+}
+
+// post sends a delivery to its webhook and returns the response status.
+// Anything but a 2xx response is an error. Errors are those safe to show
+// the owner of the webhook.
+func (w *WebhookWorker) post(webhook *Webhook, delivery *WebhookDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, errWebhookRequestFailed
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", signWebhook(webhook.Secret, timestamp, delivery.Payload))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, webhookRequestError(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+)
+
+const keysUsage = `usage: main [-config file] keys <command>
+
+commands:
+  generate [alg]  add a key that signs new tokens from now on; alg is RS256
+                  or EdDSA (default auth.signing.algorithm)
+  list            list keys and their state
+  retire <kid>    stop signing with a key; it keeps verifying the tokens it
+                  signed for auth.refresh_token_ttl`
+
+// runKeys implements the keys subcommand. Running instances pick up the
+// changes within auth.signing.key_cache_ttl.
+func runKeys(keys handlers.SigningKeyStore, cfg config.AuthConfig, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, keysUsage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "generate":
+		algorithm := cfg.Signing.Algorithm
+		if len(args) > 1 {
+			algorithm = args[1]
+		}
+		key, err := handlers.GenerateSigningKey(algorithm)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := keys.Create(key); err != nil {
+			log.Fatal("Error saving key:", err)
+		}
+		fmt.Printf("Generated %s key %s\n", key.Algorithm, key.ID)
+	case "list":
+		list, err := keys.List()
+		if err != nil {
+			log.Fatal(err)
+		}
+		signing := ""
+		for _, key := range list {
+			if key.RetiredAt == nil {
+				signing = key.ID
+			}
+		}
+		now := time.Now()
+		for _, key := range list {
+			state := "verifying"
+			if key.ID == signing {
+				state = "signing"
+			} else if until := key.VerifiesUntil(cfg); until != nil {
+				if now.After(*until) {
+					state = "expired"
+				} else {
+					state = "retired, verifying until " + until.Format("2006-01-02 15:04:05")
+				}
+			}
+			fmt.Printf("%s  %-5s  created %s  %s\n", key.ID, key.Algorithm, key.CreatedAt.Format("2006-01-02 15:04:05"), state)
+		}
+	case "retire":
+		if len(args) < 2 {
+			log.Fatal("retire expects a key ID")
+		}
+		err := keys.Retire(args[1], time.Now())
+		if errors.Is(err, handlers.ErrNotFound) {
+			log.Fatalf("No active key %s", args[1])
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Retired key %s\n", args[1])
+	default:
+		fmt.Fprintln(os.Stderr, keysUsage)
+		os.Exit(2)
+	}
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
-	"net/http"
+	"os"
 
+	"github.com/Adnen2/tutorial/firstProject/config"
 	handlers "github.com/Adnen2/tutorial/firstProject/handlers"
-	"github.com/gin-contrib/static"
+	"github.com/Adnen2/tutorial/firstProject/mail"
+	"github.com/Adnen2/tutorial/firstProject/migrations"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/jackc/pgx/v4/stdlib"
@@ -14,194 +18,116 @@ import (
 	"gorm.io/gorm"
 )
 
-var (
-	db     *gorm.DB
-	dbName = "firstdb1"
-)
+var db *gorm.DB
 
-func initDB() {
+// initDB connects to the database and handles pending migrations according
+// to cfg.Migrations
+func initDB(cfg config.DatabaseConfig) {
 	var err error
 
-	// Update these values with your actual database credentials and settings
-	username := "admin"
-	password := "admin"
-
-	dsn := fmt.Sprintf("host=localhost user=%s password=%s dbname=%s port=5432 sslmode=disable", username, password, dbName)
 	// Assign the connection to the global db variable, not creating a new local one
-	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err = gorm.Open(postgres.Open(cfg.DSN()), &gorm.Config{})
 	if err != nil {
 		log.Fatal("Error connecting to the database:", err)
 	}
 
-	// Auto-migrate the User model
-	err = db.AutoMigrate(&handlers.User{})
-	// Auto-migrate the Post model
-	err1 := db.AutoMigrate(&handlers.Post{})
-	// Auto-migrate the Engagement model
-	err2 := db.AutoMigrate(&handlers.Engagement{})
-	// Auto-migrate the Notification model
-	err3 := db.AutoMigrate(&handlers.Notification{})
-	// Auto-migrate the Follow model
-	err4 := db.AutoMigrate(&handlers.Follow{})
-	// Auto-migrate the Search model
-	err5 := db.AutoMigrate(&handlers.Search{})
-	// Auto-migrate the PostView model
-	err6 := db.AutoMigrate(&handlers.PostView{})
-	// Auto-migrate the EngagementMetrics model
-	err7 := db.AutoMigrate(&handlers.EngagementMetrics{})
-	// Auto-migrate the Company model
-	err8 := db.AutoMigrate(&handlers.Company{})
-	// Auto-migrate the Role model
-	err9 := db.AutoMigrate(&handlers.Role{})
-	if err != nil && err1 != nil && err2 != nil && err3 != nil && err4 != nil && err5 != nil && err6 != nil && err7 != nil && err8 != nil && err9 != nil {
-		log.Fatal("Error auto-migrating database:", err)
-	}
-
-	// This line is optional but closes the database connection when the main function exits
-	//  sqlDB, err := db.DB()
+	sqlDB, err := db.DB()
 	if err != nil {
 		log.Fatal("Error getting underlying *sql.DB:", err)
 	}
-	// defer sqlDB.Close()
+	migrator, err := migrations.New(sqlDB)
+	if err != nil {
+		log.Fatal("Error loading migrations:", err)
+	}
 
-	fmt.Println("Connected to PostgreSQL and auto-migrated tables!")
+	switch cfg.Migrations {
+	case "auto":
+		applied, err := migrator.Up(context.Background())
+		if err != nil {
+			log.Fatal("Error migrating database:", err)
+		}
+		for _, m := range applied {
+			fmt.Printf("Applied migration %d_%s\n", m.Version, m.Name)
+		}
+	case "check":
+		pending, err := migrator.Pending(context.Background())
+		if err != nil {
+			log.Fatal("Error checking migrations:", err)
+		}
+		if len(pending) > 0 {
+			log.Fatalf("Database schema is out of date: %d pending migration(s), run the migrate up command first", len(pending))
+		}
+	}
+
+	fmt.Println("Connected to PostgreSQL!")
 }
 
 func main() {
-	initDB()
-
-	router := gin.Default()
-	// user routes
-	router.POST("/register", func(c *gin.Context) {
-		handlers.Register(c, db)
-	})
-	router.POST("/login", func(c *gin.Context) {
-		handlers.Login(c, db)
-	})
-	router.GET("/profile", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.Profile(c, db)
-	})
-
-	router.PUT("/update-profile", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.UpdateProfile(c, db)
-	})
-	//Router of post
-	router.POST("/create-post", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.CreatePost(c, db)
-	})
-
-	router.PUT("/edit-post/:postId", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.EditPost(c, db)
-	})
-	router.DELETE("/posts/:postId", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.DeletePost(c, db)
-	})
-	router.GET("/posts/:postId", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.GetPostByID(c, db)
-	})
-	router.GET("/posts", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.GetAllPosts(c, db)
-	})
-	//Engagement router
-	router.POST("/engagements", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.CreateEngagement(c, db)
-	})
-	router.PUT("/engagements/:engagementId", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.UpdateEngagement(c, db)
-	})
-	router.DELETE("/engagements/:engagementId", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.DeleteEngagement(c, db)
-	})
-	router.GET("/engagements/:postId", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.GetEngagementsForPost(c, db)
-	})
-	// Notification routes
-	router.POST("/notifications", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.CreateNotification(c, db)
-	})
-	router.GET("/notifications", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.GetNotifications(c, db)
-	})
-	router.PATCH("/notifications/:notificationId/read", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.MarkNotificationAsRead(c, db)
-	})
-	// Follow/Unfollow routes
-	router.POST("/follow", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.FollowUser(c, db)
-	})
-
-	router.DELETE("/unfollow/:followingId", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.UnfollowUser(c, db)
-	})
-
-	router.GET("/followers/:userId", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.GetFollowers(c, db)
-	})
-
-	router.GET("/followings/:userId", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.GetFollowings(c, db)
-	})
-	// Add these search routes
-	router.POST("/search/posts", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.SearchPosts(c, db)
-	})
-
-	router.POST("/search/users", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.SearchUsers(c, db)
-	})
-	// New routes for Analytics
-	router.POST("/track-post-view", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.TrackPostView(c, db)
-	})
-	router.GET("/post-analytics/:postId", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.GetPostAnalytics(c, db)
-	})
-	// Serve uploaded files
-	router.Use(static.Serve("/", static.LocalFile("./uploads", true)))
-
-	// File upload endpoints
-	router.POST("/upload", handlers.UploadFile)
-	router.GET("/files", handlers.GetUploadedFiles)
-	//company router
-	router.POST("/create-company", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.CreateCompany(c, db)
-	})
-	router.GET("/companies/:companyId", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.GetCompanyByID(c, db)
-	})
-	router.PUT("/companies/:companyId", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.UpdateCompany(c, db)
-	})
-	router.DELETE("/companies/:companyId", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.DeleteCompany(c, db)
-	})
-	// Role routes
-	router.POST("/roles", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.CreateRole(c, db)
-	})
-
-	router.PUT("/roles/:roleId", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.EditRole(c, db)
-	})
-
-	router.DELETE("/roles/:roleId", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.DeleteRole(c, db)
-	})
-
-	router.GET("/roles", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.GetAllRoles(c, db)
-	})
-
-	router.GET("/roles/:roleId", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.GetRoleByID(c, db)
-	})
-	// Debugging route
-	router.GET("/debug/routes", func(c *gin.Context) {
-		fmt.Println("yes")
-		c.JSON(http.StatusOK, router.Routes())
-	})
-
-	err := router.Run(":8080")
+	configPath := flag.String("config", os.Getenv("APP_CONFIG"), "path to a YAML or TOML config file")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal("Invalid configuration:\n", err)
+	}
+	gin.SetMode(cfg.Server.Mode)
+
+	if flag.Arg(0) == "migrate" {
+		runMigrate(cfg.Database, flag.Args()[1:])
+		return
+	}
+
+	initDB(cfg.Database)
+
+	stores := handlers.NewPostgresStores(db)
+	feed := handlers.NewFeed(cfg.Feed, stores.Timelines)
+	oauth := handlers.NewOAuth(cfg.OAuth, nil)
+	mailer, err := mail.New(cfg.Mail)
+	if err != nil {
+		log.Fatal("Error setting up mail:", err)
+	}
+
+	if flag.Arg(0) == "rebuild-timelines" {
+		if err := stores.Timelines.Rebuild(); err != nil {
+			log.Fatal("Error rebuilding timelines:", err)
+		}
+		fmt.Println("Timelines rebuilt")
+		return
+	}
+
+	if flag.Arg(0) == "keys" {
+		runKeys(stores.SigningKeys, cfg.Auth, flag.Args()[1:])
+		return
+	}
+
+	if err := stores.Roles.Seed(); err != nil {
+		log.Fatal("Error seeding roles:", err)
+	}
+
+	go stores.SessionActivity.Run(context.Background(), cfg.Auth.Sessions.FlushInterval.Duration())
+	if cfg.Notifications.Broker == "postgres" {
+		broker := handlers.NewPostgresBroker(db, cfg.Database.DSN(), stores.Notifications)
+		stores.Broker = broker
+		go broker.Run(context.Background())
+	}
+	go handlers.NewAccountWorker(stores, mailer, cfg.Account).Run(context.Background())
+	if cfg.Notifications.Digest.Enabled {
+		go handlers.NewDigestWorker(stores, mailer, cfg.Notifications.Digest).Run(context.Background())
+	}
+	if cfg.Webhooks.Enabled {
+		go handlers.NewWebhookWorker(stores, cfg.Webhooks).Run(context.Background())
+	}
+
+	if cfg.Publisher.Enabled {
+		go handlers.NewPublisher(stores, feed, cfg.Publisher).Run(context.Background())
+	}
+
+	router, err := handlers.NewRouter(stores, cfg, mailer, feed, oauth)
+	if err != nil {
+		log.Fatal("Error setting up routes:", err)
+	}
+
+	err = router.Run(cfg.Server.Addr)
 	if err != nil {
 		log.Fatal(err)
 	}
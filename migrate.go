@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/migrations"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+const migrateUsage = `usage: main [-config file] migrate <command>
+
+commands:
+  up        apply every pending migration
+  down [n]  revert the last n migrations (default 1)
+  status    list migrations and when they were applied
+  redo      revert and re-apply the last migration`
+
+// runMigrate implements the migrate subcommand
+func runMigrate(cfg config.DatabaseConfig, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+
+	conn, err := gorm.Open(postgres.Open(cfg.DSN()), &gorm.Config{})
+	if err != nil {
+		log.Fatal("Error connecting to the database:", err)
+	}
+	sqlDB, err := conn.DB()
+	if err != nil {
+		log.Fatal("Error getting underlying *sql.DB:", err)
+	}
+	defer sqlDB.Close()
+
+	migrator, err := migrations.New(sqlDB)
+	if err != nil {
+		log.Fatal("Error loading migrations:", err)
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, m := range applied {
+			fmt.Printf("Applied %d_%s\n", m.Version, m.Name)
+		}
+		if len(applied) == 0 {
+			fmt.Println("Schema is up to date")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatal("down expects a positive number of steps")
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, m := range reverted {
+			fmt.Printf("Reverted %d_%s\n", m.Version, m.Name)
+		}
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.AppliedAt != nil {
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, state)
+		}
+	case "redo":
+		redone, err := migrator.Redo(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if redone == nil {
+			fmt.Println("No migration has been applied")
+			return
+		}
+		fmt.Printf("Redid %d_%s\n", redone.Version, redone.Name)
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS roles;
+DROP TABLE IF EXISTS engagement_metrics;
+DROP TABLE IF EXISTS post_views;
+DROP TABLE IF EXISTS follows;
+DROP TABLE IF EXISTS notifications;
+DROP TABLE IF EXISTS engagements;
+DROP TABLE IF EXISTS posts;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS companies;
@@ -0,0 +1,66 @@
+-- Tables previously created by gorm AutoMigrate. IF NOT EXISTS lets this
+-- migration adopt databases that were set up before migrations existed.
+CREATE TABLE IF NOT EXISTS companies (
+    id          bigserial PRIMARY KEY,
+    name        text,
+    description text
+);
+
+CREATE TABLE IF NOT EXISTS users (
+    id         bigserial PRIMARY KEY,
+    username   text,
+    password   text,
+    company_id bigint,
+    role       text,
+    CONSTRAINT fk_companies_teams FOREIGN KEY (company_id) REFERENCES companies (id)
+);
+
+CREATE TABLE IF NOT EXISTS posts (
+    id            bigserial PRIMARY KEY,
+    content       text,
+    schedule_time timestamptz,
+    user_id       bigint
+);
+
+CREATE TABLE IF NOT EXISTS engagements (
+    id      bigserial PRIMARY KEY,
+    post_id bigint,
+    user_id bigint,
+    "like"  boolean,
+    comment text
+);
+
+CREATE TABLE IF NOT EXISTS notifications (
+    id         bigserial PRIMARY KEY,
+    user_id    bigint,
+    message    text,
+    is_read    boolean,
+    created_at timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS follows (
+    id           bigserial PRIMARY KEY,
+    follower_id  bigint,
+    following_id bigint
+);
+
+CREATE TABLE IF NOT EXISTS post_views (
+    id          bigserial PRIMARY KEY,
+    post_id     bigint,
+    user_id     bigint,
+    "timestamp" timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS engagement_metrics (
+    post_id bigint,
+    "like"  bigint,
+    comment bigint,
+    "view"  bigint,
+    user_id bigint
+);
+
+CREATE TABLE IF NOT EXISTS roles (
+    id      bigserial PRIMARY KEY,
+    user_id bigint,
+    type    text
+);
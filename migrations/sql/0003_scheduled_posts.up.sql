@@ -0,0 +1,5 @@
+-- Existing posts were already visible, so they are all marked published
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'published';
+ALTER TABLE posts ADD COLUMN IF NOT EXISTS published_at timestamptz;
+
+CREATE INDEX IF NOT EXISTS idx_posts_scheduled ON posts (schedule_time) WHERE status = 'scheduled';
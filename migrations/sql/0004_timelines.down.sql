@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS timeline_entries;
+DROP INDEX IF EXISTS idx_follows_following_id;
+DROP INDEX IF EXISTS idx_follows_follower_id;
+DROP INDEX IF EXISTS idx_posts_user_published;
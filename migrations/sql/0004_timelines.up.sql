@@ -0,0 +1,17 @@
+-- Timelines are ordered by published_at, so every published post needs one.
+-- Posts from before scheduling existed fall back to their schedule time.
+UPDATE posts SET published_at = schedule_time WHERE status = 'published' AND published_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_posts_user_published ON posts (user_id, published_at DESC, id DESC) WHERE status = 'published';
+CREATE INDEX IF NOT EXISTS idx_follows_follower_id ON follows (follower_id);
+CREATE INDEX IF NOT EXISTS idx_follows_following_id ON follows (following_id);
+
+-- Materialized home timelines, used by the fanout feed strategy
+CREATE TABLE IF NOT EXISTS timeline_entries (
+    user_id      bigint NOT NULL,
+    post_id      bigint NOT NULL REFERENCES posts (id) ON DELETE CASCADE,
+    author_id    bigint NOT NULL,
+    published_at timestamptz NOT NULL,
+    PRIMARY KEY (user_id, post_id)
+);
+CREATE INDEX IF NOT EXISTS idx_timeline_entries_page ON timeline_entries (user_id, published_at DESC, post_id DESC);
@@ -0,0 +1,25 @@
+-- Assignments collapse back into users.role and (user_id, type) rows; roles
+-- created since, and the scope of company assignments, are lost.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role text;
+UPDATE users SET role = 'user';
+UPDATE users u SET role = r.name
+FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+WHERE ur.user_id = u.id AND r.name IN ('admin', 'company_admin');
+
+CREATE TABLE legacy_roles (
+    id      bigserial PRIMARY KEY,
+    user_id bigint,
+    type    text
+);
+INSERT INTO legacy_roles (user_id, type)
+SELECT ur.user_id, r.name FROM user_roles ur JOIN roles r ON r.id = ur.role_id
+WHERE r.name <> 'user'
+ORDER BY ur.id;
+
+DROP TABLE user_roles;
+DROP TABLE role_permissions;
+DROP TABLE roles;
+DROP TABLE permissions;
+
+ALTER TABLE legacy_roles RENAME TO roles;
+ALTER SEQUENCE legacy_roles_id_seq RENAME TO roles_id_seq;
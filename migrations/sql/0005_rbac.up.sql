@@ -0,0 +1,93 @@
+-- Roles become named sets of permissions assigned to users, globally or
+-- within a company. The old roles table held free-text (user_id, type)
+-- pairs; it is kept aside until its rows have been converted.
+ALTER TABLE roles RENAME TO legacy_roles;
+ALTER SEQUENCE IF EXISTS roles_id_seq RENAME TO legacy_roles_id_seq;
+
+CREATE TABLE permissions (
+    name        text PRIMARY KEY,
+    description text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE roles (
+    id          bigserial PRIMARY KEY,
+    name        text NOT NULL UNIQUE,
+    description text NOT NULL DEFAULT '',
+    system      boolean NOT NULL DEFAULT false,
+    created_at  timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE role_permissions (
+    role_id    bigint NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    permission text NOT NULL REFERENCES permissions (name) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission)
+);
+
+CREATE TABLE user_roles (
+    id         bigserial PRIMARY KEY,
+    user_id    bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    role_id    bigint NOT NULL REFERENCES roles (id) ON DELETE CASCADE,
+    company_id bigint REFERENCES companies (id) ON DELETE CASCADE,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+-- A role is assigned at most once globally and once per company
+CREATE UNIQUE INDEX idx_user_roles_global ON user_roles (user_id, role_id) WHERE company_id IS NULL;
+CREATE UNIQUE INDEX idx_user_roles_company ON user_roles (user_id, role_id, company_id) WHERE company_id IS NOT NULL;
+
+-- Default roles, kept in line with handlers.Permissions and
+-- handlers.DefaultRoles, which the server also seeds on start
+INSERT INTO permissions (name, description) VALUES
+    ('*', 'Every permission'),
+    ('posts:create', 'Publish posts'),
+    ('posts:update', 'Edit posts of other users'),
+    ('posts:delete', 'Delete posts of other users'),
+    ('engagements:create', 'Like and comment on posts'),
+    ('engagements:update', 'Edit engagements of other users'),
+    ('engagements:delete', 'Delete engagements of other users'),
+    ('companies:create', 'Create companies'),
+    ('companies:update', 'Edit companies'),
+    ('companies:delete', 'Delete companies'),
+    ('roles:manage', 'Create, edit and delete roles'),
+    ('roles:grant', 'Grant and revoke roles');
+
+INSERT INTO roles (name, description, system) VALUES
+    ('admin', 'Can do everything', true),
+    ('moderator', 'Removes posts and engagements of other users', true),
+    ('company_admin', 'Manages a company and the roles of its members', true),
+    ('user', 'Default role of every registered user', true);
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT r.id, p.permission
+FROM roles r
+JOIN (VALUES
+    ('admin', '*'),
+    ('moderator', 'posts:delete'),
+    ('moderator', 'engagements:delete'),
+    ('company_admin', 'companies:update'),
+    ('company_admin', 'companies:delete'),
+    ('company_admin', 'roles:grant'),
+    ('user', 'posts:create'),
+    ('user', 'engagements:create'),
+    ('user', 'companies:create')
+) AS p (role, permission) ON p.role = r.name;
+
+-- Every existing user keeps the default role. users.role and the legacy
+-- rows become assignments when they name a known role; company admins are
+-- scoped to the company they belong to.
+INSERT INTO user_roles (user_id, role_id)
+SELECT u.id, r.id FROM users u JOIN roles r ON r.name = 'user';
+
+INSERT INTO user_roles (user_id, role_id, company_id)
+SELECT DISTINCT u.id, r.id, CASE WHEN r.name = 'company_admin' THEN u.company_id END
+FROM (
+    SELECT id, role FROM users
+    UNION
+    SELECT l.user_id, l.type FROM legacy_roles l JOIN users ON users.id = l.user_id
+) AS granted (user_id, role)
+JOIN users u ON u.id = granted.user_id
+JOIN roles r ON r.name = granted.role
+WHERE r.name <> 'company_admin' OR u.company_id IS NOT NULL
+ON CONFLICT DO NOTHING;
+
+DROP TABLE legacy_roles;
+ALTER TABLE users DROP COLUMN IF EXISTS role;
@@ -0,0 +1,13 @@
+-- Password resets are mailed, so users need an address to receive them
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email text;
+CREATE INDEX IF NOT EXISTS idx_users_email ON users (lower(email));
+
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    id         bigserial PRIMARY KEY,
+    user_id    bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    token_hash text NOT NULL UNIQUE,
+    expires_at timestamptz NOT NULL,
+    used_at    timestamptz,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user_id ON password_reset_tokens (user_id);
@@ -0,0 +1,30 @@
+-- Emails are stored trimmed and lower-cased and belong to one account. Of
+-- accounts sharing an address, the oldest keeps it.
+UPDATE users SET email = lower(btrim(email)) WHERE email IS NOT NULL;
+UPDATE users u SET email = NULL
+FROM users o
+WHERE o.email = u.email AND o.id < u.id;
+DROP INDEX IF EXISTS idx_users_email;
+CREATE UNIQUE INDEX idx_users_email ON users (email) WHERE email IS NOT NULL AND email <> '';
+
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS email_verified boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS display_name text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS bio text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS avatar text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS created_at timestamptz NOT NULL DEFAULT now(),
+    ADD COLUMN IF NOT EXISTS updated_at timestamptz NOT NULL DEFAULT now();
+
+-- Accounts from before verification existed keep their access
+UPDATE users SET email_verified = true;
+
+CREATE TABLE IF NOT EXISTS email_verification_tokens (
+    id         bigserial PRIMARY KEY,
+    user_id    bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    email      text NOT NULL,
+    token_hash text NOT NULL UNIQUE,
+    expires_at timestamptz NOT NULL,
+    used_at    timestamptz,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_email_verification_tokens_user_id ON email_verification_tokens (user_id);
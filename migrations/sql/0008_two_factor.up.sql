@@ -0,0 +1,17 @@
+-- TOTP enrollments; confirmed_at stays NULL until the first code is accepted
+CREATE TABLE IF NOT EXISTS two_factors (
+    user_id      bigint PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    secret       text NOT NULL,
+    last_step    bigint NOT NULL DEFAULT 0,
+    confirmed_at timestamptz,
+    created_at   timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id         bigserial PRIMARY KEY,
+    user_id    bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    code_hash  text NOT NULL,
+    used_at    timestamptz,
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes (user_id);
@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE name IN ('users:unlock', 'audit:read');
+DROP TABLE IF EXISTS audit_events;
+DROP TABLE IF EXISTS login_throttles;
@@ -0,0 +1,23 @@
+-- Failed logins per key: "account:<username>" or "ip:<address>"
+CREATE TABLE IF NOT EXISTS login_throttles (
+    key             text PRIMARY KEY,
+    failures        integer NOT NULL,
+    last_failure_at timestamptz NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS audit_events (
+    id         bigserial PRIMARY KEY,
+    type       text NOT NULL,
+    user_id    bigint REFERENCES users (id) ON DELETE SET NULL,
+    username   text NOT NULL DEFAULT '',
+    ip         text NOT NULL DEFAULT '',
+    detail     text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_audit_events_type ON audit_events (type);
+CREATE INDEX IF NOT EXISTS idx_audit_events_user_id ON audit_events (user_id);
+
+INSERT INTO permissions (name, description) VALUES
+    ('users:unlock', 'Unlock accounts locked after failed logins'),
+    ('audit:read', 'Read the audit log')
+ON CONFLICT (name) DO NOTHING;
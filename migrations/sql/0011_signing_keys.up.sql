@@ -0,0 +1,8 @@
+-- PKCS #8 PEM private keys that sign JWTs; the kid is the id
+CREATE TABLE IF NOT EXISTS signing_keys (
+    id          text PRIMARY KEY,
+    algorithm   text NOT NULL,
+    private_key text NOT NULL,
+    created_at  timestamptz NOT NULL DEFAULT now(),
+    retired_at  timestamptz
+);
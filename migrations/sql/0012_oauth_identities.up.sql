@@ -0,0 +1,22 @@
+-- Provider accounts linked to users
+CREATE TABLE IF NOT EXISTS identities (
+    id         bigserial PRIMARY KEY,
+    user_id    bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    provider   text NOT NULL,
+    subject    text NOT NULL,
+    email      text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT now(),
+    UNIQUE (provider, subject)
+);
+CREATE INDEX IF NOT EXISTS idx_identities_user_id ON identities (user_id);
+
+-- Provider sign-ins in progress
+CREATE TABLE IF NOT EXISTS oauth_states (
+    state_hash    text PRIMARY KEY,
+    provider      text NOT NULL,
+    nonce         text NOT NULL,
+    code_verifier text NOT NULL,
+    user_id       bigint REFERENCES users (id) ON DELETE CASCADE,
+    expires_at    timestamptz NOT NULL,
+    created_at    timestamptz NOT NULL DEFAULT now()
+);
@@ -0,0 +1,11 @@
+-- One row per login, sharing its ID with the login's refresh token family
+CREATE TABLE IF NOT EXISTS sessions (
+    id           text PRIMARY KEY,
+    user_id      bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    user_agent   text NOT NULL DEFAULT '',
+    ip           text NOT NULL DEFAULT '',
+    created_at   timestamptz NOT NULL DEFAULT now(),
+    last_seen_at timestamptz NOT NULL DEFAULT now(),
+    revoked_at   timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS account_exports;
+ALTER TABLE users
+    DROP COLUMN IF EXISTS deleted_at,
+    DROP COLUMN IF EXISTS delete_after;
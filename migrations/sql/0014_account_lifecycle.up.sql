@@ -0,0 +1,21 @@
+-- delete_after is set while a deletion is pending; deleted_at marks the
+-- placeholder left by an anonymized account
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS delete_after timestamptz,
+    ADD COLUMN IF NOT EXISTS deleted_at timestamptz;
+CREATE INDEX IF NOT EXISTS idx_users_delete_after ON users (delete_after) WHERE delete_after IS NOT NULL;
+
+-- Personal data exports, built in the background
+CREATE TABLE IF NOT EXISTS account_exports (
+    id           bigserial PRIMARY KEY,
+    user_id      bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    status       text NOT NULL,
+    path         text NOT NULL DEFAULT '',
+    error        text NOT NULL DEFAULT '',
+    started_at   timestamptz,
+    completed_at timestamptz,
+    expires_at   timestamptz,
+    created_at   timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_account_exports_user_id ON account_exports (user_id);
+CREATE INDEX IF NOT EXISTS idx_account_exports_status ON account_exports (status);
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_notifications_user_id_updated_at;
+DROP INDEX IF EXISTS idx_notifications_unread_group;
+ALTER TABLE notifications
+    DROP COLUMN IF EXISTS updated_at,
+    DROP COLUMN IF EXISTS group_key,
+    DROP COLUMN IF EXISTS post_id,
+    DROP COLUMN IF EXISTS actor_count,
+    DROP COLUMN IF EXISTS actor_ids,
+    DROP COLUMN IF EXISTS type;
@@ -0,0 +1,15 @@
+-- Notifications are emitted by the server with structured payloads. Rows
+-- from before are system notifications with a plain message.
+ALTER TABLE notifications
+    ADD COLUMN IF NOT EXISTS type text NOT NULL DEFAULT 'system',
+    ADD COLUMN IF NOT EXISTS actor_ids jsonb NOT NULL DEFAULT '[]',
+    ADD COLUMN IF NOT EXISTS actor_count integer NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS post_id bigint,
+    ADD COLUMN IF NOT EXISTS group_key text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS updated_at timestamptz;
+UPDATE notifications SET updated_at = created_at WHERE updated_at IS NULL;
+
+-- At most one unread notification collects each group of events
+CREATE UNIQUE INDEX IF NOT EXISTS idx_notifications_unread_group
+    ON notifications (user_id, group_key) WHERE is_read IS NOT TRUE AND group_key <> '';
+CREATE INDEX IF NOT EXISTS idx_notifications_user_id_updated_at ON notifications (user_id, updated_at);
@@ -0,0 +1,14 @@
+-- What each user wants to hear about, per notification type. Types without
+-- a row use the defaults: in-app and in the email digest.
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id      bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    type         text NOT NULL,
+    in_app       boolean NOT NULL DEFAULT true,
+    email_digest boolean NOT NULL DEFAULT true,
+    muted        boolean NOT NULL DEFAULT false,
+    updated_at   timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, type)
+);
+
+-- Unread badges count the unread notifications of a user
+CREATE INDEX IF NOT EXISTS idx_notifications_user_id_unread ON notifications (user_id) WHERE is_read IS NOT TRUE;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_notifications_updated_at;
+DROP TABLE IF EXISTS digests;
+DROP TABLE IF EXISTS digest_subscriptions;
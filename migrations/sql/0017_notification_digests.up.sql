@@ -0,0 +1,25 @@
+-- How often each user receives the email digest. Users without a row get
+-- the configured default; secret signs their unsubscribe links.
+CREATE TABLE IF NOT EXISTS digest_subscriptions (
+    user_id    bigint PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    frequency  text NOT NULL,
+    secret     text NOT NULL DEFAULT '',
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+-- Every digest is claimed here before it is sent, so it is sent at most
+-- once per user and period
+CREATE TABLE IF NOT EXISTS digests (
+    id                 bigserial PRIMARY KEY,
+    user_id            bigint NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    frequency          text NOT NULL,
+    period_start       timestamptz NOT NULL,
+    period_end         timestamptz NOT NULL,
+    notification_count integer NOT NULL DEFAULT 0,
+    sent_at            timestamptz,
+    created_at         timestamptz NOT NULL DEFAULT now(),
+    UNIQUE (user_id, period_end)
+);
+
+-- The digest worker looks up the users with notifications updated in a period
+CREATE INDEX IF NOT EXISTS idx_notifications_updated_at ON notifications (updated_at);
@@ -0,0 +1,45 @@
+-- Outgoing webhooks belong to a user or to a company, never both. secret
+-- signs the deliveries; events is a JSON array of event types.
+CREATE TABLE IF NOT EXISTS webhooks (
+    id         bigserial PRIMARY KEY,
+    user_id    bigint REFERENCES users (id) ON DELETE CASCADE,
+    company_id bigint REFERENCES companies (id) ON DELETE CASCADE,
+    url        text NOT NULL,
+    events     jsonb NOT NULL DEFAULT '[]',
+    secret     text NOT NULL,
+    active     boolean NOT NULL DEFAULT true,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now(),
+    CHECK ((user_id IS NULL) <> (company_id IS NULL))
+);
+CREATE INDEX IF NOT EXISTS idx_webhooks_user_id ON webhooks (user_id);
+CREATE INDEX IF NOT EXISTS idx_webhooks_company_id ON webhooks (company_id);
+
+-- Every event queued for a webhook, with the outcome of its last attempt
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id              bigserial PRIMARY KEY,
+    webhook_id      bigint NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+    event_id        text NOT NULL,
+    event           text NOT NULL,
+    payload         jsonb NOT NULL,
+    status          text NOT NULL,
+    attempts        integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamptz NOT NULL DEFAULT now(),
+    last_attempt_at timestamptz,
+    response_status integer NOT NULL DEFAULT 0,
+    last_error      text NOT NULL DEFAULT '',
+    delivered_at    timestamptz,
+    created_at      timestamptz NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id, id);
+-- The worker looks up the deliveries due or left delivering
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at)
+    WHERE status IN ('pending', 'delivering');
+
+INSERT INTO permissions (name, description) VALUES
+    ('webhooks:manage', 'Manage the webhooks of companies')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions (role_id, permission)
+SELECT id, 'webhooks:manage' FROM roles WHERE name = 'company_admin'
+ON CONFLICT DO NOTHING;
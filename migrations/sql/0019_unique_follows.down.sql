@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_follows_follower_following;
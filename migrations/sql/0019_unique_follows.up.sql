@@ -0,0 +1,9 @@
+-- A user follows another at most once. Repeated follows used to be stored
+-- again; the oldest of each pair is kept.
+DELETE FROM follows f
+USING follows kept
+WHERE kept.follower_id = f.follower_id
+  AND kept.following_id = f.following_id
+  AND kept.id < f.id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_follows_follower_following ON follows (follower_id, following_id);
@@ -0,0 +1,133 @@
+package test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersonalAccessTokens(t *testing.T) {
+	app := newTestApp(t)
+	stores := app.stores
+	user := handlers.User{Username: "alice"}
+	require.NoError(t, stores.Users.Create(&user))
+	jwt := app.token(user)
+
+	createToken := func(t *testing.T, body string) (string, handlers.PersonalAccessToken) {
+		w := app.send("POST", "/access-tokens", body, bearer(jwt))
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var response struct {
+			Token       string                       `json:"token"`
+			AccessToken handlers.PersonalAccessToken `json:"accessToken"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response.Token, response.AccessToken
+	}
+
+	t.Run("Create validates scopes", func(t *testing.T) {
+		w := app.send("POST", "/access-tokens", `{"name": "ci", "scopes": ["posts:delete"]}`, bearer(jwt))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w = app.send("POST", "/access-tokens", `{"name": "ci", "scopes": []}`, bearer(jwt))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("The token is only shown once", func(t *testing.T) {
+		raw, token := createToken(t, `{"name": "ci", "scopes": ["users:read"]}`)
+		assert.Contains(t, raw, "pat_")
+		assert.Equal(t, raw[:len(token.Prefix)], token.Prefix)
+
+		w := app.send("GET", "/access-tokens", "", bearer(jwt))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), raw)
+		assert.Contains(t, w.Body.String(), token.Prefix)
+	})
+
+	t.Run("Scopes limit the routes a token can use", func(t *testing.T) {
+		raw, token := createToken(t, `{"name": "profile reader", "scopes": ["users:read"]}`)
+
+		w := app.send("GET", "/profile", "", bearer(raw))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "alice")
+
+		w = app.send("GET", "/posts", "", bearer(raw))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), "posts:read")
+
+		tokens, err := stores.AccessTokens.ListByUser(user.ID)
+		require.NoError(t, err)
+		for _, listed := range tokens {
+			if listed.ID == token.ID {
+				assert.NotNil(t, listed.LastUsedAt, "use of the token is recorded")
+			}
+		}
+	})
+
+	t.Run("Tokens cannot manage tokens", func(t *testing.T) {
+		raw, _ := createToken(t, `{"name": "everything", "scopes": ["users:read", "users:write", "posts:read"]}`)
+		w := app.send("POST", "/access-tokens", `{"name": "child", "scopes": ["users:read"]}`, bearer(raw))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = app.send("GET", "/access-tokens", "", bearer(raw))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Revoked and expired tokens are rejected", func(t *testing.T) {
+		raw, token := createToken(t, `{"name": "revoked", "scopes": ["users:read"]}`)
+		path := "/access-tokens/" + strconv.Itoa(token.ID)
+		require.Equal(t, http.StatusOK, app.send("DELETE", path, "", bearer(jwt)).Code)
+		assert.Equal(t, http.StatusNotFound, app.send("DELETE", path, "", bearer(jwt)).Code)
+		assert.Equal(t, http.StatusUnauthorized, app.send("GET", "/profile", "", bearer(raw)).Code)
+
+		past := time.Now().Add(-time.Minute)
+		sum := sha256.Sum256([]byte("pat_expired"))
+		require.NoError(t, stores.AccessTokens.Create(&handlers.PersonalAccessToken{
+			UserID:    user.ID,
+			Name:      "expired",
+			TokenHash: hex.EncodeToString(sum[:]),
+			Scopes:    []handlers.Scope{handlers.ScopeUsersRead},
+			ExpiresAt: &past,
+		}))
+		assert.Equal(t, http.StatusUnauthorized, app.send("GET", "/profile", "", bearer("pat_expired")).Code)
+		assert.Equal(t, http.StatusUnauthorized, app.send("GET", "/profile", "", bearer("pat_unknown")).Code)
+
+		body := `{"name": "late", "scopes": ["users:read"], "expiresAt": "` + past.Format(time.RFC3339) + `"}`
+		assert.Equal(t, http.StatusBadRequest, app.send("POST", "/access-tokens", body, bearer(jwt)).Code)
+	})
+
+	t.Run("Other users cannot revoke the token", func(t *testing.T) {
+		_, token := createToken(t, `{"name": "mine", "scopes": ["users:read"]}`)
+		err := stores.AccessTokens.Revoke(user.ID+1, token.ID, time.Now())
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+	})
+
+	t.Run("Tokens stop while the account is being deleted", func(t *testing.T) {
+		raw, _ := createToken(t, `{"name": "pending", "scopes": ["users:read"]}`)
+		found, err := stores.Users.GetByID(user.ID)
+		require.NoError(t, err)
+		deleteAfter := time.Now().Add(time.Hour)
+		found.DeleteAfter = &deleteAfter
+		require.NoError(t, stores.Users.Update(found))
+		assert.Equal(t, http.StatusUnauthorized, app.send("GET", "/profile", "", bearer(raw)).Code)
+
+		found.DeleteAfter = nil
+		require.NoError(t, stores.Users.Update(found))
+		assert.Equal(t, http.StatusOK, app.send("GET", "/profile", "", bearer(raw)).Code)
+	})
+
+	t.Run("Logging out everywhere revokes the tokens", func(t *testing.T) {
+		raw, _ := createToken(t, `{"name": "ci", "scopes": ["users:read"]}`)
+		require.Equal(t, http.StatusOK, app.send("POST", "/logout-all", "", bearer(jwt)).Code)
+		assert.Equal(t, http.StatusUnauthorized, app.send("GET", "/profile", "", bearer(raw)).Code)
+
+		tokens, err := stores.AccessTokens.ListByUser(user.ID)
+		require.NoError(t, err)
+		assert.Empty(t, tokens)
+	})
+}
@@ -0,0 +1,176 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterValidation(t *testing.T) {
+	app := newTestApp(t)
+	stores := app.stores
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"missing email", `{"username": "alice", "password": "long-enough"}`, http.StatusBadRequest},
+		{"invalid email", `{"username": "alice", "email": "alice", "password": "long-enough"}`, http.StatusBadRequest},
+		{"short password", `{"username": "alice", "email": "alice@example.com", "password": "short"}`, http.StatusBadRequest},
+		{"short username", `{"username": "al", "email": "alice@example.com", "password": "long-enough"}`, http.StatusBadRequest},
+		{"username with symbols", `{"username": "al ice!", "email": "alice@example.com", "password": "long-enough"}`, http.StatusBadRequest},
+		{"valid", `{"username": "alice", "email": "Alice@Example.com", "password": "long-enough"}`, http.StatusCreated},
+		{"taken username", `{"username": "alice", "email": "other@example.com", "password": "long-enough"}`, http.StatusConflict},
+		{"taken email", `{"username": "alicia", "email": "ALICE@example.com", "password": "long-enough"}`, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.status, app.send("POST", "/register", tt.body).Code)
+		})
+	}
+
+	user, err := stores.Users.GetByUsername("alice")
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", user.Email, "emails are stored normalized")
+}
+
+func TestEmailVerification(t *testing.T) {
+	app := newTestApp(t)
+	stores, mailer := app.stores, app.mailer
+
+	w := app.send("POST", "/register", `{"username": "alice", "email": "alice@example.com", "password": "password", "displayName": "Alice"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	user, _ := stores.Users.GetByUsername("alice")
+	require.Len(t, mailer.sent(), 1)
+	assert.Equal(t, "alice@example.com", mailer.sent()[0].To)
+
+	t.Run("Unverified accounts are limited", func(t *testing.T) {
+		w := app.as(*user, "POST", "/create-post", `{"content": "hello"}`)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), "Email not verified")
+	})
+
+	t.Run("The profile is complete and hides the password", func(t *testing.T) {
+		w := app.as(*user, "GET", "/profile", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var profile map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &profile))
+		assert.Equal(t, "alice", profile["username"])
+		assert.Equal(t, "Alice", profile["displayName"])
+		assert.Equal(t, false, profile["emailVerified"])
+		assert.NotEmpty(t, profile["createdAt"])
+		assert.NotContains(t, profile, "password")
+	})
+
+	t.Run("The emailed link verifies the address once", func(t *testing.T) {
+		token := resetToken(t, mailer.sent()[0])
+		assert.Equal(t, http.StatusOK, app.send("POST", "/email/verify", `{"token": "`+token+`"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, app.send("POST", "/email/verify", `{"token": "`+token+`"}`).Code)
+
+		found, _ := stores.Users.GetByID(user.ID)
+		assert.True(t, found.EmailVerified)
+		assert.Equal(t, http.StatusCreated, app.as(*user, "POST", "/create-post", `{"content": "hello"}`).Code)
+		assert.Equal(t, http.StatusConflict, app.as(*user, "POST", "/email/verification", "").Code)
+	})
+
+	t.Run("Changing the email requires verifying it again", func(t *testing.T) {
+		w := app.as(*user, "PUT", "/update-profile", `{"email": "alice@new.example.com", "bio": "Hello"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		found, _ := stores.Users.GetByID(user.ID)
+		assert.False(t, found.EmailVerified)
+		assert.Equal(t, "Hello", found.Bio)
+		assert.Equal(t, http.StatusForbidden, app.as(*user, "POST", "/create-post", `{"content": "hello"}`).Code)
+		stale := resetToken(t, mailer.sent()[len(mailer.sent())-1])
+
+		w = app.as(*user, "PUT", "/update-profile", `{"email": "alice@newer.example.com"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, http.StatusBadRequest, app.send("POST", "/email/verify", `{"token": "`+stale+`"}`).Code,
+			"links sent to a replaced address do not verify the new one")
+
+		assert.Equal(t, http.StatusAccepted, app.as(*user, "POST", "/email/verification", "").Code)
+		token := resetToken(t, mailer.sent()[len(mailer.sent())-1])
+		assert.Equal(t, "alice@newer.example.com", mailer.sent()[len(mailer.sent())-1].To)
+		assert.Equal(t, http.StatusOK, app.send("POST", "/email/verify", `{"token": "`+token+`"}`).Code)
+	})
+
+	t.Run("Emails stay unique", func(t *testing.T) {
+		other := handlers.User{Username: "bob", Email: "bob@example.com"}
+		require.NoError(t, stores.Users.Create(&other))
+		w := app.as(other, "PUT", "/update-profile", `{"email": "ALICE@newer.example.com"}`)
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+}
+
+func TestUploadAvatar(t *testing.T) {
+	app := newTestApp(t)
+	stores := app.stores
+	user := handlers.User{Username: "alice"}
+	require.NoError(t, stores.Users.Create(&user))
+	t.Cleanup(func() { os.RemoveAll("uploads") })
+
+	upload := func(content []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", "avatar.png")
+		part.Write(content)
+		form.Close()
+		return app.send("PUT", "/profile/avatar", body.String(),
+			bearer(app.token(user)), withHeader("Content-Type", form.FormDataContentType()))
+	}
+
+	w := upload([]byte("#!/bin/sh\necho not an image\n"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	var img bytes.Buffer
+	require.NoError(t, png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 4, 4))))
+	w = upload(img.Bytes())
+	require.Equal(t, http.StatusOK, w.Code)
+	found, _ := stores.Users.GetByID(user.ID)
+	assert.Regexp(t, `^/avatars/\d+-[0-9a-f]+\.png$`, found.Avatar)
+	_, err := os.Stat("uploads" + found.Avatar)
+	assert.NoError(t, err)
+
+	first := found.Avatar
+	require.Equal(t, http.StatusOK, upload(img.Bytes()).Code)
+	_, err = os.Stat("uploads" + first)
+	assert.True(t, os.IsNotExist(err), "the previous avatar is removed")
+}
+
+func TestUpdateProfileCompany(t *testing.T) {
+	app := newTestApp(t)
+	stores := app.stores
+	acme := handlers.Company{Name: "Acme"}
+	require.NoError(t, stores.Companies.Create(&acme))
+	acmeID := int(acme.ID)
+	admin := createUserWithRole(t, stores, "admin", handlers.RoleCompanyAdmin, &acmeID)
+	alice := createUserWithRole(t, stores, "alice", handlers.RoleUser, nil)
+	body := `{"companyId": ` + strconv.Itoa(acmeID) + `}`
+
+	assert.Equal(t, http.StatusForbidden, app.as(alice, "PUT", "/update-profile", body).Code)
+	assert.Equal(t, http.StatusNotFound, app.as(alice, "PUT", "/update-profile", `{"companyId": 999}`).Code)
+	found, err := stores.Users.GetByID(alice.ID)
+	require.NoError(t, err)
+	assert.Nil(t, found.CompanyID, "users cannot join companies they do not manage")
+
+	require.Equal(t, http.StatusOK, app.as(admin, "PUT", "/update-profile", body).Code)
+	found, err = stores.Users.GetByID(admin.ID)
+	require.NoError(t, err)
+	assert.Equal(t, &acmeID, found.CompanyID)
+
+	alice.CompanyID = &acmeID
+	require.NoError(t, stores.Users.Update(&alice))
+	assert.Equal(t, http.StatusOK, app.as(alice, "PUT", "/update-profile", `{"bio": "Hi", "companyId": `+strconv.Itoa(acmeID)+`}`).Code,
+		"members resending their company need no permission")
+}
@@ -0,0 +1,160 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testPassword is the password of every user the tests log in as
+const testPassword = "password"
+
+// testPasswordHash is testPassword hashed at the lowest cost, which keeps
+// logins fast
+var testPasswordHash = func() string {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		panic(err)
+	}
+	return string(hashed)
+}()
+
+// testApp is the API as main wires it, backed by memory stores
+type testApp struct {
+	t      *testing.T
+	stores *handlers.Stores
+	cfg    *config.Config
+	mailer *recordingMailer
+	feed   handlers.Feed
+	router *gin.Engine
+
+	oauthClient *http.Client
+	tokens      map[int]string
+}
+
+// appOption adjusts a testApp before its router is built
+type appOption func(*testApp)
+
+// withConfig lets configure change the default test configuration
+func withConfig(configure func(cfg *config.Config)) appOption {
+	return func(a *testApp) {
+		configure(a.cfg)
+	}
+}
+
+// withOAuthClient sends the requests to identity providers through client
+func withOAuthClient(client *http.Client) appOption {
+	return func(a *testApp) {
+		a.oauthClient = client
+	}
+}
+
+// newTestApp builds the router of main over fresh memory stores. Logins are
+// not throttled unless an option enables the lockout again.
+func newTestApp(t *testing.T, options ...appOption) *testApp {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Auth = testAuthConfig()
+	cfg.Auth.Lockout.Enabled = false
+	app := &testApp{
+		t:      t,
+		stores: handlers.NewMemoryStores(),
+		cfg:    cfg,
+		mailer: &recordingMailer{},
+		tokens: map[int]string{},
+	}
+	for _, option := range options {
+		option(app)
+	}
+
+	app.feed = handlers.NewFeed(cfg.Feed, app.stores.Timelines)
+	router, err := handlers.NewRouter(app.stores, cfg, app.mailer, app.feed, handlers.NewOAuth(cfg.OAuth, app.oauthClient))
+	require.NoError(t, err)
+	app.router = router
+	return app
+}
+
+// requestOption adjusts a request before send serves it
+type requestOption func(*http.Request)
+
+// bearer authenticates the request with token
+func bearer(token string) requestOption {
+	return func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// fromIP sends the request from the given client address
+func fromIP(ip string) requestOption {
+	return func(req *http.Request) {
+		req.RemoteAddr = ip + ":40000"
+	}
+}
+
+// withHeader sets a request header
+func withHeader(name, value string) requestOption {
+	return func(req *http.Request) {
+		req.Header.Set(name, value)
+	}
+}
+
+// send serves a request with a JSON body through router
+func send(router http.Handler, method, path, body string, options ...requestOption) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	for _, option := range options {
+		option(req)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// send serves a request without credentials
+func (a *testApp) send(method, path, body string, options ...requestOption) *httptest.ResponseRecorder {
+	return send(a.router, method, path, body, options...)
+}
+
+// as serves a request authenticated as user
+func (a *testApp) as(user handlers.User, method, path, body string) *httptest.ResponseRecorder {
+	return a.send(method, path, body, bearer(a.token(user)))
+}
+
+// login logs username in with testPassword and returns the access and
+// refresh tokens
+func (a *testApp) login(username string, options ...requestOption) (string, string) {
+	a.t.Helper()
+	body, _ := json.Marshal(map[string]string{"username": username, "password": testPassword})
+	w := a.send("POST", "/login", string(body), options...)
+	require.Equal(a.t, http.StatusOK, w.Code, w.Body.String())
+	var response map[string]string
+	require.NoError(a.t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.NotEmpty(a.t, response["access_token"], "the login must not need a second factor")
+	return response["access_token"], response["refresh_token"]
+}
+
+// token returns an access token of user, logging them in on first use.
+// Users without a password are given testPassword.
+func (a *testApp) token(user handlers.User) string {
+	a.t.Helper()
+	if token, ok := a.tokens[user.ID]; ok {
+		return token
+	}
+	stored, err := a.stores.Users.GetByID(user.ID)
+	require.NoError(a.t, err)
+	if stored.Password == "" {
+		stored.Password = testPasswordHash
+		require.NoError(a.t, a.stores.Users.Update(stored))
+	}
+	token, _ := a.login(stored.Username)
+	a.tokens[user.ID] = token
+	return token
+}
@@ -0,0 +1,148 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// databaseCredentials sets the database user and password, which have no
+// defaults, through the environment
+func databaseCredentials(t *testing.T) {
+	t.Setenv("APP_DATABASE_USER", "app")
+	t.Setenv("APP_DATABASE_PASSWORD", "secret")
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Run("YAML", func(t *testing.T) {
+		path := writeFile(t, "config.yaml", `
+server:
+  addr: ":9090"
+database:
+  host: db.internal
+  user: app
+  password: secret
+auth:
+  jwt_secret: yaml-secret
+  access_token_ttl: 5m
+`)
+		cfg, err := config.Load(path)
+		assert.NoError(t, err)
+		assert.Equal(t, ":9090", cfg.Server.Addr)
+		assert.Equal(t, "db.internal", cfg.Database.Host)
+		assert.Equal(t, 5432, cfg.Database.Port)
+		assert.Equal(t, "yaml-secret", cfg.Auth.JWTSecret)
+		assert.Equal(t, 5*time.Minute, cfg.Auth.AccessTokenTTL.Duration())
+	})
+
+	t.Run("TOML", func(t *testing.T) {
+		path := writeFile(t, "config.toml", `
+[database]
+name = "tomldb"
+user = "app"
+password = "secret"
+
+[auth]
+jwt_secret = "toml-secret"
+token_sources = ["cookie"]
+`)
+		cfg, err := config.Load(path)
+		assert.NoError(t, err)
+		assert.Equal(t, "tomldb", cfg.Database.Name)
+		assert.Equal(t, []string{"cookie"}, cfg.Auth.TokenSources)
+	})
+
+	t.Run("EnvironmentOverridesFile", func(t *testing.T) {
+		path := writeFile(t, "config.yaml", "auth:\n  jwt_secret: file-secret\n")
+		databaseCredentials(t)
+		t.Setenv("APP_SERVER_ADDR", ":7070")
+		t.Setenv("APP_DATABASE_PORT", "6543")
+		t.Setenv("APP_AUTH_TOKEN_SOURCES", "cookie, header")
+
+		cfg, err := config.Load(path)
+		assert.NoError(t, err)
+		assert.Equal(t, ":7070", cfg.Server.Addr)
+		assert.Equal(t, 6543, cfg.Database.Port)
+		assert.Equal(t, []string{"cookie", "header"}, cfg.Auth.TokenSources)
+	})
+
+	t.Run("SecretFiles", func(t *testing.T) {
+		t.Setenv("APP_DATABASE_USER", "app")
+		t.Setenv("APP_AUTH_JWT_SECRET_FILE", writeFile(t, "jwt", "from-file\n"))
+		t.Setenv("APP_DATABASE_PASSWORD_FILE", writeFile(t, "db", "db-password\n"))
+
+		cfg, err := config.Load("")
+		assert.NoError(t, err)
+		assert.Equal(t, "from-file", cfg.Auth.JWTSecret)
+		assert.Equal(t, "db-password", cfg.Database.Password)
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		path := writeFile(t, "config.yaml", `
+server:
+  mode: production
+auth:
+  token_sources: [query]
+  signing:
+    algorithm: HS256
+  lockout:
+    account_free_attempts: 10
+    account_max_failures: 5
+`)
+		_, err := config.Load(path)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "server.mode")
+		assert.Contains(t, err.Error(), "auth.signing.algorithm")
+		assert.Contains(t, err.Error(), "unknown source")
+		assert.Contains(t, err.Error(), "auth.lockout.account_max_failures")
+		assert.Contains(t, err.Error(), "database.user is required", "there are no default credentials")
+		assert.Contains(t, err.Error(), "database.password")
+	})
+
+	t.Run("LogMailTransportIsOptIn", func(t *testing.T) {
+		databaseCredentials(t)
+		t.Setenv("APP_MAIL_TRANSPORT", "log")
+		_, err := config.Load("")
+		assert.ErrorContains(t, err, "mail.allow_log")
+
+		t.Setenv("APP_MAIL_ALLOW_LOG", "true")
+		cfg, err := config.Load("")
+		assert.NoError(t, err)
+		assert.Equal(t, "log", cfg.Mail.Transport)
+	})
+}
+
+func TestDatabaseDSN(t *testing.T) {
+	for _, password := range []string{"with space", "it's", `back\slash`, "x sslmode=disable", "' sslmode='disable"} {
+		t.Run(password, func(t *testing.T) {
+			db := config.DatabaseConfig{
+				Host:     "db.internal",
+				Port:     5432,
+				User:     "app",
+				Password: password,
+				Name:     "firstdb1",
+				SSLMode:  "require",
+			}
+			parsed, err := pgconn.ParseConfig(db.DSN())
+			require.NoError(t, err)
+			assert.Equal(t, password, parsed.Password)
+			assert.Equal(t, "app", parsed.User)
+			assert.Equal(t, "firstdb1", parsed.Database)
+			assert.NotNil(t, parsed.TLSConfig, "the password cannot turn off TLS")
+		})
+	}
+}
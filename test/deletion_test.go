@@ -0,0 +1,260 @@
+package test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newLifecycleApp wires the API with the given account settings
+func newLifecycleApp(t *testing.T, cfg config.AccountConfig) *testApp {
+	return newTestApp(t, withConfig(func(c *config.Config) {
+		c.Account = cfg
+	}))
+}
+
+// accountFixture is a user with something in every store, and another
+// user they interact with
+type accountFixture struct {
+	alice, bob         handlers.User
+	published, pending handlers.Post
+	bobsPost           handlers.Post
+	avatar             string
+}
+
+func seedAccount(t *testing.T, stores *handlers.Stores) accountFixture {
+	t.Helper()
+	f := accountFixture{
+		alice: handlers.User{Username: "alice", Password: testPasswordHash, Email: "alice@example.com", EmailVerified: true},
+		bob:   handlers.User{Username: "bob"},
+	}
+	require.NoError(t, stores.Users.Create(&f.alice))
+	require.NoError(t, stores.Users.Create(&f.bob))
+
+	// The avatar lives where UploadAvatar puts it, relative to the test
+	f.avatar = filepath.Join("uploads", "avatars", strconv.Itoa(f.alice.ID)+"-avatar.png")
+	require.NoError(t, os.MkdirAll(filepath.Dir(f.avatar), 0o755))
+	require.NoError(t, os.WriteFile(f.avatar, []byte("png"), 0o644))
+	t.Cleanup(func() { os.RemoveAll("uploads") })
+	f.alice.Avatar = "/avatars/" + filepath.Base(f.avatar)
+	require.NoError(t, stores.Users.Update(&f.alice))
+
+	f.published = handlers.Post{UserID: f.alice.ID, Content: "hello"}
+	f.pending = handlers.Post{UserID: f.alice.ID, Content: "later", Status: handlers.PostStatusScheduled, ScheduleTime: time.Now().Add(time.Hour)}
+	f.bobsPost = handlers.Post{UserID: f.bob.ID, Content: "hi alice"}
+	for _, post := range []*handlers.Post{&f.published, &f.pending, &f.bobsPost} {
+		require.NoError(t, stores.Posts.Create(post))
+	}
+
+	require.NoError(t, stores.Engagements.Create(&handlers.Engagement{PostID: f.published.ID, UserID: f.bob.ID, Like: true}))
+	require.NoError(t, stores.Engagements.Create(&handlers.Engagement{PostID: f.bobsPost.ID, UserID: f.alice.ID, Comment: "nice"}))
+	require.NoError(t, stores.Follows.Create(&handlers.Follow{FollowerID: f.alice.ID, FollowingID: f.bob.ID}))
+	require.NoError(t, stores.Follows.Create(&handlers.Follow{FollowerID: f.bob.ID, FollowingID: f.alice.ID}))
+	require.NoError(t, stores.Notifications.Create(&handlers.Notification{UserID: f.alice.ID, Message: "bob followed you"}))
+	require.NoError(t, stores.Analytics.RecordView(&handlers.PostView{PostID: f.bobsPost.ID, UserID: f.alice.ID}))
+	require.NoError(t, stores.Analytics.RecordView(&handlers.PostView{PostID: f.published.ID, UserID: f.bob.ID}))
+	require.NoError(t, stores.Identities.Create(&handlers.Identity{UserID: f.alice.ID, Provider: "google", Subject: "alice"}))
+	require.NoError(t, stores.AccessTokens.Create(&handlers.PersonalAccessToken{UserID: f.alice.ID, Name: "ci", TokenHash: "hash"}))
+	return f
+}
+
+func TestAccountDeletion(t *testing.T) {
+	cfg := config.Default().Account
+	worker := func(stores *handlers.Stores, erasure string) *handlers.AccountWorker {
+		cfg := cfg
+		cfg.Erasure = erasure
+		return handlers.NewAccountWorker(stores, &recordingMailer{}, cfg)
+	}
+	afterGrace := time.Now().Add(cfg.DeletionGracePeriod.Duration() + time.Minute)
+
+	t.Run("Deletion waits for the grace period and can be cancelled", func(t *testing.T) {
+		app := newLifecycleApp(t, cfg)
+		stores := app.stores
+		f := seedAccount(t, stores)
+
+		assert.Equal(t, http.StatusForbidden, app.as(f.alice, "DELETE", "/account", `{"password": "wrong"}`).Code)
+		w := app.as(f.alice, "DELETE", "/account", `{"password": "password"}`)
+		require.Equal(t, http.StatusAccepted, w.Code)
+		assert.Contains(t, w.Body.String(), "deleteAfter")
+		assert.Equal(t, http.StatusUnauthorized, app.as(f.alice, "DELETE", "/account", `{"password": "password"}`).Code,
+			"deleting logs out every session")
+		token, _ := app.login("alice")
+		assert.Equal(t, http.StatusConflict, app.send("DELETE", "/account", `{"password": "password"}`, bearer(token)).Code)
+
+		erased, err := worker(stores, handlers.ErasureAnonymize).EraseDue(time.Now())
+		require.NoError(t, err)
+		assert.Zero(t, erased)
+
+		assert.Equal(t, http.StatusOK, app.send("POST", "/account/restore", "", bearer(token)).Code)
+		assert.Equal(t, http.StatusConflict, app.send("POST", "/account/restore", "", bearer(token)).Code)
+		erased, err = worker(stores, handlers.ErasureAnonymize).EraseDue(afterGrace)
+		require.NoError(t, err)
+		assert.Zero(t, erased)
+	})
+
+	t.Run("Anonymizing keeps published content under a placeholder", func(t *testing.T) {
+		app := newLifecycleApp(t, cfg)
+		stores := app.stores
+		f := seedAccount(t, stores)
+		require.Equal(t, http.StatusAccepted, app.as(f.alice, "DELETE", "/account", `{"password": "password"}`).Code)
+
+		erased, err := worker(stores, handlers.ErasureAnonymize).EraseDue(afterGrace)
+		require.NoError(t, err)
+		assert.Equal(t, 1, erased)
+
+		placeholder, err := stores.Users.GetByID(f.alice.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "deleted-"+strconv.Itoa(f.alice.ID), placeholder.Username)
+		assert.Empty(t, placeholder.Password)
+		assert.Empty(t, placeholder.Email)
+		assert.Empty(t, placeholder.Avatar)
+		assert.Nil(t, placeholder.DeleteAfter)
+		assert.NotNil(t, placeholder.DeletedAt)
+		_, err = os.Stat(f.avatar)
+		assert.True(t, os.IsNotExist(err), "uploaded files are removed")
+
+		_, err = stores.Posts.GetByID(f.published.ID)
+		assert.NoError(t, err)
+		_, err = stores.Posts.GetByID(f.pending.ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound, "scheduled posts are never published")
+		likes, _ := stores.Engagements.CountLikes(f.published.ID)
+		assert.EqualValues(t, 1, likes)
+		comments, _ := stores.Engagements.CountComments(f.bobsPost.ID)
+		assert.EqualValues(t, 1, comments)
+		views, _ := stores.Analytics.CountViews(f.bobsPost.ID)
+		assert.EqualValues(t, 1, views)
+
+		data, err := stores.Accounts.Collect(f.alice.ID)
+		require.NoError(t, err)
+		assert.Empty(t, data.Followers)
+		assert.Empty(t, data.Followings)
+		assert.Empty(t, data.Notifications)
+		assert.Empty(t, data.PostViews)
+
+		identities, _ := stores.Identities.ListByUser(f.alice.ID)
+		assert.Empty(t, identities)
+		tokens, _ := stores.AccessTokens.ListByUser(f.alice.ID)
+		assert.Empty(t, tokens)
+	})
+
+	t.Run("Deleting removes the content too", func(t *testing.T) {
+		app := newLifecycleApp(t, cfg)
+		stores := app.stores
+		f := seedAccount(t, stores)
+		require.Equal(t, http.StatusAccepted, app.as(f.alice, "DELETE", "/account", `{"password": "password"}`).Code)
+
+		erased, err := worker(stores, handlers.ErasureDelete).EraseDue(afterGrace)
+		require.NoError(t, err)
+		assert.Equal(t, 1, erased)
+
+		_, err = stores.Users.GetByID(f.alice.ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+		_, err = stores.Posts.GetByID(f.published.ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+		_, err = stores.Posts.GetByID(f.bobsPost.ID)
+		assert.NoError(t, err)
+		likes, _ := stores.Engagements.CountLikes(f.published.ID)
+		assert.Zero(t, likes)
+		comments, _ := stores.Engagements.CountComments(f.bobsPost.ID)
+		assert.Zero(t, comments)
+		views, _ := stores.Analytics.CountViews(f.bobsPost.ID)
+		assert.Zero(t, views)
+
+		data, err := stores.Accounts.Collect(f.bob.ID)
+		require.NoError(t, err)
+		assert.Empty(t, data.Followers)
+		assert.Empty(t, data.Followings)
+	})
+}
+
+func TestAccountExport(t *testing.T) {
+	cfg := config.Default().Account
+	cfg.ExportDir = t.TempDir()
+	app := newLifecycleApp(t, cfg)
+	stores := app.stores
+	mailer := &recordingMailer{}
+	worker := handlers.NewAccountWorker(stores, mailer, cfg)
+	f := seedAccount(t, stores)
+
+	w := app.as(f.alice, "GET", "/account/export", "")
+	require.Equal(t, http.StatusAccepted, w.Code)
+	var export handlers.AccountExport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &export))
+	assert.Equal(t, handlers.ExportStatusPending, export.Status)
+
+	w = app.as(f.alice, "GET", "/account/export", "")
+	require.Equal(t, http.StatusAccepted, w.Code)
+	assert.Contains(t, w.Body.String(), `"id":`+strconv.Itoa(export.ID), "a pending export is not requested twice")
+
+	built, err := worker.BuildExports(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 1, built)
+
+	t.Run("The user is told the export is ready", func(t *testing.T) {
+		require.Len(t, mailer.sent(), 1)
+		assert.Equal(t, "alice@example.com", mailer.sent()[0].To)
+		data, err := stores.Accounts.Collect(f.alice.ID)
+		require.NoError(t, err)
+		assert.Contains(t, data.Notifications[len(data.Notifications)-1].Message, "/account/export")
+	})
+
+	t.Run("The archive holds the data and files of the user", func(t *testing.T) {
+		w := app.as(f.alice, "GET", "/account/export", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Header().Get("Content-Disposition"), "attachment")
+
+		archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		require.NoError(t, err)
+		files := map[string][]byte{}
+		for _, file := range archive.File {
+			r, err := file.Open()
+			require.NoError(t, err)
+			files[file.Name], _ = io.ReadAll(r)
+			r.Close()
+		}
+		assert.Equal(t, []byte("png"), files["media/avatars/"+filepath.Base(f.avatar)])
+
+		var data handlers.PersonalData
+		require.NoError(t, json.Unmarshal(files["data.json"], &data))
+		assert.Equal(t, "alice", data.User.Username)
+		assert.Len(t, data.Posts, 2)
+		assert.Len(t, data.Engagements, 1)
+		assert.Len(t, data.Followers, 1)
+		assert.Len(t, data.Followings, 1)
+		assert.Len(t, data.PostViews, 1)
+		assert.Len(t, data.Identities, 1)
+		assert.Len(t, data.AccessTokens, 1)
+		assert.NotContains(t, string(files["data.json"]), "hash", "secrets stay out of exports")
+	})
+
+	t.Run("Expired exports are removed", func(t *testing.T) {
+		entries, _ := os.ReadDir(cfg.ExportDir)
+		require.Len(t, entries, 1)
+		require.NoError(t, worker.PruneExports(time.Now().Add(cfg.ExportTTL.Duration()+time.Minute)))
+		entries, _ = os.ReadDir(cfg.ExportDir)
+		assert.Empty(t, entries)
+
+		w := app.as(f.alice, "GET", "/account/export", "")
+		assert.Equal(t, http.StatusAccepted, w.Code, "a new export is started")
+	})
+
+	t.Run("Other users only see their own exports", func(t *testing.T) {
+		w := app.as(f.bob, "GET", "/account/export", "")
+		require.Equal(t, http.StatusAccepted, w.Code)
+		var export handlers.AccountExport
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &export))
+		assert.Equal(t, f.bob.ID, export.UserID)
+	})
+}
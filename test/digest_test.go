@@ -0,0 +1,200 @@
+package test
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/Adnen2/tutorial/firstProject/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingMailer refuses every message
+type failingMailer struct{}
+
+func (failingMailer) Send(mail.Message) error {
+	return errors.New("mail server unavailable")
+}
+
+// createDigestReader creates a user with a verified email
+func createDigestReader(t *testing.T, stores *handlers.Stores, username string) handlers.User {
+	t.Helper()
+	user := createUserWithRole(t, stores, username, handlers.RoleUser, nil)
+	user.Email = username + "@example.com"
+	user.EmailVerified = true
+	require.NoError(t, stores.Users.Update(&user))
+	return user
+}
+
+var unsubscribeLink = regexp.MustCompile(`Unsubscribe: (\S+)`)
+
+// unsubscribeTokenOf returns the token of the unsubscribe link of a digest
+func unsubscribeTokenOf(t *testing.T, msg mail.Message) string {
+	t.Helper()
+	match := unsubscribeLink.FindStringSubmatch(msg.Text)
+	require.NotNil(t, match, "the digest has an unsubscribe link")
+	link, err := url.Parse(match[1])
+	require.NoError(t, err)
+	return link.Query().Get("token")
+}
+
+func TestNotificationDigest(t *testing.T) {
+	app := newTestApp(t)
+	stores, cfg := app.stores, app.cfg.Notifications.Digest
+	alice := createDigestReader(t, stores, "alice")
+	bob := createDigestReader(t, stores, "bob")
+	carol := createUserWithRole(t, stores, "carol", handlers.RoleUser, nil)
+	dave := createDigestReader(t, stores, "dave")
+
+	// Wednesday: the last day started on Tuesday at 8:00, the last week
+	// ended on Monday at 8:00
+	now := time.Date(2026, time.October, 14, 9, 0, 0, 0, time.UTC)
+	yesterday := now.Add(-20 * time.Hour)
+	lastWeek := now.AddDate(0, 0, -5)
+	seed := []handlers.Notification{
+		{UserID: alice.ID, Type: handlers.NotificationLike, ActorIDs: []int{bob.ID}, ActorCount: 1, CreatedAt: yesterday},
+		{UserID: alice.ID, Type: handlers.NotificationComment, ActorIDs: []int{dave.ID}, ActorCount: 1, IsRead: true, CreatedAt: yesterday},
+		{UserID: alice.ID, Type: handlers.NotificationMention, ActorIDs: []int{bob.ID}, ActorCount: 1, CreatedAt: yesterday},
+		{UserID: alice.ID, Type: handlers.NotificationSystem, Message: "already read", IsRead: true, CreatedAt: yesterday},
+		{UserID: alice.ID, Type: handlers.NotificationSystem, Message: "too recent", CreatedAt: now.Add(-time.Minute)},
+		{UserID: bob.ID, Type: handlers.NotificationSystem, Message: "welcome", CreatedAt: lastWeek},
+		{UserID: carol.ID, Type: handlers.NotificationSystem, Message: "unverified", CreatedAt: yesterday},
+		{UserID: dave.ID, Type: handlers.NotificationSystem, Message: "unsubscribed", CreatedAt: lastWeek},
+	}
+	for i := range seed {
+		require.NoError(t, stores.Notifications.Create(&seed[i]))
+	}
+
+	w := app.as(alice, "GET", "/notifications/digest", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"frequency":"weekly"`, "the configured default applies")
+	assert.Equal(t, http.StatusBadRequest, app.as(alice, "PUT", "/notifications/digest", `{"frequency": "hourly"}`).Code)
+	require.Equal(t, http.StatusOK, app.as(alice, "PUT", "/notifications/digest", `{"frequency": "daily"}`).Code)
+	require.Equal(t, http.StatusOK, app.as(dave, "PUT", "/notifications/digest", `{"frequency": "off"}`).Code)
+	// Comments only by email, no mentions by email
+	require.Equal(t, http.StatusOK, app.as(alice, "PUT", "/notifications/preferences/comment", `{"inApp": false}`).Code)
+	require.Equal(t, http.StatusOK, app.as(alice, "PUT", "/notifications/preferences/mention", `{"emailDigest": false}`).Code)
+
+	mailer := &recordingMailer{}
+	worker := handlers.NewDigestWorker(stores, mailer, cfg)
+
+	t.Run("Due digests are sent by each user's frequency", func(t *testing.T) {
+		sent, err := worker.SendDue(now)
+		require.NoError(t, err)
+		assert.Equal(t, 2, sent)
+
+		messages := mailer.sent()
+		require.Len(t, messages, 2)
+		byRecipient := map[string]mail.Message{}
+		for _, msg := range messages {
+			byRecipient[msg.To] = msg
+		}
+
+		digest := byRecipient[alice.Email]
+		assert.Equal(t, "Your daily digest: 2 unread notifications", digest.Subject)
+		assert.Contains(t, digest.Text, "bob liked your post")
+		assert.Contains(t, digest.Text, "dave commented on your post", "email-only notifications are included")
+		assert.NotContains(t, digest.Text, "mentioned you")
+		assert.NotContains(t, digest.Text, "already read")
+		assert.NotContains(t, digest.Text, "too recent")
+		assert.Contains(t, digest.HTML, "<li>bob liked your post")
+		assert.Contains(t, digest.HTML, cfg.URL)
+
+		digest = byRecipient[bob.Email]
+		assert.Equal(t, "Your weekly digest: 1 unread notification", digest.Subject)
+		assert.Contains(t, digest.Text, "welcome")
+		assert.Contains(t, digest.Text, "in the last week")
+	})
+
+	t.Run("Digests are sent once per period", func(t *testing.T) {
+		sent, err := worker.SendDue(now.Add(time.Hour))
+		require.NoError(t, err)
+		assert.Zero(t, sent)
+
+		sent, err = handlers.NewDigestWorker(stores, mailer, cfg).SendDue(now)
+		require.NoError(t, err)
+		assert.Zero(t, sent, "another worker does not send them again")
+		assert.Len(t, mailer.sent(), 2)
+	})
+
+	t.Run("A failed send is retried", func(t *testing.T) {
+		tomorrow := now.AddDate(0, 0, 1)
+		require.NoError(t, stores.Notifications.Create(&handlers.Notification{UserID: alice.ID, Type: handlers.NotificationSystem, Message: "retry me", CreatedAt: now}))
+
+		_, err := handlers.NewDigestWorker(stores, failingMailer{}, cfg).SendDue(tomorrow)
+		assert.Error(t, err)
+		sent, err := worker.SendDue(tomorrow)
+		require.NoError(t, err)
+		assert.Equal(t, 1, sent)
+		assert.Contains(t, mailer.sent()[2].Text, "retry me")
+	})
+
+	t.Run("Unsubscribe links turn the digest off", func(t *testing.T) {
+		aliceToken := unsubscribeTokenOf(t, mailer.sent()[2])
+		bobToken := ""
+		for _, msg := range mailer.sent() {
+			if msg.To == bob.Email {
+				bobToken = unsubscribeTokenOf(t, msg)
+			}
+		}
+		require.NotEmpty(t, bobToken)
+
+		forged := strconv.Itoa(alice.ID) + bobToken[len(strconv.Itoa(bob.ID)):]
+		for _, token := range []string{"garbage", forged, aliceToken + "x"} {
+			w := app.send("POST", "/notifications/digest/unsubscribe", `{"token": "`+token+`"}`)
+			assert.Equal(t, http.StatusBadRequest, w.Code, token)
+		}
+
+		w := app.send("POST", "/notifications/digest/unsubscribe", `{"token": "`+aliceToken+`"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		w = app.as(alice, "GET", "/notifications/digest", "")
+		assert.Contains(t, w.Body.String(), `"frequency":"off"`)
+
+		require.NoError(t, stores.Notifications.Create(&handlers.Notification{UserID: alice.ID, Type: handlers.NotificationSystem, Message: "unsubscribed", CreatedAt: now.AddDate(0, 0, 1)}))
+		sent, err := worker.SendDue(now.AddDate(0, 0, 2))
+		require.NoError(t, err)
+		assert.Zero(t, sent)
+	})
+}
+
+func TestNotificationDigestFileSink(t *testing.T) {
+	stores := handlers.NewMemoryStores()
+	cfg := config.Default().Notifications.Digest
+	cfg.DefaultFrequency = handlers.DigestDaily
+	cfg.MaxItems = 2
+	alice := createDigestReader(t, stores, "alice")
+
+	now := time.Date(2026, time.October, 14, 9, 0, 0, 0, time.UTC)
+	for _, message := range []string{"first", "second", "third"} {
+		require.NoError(t, stores.Notifications.Create(&handlers.Notification{UserID: alice.ID, Type: handlers.NotificationSystem, Message: message, CreatedAt: now.Add(-time.Hour * 2)}))
+	}
+
+	mailCfg := config.Default().Mail
+	mailCfg.Transport = "file"
+	mailCfg.Dir = filepath.Join(t.TempDir(), "outbox")
+	mailer, err := mail.New(mailCfg)
+	require.NoError(t, err)
+	sent, err := handlers.NewDigestWorker(stores, mailer, cfg).SendDue(now)
+	require.NoError(t, err)
+	require.Equal(t, 1, sent)
+
+	files, err := os.ReadDir(mailCfg.Dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	raw, err := os.ReadFile(filepath.Join(mailCfg.Dir, files[0].Name()))
+	require.NoError(t, err)
+	content := string(raw)
+	assert.Contains(t, content, "To: alice@example.com")
+	assert.Contains(t, content, "multipart/alternative")
+	assert.Contains(t, content, "- and 1 more", "digests list at most max_items notifications")
+	assert.Contains(t, content, "Your daily digest: 3 unread notifications")
+}
@@ -0,0 +1,109 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeed(t *testing.T) {
+	for _, strategy := range []string{handlers.FeedStrategyPull, handlers.FeedStrategyFanout} {
+		t.Run(strategy, func(t *testing.T) {
+			app := newTestApp(t, withConfig(func(cfg *config.Config) {
+				cfg.Feed.Strategy = strategy
+			}))
+			stores := app.stores
+			// Users 1 to 3; only existing users can be followed
+			var users []handlers.User
+			for _, username := range []string{"alice", "bob", "carol"} {
+				users = append(users, createUserWithRole(t, stores, username, handlers.RoleUser, nil))
+			}
+
+			do := func(method, path string, userID int, body string) *httptest.ResponseRecorder {
+				return app.as(users[userID-1], method, path, body)
+			}
+			post := func(userID int, content string) {
+				require.Equal(t, http.StatusCreated, do("POST", "/create-post", userID, `{"content": "`+content+`"}`).Code)
+			}
+			// readFeed follows next_cursor until the last page and returns
+			// the contents of every post in order
+			readFeed := func(userID, limit int) []string {
+				var contents []string
+				cursor := ""
+				for {
+					w := do("GET", "/feed?limit="+strconv.Itoa(limit)+"&cursor="+url.QueryEscape(cursor), userID, "")
+					require.Equal(t, http.StatusOK, w.Code)
+					var page handlers.Page[handlers.Post]
+					require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+					for _, p := range page.Items {
+						contents = append(contents, p.Content)
+					}
+					if !page.HasMore {
+						assert.Empty(t, page.NextCursor)
+						return contents
+					}
+					cursor = page.NextCursor
+				}
+			}
+
+			post(2, "followed before follow")
+			require.Equal(t, http.StatusCreated, do("POST", "/follow", 1, `{"followingId": 2}`).Code)
+			post(1, "own")
+			post(3, "stranger")
+			post(2, "followed")
+
+			assert.Equal(t, []string{"followed", "own", "followed before follow"}, readFeed(1, 2))
+			assert.Equal(t, []string{"followed", "followed before follow"}, readFeed(2, 1))
+
+			// Scheduled posts join the feed once published
+			at := time.Now().Add(time.Hour)
+			w := do("POST", "/create-post", 2, `{"content": "scheduled", "scheduleTime": "`+at.Format(time.RFC3339)+`"}`)
+			require.Equal(t, http.StatusCreated, w.Code)
+			assert.NotContains(t, readFeed(1, 10), "scheduled")
+			publisher := handlers.NewPublisher(stores, app.feed, app.cfg.Publisher)
+			_, err := publisher.PublishDue(at.Add(time.Minute))
+			require.NoError(t, err)
+			assert.Equal(t, "scheduled", readFeed(1, 10)[0])
+
+			require.Equal(t, http.StatusOK, do("DELETE", "/unfollow/2", 1, "").Code)
+			assert.Equal(t, []string{"own"}, readFeed(1, 10))
+
+			assert.Equal(t, http.StatusBadRequest, do("GET", "/feed?cursor=!", 1, "").Code)
+			assert.Equal(t, http.StatusBadRequest, do("GET", "/feed?limit=1000", 1, "").Code)
+		})
+	}
+}
+
+func TestFeedCursor(t *testing.T) {
+	app := newTestApp(t)
+	alice := createUserWithRole(t, app.stores, "alice", handlers.RoleUser, nil)
+	for _, content := range []string{"first", "second"} {
+		require.Equal(t, http.StatusCreated, app.as(alice, "POST", "/create-post", `{"content": "`+content+`"}`).Code)
+	}
+
+	w := app.as(alice, "GET", "/feed?limit=1", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var page handlers.Page[handlers.Post]
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.True(t, page.HasMore)
+	cursor, err := handlers.DecodeCursor(page.NextCursor)
+	require.NoError(t, err)
+	assert.Equal(t, "published_at", cursor.Sort)
+	assert.True(t, cursor.Desc)
+	assert.Equal(t, int64(page.Items[0].ID), cursor.ID)
+
+	// Cursors of other lists, ordered some other way, are rejected
+	for _, other := range []handlers.Cursor{{Sort: "id", ID: 1}, {Sort: "published_at", Value: cursor.Value, ID: cursor.ID}} {
+		w := app.as(alice, "GET", "/feed?cursor="+other.Encode(), "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	}
+}
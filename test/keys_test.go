@@ -0,0 +1,142 @@
+package test
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tokenHeader decodes the JOSE header of a JWT
+func tokenHeader(t *testing.T, token string) map[string]interface{} {
+	segment, err := jwt.DecodeSegment(strings.Split(token, ".")[0])
+	require.NoError(t, err)
+	var header map[string]interface{}
+	require.NoError(t, json.Unmarshal(segment, &header))
+	return header
+}
+
+func getJWKS(t *testing.T, app *testApp) []handlers.JWK {
+	w := app.send("GET", "/.well-known/jwks.json", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var jwks struct {
+		Keys []handlers.JWK `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	return jwks.Keys
+}
+
+func TestSigningKeys(t *testing.T) {
+	// The keys are never cached, so changes to them apply straight away
+	app := newTestApp(t, withConfig(func(cfg *config.Config) {
+		cfg.Auth.Signing.KeyCacheTTL = config.Duration(time.Nanosecond)
+	}))
+	stores, router, cfg := app.stores, app.router, app.cfg.Auth
+	require.NoError(t, stores.Users.Create(&handlers.User{Username: "alice", Password: testPasswordHash}))
+
+	profile := func(token string) int {
+		return app.send("GET", "/profile", "", bearer(token)).Code
+	}
+
+	first, _ := app.login("alice")
+	header := tokenHeader(t, first)
+	firstKid, _ := header["kid"].(string)
+
+	t.Run("The first key is generated on demand", func(t *testing.T) {
+		assert.Equal(t, handlers.AlgorithmEdDSA, header["alg"])
+		assert.NotEmpty(t, firstKid)
+		assert.Equal(t, http.StatusOK, profile(first))
+	})
+
+	t.Run("The JWKS verifies issued tokens", func(t *testing.T) {
+		keys := getJWKS(t, app)
+		require.Len(t, keys, 1)
+		assert.Equal(t, firstKid, keys[0].KeyID)
+		assert.Equal(t, "OKP", keys[0].KeyType)
+		assert.Equal(t, "Ed25519", keys[0].Curve)
+
+		public, err := base64.RawURLEncoding.DecodeString(keys[0].X)
+		require.NoError(t, err)
+		parts := strings.Split(first, ".")
+		signature, err := jwt.DecodeSegment(parts[2])
+		require.NoError(t, err)
+		assert.True(t, ed25519.Verify(public, []byte(parts[0]+"."+parts[1]), signature))
+	})
+
+	t.Run("A new key signs while the old one keeps verifying", func(t *testing.T) {
+		key, err := handlers.GenerateSigningKey(handlers.AlgorithmRS256)
+		require.NoError(t, err)
+		require.NoError(t, stores.SigningKeys.Create(key))
+
+		second, _ := app.login("alice")
+		assert.Equal(t, key.ID, tokenHeader(t, second)["kid"])
+		assert.Equal(t, handlers.AlgorithmRS256, tokenHeader(t, second)["alg"])
+		assert.Equal(t, http.StatusOK, profile(second))
+		assert.Equal(t, http.StatusOK, profile(first))
+
+		keys := getJWKS(t, app)
+		require.Len(t, keys, 2)
+		assert.Equal(t, "RSA", keys[1].KeyType)
+		assert.Equal(t, "AQAB", keys[1].E)
+	})
+
+	t.Run("Retired keys verify until refresh tokens expire", func(t *testing.T) {
+		require.NoError(t, stores.SigningKeys.Retire(firstKid, time.Now()))
+		assert.ErrorIs(t, stores.SigningKeys.Retire(firstKid, time.Now()), handlers.ErrNotFound)
+		assert.Equal(t, http.StatusOK, profile(first))
+
+		expired := cfg
+		expired.RefreshTokenTTL = config.Duration(time.Nanosecond)
+		router.GET("/profile-expired", handlers.AuthMiddleware(stores, expired), func(c *gin.Context) {
+			handlers.Profile(c, stores)
+		})
+		assert.Equal(t, http.StatusUnauthorized, app.send("GET", "/profile-expired", "", bearer(first)).Code)
+	})
+
+	t.Run("Tokens cannot choose their algorithm", func(t *testing.T) {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"type":    "access",
+			"user_id": 1,
+			"exp":     time.Now().Add(time.Minute).Unix(),
+		})
+		token.Header["kid"] = firstKid
+		keys := getJWKS(t, app)
+		public, _ := base64.RawURLEncoding.DecodeString(keys[0].X)
+		forged, err := token.SignedString(public)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, profile(forged))
+
+		delete(token.Header, "kid")
+		legacy, err := token.SignedString([]byte("old-secret"))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, profile(legacy), "HS256 tokens need auth.jwt_secret")
+	})
+}
+
+func TestLegacySecretTokens(t *testing.T) {
+	app := newTestApp(t, withConfig(func(cfg *config.Config) {
+		cfg.Auth.JWTSecret = "old-secret"
+	}))
+	stores := app.stores
+	user := handlers.User{Username: "alice"}
+	require.NoError(t, stores.Users.Create(&user))
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"type":    "access",
+		"user_id": user.ID,
+		"exp":     time.Now().Add(time.Minute).Unix(),
+	})
+	legacy, err := token.SignedString([]byte("old-secret"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, app.send("GET", "/profile", "", bearer(legacy)).Code)
+}
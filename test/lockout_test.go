@@ -0,0 +1,142 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lockoutConfig sets delays long enough that a test never outlives them
+func lockoutConfig(cfg *config.Config) {
+	cfg.Auth.Lockout = config.LockoutConfig{
+		Enabled:             true,
+		Window:              config.Duration(time.Hour),
+		BaseDelay:           config.Duration(time.Minute),
+		MaxDelay:            config.Duration(time.Minute * 4),
+		LockDuration:        config.Duration(time.Hour),
+		AccountFreeAttempts: 2,
+		AccountMaxFailures:  5,
+		IPFreeAttempts:      6,
+		IPMaxFailures:       8,
+	}
+}
+
+// loginFrom attempts a login from the given client IP
+func loginFrom(app *testApp, ip, username, password string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+	return app.send("POST", "/login", string(body), fromIP(ip))
+}
+
+func TestLoginLockout(t *testing.T) {
+	app := newTestApp(t, withConfig(lockoutConfig))
+	stores := app.stores
+	user := handlers.User{Username: "alice", Password: testPasswordHash}
+	require.NoError(t, stores.Users.Create(&user))
+	admin := createUserWithRole(t, stores, "admin", handlers.RoleAdmin, nil)
+	// Log both in while alice is not delayed yet
+	app.token(user)
+	app.token(admin)
+
+	t.Run("Failures past the free attempts are delayed", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			w := loginFrom(app, "198.51.100.1", "alice", "wrong")
+			require.Equal(t, http.StatusUnauthorized, w.Code, "attempt %d", i+1)
+		}
+
+		w := loginFrom(app, "198.51.100.2", "alice", "password")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code, "the delay applies to the account from any IP")
+		assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	})
+
+	t.Run("Unknown usernames get the same responses", func(t *testing.T) {
+		var known, unknown []string
+		for i := 0; i < 4; i++ {
+			w := loginFrom(app, "198.51.100.3", "bob", "wrong")
+			unknown = append(unknown, strconv.Itoa(w.Code)+w.Body.String()+w.Header().Get("Retry-After"))
+		}
+		other := handlers.User{Username: "carol", Password: testPasswordHash}
+		require.NoError(t, stores.Users.Create(&other))
+		for i := 0; i < 4; i++ {
+			w := loginFrom(app, "198.51.100.4", "carol", "wrong")
+			known = append(known, strconv.Itoa(w.Code)+w.Body.String()+w.Header().Get("Retry-After"))
+		}
+		assert.Equal(t, known, unknown)
+	})
+
+	t.Run("Too many failures from one IP block it for every account", func(t *testing.T) {
+		for i := 0; i < 7; i++ {
+			w := loginFrom(app, "203.0.113.9", "user"+strconv.Itoa(i), "wrong")
+			require.Equal(t, http.StatusUnauthorized, w.Code, "attempt %d", i+1)
+		}
+		w := loginFrom(app, "203.0.113.9", "carol", "password")
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "60", w.Header().Get("Retry-After"))
+
+		w = loginFrom(app, "203.0.113.10", "dave", "wrong")
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "other IPs are not affected")
+	})
+
+	t.Run("Admins can unlock an account", func(t *testing.T) {
+		path := "/users/" + strconv.Itoa(user.ID) + "/unlock"
+		w := app.as(user, "POST", path, "")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		w = app.as(admin, "POST", path, "")
+		require.Equal(t, http.StatusOK, w.Code)
+		w = loginFrom(app, "198.51.100.2", "alice", "password")
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Failed attempts are audited", func(t *testing.T) {
+		w := app.as(admin, "GET", "/audit-events?type=login.failed&username=alice", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var page handlers.Page[handlers.AuditEvent]
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+		require.Len(t, page.Items, 3)
+		assert.Equal(t, "198.51.100.1", page.Items[0].IP)
+		require.NotNil(t, page.Items[0].UserID)
+		assert.Equal(t, user.ID, *page.Items[0].UserID)
+		assert.Equal(t, "wrong password", page.Items[0].Detail)
+
+		w = app.as(admin, "GET", "/audit-events?type=login.failed&username=bob", "")
+		var unknown handlers.Page[handlers.AuditEvent]
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &unknown))
+		require.NotEmpty(t, unknown.Items)
+		assert.Nil(t, unknown.Items[0].UserID)
+
+		w = app.as(admin, "GET", "/audit-events?type=account.unlocked", "")
+		var unlocked handlers.Page[handlers.AuditEvent]
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &unlocked))
+		assert.Len(t, unlocked.Items, 1)
+	})
+}
+
+func TestLoginLockoutLocksAtMaxFailures(t *testing.T) {
+	app := newTestApp(t, withConfig(func(cfg *config.Config) {
+		lockoutConfig(cfg)
+		// No delays before the lock, so every failure can be made straight away
+		cfg.Auth.Lockout.AccountFreeAttempts = 4
+	}))
+	stores := app.stores
+
+	for i := 0; i < 5; i++ {
+		w := app.send("POST", "/login", `{"username": "erin", "password": "wrong"}`)
+		require.Equal(t, http.StatusUnauthorized, w.Code, "attempt %d", i+1)
+	}
+	w := app.send("POST", "/login", `{"username": "erin", "password": "wrong"}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "3600", w.Header().Get("Retry-After"))
+
+	events, err := stores.Audit.List(handlers.ListQuery{Filters: map[string]interface{}{"type": handlers.AuditAccountLocked}})
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, "erin", events[0].Username)
+}
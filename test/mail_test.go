@@ -0,0 +1,45 @@
+package test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileMailer(t *testing.T) {
+	cfg := config.Default().Mail
+	cfg.Transport = "file"
+	cfg.Dir = filepath.Join(t.TempDir(), "outbox")
+	mailer, err := mail.New(cfg)
+	require.NoError(t, err)
+
+	require.NoError(t, mailer.Send(mail.Message{To: "bob@example.com", Subject: "Hello", Text: "plain body", HTML: "<p>html body</p>"}))
+	require.NoError(t, mailer.Send(mail.Message{To: "carol@example.com", Subject: "Second", Text: "only text"}))
+
+	files, err := os.ReadDir(cfg.Dir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	first, err := os.ReadFile(filepath.Join(cfg.Dir, files[0].Name()))
+	require.NoError(t, err)
+	content := string(first)
+	assert.Contains(t, content, "From: no-reply@localhost\r\n")
+	assert.Contains(t, content, "To: bob@example.com\r\n")
+	assert.Contains(t, content, "multipart/alternative")
+	assert.Contains(t, content, "plain body")
+	assert.Contains(t, content, "<p>html body</p>")
+
+	second, _ := os.ReadFile(filepath.Join(cfg.Dir, files[1].Name()))
+	assert.False(t, strings.Contains(string(second), "multipart"))
+}
+
+func TestComposeRejectsHeaderInjection(t *testing.T) {
+	_, err := mail.Compose("from@example.com", mail.Message{To: "a@example.com\r\nBcc: evil@example.com", Subject: "Hi"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,23 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Adnen2/tutorial/firstProject/migrations"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	loaded, err := migrations.Load()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, loaded)
+
+	for i, m := range loaded {
+		if i > 0 {
+			assert.Greater(t, m.Version, loaded[i-1].Version, "migrations must be ordered by version")
+		}
+		assert.NotEmpty(t, strings.TrimSpace(m.Up), "%d_%s has an empty up file", m.Version, m.Name)
+		assert.NotEmpty(t, strings.TrimSpace(m.Down), "%d_%s has an empty down file", m.Version, m.Name)
+	}
+}
@@ -0,0 +1,276 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getNotifications(t *testing.T, app *testApp, user handlers.User) []handlers.Notification {
+	t.Helper()
+	return listNotifications(t, app, user, "")
+}
+
+// listNotifications lists the notifications of user with a query string
+func listNotifications(t *testing.T, app *testApp, user handlers.User, query string) []handlers.Notification {
+	t.Helper()
+	w := app.as(user, "GET", "/notifications"+query, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var page struct {
+		Items []handlers.Notification `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	return page.Items
+}
+
+func TestNotifications(t *testing.T) {
+	app := newTestApp(t)
+	stores := app.stores
+	admin := createUserWithRole(t, stores, "admin", handlers.RoleAdmin, nil)
+	var users []handlers.User
+	for _, name := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		users = append(users, createUserWithRole(t, stores, name, handlers.RoleUser, nil))
+	}
+	alice, bob, carol := users[0], users[1], users[2]
+
+	w := app.as(alice, "POST", "/create-post", `{"content": "hello"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created struct {
+		PostID int `json:"postId"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	like := `{"postId": ` + strconv.Itoa(created.PostID) + `, "like": true}`
+
+	t.Run("Only admins send notifications directly", func(t *testing.T) {
+		body := `{"userId": ` + strconv.Itoa(bob.ID) + `, "message": "spam"}`
+		assert.Equal(t, http.StatusForbidden, app.as(alice, "POST", "/notifications", body).Code)
+		assert.Empty(t, getNotifications(t, app, bob))
+
+		require.Equal(t, http.StatusCreated, app.as(admin, "POST", "/notifications", body).Code)
+		notifications := getNotifications(t, app, bob)
+		require.Len(t, notifications, 1)
+		assert.Equal(t, handlers.NotificationSystem, notifications[0].Type)
+		assert.Equal(t, "spam", notifications[0].Message)
+	})
+
+	t.Run("Likes on a post are grouped", func(t *testing.T) {
+		require.Equal(t, http.StatusCreated, app.as(alice, "POST", "/engagements", like).Code)
+		assert.Empty(t, getNotifications(t, app, alice), "liking your own post is not news")
+
+		require.Equal(t, http.StatusCreated, app.as(bob, "POST", "/engagements", like).Code)
+		notifications := getNotifications(t, app, alice)
+		require.Len(t, notifications, 1)
+		assert.Equal(t, handlers.NotificationLike, notifications[0].Type)
+		assert.Equal(t, created.PostID, *notifications[0].PostID)
+		assert.Equal(t, "bob liked your post", notifications[0].Message)
+
+		require.Equal(t, http.StatusCreated, app.as(carol, "POST", "/engagements", like).Code)
+		notifications = getNotifications(t, app, alice)
+		require.Len(t, notifications, 1)
+		assert.Equal(t, "carol and bob liked your post", notifications[0].Message)
+
+		for _, user := range users[3:] {
+			require.Equal(t, http.StatusCreated, app.as(user, "POST", "/engagements", like).Code)
+		}
+		require.Equal(t, http.StatusCreated, app.as(bob, "POST", "/engagements", like).Code)
+		notifications = getNotifications(t, app, alice)
+		require.Len(t, notifications, 1)
+		assert.Equal(t, 4, notifications[0].ActorCount, "repeated actors are counted once")
+		assert.Equal(t, []int{bob.ID, users[4].ID, users[3].ID, carol.ID}, notifications[0].ActorIDs)
+		assert.Equal(t, "bob and 3 others liked your post", notifications[0].Message)
+	})
+
+	t.Run("Reading a group starts a new one", func(t *testing.T) {
+		grouped := getNotifications(t, app, alice)[0]
+		require.Equal(t, http.StatusOK, app.as(alice, "PATCH", "/notifications/"+strconv.Itoa(grouped.ID)+"/read", "").Code)
+
+		require.Equal(t, http.StatusCreated, app.as(carol, "POST", "/engagements", like).Code)
+		notifications := getNotifications(t, app, alice)
+		require.Len(t, notifications, 2)
+		assert.Equal(t, "carol liked your post", notifications[0].Message)
+		assert.False(t, notifications[0].IsRead)
+	})
+
+	t.Run("Comments and follows notify", func(t *testing.T) {
+		comment := `{"postId": ` + strconv.Itoa(created.PostID) + `, "comment": "nice"}`
+		require.Equal(t, http.StatusCreated, app.as(bob, "POST", "/engagements", comment).Code)
+		notifications := getNotifications(t, app, alice)
+		assert.Equal(t, handlers.NotificationComment, notifications[0].Type)
+		assert.Equal(t, "bob commented on your post", notifications[0].Message)
+
+		require.Equal(t, http.StatusCreated, app.as(bob, "POST", "/follow", `{"followingId": `+strconv.Itoa(alice.ID)+`}`).Code)
+		require.Equal(t, http.StatusCreated, app.as(carol, "POST", "/follow", `{"followingId": `+strconv.Itoa(alice.ID)+`}`).Code)
+		notifications = getNotifications(t, app, alice)
+		assert.Equal(t, handlers.NotificationFollow, notifications[0].Type)
+		assert.Nil(t, notifications[0].PostID)
+		assert.Equal(t, "carol and bob followed you", notifications[0].Message)
+	})
+
+	t.Run("Only new follows of other existing users notify", func(t *testing.T) {
+		before := getNotifications(t, app, alice)
+		assert.Equal(t, http.StatusConflict, app.as(bob, "POST", "/follow", `{"followingId": `+strconv.Itoa(alice.ID)+`}`).Code)
+		assert.Equal(t, http.StatusBadRequest, app.as(alice, "POST", "/follow", `{"followingId": `+strconv.Itoa(alice.ID)+`}`).Code)
+		assert.Equal(t, http.StatusNotFound, app.as(alice, "POST", "/follow", `{"followingId": 999}`).Code)
+		assert.Equal(t, before, getNotifications(t, app, alice))
+	})
+
+	t.Run("Mentions notify once published", func(t *testing.T) {
+		content := `{"content": "thanks @bob, @bob and @nobody! mail me at carol@example.com"}`
+		require.Equal(t, http.StatusCreated, app.as(alice, "POST", "/create-post", content).Code)
+		notifications := getNotifications(t, app, bob)
+		require.Len(t, notifications, 2)
+		assert.Equal(t, handlers.NotificationMention, notifications[0].Type)
+		assert.Equal(t, "alice mentioned you in a post", notifications[0].Message)
+		assert.Len(t, getNotifications(t, app, carol), 0, "email addresses are not mentions")
+
+		scheduleTime := time.Now().Add(time.Hour).Format(time.RFC3339)
+		content = `{"content": "see you @carol", "scheduleTime": "` + scheduleTime + `"}`
+		require.Equal(t, http.StatusCreated, app.as(alice, "POST", "/create-post", content).Code)
+		assert.Empty(t, getNotifications(t, app, carol), "scheduled posts mention nobody yet")
+
+		publisher := handlers.NewPublisher(stores, handlers.NewFeed(config.Default().Feed, stores.Timelines), config.Default().Publisher)
+		_, err := publisher.PublishDue(time.Now().Add(2 * time.Hour))
+		require.NoError(t, err)
+		notifications = getNotifications(t, app, carol)
+		require.Len(t, notifications, 1)
+		assert.Equal(t, "alice mentioned you in a post", notifications[0].Message)
+	})
+
+	t.Run("Edits notify only newly mentioned users", func(t *testing.T) {
+		w := app.as(alice, "POST", "/create-post", `{"content": "hi @bob"}`)
+		require.Equal(t, http.StatusCreated, w.Code)
+		var post struct {
+			PostID int `json:"postId"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &post))
+		bobBefore, carolBefore := len(getNotifications(t, app, bob)), len(getNotifications(t, app, carol))
+
+		edit := `{"content": "hi @bob and @carol"}`
+		require.Equal(t, http.StatusOK, app.as(alice, "PUT", "/edit-post/"+strconv.Itoa(post.PostID), edit).Code)
+		assert.Len(t, getNotifications(t, app, bob), bobBefore, "bob was told when the post was published")
+		notifications := getNotifications(t, app, carol)
+		require.Len(t, notifications, carolBefore+1)
+		assert.Equal(t, handlers.NotificationMention, notifications[0].Type)
+		assert.Equal(t, post.PostID, *notifications[0].PostID)
+	})
+}
+
+func unreadCount(t *testing.T, app *testApp, user handlers.User) int {
+	t.Helper()
+	w := app.as(user, "GET", "/notifications/unread-count", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		Unread int `json:"unread"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return response.Unread
+}
+
+func TestNotificationBulkActions(t *testing.T) {
+	app := newTestApp(t)
+	stores := app.stores
+	alice := createUserWithRole(t, stores, "alice", handlers.RoleUser, nil)
+	bob := createUserWithRole(t, stores, "bob", handlers.RoleUser, nil)
+
+	now := time.Now()
+	seed := []handlers.Notification{
+		{UserID: alice.ID, Type: handlers.NotificationSystem, Message: "old", CreatedAt: now.Add(-2 * time.Hour)},
+		{UserID: alice.ID, Type: handlers.NotificationFollow, ActorIDs: []int{bob.ID}, ActorCount: 1, CreatedAt: now.Add(-time.Hour)},
+		{UserID: alice.ID, Type: handlers.NotificationLike, ActorIDs: []int{bob.ID}, ActorCount: 1, CreatedAt: now},
+		{UserID: alice.ID, Type: handlers.NotificationLike, ActorIDs: []int{bob.ID}, ActorCount: 1, CreatedAt: now},
+		{UserID: bob.ID, Type: handlers.NotificationSystem, Message: "bob's", CreatedAt: now},
+	}
+	for i := range seed {
+		require.NoError(t, stores.Notifications.Create(&seed[i]))
+	}
+	assert.Equal(t, 4, unreadCount(t, app, alice))
+
+	t.Run("Lists filter by type and read state", func(t *testing.T) {
+		assert.Len(t, listNotifications(t, app, alice, "?type=like"), 2)
+		assert.Len(t, listNotifications(t, app, alice, "?type=like&is_read=true"), 0)
+	})
+
+	t.Run("Notifications are marked read by type", func(t *testing.T) {
+		w := app.as(alice, "POST", "/notifications/read", `{"type": "like"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"marked":2`)
+		assert.Equal(t, 2, unreadCount(t, app, alice))
+		assert.Len(t, listNotifications(t, app, alice, "?is_read=false"), 2)
+
+		assert.Equal(t, http.StatusBadRequest, app.as(alice, "POST", "/notifications/read", `{"type": "gossip"}`).Code)
+	})
+
+	t.Run("Notifications are marked read before a time", func(t *testing.T) {
+		before := now.Add(-90 * time.Minute).Format(time.RFC3339Nano)
+		w := app.as(alice, "POST", "/notifications/read", `{"before": "`+before+`"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"marked":1`)
+		assert.Equal(t, 1, unreadCount(t, app, alice))
+	})
+
+	t.Run("All notifications are marked read", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, app.as(alice, "POST", "/notifications/read", "").Code)
+		assert.Zero(t, unreadCount(t, app, alice))
+		assert.Equal(t, 1, unreadCount(t, app, bob), "other users are untouched")
+	})
+
+	t.Run("Notifications are deleted by their owner", func(t *testing.T) {
+		path := "/notifications/" + strconv.Itoa(seed[0].ID)
+		assert.Equal(t, http.StatusNotFound, app.as(bob, "DELETE", path, "").Code)
+		assert.Equal(t, http.StatusOK, app.as(alice, "DELETE", path, "").Code)
+		assert.Equal(t, http.StatusNotFound, app.as(alice, "DELETE", path, "").Code)
+		assert.Len(t, getNotifications(t, app, alice), 3)
+	})
+}
+
+func TestNotificationPreferences(t *testing.T) {
+	app := newTestApp(t)
+	stores := app.stores
+	alice := createUserWithRole(t, stores, "alice", handlers.RoleUser, nil)
+	bob := createUserWithRole(t, stores, "bob", handlers.RoleUser, nil)
+	carol := createUserWithRole(t, stores, "carol", handlers.RoleUser, nil)
+
+	w := app.as(alice, "GET", "/notifications/preferences", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var preferences []handlers.NotificationPreference
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &preferences))
+	require.Len(t, preferences, len(handlers.PreferenceTypes))
+	for _, preference := range preferences {
+		assert.True(t, preference.InApp && preference.EmailDigest && !preference.Muted, "everything is on by default")
+	}
+
+	assert.Equal(t, http.StatusNotFound, app.as(alice, "PUT", "/notifications/preferences/system", `{"muted": true}`).Code)
+	w = app.as(alice, "PUT", "/notifications/preferences/follow", `{"muted": true}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"inApp":true`, "fields left out are kept")
+	require.Equal(t, http.StatusOK, app.as(alice, "PUT", "/notifications/preferences/like", `{"inApp": false}`).Code)
+
+	w = app.as(alice, "POST", "/create-post", `{"content": "hello"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created struct {
+		PostID int `json:"postId"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+
+	for _, user := range []handlers.User{bob, carol} {
+		require.Equal(t, http.StatusCreated, app.as(user, "POST", "/follow", `{"followingId": `+strconv.Itoa(alice.ID)+`}`).Code)
+		like := `{"postId": ` + strconv.Itoa(created.PostID) + `, "like": true, "comment": "hi"}`
+		require.Equal(t, http.StatusCreated, app.as(user, "POST", "/engagements", like).Code)
+	}
+
+	assert.Empty(t, listNotifications(t, app, alice, "?type=follow"), "muted types are dropped")
+	assert.Len(t, listNotifications(t, app, alice, "?type=comment&is_read=false"), 1)
+	likes := listNotifications(t, app, alice, "?type=like")
+	assert.Len(t, likes, 2, "digest-only notifications are kept, one per event")
+	for _, like := range likes {
+		assert.True(t, like.IsRead)
+	}
+	assert.Equal(t, 1, unreadCount(t, app, alice))
+}
@@ -0,0 +1,325 @@
+package test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const stubClientID = "stub-client"
+
+// stubProvider is a minimal OpenID Connect provider. Its authorization
+// endpoint signs in whoever the test put in next without asking.
+type stubProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	next  jwt.MapClaims
+	codes map[string]stubGrant
+	// nonce, when set, replaces the nonce of the next ID token
+	nonce string
+}
+
+type stubGrant struct {
+	claims      jwt.MapClaims
+	nonce       string
+	challenge   string
+	redirectURI string
+}
+
+func newStubProvider(t *testing.T) *stubProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	stub := &stubProvider{key: key, codes: make(map[string]stubGrant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 stub.URL,
+			"authorization_endpoint": stub.URL + "/authorize",
+			"token_endpoint":         stub.URL + "/token",
+			"jwks_uri":               stub.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "stub-key",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("client_id") != stubClientID || query.Get("response_type") != "code" ||
+			query.Get("code_challenge_method") != "S256" || !strings.Contains(query.Get("scope"), "openid") {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		stub.mu.Lock()
+		code := "code-" + strconv.Itoa(len(stub.codes))
+		stub.codes[code] = stubGrant{
+			claims:      stub.next,
+			nonce:       query.Get("nonce"),
+			challenge:   query.Get("code_challenge"),
+			redirectURI: query.Get("redirect_uri"),
+		}
+		stub.mu.Unlock()
+		http.Redirect(w, r, query.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(query.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		stub.mu.Lock()
+		grant, ok := stub.codes[r.FormValue("code")]
+		delete(stub.codes, r.FormValue("code"))
+		nonce := stub.nonce
+		stub.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || r.FormValue("client_secret") != "stub-secret" || r.FormValue("redirect_uri") != grant.redirectURI ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		if nonce == "" {
+			nonce = grant.nonce
+		}
+
+		claims := jwt.MapClaims{
+			"iss":   stub.URL,
+			"aud":   stubClientID,
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": nonce,
+		}
+		for k, v := range grant.claims {
+			claims[k] = v
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "stub-key"
+		idToken, _ := token.SignedString(key)
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "opaque", "token_type": "Bearer", "id_token": idToken})
+	})
+	stub.Server = httptest.NewServer(mux)
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+// signInAs makes the next sign-in at the stub return these claims
+func (p *stubProvider) signInAs(claims jwt.MapClaims) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.next = claims
+}
+
+// newOAuthApp wires the API with the stub and a Facebook provider
+func newOAuthApp(t *testing.T, stub *stubProvider) *testApp {
+	return newTestApp(t, withOAuthClient(stub.Client()), withConfig(func(cfg *config.Config) {
+		cfg.OAuth = config.OAuthConfig{
+			CallbackURL: "http://localhost:8080/oauth/{provider}/callback",
+			StateTTL:    config.Duration(time.Minute),
+			Providers: map[string]config.OIDCProviderConfig{
+				"stub":     {Issuer: stub.URL, ClientID: stubClientID, ClientSecret: "stub-secret"},
+				"facebook": {ClientID: "fb-client", ClientSecret: "fb-secret"},
+			},
+		}
+	}))
+}
+
+// followToCallback sends the browser from the stub's authorization URL back
+// to the callback and returns the callback path with its query
+func followToCallback(t *testing.T, stub *stubProvider, authURL string) string {
+	client := stub.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(authURL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	return callback.RequestURI()
+}
+
+// oauthSignIn runs a whole sign-in with the stub and returns the response
+// of the callback together with the callback path
+func oauthSignIn(t *testing.T, app *testApp, stub *stubProvider) (*httptest.ResponseRecorder, string) {
+	w := app.send("GET", "/oauth/stub/login", "")
+	require.Equal(t, http.StatusFound, w.Code)
+
+	callback := followToCallback(t, stub, w.Header().Get("Location"))
+	w = app.send("GET", callback, "")
+	return w, callback
+}
+
+func TestOAuthSignIn(t *testing.T) {
+	stub := newStubProvider(t)
+	app := newOAuthApp(t, stub)
+	stores := app.stores
+
+	t.Run("The first sign-in creates a user", func(t *testing.T) {
+		stub.signInAs(jwt.MapClaims{"sub": "subject-1", "email": "Ann@Example.com", "email_verified": true,
+			"name": "Ann Example", "preferred_username": "ann.example"})
+		w, callback := oauthSignIn(t, app, stub)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), "access_token")
+
+		user, err := stores.Users.GetByEmail("ann@example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "annexample", user.Username)
+		assert.Equal(t, "Ann Example", user.DisplayName)
+		assert.True(t, user.EmailVerified)
+		assert.Empty(t, user.Password)
+
+		identity, err := stores.Identities.Get("stub", "subject-1")
+		require.NoError(t, err)
+		assert.Equal(t, user.ID, identity.UserID)
+
+		w = app.send("GET", callback, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code, "a state is only used once")
+	})
+
+	t.Run("Later sign-ins use the linked user", func(t *testing.T) {
+		stub.signInAs(jwt.MapClaims{"sub": "subject-1", "email": "changed@example.com", "email_verified": true})
+		w, _ := oauthSignIn(t, app, stub)
+		require.Equal(t, http.StatusOK, w.Code)
+		_, err := stores.Users.GetByEmail("changed@example.com")
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+	})
+
+	t.Run("Verified emails link existing users", func(t *testing.T) {
+		user := handlers.User{Username: "bob", Password: "hash", Email: "bob@example.com", EmailVerified: true}
+		require.NoError(t, stores.Users.Create(&user))
+		stub.signInAs(jwt.MapClaims{"sub": "subject-2", "email": "bob@example.com", "email_verified": true})
+		w, _ := oauthSignIn(t, app, stub)
+		require.Equal(t, http.StatusOK, w.Code)
+		identity, err := stores.Identities.Get("stub", "subject-2")
+		require.NoError(t, err)
+		assert.Equal(t, user.ID, identity.UserID)
+	})
+
+	t.Run("Unverified emails do not", func(t *testing.T) {
+		user := handlers.User{Username: "carol", Password: "hash", Email: "carol@example.com", EmailVerified: true}
+		require.NoError(t, stores.Users.Create(&user))
+		stub.signInAs(jwt.MapClaims{"sub": "subject-3", "email": "carol@example.com", "email_verified": false})
+		w, _ := oauthSignIn(t, app, stub)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		_, err := stores.Identities.Get("stub", "subject-3")
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+	})
+
+	t.Run("ID tokens must carry the nonce", func(t *testing.T) {
+		stub.signInAs(jwt.MapClaims{"sub": "subject-4"})
+		stub.mu.Lock()
+		stub.nonce = "replayed"
+		stub.mu.Unlock()
+		defer func() {
+			stub.mu.Lock()
+			stub.nonce = ""
+			stub.mu.Unlock()
+		}()
+		w, _ := oauthSignIn(t, app, stub)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Callbacks need a known state", func(t *testing.T) {
+		w := app.send("GET", "/oauth/stub/callback?code=code-0&state=forged", "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestOAuthLinking(t *testing.T) {
+	stub := newStubProvider(t)
+	app := newOAuthApp(t, stub)
+	stores := app.stores
+
+	stub.signInAs(jwt.MapClaims{"sub": "social-only", "email": "dan@example.com", "email_verified": true})
+	w, _ := oauthSignIn(t, app, stub)
+	require.Equal(t, http.StatusOK, w.Code)
+	var login map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &login))
+	token := login["access_token"]
+
+	link := func(t *testing.T, subject string) *httptest.ResponseRecorder {
+		stub.signInAs(jwt.MapClaims{"sub": subject})
+		w := app.send("POST", "/oauth/stub/link", "", bearer(token))
+		require.Equal(t, http.StatusOK, w.Code)
+		var response map[string]string
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+		w = app.send("GET", followToCallback(t, stub, response["authorization_url"]), "")
+		return w
+	}
+
+	t.Run("The last sign-in method cannot be unlinked", func(t *testing.T) {
+		w := app.send("GET", "/identities", "", bearer(token))
+		require.Equal(t, http.StatusOK, w.Code)
+		var identities []handlers.Identity
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &identities))
+		require.Len(t, identities, 1)
+
+		w = app.send("DELETE", "/identities/"+strconv.Itoa(identities[0].ID), "", bearer(token))
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("A second account can be linked and unlinked", func(t *testing.T) {
+		w := link(t, "second-account")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var identity handlers.Identity
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &identity))
+		assert.Equal(t, "second-account", identity.Subject)
+
+		w = app.send("DELETE", "/identities/"+strconv.Itoa(identity.ID), "", bearer(token))
+		assert.Equal(t, http.StatusOK, w.Code)
+		_, err := stores.Identities.Get("stub", "second-account")
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+	})
+
+	t.Run("Accounts linked to another user cannot be linked", func(t *testing.T) {
+		other := handlers.User{Username: "erin"}
+		require.NoError(t, stores.Users.Create(&other))
+		require.NoError(t, stores.Identities.Create(&handlers.Identity{UserID: other.ID, Provider: "stub", Subject: "taken"}))
+		assert.Equal(t, http.StatusConflict, link(t, "taken").Code)
+	})
+}
+
+func TestFacebookProvider(t *testing.T) {
+	app := newOAuthApp(t, newStubProvider(t))
+
+	w := app.send("GET", "/oauth/providers", "")
+	assert.JSONEq(t, `{"providers": ["facebook", "stub"]}`, w.Body.String())
+
+	w = app.send("GET", "/oauth/facebook/login", "")
+	require.Equal(t, http.StatusFound, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "www.facebook.com", location.Host)
+	assert.Equal(t, "fb-client", location.Query().Get("client_id"))
+	assert.Equal(t, "openid email public_profile", location.Query().Get("scope"))
+	assert.Equal(t, "http://localhost:8080/oauth/facebook/callback", location.Query().Get("redirect_uri"))
+	assert.NotEmpty(t, location.Query().Get("code_challenge"))
+	assert.NotEmpty(t, location.Query().Get("nonce"))
+
+	w = app.send("GET", "/oauth/unknown/login", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
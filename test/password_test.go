@@ -0,0 +1,151 @@
+package test
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/Adnen2/tutorial/firstProject/mail"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// recordingMailer keeps every message it is asked to send
+type recordingMailer struct {
+	mu       sync.Mutex
+	messages []mail.Message
+}
+
+func (m *recordingMailer) Send(msg mail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+func (m *recordingMailer) sent() []mail.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]mail.Message{}, m.messages...)
+}
+
+// waitFor waits until n messages have been sent, for mail sent after the
+// response, and returns every message
+func (m *recordingMailer) waitFor(t *testing.T, n int) []mail.Message {
+	t.Helper()
+	require.Eventually(t, func() bool { return len(m.sent()) >= n }, time.Second, time.Millisecond)
+	return m.sent()
+}
+
+// resetToken extracts the token from the link of a password reset email
+func resetToken(t *testing.T, msg mail.Message) string {
+	t.Helper()
+	link := regexp.MustCompile(`https?://\S+`).FindString(msg.Text)
+	require.NotEmpty(t, link, "the email must contain a link")
+	parsed, err := url.Parse(link)
+	require.NoError(t, err)
+	return parsed.Query().Get("token")
+}
+
+func TestPasswordReset(t *testing.T) {
+	app := newTestApp(t)
+	stores, mailer := app.stores, app.mailer
+
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("old-password"), bcrypt.DefaultCost)
+	user := handlers.User{Username: "alice", Email: "alice@example.com", Password: string(hashed)}
+	require.NoError(t, stores.Users.Create(&user))
+
+	t.Run("Unknown addresses get the same response", func(t *testing.T) {
+		known := app.send("POST", "/password/forgot", `{"email": "ALICE@example.com"}`)
+		unknown := app.send("POST", "/password/forgot", `{"email": "nobody@example.com"}`)
+		assert.Equal(t, http.StatusAccepted, known.Code)
+		assert.Equal(t, known.Code, unknown.Code)
+		assert.Equal(t, known.Body.String(), unknown.Body.String())
+		assert.Equal(t, "alice@example.com", mailer.waitFor(t, 1)[0].To)
+		time.Sleep(10 * time.Millisecond)
+		assert.Len(t, mailer.sent(), 1, "unknown addresses get no mail")
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, app.send("POST", "/password/forgot", `{"email": "not-an-email"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, app.send("POST", "/password/reset", `{"token": "x", "password": "short"}`).Code)
+		assert.Equal(t, http.StatusBadRequest, app.send("POST", "/password/reset", `{"token": "unknown", "password": "long-enough"}`).Code)
+	})
+
+	t.Run("A token resets the password once and logs out every session", func(t *testing.T) {
+		first := resetToken(t, mailer.sent()[0])
+		app.send("POST", "/password/forgot", `{"email": "alice@example.com"}`)
+		second := resetToken(t, mailer.waitFor(t, 2)[1])
+		require.NotEqual(t, first, second)
+
+		issuedAt := time.Now().Add(-time.Minute)
+		require.NoError(t, stores.RefreshTokens.Create(&handlers.RefreshToken{
+			ID: "session", FamilyID: "f", UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour),
+		}))
+		require.NoError(t, stores.AccessTokens.Create(&handlers.PersonalAccessToken{
+			UserID: user.ID, Name: "ci", TokenHash: "hash", Scopes: []handlers.Scope{handlers.ScopeUsersRead},
+		}))
+
+		w := app.send("POST", "/password/reset", `{"token": "`+first+`", "password": "new-password"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		found, _ := stores.Users.GetByID(user.ID)
+		assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(found.Password), []byte("new-password")))
+
+		w = app.send("POST", "/password/reset", `{"token": "`+first+`", "password": "another-password"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "tokens are single-use")
+		w = app.send("POST", "/password/reset", `{"token": "`+second+`", "password": "another-password"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "outstanding tokens die with the old password")
+
+		revoked, err := stores.Revocations.IsRevoked("any", "", user.ID, issuedAt)
+		require.NoError(t, err)
+		assert.True(t, revoked, "access tokens issued before the reset are rejected")
+		claimed, _ := stores.RefreshTokens.Claim("session", time.Now())
+		assert.False(t, claimed, "refresh tokens are revoked")
+		pat, _ := stores.AccessTokens.GetByHash("hash")
+		assert.NotNil(t, pat.RevokedAt, "personal access tokens are revoked")
+	})
+
+	t.Run("Expired tokens are rejected", func(t *testing.T) {
+		app.cfg.PasswordReset.TokenTTL = config.Duration(-time.Minute)
+
+		sent := len(mailer.sent())
+		app.send("POST", "/password/forgot", `{"email": "alice@example.com"}`)
+		token := resetToken(t, mailer.waitFor(t, sent+1)[sent])
+		w := app.send("POST", "/password/reset", `{"token": "`+token+`", "password": "new-password"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestPasswordResetLimit(t *testing.T) {
+	app := newTestApp(t, withConfig(func(cfg *config.Config) {
+		cfg.PasswordReset.MaxActiveTokens = 2
+	}))
+	user := handlers.User{Username: "alice", Email: "alice@example.com"}
+	require.NoError(t, app.stores.Users.Create(&user))
+	forgot := func() {
+		require.Equal(t, http.StatusAccepted, app.send("POST", "/password/forgot", `{"email": "alice@example.com"}`).Code)
+	}
+
+	forgot()
+	app.mailer.waitFor(t, 1)
+	forgot()
+	app.mailer.waitFor(t, 2)
+	forgot()
+	time.Sleep(10 * time.Millisecond)
+	assert.Len(t, app.mailer.sent(), 2, "no more links while two are outstanding")
+	active, err := app.stores.PasswordResets.CountActive(user.ID, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 2, active)
+
+	token := resetToken(t, app.mailer.sent()[0])
+	require.Equal(t, http.StatusOK, app.send("POST", "/password/reset", `{"token": "`+token+`", "password": "new-password"}`).Code)
+	forgot()
+	app.mailer.waitFor(t, 3)
+}
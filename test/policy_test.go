@@ -0,0 +1,150 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorize(t *testing.T) {
+	companyID, otherCompanyID := 1, 2
+	owner := handlers.Actor{UserID: 1}
+	stranger := handlers.Actor{UserID: 2, Grants: []handlers.Grant{{Permission: handlers.ActionCreatePost}}}
+	admin := handlers.Actor{UserID: 3, Grants: []handlers.Grant{{Permission: handlers.ActionAll}}}
+	companyAdmin := handlers.Actor{UserID: 4, Grants: []handlers.Grant{
+		{Permission: handlers.ActionUpdateCompany, CompanyID: &companyID},
+		{Permission: handlers.ActionDeleteCompany, CompanyID: &companyID},
+	}}
+	otherCompanyAdmin := handlers.Actor{UserID: 5, Grants: []handlers.Grant{
+		{Permission: handlers.ActionUpdateCompany, CompanyID: &otherCompanyID},
+	}}
+	moderator := handlers.Actor{UserID: 6, Grants: []handlers.Grant{{Permission: handlers.ActionDeletePost}}}
+	scopedAdmin := handlers.Actor{UserID: 7, Grants: []handlers.Grant{{Permission: handlers.ActionAll, CompanyID: &companyID}}}
+
+	post := &handlers.Post{ID: 1, UserID: 1}
+	engagement := &handlers.Engagement{ID: 1, UserID: 1}
+	company := &handlers.Company{ID: 1}
+
+	tests := []struct {
+		name     string
+		actor    handlers.Actor
+		action   handlers.Action
+		resource interface{}
+		allowed  bool
+	}{
+		{"owner updates post", owner, handlers.ActionUpdatePost, post, true},
+		{"owner deletes post", owner, handlers.ActionDeletePost, post, true},
+		{"stranger updates post", stranger, handlers.ActionUpdatePost, post, false},
+		{"stranger deletes post", stranger, handlers.ActionDeletePost, post, false},
+		{"admin deletes post", admin, handlers.ActionDeletePost, post, true},
+		{"moderator deletes post", moderator, handlers.ActionDeletePost, post, true},
+		{"moderator updates post", moderator, handlers.ActionUpdatePost, post, false},
+		{"company admin deletes post", companyAdmin, handlers.ActionDeletePost, post, false},
+		{"owner updates engagement", owner, handlers.ActionUpdateEngagement, engagement, true},
+		{"stranger updates engagement", stranger, handlers.ActionUpdateEngagement, engagement, false},
+		{"stranger deletes engagement", stranger, handlers.ActionDeleteEngagement, engagement, false},
+		{"admin deletes engagement", admin, handlers.ActionDeleteEngagement, engagement, true},
+		{"company admin updates company", companyAdmin, handlers.ActionUpdateCompany, company, true},
+		{"company admin deletes company", companyAdmin, handlers.ActionDeleteCompany, company, true},
+		{"other company admin updates company", otherCompanyAdmin, handlers.ActionUpdateCompany, company, false},
+		{"stranger updates company", stranger, handlers.ActionUpdateCompany, company, false},
+		{"admin deletes company", admin, handlers.ActionDeleteCompany, company, true},
+		{"scoped admin deletes its company", scopedAdmin, handlers.ActionDeleteCompany, company, true},
+		{"scoped admin deletes post", scopedAdmin, handlers.ActionDeletePost, post, false},
+		{"user creates post", stranger, handlers.ActionCreatePost, nil, true},
+		{"owner without role creates post", owner, handlers.ActionCreatePost, nil, false},
+		{"company admin manages roles", companyAdmin, handlers.ActionManageRoles, nil, false},
+		{"admin manages roles", admin, handlers.ActionManageRoles, nil, true},
+		{"unknown action", owner, handlers.Action("posts:frobnicate"), post, false},
+		{"owner with wrong resource type", owner, handlers.ActionUpdatePost, company, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := handlers.Authorize(tt.actor, tt.action, tt.resource)
+			if tt.allowed {
+				assert.NoError(t, err)
+				return
+			}
+			var forbidden *handlers.ForbiddenError
+			require.ErrorAs(t, err, &forbidden)
+			assert.Equal(t, tt.action, forbidden.Action)
+			assert.NotEmpty(t, forbidden.Reason)
+		})
+	}
+}
+
+func TestOwnershipChecks(t *testing.T) {
+	app := newTestApp(t)
+	stores := app.stores
+
+	company := handlers.Company{Name: "Acme"}
+	require.NoError(t, stores.Companies.Create(&company))
+	companyID := int(company.ID)
+	owner := createUserWithRole(t, stores, "owner", handlers.RoleUser, nil)
+	stranger := createUserWithRole(t, stores, "stranger", handlers.RoleUser, nil)
+	admin := createUserWithRole(t, stores, "admin", handlers.RoleAdmin, nil)
+	moderator := createUserWithRole(t, stores, "moderator", handlers.RoleModerator, nil)
+	companyAdmin := createUserWithRole(t, stores, "boss", handlers.RoleCompanyAdmin, &companyID)
+
+	post := handlers.Post{Content: "mine", UserID: owner.ID}
+	require.NoError(t, stores.Posts.Create(&post))
+	other := handlers.Post{Content: "spam", UserID: stranger.ID}
+	require.NoError(t, stores.Posts.Create(&other))
+	engagement := handlers.Engagement{PostID: post.ID, UserID: owner.ID, Like: true}
+	require.NoError(t, stores.Engagements.Create(&engagement))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		user   handlers.User
+		status int
+	}{
+		{"stranger edits post", "PUT", "/edit-post/" + strconv.Itoa(post.ID), `{"content": "hijacked"}`, stranger, http.StatusForbidden},
+		{"owner edits post", "PUT", "/edit-post/" + strconv.Itoa(post.ID), `{"content": "edited"}`, owner, http.StatusOK},
+		{"admin edits post", "PUT", "/edit-post/" + strconv.Itoa(post.ID), `{"content": "moderated"}`, admin, http.StatusOK},
+		{"moderator edits post", "PUT", "/edit-post/" + strconv.Itoa(post.ID), `{"content": "censored"}`, moderator, http.StatusForbidden},
+		{"moderator deletes post", "DELETE", "/posts/" + strconv.Itoa(other.ID), "", moderator, http.StatusOK},
+		{"stranger deletes engagement", "DELETE", "/engagements/" + strconv.Itoa(engagement.ID), "", stranger, http.StatusForbidden},
+		{"stranger updates company", "PUT", "/companies/" + strconv.Itoa(companyID), `{"name": "Mine"}`, stranger, http.StatusForbidden},
+		{"company admin updates company", "PUT", "/companies/" + strconv.Itoa(companyID), `{"name": "Acme Inc"}`, companyAdmin, http.StatusOK},
+		{"owner deletes engagement", "DELETE", "/engagements/" + strconv.Itoa(engagement.ID), "", owner, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := app.as(tt.user, tt.method, tt.path, tt.body)
+
+			assert.Equal(t, tt.status, w.Code)
+			if tt.status == http.StatusForbidden {
+				var response map[string]interface{}
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+				assert.Equal(t, "Forbidden", response["error"])
+				assert.NotEmpty(t, response["action"])
+				assert.NotEmpty(t, response["reason"])
+			}
+		})
+	}
+
+	updated, _ := stores.Posts.GetByID(post.ID)
+	assert.Equal(t, "moderated", updated.Content)
+}
+
+// createUserWithRole stores a verified user holding the role named roleName, within
+// companyID when it is not nil
+func createUserWithRole(t *testing.T, stores *handlers.Stores, username, roleName string, companyID *int) handlers.User {
+	t.Helper()
+	user := handlers.User{Username: username, EmailVerified: true}
+	require.NoError(t, stores.Users.Create(&user))
+	role, err := stores.Roles.GetByName(roleName)
+	require.NoError(t, err)
+	require.NoError(t, stores.Roles.Assign(&handlers.UserRole{UserID: user.ID, RoleID: role.ID, CompanyID: companyID}))
+	return user
+}
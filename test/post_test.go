@@ -1,89 +1,58 @@
 package test
 
 import (
-	"bytes"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
 	"testing"
+	"time"
 
+	"github.com/Adnen2/tutorial/firstProject/config"
 	"github.com/Adnen2/tutorial/firstProject/handlers"
-	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
+	"github.com/stretchr/testify/require"
 )
 
-func setupTestDB1() *gorm.DB {
-	dsn := "host=localhost user=admin password=admin dbname=firstdb1 port=5432 sslmode=disable"
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
-	if err != nil {
-		panic("Failed to connect to the database: " + err.Error())
-	}
-
-	err = db.AutoMigrate(&handlers.Post{})
-	if err != nil {
-		panic("Failed to run migrations: " + err.Error())
-	}
-
-	return db
-}
-
 func TestCreatePost(t *testing.T) {
-	db := setupTestDB1()
-	router := gin.New()
-	router.Use(func(c *gin.Context) {
-		c.Set("user_id", 1)
-		c.Set("db", db)
-		c.Next()
-	})
-	router.POST("/create-post", func(c *gin.Context) {
-		handlers.CreatePost(c, db)
-	})
+	app := newTestApp(t)
+	user := createUserWithRole(t, app.stores, "alice", handlers.RoleUser, nil)
 
 	t.Run("Create a post", func(t *testing.T) {
-		payload := []byte(`{"content": "Test post content"}`)
-		req, _ := http.NewRequest("POST", "/create-post", bytes.NewBuffer(payload))
-		req.Header.Set("Content-Type", "application/json")
-
-		w := httptest.NewRecorder()
-		router.ServeHTTP(w, req)
+		w := app.as(user, "POST", "/create-post", `{"content": "Test post content"}`)
 
 		assert.Equal(t, http.StatusCreated, w.Code)
 		var response map[string]interface{}
 		_ = json.Unmarshal(w.Body.Bytes(), &response)
 		assert.Equal(t, "Post created successfully", response["message"])
 	})
+
+	t.Run("Client IDs are ignored", func(t *testing.T) {
+		w := app.as(user, "POST", "/create-post", `{"id": 1, "content": "overwrite"}`)
+		require.Equal(t, http.StatusCreated, w.Code)
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.NotEqual(t, float64(1), response["postId"])
+
+		found, err := app.stores.Posts.GetByID(1)
+		require.NoError(t, err)
+		assert.Equal(t, "Test post content", found.Content)
+	})
 }
 
 func TestEditPost(t *testing.T) {
-	db := setupTestDB1()
-	router := gin.New()
-	router.Use(func(c *gin.Context) {
-		c.Set("user_id", 1)
-		c.Set("db", db)
-		c.Next()
-	})
-	router.PUT("/edit-post/:postId", func(c *gin.Context) {
-		handlers.EditPost(c, db)
-	})
+	app := newTestApp(t)
+	stores := app.stores
 
 	t.Run("Edit a post", func(t *testing.T) {
-		// Create a test post in the database
-		post := handlers.Post{Content: "Test post content"}
-		db.Create(&post)
-
-		// Create a request body
-		requestBody := []byte(`{"content": "Updated post content"}`)
-		req, _ := http.NewRequest("PUT", "/edit-post/"+strconv.Itoa(post.ID), bytes.NewBuffer(requestBody))
-		req.Header.Set("Content-Type", "application/json")
+		// Create the author and their post in the database
+		author := handlers.User{Username: "author"}
+		stores.Users.Create(&author)
+		post := handlers.Post{Content: "Test post content", UserID: author.ID}
+		stores.Posts.Create(&post)
 
-		// Create a response recorder to capture the response
-		w := httptest.NewRecorder()
-
-		// Serve the HTTP request
-		router.ServeHTTP(w, req)
+		// Send the edit as the author
+		w := app.as(author, "PUT", "/edit-post/"+strconv.Itoa(post.ID), `{"content": "Updated post content"}`)
 
 		// Assert the response status code
 		assert.Equal(t, http.StatusOK, w.Code)
@@ -94,37 +63,25 @@ func TestEditPost(t *testing.T) {
 		assert.Equal(t, "Post content edited successfully", response["message"])
 
 		// Assert the post is updated in the database
-		var updatedPost handlers.Post
-		db.First(&updatedPost, post.ID)
+		updatedPost, err := stores.Posts.GetByID(post.ID)
+		assert.NoError(t, err)
 		assert.Equal(t, "Updated post content", updatedPost.Content)
 	})
 }
 
 func TestDeletePost(t *testing.T) {
-	db := setupTestDB1()
-	router := gin.New()
-	router.Use(func(c *gin.Context) {
-		c.Set("user_id", 1)
-		c.Set("db", db)
-		c.Next()
-	})
-	router.DELETE("/delete-post/:postId", func(c *gin.Context) {
-		handlers.DeletePost(c, db)
-	})
+	app := newTestApp(t)
+	stores := app.stores
 
 	t.Run("Delete a post", func(t *testing.T) {
-		// Create a test post in the database
-		post := handlers.Post{Content: "Test post content"}
-		db.Create(&post)
-
-		// Create a request
-		req, _ := http.NewRequest("DELETE", "/delete-post/"+strconv.Itoa(post.ID), nil)
+		// Create the author and their post in the database
+		author := handlers.User{Username: "author"}
+		stores.Users.Create(&author)
+		post := handlers.Post{Content: "Test post content", UserID: author.ID}
+		stores.Posts.Create(&post)
 
-		// Create a response recorder to capture the response
-		w := httptest.NewRecorder()
-
-		// Serve the HTTP request
-		router.ServeHTTP(w, req)
+		// Send the deletion as the author
+		w := app.as(author, "DELETE", "/posts/"+strconv.Itoa(post.ID), "")
 
 		// Assert the response status code
 		assert.Equal(t, http.StatusOK, w.Code)
@@ -135,37 +92,23 @@ func TestDeletePost(t *testing.T) {
 		assert.Equal(t, "Post deleted successfully", response["message"])
 
 		// Assert the post is deleted from the database
-		var deletedPost handlers.Post
-		db.First(&deletedPost, post.ID)
-		assert.Equal(t, 0, deletedPost.ID)
+		_, err := stores.Posts.GetByID(post.ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
 	})
 }
 
 func TestGetPostByID(t *testing.T) {
-	db := setupTestDB1()
-	router := gin.New()
-	router.Use(func(c *gin.Context) {
-		c.Set("user_id", 1)
-		c.Set("db", db)
-		c.Next()
-	})
-	router.GET("/post/:postId", func(c *gin.Context) {
-		handlers.GetPostByID(c, db)
-	})
+	app := newTestApp(t)
+	stores := app.stores
+	reader := createUserWithRole(t, stores, "reader", handlers.RoleUser, nil)
 
 	t.Run("Get a post by ID", func(t *testing.T) {
 		// Create a test post in the database
 		post := handlers.Post{Content: "Test post content"}
-		db.Create(&post)
-
-		// Create a request
-		req, _ := http.NewRequest("GET", "/post/"+strconv.Itoa(post.ID), nil)
+		stores.Posts.Create(&post)
 
-		// Create a response recorder to capture the response
-		w := httptest.NewRecorder()
-
-		// Serve the HTTP request
-		router.ServeHTTP(w, req)
+		// Send the request as another user
+		w := app.as(reader, "GET", "/posts/"+strconv.Itoa(post.ID), "")
 
 		// Assert the response status code
 		assert.Equal(t, http.StatusOK, w.Code)
@@ -178,26 +121,143 @@ func TestGetPostByID(t *testing.T) {
 }
 
 func TestGetAllPosts(t *testing.T) {
-	db := setupTestDB1()
-	router := gin.New()
-	router.Use(func(c *gin.Context) {
-		c.Set("user_id", 1)
-		c.Set("db", db)
-		c.Next()
-	})
-	router.GET("/posts", func(c *gin.Context) {
-		handlers.GetAllPosts(c, db)
-	})
+	app := newTestApp(t)
+	stores := app.stores
+	reader := createUserWithRole(t, stores, "reader", handlers.RoleUser, nil)
 
 	t.Run("Get all posts", func(t *testing.T) {
-		getReq, _ := http.NewRequest("GET", "/posts", nil)
+		stores.Posts.Create(&handlers.Post{Content: "Test post content"})
 
-		getW := httptest.NewRecorder()
-		router.ServeHTTP(getW, getReq)
+		getW := app.as(reader, "GET", "/posts", "")
 
 		assert.Equal(t, http.StatusOK, getW.Code)
-		var getAllResponse []handlers.Post
+		var getAllResponse handlers.Page[handlers.Post]
 		_ = json.Unmarshal(getW.Body.Bytes(), &getAllResponse)
-		assert.GreaterOrEqual(t, len(getAllResponse), 1)
+		assert.GreaterOrEqual(t, len(getAllResponse.Items), 1)
+	})
+
+	t.Run("Page through posts", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			stores.Posts.Create(&handlers.Post{Content: "Paged post", UserID: 2})
+		}
+
+		var ids []int
+		cursor := ""
+		for {
+			w := app.as(reader, "GET", "/posts?limit=2&sort=id&user_id=2&cursor="+cursor, "")
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var page handlers.Page[handlers.Post]
+			_ = json.Unmarshal(w.Body.Bytes(), &page)
+			for _, post := range page.Items {
+				assert.Equal(t, 2, post.UserID)
+				ids = append(ids, post.ID)
+			}
+			if !page.HasMore {
+				break
+			}
+			cursor = page.NextCursor
+		}
+		assert.Len(t, ids, 4)
+		assert.IsIncreasing(t, ids)
+	})
+
+	t.Run("Reject invalid list parameters", func(t *testing.T) {
+		for _, query := range []string{"limit=0", "limit=101", "sort=content", "user_id=abc", "cursor=abc"} {
+			w := app.as(reader, "GET", "/posts?"+query, "")
+			assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		}
+
+		// A cursor only works with the sort it was issued for
+		cursor := handlers.Cursor{Sort: "id", ID: 1}.Encode()
+		w := app.as(reader, "GET", "/posts?sort=-id&cursor="+cursor, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestScheduledPosts(t *testing.T) {
+	app := newTestApp(t)
+	stores := app.stores
+	// Users 1 to 3, so both the author and another user can be exercised
+	var users []handlers.User
+	for _, username := range []string{"alice", "bob", "carol"} {
+		users = append(users, createUserWithRole(t, stores, username, handlers.RoleUser, nil))
+	}
+
+	do := func(method, path string, userID int, body string) *httptest.ResponseRecorder {
+		return app.as(users[userID-1], method, path, body)
+	}
+	schedule := func(userID int, at time.Time) int {
+		w := do("POST", "/create-post", userID, `{"content": "later", "scheduleTime": "`+at.Format(time.RFC3339)+`"}`)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var response map[string]interface{}
+		_ = json.Unmarshal(w.Body.Bytes(), &response)
+		assert.Equal(t, handlers.PostStatusScheduled, response["status"])
+		return int(response["postId"].(float64))
+	}
+
+	t.Run("Scheduled posts are hidden from everyone but the author", func(t *testing.T) {
+		postID := schedule(1, time.Now().Add(time.Hour))
+		path := "/posts/" + strconv.Itoa(postID)
+
+		assert.Equal(t, http.StatusOK, do("GET", path, 1, "").Code)
+		assert.Equal(t, http.StatusNotFound, do("GET", path, 2, "").Code)
+
+		var page handlers.Page[handlers.Post]
+		_ = json.Unmarshal(do("GET", "/posts", 1, "").Body.Bytes(), &page)
+		assert.Empty(t, page.Items)
+
+		_ = json.Unmarshal(do("GET", "/posts/scheduled", 1, "").Body.Bytes(), &page)
+		assert.Len(t, page.Items, 1)
+		_ = json.Unmarshal(do("GET", "/posts/scheduled", 2, "").Body.Bytes(), &page)
+		assert.Empty(t, page.Items)
+
+		like := `{"postId": ` + strconv.Itoa(postID) + `, "like": true}`
+		assert.Equal(t, http.StatusNotFound, do("POST", "/engagements", 2, like).Code, "others cannot engage with it")
+		assert.Equal(t, http.StatusCreated, do("POST", "/engagements", 1, like).Code)
+		assert.Equal(t, http.StatusNotFound, do("POST", "/engagements", 2, `{"postId": 999, "like": true}`).Code)
+	})
+
+	t.Run("Reschedule a post", func(t *testing.T) {
+		postID := schedule(1, time.Now().Add(time.Hour))
+		path := "/posts/" + strconv.Itoa(postID) + "/schedule"
+		later := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+
+		w := do("PUT", path, 2, `{"scheduleTime": "`+later.Format(time.RFC3339)+`"}`)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		w = do("PUT", path, 1, `{"scheduleTime": "`+time.Now().Add(-time.Hour).Format(time.RFC3339)+`"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w = do("PUT", path, 1, `{"scheduleTime": "`+later.Format(time.RFC3339)+`"}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		post, err := stores.Posts.GetByID(postID)
+		assert.NoError(t, err)
+		assert.True(t, post.ScheduleTime.Equal(later))
+	})
+
+	t.Run("Cancel a scheduled post", func(t *testing.T) {
+		postID := schedule(1, time.Now().Add(time.Hour))
+		path := "/posts/" + strconv.Itoa(postID) + "/schedule"
+
+		assert.Equal(t, http.StatusNotFound, do("DELETE", path, 2, "").Code)
+		assert.Equal(t, http.StatusOK, do("DELETE", path, 1, "").Code)
+		assert.Equal(t, http.StatusNotFound, do("DELETE", path, 1, "").Code)
+	})
+
+	t.Run("The publisher publishes due posts", func(t *testing.T) {
+		postID := schedule(3, time.Now().Add(time.Hour))
+
+		publisher := handlers.NewPublisher(stores, handlers.NewFeed(config.Default().Feed, stores.Timelines), config.PublisherConfig{Interval: config.Duration(time.Second), BatchSize: 1})
+		published, err := publisher.PublishDue(time.Now())
+		assert.NoError(t, err)
+		assert.Empty(t, published)
+
+		published, err = publisher.PublishDue(time.Now().Add(3 * time.Hour))
+		assert.NoError(t, err)
+		assert.Len(t, published, 3, "every due post is published across batches")
+
+		assert.Equal(t, http.StatusOK, do("GET", "/posts/"+strconv.Itoa(postID), 2, "").Code)
+		w := do("DELETE", "/posts/"+strconv.Itoa(postID)+"/schedule", 3, "")
+		assert.Equal(t, http.StatusNotFound, w.Code, "published posts can no longer be cancelled")
 	})
 }
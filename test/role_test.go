@@ -0,0 +1,131 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoleManagement(t *testing.T) {
+	app := newTestApp(t)
+	stores := app.stores
+	admin := createUserWithRole(t, stores, "admin", handlers.RoleAdmin, nil)
+	user := createUserWithRole(t, stores, "user", handlers.RoleUser, nil)
+
+	t.Run("Only role managers can create roles", func(t *testing.T) {
+		w := app.as(user, "POST", "/roles", `{"name": "editor", "permissions": ["posts:update"]}`)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		w = app.as(admin, "POST", "/roles", `{"name": "editor", "permissions": ["posts:update"]}`)
+		require.Equal(t, http.StatusCreated, w.Code)
+		var role handlers.Role
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &role))
+		assert.Equal(t, []handlers.Action{handlers.ActionUpdatePost}, role.Permissions)
+
+		w = app.as(admin, "POST", "/roles", `{"name": "editor"}`)
+		assert.Equal(t, http.StatusConflict, w.Code)
+		w = app.as(admin, "POST", "/roles", `{"name": "wizard", "permissions": ["spells:cast"]}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Edits replace the permissions", func(t *testing.T) {
+		role, err := stores.Roles.GetByName("editor")
+		require.NoError(t, err)
+		w := app.as(admin, "PUT", "/roles/"+strconv.Itoa(int(role.ID)), `{"permissions": ["posts:update", "posts:delete"]}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		role, _ = stores.Roles.GetByID(role.ID)
+		assert.ElementsMatch(t, []handlers.Action{handlers.ActionUpdatePost, handlers.ActionDeletePost}, role.Permissions)
+	})
+
+	t.Run("System roles cannot be deleted", func(t *testing.T) {
+		role, _ := stores.Roles.GetByName(handlers.RoleUser)
+		w := app.as(admin, "DELETE", "/roles/"+strconv.Itoa(int(role.ID)), "")
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("Granting and revoking a global role", func(t *testing.T) {
+		role, _ := stores.Roles.GetByName("editor")
+		path := "/users/" + strconv.Itoa(user.ID) + "/roles"
+		body := `{"roleId": ` + strconv.Itoa(int(role.ID)) + `}`
+
+		w := app.as(user, "POST", path, body)
+		assert.Equal(t, http.StatusForbidden, w.Code, "users cannot grant themselves roles")
+
+		w = app.as(admin, "POST", path, body)
+		require.Equal(t, http.StatusCreated, w.Code)
+		w = app.as(admin, "POST", path, body)
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		w = app.as(user, "GET", path, "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var assignments []handlers.UserRole
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &assignments))
+		require.Len(t, assignments, 2)
+		assert.Equal(t, "editor", assignments[1].RoleName)
+
+		w = app.as(admin, "DELETE", path+"/"+strconv.Itoa(int(role.ID)), "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		w = app.as(admin, "DELETE", path+"/"+strconv.Itoa(int(role.ID)), "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Company admins grant within their company only", func(t *testing.T) {
+		acme := handlers.Company{Name: "Acme"}
+		require.NoError(t, stores.Companies.Create(&acme))
+		other := handlers.Company{Name: "Other"}
+		require.NoError(t, stores.Companies.Create(&other))
+		acmeID, otherID := int(acme.ID), int(other.ID)
+		boss := createUserWithRole(t, stores, "boss", handlers.RoleCompanyAdmin, &acmeID)
+		companyAdmin, _ := stores.Roles.GetByName(handlers.RoleCompanyAdmin)
+		adminRole, _ := stores.Roles.GetByName(handlers.RoleAdmin)
+		path := "/users/" + strconv.Itoa(user.ID) + "/roles"
+		grant := func(roleID uint, companyID *int) string {
+			body := map[string]interface{}{"roleId": roleID}
+			if companyID != nil {
+				body["companyId"] = *companyID
+			}
+			raw, _ := json.Marshal(body)
+			return string(raw)
+		}
+
+		w := app.as(boss, "POST", path, grant(companyAdmin.ID, nil))
+		assert.Equal(t, http.StatusForbidden, w.Code, "company admins cannot grant global roles")
+		w = app.as(boss, "POST", path, grant(companyAdmin.ID, &otherID))
+		assert.Equal(t, http.StatusForbidden, w.Code, "company admins cannot grant in other companies")
+		w = app.as(boss, "POST", path, grant(adminRole.ID, &acmeID))
+		assert.Equal(t, http.StatusForbidden, w.Code, "company admins cannot grant more than they hold")
+
+		w = app.as(user, "PUT", "/companies/"+strconv.Itoa(acmeID), `{"name": "Mine"}`)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = app.as(boss, "POST", path, grant(companyAdmin.ID, &acmeID))
+		require.Equal(t, http.StatusCreated, w.Code)
+		w = app.as(user, "PUT", "/companies/"+strconv.Itoa(acmeID), `{"name": "Acme Inc"}`)
+		assert.Equal(t, http.StatusOK, w.Code, "the new company admin can update the company")
+		w = app.as(user, "PUT", "/companies/"+strconv.Itoa(otherID), `{"name": "Mine"}`)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		w = app.as(boss, "DELETE", path+"/"+strconv.Itoa(int(companyAdmin.ID))+"?companyId="+strconv.Itoa(acmeID), "")
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func TestRegisterAssignsDefaultRole(t *testing.T) {
+	app := newTestApp(t)
+	stores := app.stores
+
+	w := app.send("POST", "/register", `{"username": "newbie", "email": "newbie@example.com", "password": "secret-password"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	user, err := stores.Users.GetByUsername("newbie")
+	require.NoError(t, err)
+	grants, err := stores.Roles.Grants(user.ID)
+	require.NoError(t, err)
+	actor := handlers.Actor{UserID: user.ID, Grants: grants}
+	assert.True(t, actor.Can(handlers.ActionCreatePost, nil))
+	assert.False(t, actor.Can(handlers.ActionDeletePost, nil))
+}
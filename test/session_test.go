@@ -0,0 +1,114 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loginWithAgent logs in with the given user agent and returns the access and
+// refresh tokens
+func loginWithAgent(app *testApp, username, userAgent string) (string, string) {
+	return app.login(username, withHeader("User-Agent", userAgent), fromIP("192.0.2.1"))
+}
+
+func getSessions(t *testing.T, app *testApp, token string) []handlers.Session {
+	w := app.send("GET", "/sessions", "", bearer(token))
+	require.Equal(t, http.StatusOK, w.Code)
+	var sessions []handlers.Session
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &sessions))
+	return sessions
+}
+
+func TestSessions(t *testing.T) {
+	app := newTestApp(t)
+	stores := app.stores
+	for _, username := range []string{"alice", "bob"} {
+		require.NoError(t, stores.Users.Create(&handlers.User{Username: username, Password: testPasswordHash}))
+	}
+
+	laptop, _ := loginWithAgent(app, "alice", "Laptop")
+	phone, phoneRefresh := loginWithAgent(app, "alice", "Phone")
+	tablet, _ := loginWithAgent(app, "alice", "Tablet")
+	bob, _ := loginWithAgent(app, "bob", "Desktop")
+
+	t.Run("Every login is a session", func(t *testing.T) {
+		sessions := getSessions(t, app, laptop)
+		require.Len(t, sessions, 3)
+		assert.Equal(t, "Laptop", sessions[0].UserAgent, "the session listing them was just seen")
+		assert.True(t, sessions[0].Current)
+		assert.False(t, sessions[1].Current)
+		assert.Equal(t, "192.0.2.1", sessions[0].IP)
+		assert.Equal(t, tokenClaim(t, laptop, "family"), sessions[0].ID)
+	})
+
+	t.Run("Last seen is written in batches", func(t *testing.T) {
+		stored, err := stores.Sessions.ListByUser(1, time.Time{})
+		require.NoError(t, err)
+		lastSeen := map[string]time.Time{}
+		for _, session := range stored {
+			lastSeen[session.UserAgent] = session.LastSeenAt
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		require.Equal(t, http.StatusOK, app.send("GET", "/sessions", "", bearer(tablet)).Code)
+		stored, _ = stores.Sessions.ListByUser(1, time.Time{})
+		for _, session := range stored {
+			assert.Equal(t, lastSeen[session.UserAgent], session.LastSeenAt, "requests do not write")
+		}
+
+		require.NoError(t, stores.SessionActivity.Flush())
+		stored, _ = stores.Sessions.ListByUser(1, time.Time{})
+		assert.Equal(t, "Tablet", stored[0].UserAgent)
+		assert.True(t, stored[0].LastSeenAt.After(lastSeen["Tablet"]))
+	})
+
+	t.Run("A session can be revoked", func(t *testing.T) {
+		phoneSession := tokenClaim(t, phone, "family")
+		assert.Equal(t, http.StatusNotFound, app.send("DELETE", "/sessions/"+phoneSession, "", bearer(bob)).Code)
+		assert.Equal(t, http.StatusOK, app.send("DELETE", "/sessions/"+phoneSession, "", bearer(laptop)).Code)
+		assert.Equal(t, http.StatusNotFound, app.send("DELETE", "/sessions/"+phoneSession, "", bearer(laptop)).Code)
+
+		assert.Equal(t, http.StatusUnauthorized, app.send("GET", "/sessions", "", bearer(phone)).Code)
+		w := app.send("POST", "/token/refresh", `{"refresh_token": "`+phoneRefresh+`"}`)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Len(t, getSessions(t, app, laptop), 2)
+	})
+
+	t.Run("Other sessions can be revoked at once", func(t *testing.T) {
+		w := app.send("DELETE", "/sessions", "", bearer(laptop))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"message": "Other sessions revoked successfully", "revoked": 1}`, w.Body.String())
+
+		assert.Equal(t, http.StatusUnauthorized, app.send("GET", "/sessions", "", bearer(tablet)).Code)
+		sessions := getSessions(t, app, laptop)
+		require.Len(t, sessions, 1)
+		assert.True(t, sessions[0].Current)
+		assert.Len(t, getSessions(t, app, bob), 1, "other users keep their sessions")
+	})
+
+	t.Run("Logging out ends the session", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, app.send("POST", "/logout", "", bearer(bob)).Code)
+		sessions, err := stores.Sessions.ListByUser(2, time.Time{})
+		require.NoError(t, err)
+		assert.Empty(t, sessions)
+	})
+}
+
+// tokenClaim returns a claim from the payload of a JWT without
+// verifying it
+func tokenClaim(t *testing.T, token, claim string) string {
+	var claims map[string]interface{}
+	segment, err := jwt.DecodeSegment(strings.Split(token, ".")[1])
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(segment, &claims))
+	value, _ := claims[claim].(string)
+	return value
+}
@@ -0,0 +1,1152 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/Adnen2/tutorial/firstProject/migrations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestMemoryStores(t *testing.T) {
+	runStoreConformance(t, func(t *testing.T) *handlers.Stores {
+		return handlers.NewMemoryStores()
+	})
+}
+
+// TestPostgresStores runs the conformance suite against the database named
+// by TEST_DATABASE_DSN. Every table in it is truncated between subtests.
+func TestPostgresStores(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	require.NoError(t, err)
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	migrator, err := migrations.New(sqlDB)
+	require.NoError(t, err)
+	_, err = migrator.Up(context.Background())
+	require.NoError(t, err)
+
+	runStoreConformance(t, func(t *testing.T) *handlers.Stores {
+		var tables []string
+		err := db.Raw("SELECT tablename FROM pg_tables WHERE schemaname = 'public' AND tablename <> 'schema_migrations'").
+			Scan(&tables).Error
+		require.NoError(t, err)
+		require.NoError(t, db.Exec("TRUNCATE "+strings.Join(tables, ", ")+" RESTART IDENTITY CASCADE").Error)
+		stores := handlers.NewPostgresStores(db)
+		require.NoError(t, stores.Roles.Seed())
+		return stores
+	})
+}
+
+// runStoreConformance checks the behaviour every Stores implementation must
+// share. newStores must return empty stores, apart from the seeded roles.
+func runStoreConformance(t *testing.T, newStores func(t *testing.T) *handlers.Stores) {
+	t.Run("Users", func(t *testing.T) {
+		s := newStores(t)
+
+		user := handlers.User{Username: "alice", Password: "hash", Email: "Alice@Example.com"}
+		require.NoError(t, s.Users.Create(&user))
+		assert.NotZero(t, user.ID)
+		require.NoError(t, s.Users.Create(&handlers.User{Username: "bob"}))
+
+		byEmail, err := s.Users.GetByEmail("alice@example.com")
+		require.NoError(t, err)
+		assert.Equal(t, user.ID, byEmail.ID)
+		_, err = s.Users.GetByEmail("")
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+		assert.ErrorIs(t, s.Users.Create(&handlers.User{Username: "alicia", Email: "ALICE@example.com"}), handlers.ErrConflict)
+
+		found, err := s.Users.GetByID(user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "alice", found.Username)
+
+		found, err = s.Users.GetByUsername("alice")
+		require.NoError(t, err)
+		assert.Equal(t, user.ID, found.ID)
+
+		_, err = s.Users.GetByUsername("nobody")
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+		_, err = s.Users.GetByID(user.ID + 100)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+
+		found.Username = "alicia"
+		require.NoError(t, s.Users.Update(found))
+		found, _ = s.Users.GetByID(user.ID)
+		assert.Equal(t, "alicia", found.Username)
+
+		users, err := s.Users.Search("lic", handlers.ListQuery{})
+		require.NoError(t, err)
+		assert.Len(t, users, 1)
+		users, err = s.Users.Search("", handlers.ListQuery{})
+		require.NoError(t, err)
+		assert.Len(t, users, 2)
+	})
+
+	t.Run("Posts", func(t *testing.T) {
+		s := newStores(t)
+
+		first := handlers.Post{Content: "hello world", UserID: 1}
+		second := handlers.Post{Content: "goodbye", UserID: 2}
+		require.NoError(t, s.Posts.Create(&first))
+		require.NoError(t, s.Posts.Create(&second))
+		assert.NotEqual(t, first.ID, second.ID)
+
+		found, err := s.Posts.GetByID(first.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "hello world", found.Content)
+
+		preset := handlers.Post{ID: first.ID, Content: "overwrite", UserID: 2}
+		require.NoError(t, s.Posts.Create(&preset), "Create ignores a preset ID")
+		assert.NotEqual(t, first.ID, preset.ID)
+		found, _ = s.Posts.GetByID(first.ID)
+		assert.Equal(t, "hello world", found.Content)
+		require.NoError(t, s.Posts.Delete(preset.ID))
+
+		found.Content = "hello again"
+		require.NoError(t, s.Posts.Update(found))
+		found, _ = s.Posts.GetByID(first.ID)
+		assert.Equal(t, "hello again", found.Content)
+
+		posts, err := s.Posts.Search("hello", handlers.ListQuery{})
+		require.NoError(t, err)
+		assert.Len(t, posts, 1)
+
+		require.NoError(t, s.Posts.Delete(second.ID))
+		assert.ErrorIs(t, s.Posts.Delete(second.ID), handlers.ErrNotFound)
+		_, err = s.Posts.GetByID(second.ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+
+		posts, err = s.Posts.List(handlers.ListQuery{})
+		require.NoError(t, err)
+		assert.Len(t, posts, 1)
+	})
+
+	t.Run("ListQuery", func(t *testing.T) {
+		s := newStores(t)
+
+		base := time.Now().Truncate(time.Second)
+		for i, content := range []string{"a", "b", "c", "d", "e"} {
+			// Two posts share a publication time so the id tiebreak matters
+			publishedAt := base.Add(time.Duration(i/2) * time.Minute)
+			post := handlers.Post{Content: content, UserID: 1 + i%2, PublishedAt: &publishedAt}
+			require.NoError(t, s.Posts.Create(&post))
+		}
+
+		contents := func(posts []handlers.Post) []string {
+			var out []string
+			for _, post := range posts {
+				out = append(out, post.Content)
+			}
+			return out
+		}
+
+		posts, err := s.Posts.List(handlers.ListQuery{Sort: "published_at", Desc: true})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"e", "d", "c", "b", "a"}, contents(posts))
+
+		posts, err = s.Posts.List(handlers.ListQuery{Filters: map[string]interface{}{"user_id": int64(2)}})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"b", "d"}, contents(posts))
+
+		// Walk the list two at a time with cursors taken from the last item
+		query := handlers.ListQuery{Limit: 2, Sort: "published_at", Desc: true}
+		var walked []string
+		for {
+			posts, err := s.Posts.List(query)
+			require.NoError(t, err)
+			walked = append(walked, contents(posts)...)
+			if len(posts) < query.Limit {
+				break
+			}
+			last := posts[len(posts)-1]
+			value, _ := json.Marshal(last.PublishedAt)
+			query.After = &handlers.Cursor{Sort: query.Sort, Desc: true, Value: value, ID: int64(last.ID)}
+		}
+		assert.Equal(t, []string{"e", "d", "c", "b", "a"}, walked)
+
+		_, err = s.Posts.List(handlers.ListQuery{Sort: "password"})
+		assert.Error(t, err, "unknown columns are rejected")
+	})
+
+	t.Run("ScheduledPosts", func(t *testing.T) {
+		s := newStores(t)
+		now := time.Now()
+
+		later := handlers.Post{Content: "later", UserID: 1, Status: handlers.PostStatusScheduled, ScheduleTime: now.Add(2 * time.Hour)}
+		soon := handlers.Post{Content: "soon", UserID: 1, Status: handlers.PostStatusScheduled, ScheduleTime: now.Add(time.Hour)}
+		require.NoError(t, s.Posts.Create(&later))
+		require.NoError(t, s.Posts.Create(&soon))
+		require.NoError(t, s.Posts.Create(&handlers.Post{Content: "now", UserID: 1}))
+
+		posts, err := s.Posts.List(handlers.ListQuery{})
+		require.NoError(t, err)
+		assert.Len(t, posts, 1, "scheduled posts are not listed")
+		posts, err = s.Posts.Search("later", handlers.ListQuery{})
+		require.NoError(t, err)
+		assert.Empty(t, posts, "scheduled posts are not searchable")
+
+		posts, err = s.Posts.ListScheduled(1, handlers.ListQuery{Sort: "schedule_time"})
+		require.NoError(t, err)
+		require.Len(t, posts, 2)
+		assert.Equal(t, soon.ID, posts[0].ID)
+
+		// Update must not be able to publish a post
+		soon.Status = handlers.PostStatusPublished
+		require.NoError(t, s.Posts.Update(&soon))
+		found, _ := s.Posts.GetByID(soon.ID)
+		assert.Equal(t, handlers.PostStatusScheduled, found.Status)
+
+		require.NoError(t, s.Posts.Reschedule(later.ID, now.Add(3*time.Hour)))
+		require.NoError(t, s.Posts.CancelScheduled(later.ID))
+		assert.ErrorIs(t, s.Posts.Reschedule(later.ID, now), handlers.ErrNotFound)
+
+		published, err := s.Posts.PublishDue(now, 10)
+		require.NoError(t, err)
+		assert.Empty(t, published)
+		published, err = s.Posts.PublishDue(now.Add(time.Hour), 10)
+		require.NoError(t, err)
+		require.Len(t, published, 1)
+		assert.Equal(t, handlers.PostStatusPublished, published[0].Status)
+		assert.NotNil(t, published[0].PublishedAt)
+
+		published, _ = s.Posts.PublishDue(now.Add(time.Hour), 10)
+		assert.Empty(t, published, "a post is only published once")
+		assert.ErrorIs(t, s.Posts.CancelScheduled(soon.ID), handlers.ErrNotFound)
+		posts, _ = s.Posts.List(handlers.ListQuery{})
+		assert.Len(t, posts, 2)
+	})
+
+	t.Run("Timelines", func(t *testing.T) {
+		s := newStores(t)
+
+		require.NoError(t, s.Follows.Create(&handlers.Follow{FollowerID: 1, FollowingID: 2}))
+		var posts []handlers.Post
+		for i, userID := range []int{1, 2, 3, 2} {
+			publishedAt := time.Now().Add(time.Duration(i) * time.Minute)
+			post := handlers.Post{Content: "post", UserID: userID, PublishedAt: &publishedAt}
+			require.NoError(t, s.Posts.Create(&post))
+			posts = append(posts, post)
+		}
+
+		newest := handlers.ListQuery{Limit: 10, Sort: "published_at", Desc: true}
+		timeline, err := s.Timelines.Query(1, newest)
+		require.NoError(t, err)
+		require.Len(t, timeline, 3)
+		assert.Equal(t, posts[3].ID, timeline[0].ID)
+
+		value, _ := json.Marshal(timeline[0].PublishedAt)
+		after := handlers.ListQuery{Limit: 1, Sort: "published_at", Desc: true, After: &handlers.Cursor{
+			Sort: "published_at", Desc: true, Value: value, ID: int64(timeline[0].ID),
+		}}
+		timeline, err = s.Timelines.Query(1, after)
+		require.NoError(t, err)
+		require.Len(t, timeline, 1)
+		assert.Equal(t, posts[1].ID, timeline[0].ID)
+
+		require.NoError(t, s.Timelines.Rebuild())
+		timeline, err = s.Timelines.Read(1, newest)
+		require.NoError(t, err)
+		assert.Len(t, timeline, 3)
+
+		require.NoError(t, s.Timelines.Remove(1, 2), "still following, nothing is removed")
+		timeline, _ = s.Timelines.Read(1, newest)
+		assert.Len(t, timeline, 3)
+
+		follow, _ := s.Follows.Get(1, 2)
+		require.NoError(t, s.Follows.Delete(follow.ID))
+		require.NoError(t, s.Timelines.Remove(1, 2))
+		timeline, _ = s.Timelines.Read(1, newest)
+		assert.Len(t, timeline, 1)
+
+		require.NoError(t, s.Timelines.Backfill(1, 3))
+		require.NoError(t, s.Posts.Delete(posts[0].ID))
+		timeline, _ = s.Timelines.Read(1, newest)
+		require.Len(t, timeline, 1, "deleted posts leave the timeline")
+		assert.Equal(t, posts[2].ID, timeline[0].ID)
+	})
+
+	t.Run("Engagements", func(t *testing.T) {
+		s := newStores(t)
+
+		like := handlers.Engagement{PostID: 1, UserID: 1, Like: true}
+		comment := handlers.Engagement{PostID: 1, UserID: 2, Comment: "nice"}
+		require.NoError(t, s.Engagements.Create(&like))
+		require.NoError(t, s.Engagements.Create(&comment))
+		require.NoError(t, s.Engagements.Create(&handlers.Engagement{PostID: 2, UserID: 1, Like: true}))
+
+		engagements, err := s.Engagements.ListByPost(1, handlers.ListQuery{})
+		require.NoError(t, err)
+		assert.Len(t, engagements, 2)
+
+		likes, err := s.Engagements.CountLikes(1)
+		require.NoError(t, err)
+		assert.EqualValues(t, 1, likes)
+		comments, err := s.Engagements.CountComments(1)
+		require.NoError(t, err)
+		assert.EqualValues(t, 1, comments)
+
+		found, err := s.Engagements.GetByID(comment.ID)
+		require.NoError(t, err)
+		found.Like = true
+		require.NoError(t, s.Engagements.Update(found))
+		likes, _ = s.Engagements.CountLikes(1)
+		assert.EqualValues(t, 2, likes)
+
+		require.NoError(t, s.Engagements.Delete(like.ID))
+		_, err = s.Engagements.GetByID(like.ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+	})
+
+	t.Run("Follows", func(t *testing.T) {
+		s := newStores(t)
+
+		require.NoError(t, s.Follows.Create(&handlers.Follow{FollowerID: 1, FollowingID: 2}))
+		require.NoError(t, s.Follows.Create(&handlers.Follow{FollowerID: 3, FollowingID: 2}))
+		require.NoError(t, s.Follows.Create(&handlers.Follow{FollowerID: 2, FollowingID: 1}))
+		assert.ErrorIs(t, s.Follows.Create(&handlers.Follow{FollowerID: 1, FollowingID: 2}), handlers.ErrConflict)
+
+		followers, err := s.Follows.ListFollowers(2, handlers.ListQuery{})
+		require.NoError(t, err)
+		assert.Len(t, followers, 2)
+		followings, err := s.Follows.ListFollowings(2, handlers.ListQuery{})
+		require.NoError(t, err)
+		assert.Len(t, followings, 1)
+
+		follow, err := s.Follows.Get(1, 2)
+		require.NoError(t, err)
+		require.NoError(t, s.Follows.Delete(follow.ID))
+		_, err = s.Follows.Get(1, 2)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+		require.NoError(t, s.Follows.Create(&handlers.Follow{FollowerID: 1, FollowingID: 2}), "unfollowed users can be followed again")
+
+		followers, err = s.Follows.ListFollowers(4, handlers.ListQuery{})
+		require.NoError(t, err)
+		assert.Empty(t, followers)
+	})
+
+	t.Run("Notifications", func(t *testing.T) {
+		s := newStores(t)
+
+		older := handlers.Notification{UserID: 1, Message: "older", CreatedAt: time.Now().Add(-time.Hour)}
+		newer := handlers.Notification{UserID: 1, Message: "newer", CreatedAt: time.Now()}
+		require.NoError(t, s.Notifications.Create(&older))
+		require.NoError(t, s.Notifications.Create(&newer))
+		require.NoError(t, s.Notifications.Create(&handlers.Notification{UserID: 2, Message: "other"}))
+
+		notifications, err := s.Notifications.ListByUser(1, handlers.ListQuery{Sort: "created_at", Desc: true})
+		require.NoError(t, err)
+		require.Len(t, notifications, 2)
+		assert.Equal(t, "newer", notifications[0].Message)
+
+		require.NoError(t, s.Notifications.MarkRead(older.ID))
+		found, err := s.Notifications.GetByID(older.ID)
+		require.NoError(t, err)
+		assert.True(t, found.IsRead)
+
+		assert.ErrorIs(t, s.Notifications.MarkRead(older.ID+100), handlers.ErrNotFound)
+
+		postID := 7
+		like := func(actorID int) *handlers.Notification {
+			return &handlers.Notification{UserID: 1, Type: handlers.NotificationLike, ActorIDs: []int{actorID}, ActorCount: 1, PostID: &postID, GroupKey: "like:post:7"}
+		}
+		first := like(2)
+		require.NoError(t, s.Notifications.Group(first))
+		second := like(3)
+		require.NoError(t, s.Notifications.Group(second))
+		assert.Equal(t, first.ID, second.ID)
+		assert.Equal(t, []int{3, 2}, second.ActorIDs)
+		assert.Equal(t, 2, second.ActorCount)
+		found, err = s.Notifications.GetByID(first.ID)
+		require.NoError(t, err)
+		assert.Equal(t, []int{3, 2}, found.ActorIDs)
+		assert.Equal(t, postID, *found.PostID)
+
+		notifications, _ = s.Notifications.ListByUser(1, handlers.ListQuery{Sort: "updated_at", Desc: true})
+		assert.Equal(t, first.ID, notifications[0].ID, "grouped events move the group up")
+
+		require.NoError(t, s.Notifications.MarkRead(first.ID))
+		third := like(4)
+		require.NoError(t, s.Notifications.Group(third))
+		assert.NotEqual(t, first.ID, third.ID, "read groups are not reopened")
+		assert.Equal(t, 1, third.ActorCount)
+	})
+
+	t.Run("NotificationBulkActions", func(t *testing.T) {
+		s := newStores(t)
+		now := time.Now()
+
+		seed := []handlers.Notification{
+			{UserID: 1, Type: handlers.NotificationLike, UpdatedAt: now.Add(-2 * time.Hour)},
+			{UserID: 1, Type: handlers.NotificationLike, UpdatedAt: now},
+			{UserID: 1, Type: handlers.NotificationFollow, UpdatedAt: now},
+			{UserID: 2, Type: handlers.NotificationLike, UpdatedAt: now},
+		}
+		for i := range seed {
+			require.NoError(t, s.Notifications.Create(&seed[i]))
+		}
+		unread, err := s.Notifications.CountUnread(1)
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), unread)
+
+		before := now.Add(-time.Hour)
+		marked, err := s.Notifications.MarkAllRead(1, handlers.NotificationFilter{Type: handlers.NotificationLike, Before: &before})
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), marked)
+		marked, err = s.Notifications.MarkAllRead(1, handlers.NotificationFilter{Type: handlers.NotificationLike})
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), marked, "read notifications are not counted again")
+		unread, _ = s.Notifications.CountUnread(1)
+		assert.Equal(t, int64(1), unread)
+		unread, _ = s.Notifications.CountUnread(2)
+		assert.Equal(t, int64(1), unread)
+
+		assert.ErrorIs(t, s.Notifications.Delete(2, seed[0].ID), handlers.ErrNotFound)
+		require.NoError(t, s.Notifications.Delete(1, seed[0].ID))
+		_, err = s.Notifications.GetByID(seed[0].ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+	})
+
+	t.Run("NotificationPreferences", func(t *testing.T) {
+		s := newStores(t)
+
+		alice := handlers.User{Username: "alice"}
+		bob := handlers.User{Username: "bob"}
+		require.NoError(t, s.Users.Create(&alice))
+		require.NoError(t, s.Users.Create(&bob))
+
+		_, err := s.NotificationPreferences.Get(alice.ID, handlers.NotificationLike)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+
+		like := handlers.NotificationPreference{UserID: alice.ID, Type: handlers.NotificationLike, InApp: true}
+		require.NoError(t, s.NotificationPreferences.Save(&like))
+		like.Muted = true
+		require.NoError(t, s.NotificationPreferences.Save(&like))
+		require.NoError(t, s.NotificationPreferences.Save(&handlers.NotificationPreference{UserID: alice.ID, Type: handlers.NotificationFollow}))
+		require.NoError(t, s.NotificationPreferences.Save(&handlers.NotificationPreference{UserID: bob.ID, Type: handlers.NotificationLike}))
+
+		found, err := s.NotificationPreferences.Get(alice.ID, handlers.NotificationLike)
+		require.NoError(t, err)
+		assert.True(t, found.InApp)
+		assert.True(t, found.Muted, "saving again updates the preference")
+
+		preferences, err := s.NotificationPreferences.List(alice.ID)
+		require.NoError(t, err)
+		require.Len(t, preferences, 2)
+		assert.Equal(t, handlers.NotificationFollow, preferences[0].Type)
+
+		require.NoError(t, s.NotificationPreferences.DeleteByUser(alice.ID))
+		preferences, _ = s.NotificationPreferences.List(alice.ID)
+		assert.Empty(t, preferences)
+		preferences, _ = s.NotificationPreferences.List(bob.ID)
+		assert.Len(t, preferences, 1)
+	})
+
+	t.Run("Digests", func(t *testing.T) {
+		s := newStores(t)
+		now := time.Now().UTC().Truncate(time.Second)
+
+		alice := handlers.User{Username: "alice"}
+		bob := handlers.User{Username: "bob"}
+		require.NoError(t, s.Users.Create(&alice))
+		require.NoError(t, s.Users.Create(&bob))
+		for _, notification := range []handlers.Notification{
+			{UserID: alice.ID, Message: "old", UpdatedAt: now.Add(-2 * time.Hour)},
+			{UserID: alice.ID, Message: "first", UpdatedAt: now.Add(-time.Hour)},
+			{UserID: alice.ID, Message: "second", UpdatedAt: now.Add(-time.Minute)},
+			{UserID: bob.ID, Message: "late", UpdatedAt: now},
+		} {
+			require.NoError(t, s.Notifications.Create(&notification))
+		}
+		updated, err := s.Notifications.ListUpdated(alice.ID, now.Add(-time.Hour), now)
+		require.NoError(t, err)
+		require.Len(t, updated, 2)
+		assert.Equal(t, "second", updated[0].Message)
+		userIDs, err := s.Notifications.UpdatedUsers(now.Add(-time.Hour), now)
+		require.NoError(t, err)
+		assert.Equal(t, []int{alice.ID}, userIDs, "the period excludes its end")
+
+		_, err = s.Digests.GetSubscription(alice.ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+		subscription := handlers.DigestSubscription{UserID: alice.ID, Frequency: handlers.DigestDaily, Secret: "secret"}
+		require.NoError(t, s.Digests.SaveSubscription(&subscription))
+		subscription.Frequency = handlers.DigestOff
+		require.NoError(t, s.Digests.SaveSubscription(&subscription))
+		found, err := s.Digests.GetSubscription(alice.ID)
+		require.NoError(t, err)
+		assert.Equal(t, handlers.DigestOff, found.Frequency)
+		assert.Equal(t, "secret", found.Secret)
+
+		digest := handlers.Digest{UserID: alice.ID, Frequency: handlers.DigestDaily, PeriodStart: now.Add(-24 * time.Hour), PeriodEnd: now}
+		require.NoError(t, s.Digests.Claim(&digest))
+		assert.NotZero(t, digest.ID)
+		again := handlers.Digest{UserID: alice.ID, Frequency: handlers.DigestWeekly, PeriodStart: now.Add(-7 * 24 * time.Hour), PeriodEnd: now}
+		assert.ErrorIs(t, s.Digests.Claim(&again), handlers.ErrConflict)
+		require.NoError(t, s.Digests.Claim(&handlers.Digest{UserID: bob.ID, Frequency: handlers.DigestDaily, PeriodStart: now.Add(-24 * time.Hour), PeriodEnd: now}))
+
+		require.NoError(t, s.Digests.MarkSent(digest.ID, now))
+		assert.ErrorIs(t, s.Digests.MarkSent(digest.ID+100, now), handlers.ErrNotFound)
+		require.NoError(t, s.Digests.Release(digest.ID))
+		assert.ErrorIs(t, s.Digests.Release(digest.ID), handlers.ErrNotFound)
+		require.NoError(t, s.Digests.Claim(&again), "released digests can be claimed again")
+
+		require.NoError(t, s.Digests.DeleteByUser(alice.ID))
+		_, err = s.Digests.GetSubscription(alice.ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+		require.NoError(t, s.Digests.Claim(&handlers.Digest{UserID: alice.ID, Frequency: handlers.DigestDaily, PeriodStart: now.Add(-24 * time.Hour), PeriodEnd: now}))
+	})
+
+	t.Run("Webhooks", func(t *testing.T) {
+		s := newStores(t)
+		now := time.Now().UTC().Truncate(time.Second)
+
+		company := handlers.Company{Name: "Acme"}
+		require.NoError(t, s.Companies.Create(&company))
+		companyID := int(company.ID)
+		alice := handlers.User{Username: "alice"}
+		require.NoError(t, s.Users.Create(&alice))
+
+		personal := handlers.Webhook{UserID: &alice.ID, URL: "https://example.com/alice", Events: []string{handlers.WebhookPostCreated}, Secret: "secret", Active: true}
+		require.NoError(t, s.Webhooks.Create(&personal))
+		assert.NotZero(t, personal.ID)
+		shared := handlers.Webhook{CompanyID: &companyID, URL: "https://example.com/acme", Events: []string{handlers.WebhookPostCreated, handlers.WebhookFollowCreated}, Secret: "secret", Active: true}
+		require.NoError(t, s.Webhooks.Create(&shared))
+
+		found, err := s.Webhooks.GetByID(personal.ID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{handlers.WebhookPostCreated}, found.Events)
+		assert.Equal(t, "secret", found.Secret)
+		_, err = s.Webhooks.GetByID(personal.ID + 100)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+
+		webhooks, err := s.Webhooks.ListByCompany(companyID)
+		require.NoError(t, err)
+		require.Len(t, webhooks, 1)
+		assert.Equal(t, shared.ID, webhooks[0].ID)
+
+		subscribed, err := s.Webhooks.Subscribed(handlers.WebhookPostCreated, []int{alice.ID}, []int{companyID})
+		require.NoError(t, err)
+		assert.Len(t, subscribed, 2)
+		subscribed, err = s.Webhooks.Subscribed(handlers.WebhookFollowCreated, []int{alice.ID}, nil)
+		require.NoError(t, err)
+		assert.Empty(t, subscribed)
+		shared.Active = false
+		require.NoError(t, s.Webhooks.Update(&shared))
+		subscribed, err = s.Webhooks.Subscribed(handlers.WebhookPostCreated, nil, []int{companyID})
+		require.NoError(t, err)
+		assert.Empty(t, subscribed, "inactive webhooks are not subscribed")
+
+		due := handlers.WebhookDelivery{WebhookID: personal.ID, EventID: "e1", Event: handlers.WebhookPostCreated, Payload: []byte(`{"id":"e1"}`), Status: handlers.DeliveryStatusPending, NextAttemptAt: now}
+		later := handlers.WebhookDelivery{WebhookID: personal.ID, EventID: "e2", Event: handlers.WebhookPostCreated, Payload: []byte(`{"id":"e2"}`), Status: handlers.DeliveryStatusPending, NextAttemptAt: now.Add(time.Hour)}
+		require.NoError(t, s.Webhooks.CreateDelivery(&due))
+		require.NoError(t, s.Webhooks.CreateDelivery(&later))
+
+		claimed, err := s.Webhooks.ClaimDue(now, now.Add(-time.Minute), 10)
+		require.NoError(t, err)
+		require.Len(t, claimed, 1)
+		assert.Equal(t, due.ID, claimed[0].ID)
+		assert.Equal(t, handlers.DeliveryStatusDelivering, claimed[0].Status)
+		assert.JSONEq(t, `{"id":"e1"}`, string(claimed[0].Payload))
+		claimed, err = s.Webhooks.ClaimDue(now, now.Add(-time.Minute), 10)
+		require.NoError(t, err)
+		assert.Empty(t, claimed, "claimed deliveries are not claimed twice")
+		claimed, err = s.Webhooks.ClaimDue(now.Add(2*time.Minute), now.Add(time.Minute), 10)
+		require.NoError(t, err)
+		require.Len(t, claimed, 1, "stale deliveries are claimed again")
+
+		delivery := claimed[0]
+		delivery.Status = handlers.DeliveryStatusDead
+		delivery.Attempts = 3
+		delivery.LastError = "unexpected status 500"
+		require.NoError(t, s.Webhooks.UpdateDelivery(&delivery))
+		deliveries, err := s.Webhooks.ListDeliveries(personal.ID, handlers.ListQuery{Sort: "id", Desc: true, Filters: map[string]interface{}{"status": handlers.DeliveryStatusDead}})
+		require.NoError(t, err)
+		require.Len(t, deliveries, 1)
+		assert.Equal(t, 3, deliveries[0].Attempts)
+
+		require.NoError(t, s.Webhooks.Delete(shared.ID))
+		assert.ErrorIs(t, s.Webhooks.Delete(shared.ID), handlers.ErrNotFound)
+		require.NoError(t, s.Webhooks.DeleteByUser(alice.ID))
+		_, err = s.Webhooks.GetByID(personal.ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+		deliveries, err = s.Webhooks.ListDeliveries(personal.ID, handlers.ListQuery{})
+		require.NoError(t, err)
+		assert.Empty(t, deliveries, "deliveries go with their webhook")
+	})
+
+	t.Run("Companies", func(t *testing.T) {
+		s := newStores(t)
+
+		company := handlers.Company{Name: "Acme", Description: "Widgets"}
+		require.NoError(t, s.Companies.Create(&company))
+		assert.NotZero(t, company.ID)
+
+		companyID := int(company.ID)
+		require.NoError(t, s.Users.Create(&handlers.User{Username: "worker", CompanyID: &companyID}))
+
+		found, err := s.Companies.GetByID(company.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "Acme", found.Name)
+		require.Len(t, found.Teams, 1)
+		assert.Equal(t, "worker", found.Teams[0].Username)
+
+		found.Description = "Gadgets"
+		require.NoError(t, s.Companies.Update(found))
+		found, _ = s.Companies.GetByID(company.ID)
+		assert.Equal(t, "Gadgets", found.Description)
+
+		preset := handlers.Company{ID: company.ID, Name: "Overwrite"}
+		require.NoError(t, s.Companies.Create(&preset), "Create ignores a preset ID")
+		assert.NotEqual(t, company.ID, preset.ID)
+		found, _ = s.Companies.GetByID(company.ID)
+		assert.Equal(t, "Acme", found.Name)
+		require.NoError(t, s.Companies.Delete(preset.ID))
+
+		other := handlers.Company{Name: "Empty"}
+		require.NoError(t, s.Companies.Create(&other))
+		require.NoError(t, s.Companies.Delete(other.ID))
+		_, err = s.Companies.GetByID(other.ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+	})
+
+	t.Run("Roles", func(t *testing.T) {
+		s := newStores(t)
+
+		seeded, err := s.Roles.List(handlers.ListQuery{})
+		require.NoError(t, err)
+		require.Len(t, seeded, len(handlers.DefaultRoles))
+		admin, err := s.Roles.GetByName(handlers.RoleAdmin)
+		require.NoError(t, err)
+		assert.True(t, admin.System)
+		assert.Equal(t, []handlers.Action{handlers.ActionAll}, admin.Permissions)
+		require.NoError(t, s.Roles.Seed(), "seeding twice is a no-op")
+		permissions, err := s.Roles.Permissions()
+		require.NoError(t, err)
+		assert.Len(t, permissions, len(handlers.Permissions))
+
+		role := handlers.Role{Name: "editor", Permissions: []handlers.Action{handlers.ActionUpdatePost}}
+		require.NoError(t, s.Roles.Create(&role))
+		assert.ErrorIs(t, s.Roles.Create(&handlers.Role{Name: "editor"}), handlers.ErrConflict)
+
+		found, err := s.Roles.GetByID(role.ID)
+		require.NoError(t, err)
+		found.Description = "Edits posts"
+		found.Permissions = []handlers.Action{handlers.ActionDeletePost, handlers.ActionUpdatePost}
+		require.NoError(t, s.Roles.Update(found))
+		found, _ = s.Roles.GetByID(role.ID)
+		assert.Equal(t, "Edits posts", found.Description)
+		assert.ElementsMatch(t, []handlers.Action{handlers.ActionDeletePost, handlers.ActionUpdatePost}, found.Permissions)
+
+		roles, err := s.Roles.List(handlers.ListQuery{Filters: map[string]interface{}{"system": false}})
+		require.NoError(t, err)
+		require.Len(t, roles, 1)
+		assert.Equal(t, "editor", roles[0].Name)
+
+		company := handlers.Company{Name: "Acme"}
+		require.NoError(t, s.Companies.Create(&company))
+		companyID := int(company.ID)
+		user := handlers.User{Username: "alice"}
+		require.NoError(t, s.Users.Create(&user))
+		companyAdmin, _ := s.Roles.GetByName(handlers.RoleCompanyAdmin)
+
+		global := handlers.UserRole{UserID: user.ID, RoleID: role.ID}
+		require.NoError(t, s.Roles.Assign(&global))
+		assert.Equal(t, "editor", global.RoleName)
+		assert.ErrorIs(t, s.Roles.Assign(&handlers.UserRole{UserID: user.ID, RoleID: role.ID}), handlers.ErrConflict)
+		scoped := handlers.UserRole{UserID: user.ID, RoleID: companyAdmin.ID, CompanyID: &companyID}
+		require.NoError(t, s.Roles.Assign(&scoped))
+
+		assignments, err := s.Roles.Assignments(user.ID)
+		require.NoError(t, err)
+		require.Len(t, assignments, 2)
+		assert.Equal(t, handlers.RoleCompanyAdmin, assignments[1].RoleName)
+
+		grants, err := s.Roles.Grants(user.ID)
+		require.NoError(t, err)
+		actor := handlers.Actor{UserID: user.ID, Grants: grants}
+		assert.True(t, actor.Can(handlers.ActionDeletePost, nil))
+		assert.True(t, actor.Can(handlers.ActionUpdateCompany, &companyID))
+		assert.False(t, actor.Can(handlers.ActionUpdateCompany, nil))
+
+		assert.ErrorIs(t, s.Roles.Unassign(user.ID, companyAdmin.ID, nil), handlers.ErrNotFound)
+		require.NoError(t, s.Roles.Unassign(user.ID, companyAdmin.ID, &companyID))
+		require.NoError(t, s.Roles.Delete(role.ID))
+		_, err = s.Roles.GetByID(role.ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+		assignments, _ = s.Roles.Assignments(user.ID)
+		assert.Empty(t, assignments, "deleting a role removes its assignments")
+	})
+
+	t.Run("Analytics", func(t *testing.T) {
+		s := newStores(t)
+
+		require.NoError(t, s.Analytics.RecordView(&handlers.PostView{PostID: 1, UserID: 1, Timestamp: time.Now()}))
+		require.NoError(t, s.Analytics.RecordView(&handlers.PostView{PostID: 1, UserID: 2, Timestamp: time.Now()}))
+		require.NoError(t, s.Analytics.RecordView(&handlers.PostView{PostID: 2, UserID: 1, Timestamp: time.Now()}))
+
+		views, err := s.Analytics.CountViews(1)
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, views)
+		require.NoError(t, s.Analytics.SaveMetrics(&handlers.EngagementMetrics{PostID: 1, View: views}))
+	})
+
+	t.Run("RefreshTokens", func(t *testing.T) {
+		s := newStores(t)
+		now := time.Now()
+
+		first := handlers.RefreshToken{ID: "t1", FamilyID: "f1", UserID: 1, ExpiresAt: now.Add(time.Hour)}
+		second := handlers.RefreshToken{ID: "t2", FamilyID: "f1", UserID: 1, ExpiresAt: now.Add(time.Hour)}
+		expired := handlers.RefreshToken{ID: "t3", FamilyID: "f2", UserID: 1, ExpiresAt: now.Add(-time.Hour)}
+		other := handlers.RefreshToken{ID: "t4", FamilyID: "f3", UserID: 2, ExpiresAt: now.Add(time.Hour)}
+		for _, token := range []*handlers.RefreshToken{&first, &second, &expired, &other} {
+			require.NoError(t, s.RefreshTokens.Create(token))
+		}
+
+		claimed, err := s.RefreshTokens.Claim("t1", now)
+		require.NoError(t, err)
+		assert.True(t, claimed)
+		claimed, _ = s.RefreshTokens.Claim("t1", now)
+		assert.False(t, claimed, "a token can only be claimed once")
+		claimed, _ = s.RefreshTokens.Claim("t3", now)
+		assert.False(t, claimed, "expired tokens cannot be claimed")
+		claimed, _ = s.RefreshTokens.Claim("missing", now)
+		assert.False(t, claimed)
+
+		found, err := s.RefreshTokens.Get("t1")
+		require.NoError(t, err)
+		assert.NotNil(t, found.UsedAt)
+		_, err = s.RefreshTokens.Get("missing")
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+
+		require.NoError(t, s.RefreshTokens.RevokeFamily("f1", now))
+		claimed, _ = s.RefreshTokens.Claim("t2", now)
+		assert.False(t, claimed, "revoked tokens cannot be claimed")
+
+		require.NoError(t, s.RefreshTokens.RevokeUser(2, now))
+		found, _ = s.RefreshTokens.Get("t4")
+		assert.NotNil(t, found.RevokedAt)
+	})
+
+	t.Run("PasswordResets", func(t *testing.T) {
+		s := newStores(t)
+		now := time.Now()
+
+		user := handlers.User{Username: "alice"}
+		require.NoError(t, s.Users.Create(&user))
+		valid := handlers.PasswordResetToken{UserID: user.ID, TokenHash: "valid", ExpiresAt: now.Add(time.Hour)}
+		expired := handlers.PasswordResetToken{UserID: user.ID, TokenHash: "expired", ExpiresAt: now.Add(-time.Hour)}
+		other := handlers.PasswordResetToken{UserID: user.ID, TokenHash: "other", ExpiresAt: now.Add(time.Hour)}
+		for _, token := range []*handlers.PasswordResetToken{&valid, &expired, &other} {
+			require.NoError(t, s.PasswordResets.Create(token))
+		}
+		active, err := s.PasswordResets.CountActive(user.ID, now)
+		require.NoError(t, err)
+		assert.Equal(t, 2, active, "expired tokens are not active")
+
+		claimed, err := s.PasswordResets.Claim("valid", now)
+		require.NoError(t, err)
+		assert.Equal(t, user.ID, claimed.UserID)
+		require.NotNil(t, claimed.UsedAt)
+		_, err = s.PasswordResets.Claim("valid", now)
+		assert.ErrorIs(t, err, handlers.ErrNotFound, "a token can only be claimed once")
+		_, err = s.PasswordResets.Claim("expired", now)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+
+		active, _ = s.PasswordResets.CountActive(user.ID, now)
+		assert.Equal(t, 1, active, "used tokens are not active")
+
+		require.NoError(t, s.PasswordResets.InvalidateUser(user.ID, now))
+		_, err = s.PasswordResets.Claim("other", now)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+	})
+
+	t.Run("EmailVerifications", func(t *testing.T) {
+		s := newStores(t)
+		now := time.Now()
+
+		user := handlers.User{Username: "alice", Email: "alice@example.com"}
+		require.NoError(t, s.Users.Create(&user))
+		valid := handlers.EmailVerificationToken{UserID: user.ID, Email: user.Email, TokenHash: "valid", ExpiresAt: now.Add(time.Hour)}
+		expired := handlers.EmailVerificationToken{UserID: user.ID, Email: user.Email, TokenHash: "expired", ExpiresAt: now.Add(-time.Hour)}
+		for _, token := range []*handlers.EmailVerificationToken{&valid, &expired} {
+			require.NoError(t, s.EmailVerifications.Create(token))
+		}
+
+		claimed, err := s.EmailVerifications.Claim("valid", now)
+		require.NoError(t, err)
+		assert.Equal(t, user.ID, claimed.UserID)
+		assert.Equal(t, "alice@example.com", claimed.Email)
+		_, err = s.EmailVerifications.Claim("valid", now)
+		assert.ErrorIs(t, err, handlers.ErrNotFound, "a token can only be claimed once")
+		_, err = s.EmailVerifications.Claim("expired", now)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+	})
+
+	t.Run("TwoFactor", func(t *testing.T) {
+		s := newStores(t)
+		now := time.Now()
+
+		user := handlers.User{Username: "alice"}
+		require.NoError(t, s.Users.Create(&user))
+		_, err := s.TwoFactor.Get(user.ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+
+		require.NoError(t, s.TwoFactor.Save(&handlers.TwoFactor{UserID: user.ID, Secret: "first"}))
+		enrollment := handlers.TwoFactor{UserID: user.ID, Secret: "second", LastStep: 10, ConfirmedAt: &now}
+		require.NoError(t, s.TwoFactor.Save(&enrollment))
+		found, err := s.TwoFactor.Get(user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "second", found.Secret, "saving replaces the enrollment")
+		assert.NotNil(t, found.ConfirmedAt)
+
+		used, err := s.TwoFactor.UseStep(user.ID, 10)
+		require.NoError(t, err)
+		assert.False(t, used, "steps cannot be used twice")
+		used, _ = s.TwoFactor.UseStep(user.ID, 11)
+		assert.True(t, used)
+		used, _ = s.TwoFactor.UseStep(user.ID, 9)
+		assert.False(t, used)
+
+		require.NoError(t, s.TwoFactor.ReplaceRecoveryCodes(user.ID, []string{"a", "b"}))
+		require.NoError(t, s.TwoFactor.UseRecoveryCode(user.ID, "a", now))
+		assert.ErrorIs(t, s.TwoFactor.UseRecoveryCode(user.ID, "a", now), handlers.ErrNotFound)
+		remaining, err := s.TwoFactor.RemainingRecoveryCodes(user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 1, remaining)
+		require.NoError(t, s.TwoFactor.ReplaceRecoveryCodes(user.ID, []string{"c"}))
+		assert.ErrorIs(t, s.TwoFactor.UseRecoveryCode(user.ID, "b", now), handlers.ErrNotFound)
+
+		require.NoError(t, s.TwoFactor.Delete(user.ID))
+		_, err = s.TwoFactor.Get(user.ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+		remaining, _ = s.TwoFactor.RemainingRecoveryCodes(user.ID)
+		assert.Zero(t, remaining)
+	})
+
+	t.Run("LoginThrottles", func(t *testing.T) {
+		s := newStores(t)
+		now := time.Now().Truncate(time.Second)
+
+		_, err := s.LoginThrottles.Get("account:alice")
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+
+		throttle, err := s.LoginThrottles.RecordFailure("account:alice", now, time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, 1, throttle.Failures)
+		throttle, _ = s.LoginThrottles.RecordFailure("account:alice", now.Add(time.Minute), time.Hour)
+		assert.Equal(t, 2, throttle.Failures)
+		found, err := s.LoginThrottles.Get("account:alice")
+		require.NoError(t, err)
+		assert.Equal(t, 2, found.Failures)
+		assert.True(t, found.LastFailureAt.Equal(now.Add(time.Minute)))
+
+		throttle, _ = s.LoginThrottles.RecordFailure("account:alice", now.Add(3*time.Hour), time.Hour)
+		assert.Equal(t, 1, throttle.Failures, "failures older than the window are forgotten")
+
+		require.NoError(t, s.LoginThrottles.Reset("account:alice"))
+		_, err = s.LoginThrottles.Get("account:alice")
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+	})
+
+	t.Run("Audit", func(t *testing.T) {
+		s := newStores(t)
+
+		user := handlers.User{Username: "alice"}
+		require.NoError(t, s.Users.Create(&user))
+		require.NoError(t, s.Audit.Record(&handlers.AuditEvent{Type: handlers.AuditLoginFailed, UserID: &user.ID, Username: "alice", IP: "192.0.2.1"}))
+		require.NoError(t, s.Audit.Record(&handlers.AuditEvent{Type: handlers.AuditLoginFailed, Username: "nobody", IP: "192.0.2.1"}))
+		require.NoError(t, s.Audit.Record(&handlers.AuditEvent{Type: handlers.AuditAccountLocked, UserID: &user.ID, Username: "alice"}))
+
+		events, err := s.Audit.List(handlers.ListQuery{
+			Desc:    true,
+			Filters: map[string]interface{}{"type": handlers.AuditLoginFailed},
+		})
+		require.NoError(t, err)
+		require.Len(t, events, 2)
+		assert.Equal(t, "nobody", events[0].Username)
+		assert.Nil(t, events[0].UserID)
+		require.NotNil(t, events[1].UserID)
+		assert.Equal(t, user.ID, *events[1].UserID)
+		assert.False(t, events[1].CreatedAt.IsZero())
+
+		events, _ = s.Audit.List(handlers.ListQuery{Filters: map[string]interface{}{"user_id": int64(user.ID)}})
+		assert.Len(t, events, 2)
+	})
+
+	t.Run("AccessTokens", func(t *testing.T) {
+		s := newStores(t)
+		now := time.Now()
+
+		user := handlers.User{Username: "alice"}
+		require.NoError(t, s.Users.Create(&user))
+		token := handlers.PersonalAccessToken{
+			UserID:    user.ID,
+			Name:      "ci",
+			TokenHash: "hash-1",
+			Prefix:    "pat_abcdef",
+			Scopes:    []handlers.Scope{handlers.ScopePostsRead, handlers.ScopePostsWrite},
+		}
+		require.NoError(t, s.AccessTokens.Create(&token))
+		assert.NotZero(t, token.ID)
+		require.NoError(t, s.AccessTokens.Create(&handlers.PersonalAccessToken{UserID: user.ID, Name: "other", TokenHash: "hash-2", Scopes: []handlers.Scope{}}))
+
+		found, err := s.AccessTokens.GetByHash("hash-1")
+		require.NoError(t, err)
+		assert.Equal(t, token.Scopes, found.Scopes)
+		assert.Nil(t, found.LastUsedAt)
+		_, err = s.AccessTokens.GetByHash("missing")
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+
+		require.NoError(t, s.AccessTokens.Touch(token.ID, now))
+		found, _ = s.AccessTokens.GetByHash("hash-1")
+		require.NotNil(t, found.LastUsedAt)
+
+		assert.ErrorIs(t, s.AccessTokens.Revoke(user.ID+1, token.ID, now), handlers.ErrNotFound)
+		require.NoError(t, s.AccessTokens.Revoke(user.ID, token.ID, now))
+		assert.ErrorIs(t, s.AccessTokens.Revoke(user.ID, token.ID, now), handlers.ErrNotFound)
+		found, _ = s.AccessTokens.GetByHash("hash-1")
+		assert.NotNil(t, found.RevokedAt, "revoked tokens can still be looked up")
+
+		tokens, err := s.AccessTokens.ListByUser(user.ID)
+		require.NoError(t, err)
+		require.Len(t, tokens, 1)
+		assert.Equal(t, "other", tokens[0].Name)
+
+		require.NoError(t, s.AccessTokens.RevokeUser(user.ID, now))
+		tokens, err = s.AccessTokens.ListByUser(user.ID)
+		require.NoError(t, err)
+		assert.Empty(t, tokens)
+	})
+
+	t.Run("SigningKeys", func(t *testing.T) {
+		s := newStores(t)
+
+		first, err := handlers.GenerateSigningKey(handlers.AlgorithmEdDSA)
+		require.NoError(t, err)
+		require.NoError(t, s.SigningKeys.Create(first))
+		assert.False(t, first.CreatedAt.IsZero())
+		assert.ErrorIs(t, s.SigningKeys.Create(first), handlers.ErrConflict)
+		second, err := handlers.GenerateSigningKey(handlers.AlgorithmEdDSA)
+		require.NoError(t, err)
+		require.NoError(t, s.SigningKeys.Create(second))
+
+		require.NoError(t, s.SigningKeys.Retire(first.ID, time.Now()))
+		assert.ErrorIs(t, s.SigningKeys.Retire(first.ID, time.Now()), handlers.ErrNotFound)
+		assert.ErrorIs(t, s.SigningKeys.Retire("missing", time.Now()), handlers.ErrNotFound)
+
+		keys, err := s.SigningKeys.List()
+		require.NoError(t, err)
+		require.Len(t, keys, 2)
+		assert.Equal(t, first.ID, keys[0].ID)
+		assert.NotNil(t, keys[0].RetiredAt)
+		assert.Equal(t, second.PrivateKey, keys[1].PrivateKey)
+		assert.Nil(t, keys[1].RetiredAt)
+	})
+
+	t.Run("Identities", func(t *testing.T) {
+		s := newStores(t)
+
+		identity := handlers.Identity{UserID: 1, Provider: "google", Subject: "sub-1", Email: "a@example.com"}
+		require.NoError(t, s.Identities.Create(&identity))
+		assert.NotZero(t, identity.ID)
+		assert.ErrorIs(t, s.Identities.Create(&handlers.Identity{UserID: 2, Provider: "google", Subject: "sub-1"}), handlers.ErrConflict)
+		require.NoError(t, s.Identities.Create(&handlers.Identity{UserID: 1, Provider: "facebook", Subject: "sub-1"}))
+
+		found, err := s.Identities.Get("google", "sub-1")
+		require.NoError(t, err)
+		assert.Equal(t, 1, found.UserID)
+		_, err = s.Identities.Get("google", "missing")
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+
+		identities, err := s.Identities.ListByUser(1)
+		require.NoError(t, err)
+		assert.Len(t, identities, 2)
+
+		assert.ErrorIs(t, s.Identities.Delete(2, identity.ID), handlers.ErrNotFound)
+		require.NoError(t, s.Identities.Delete(1, identity.ID))
+		assert.ErrorIs(t, s.Identities.Delete(1, identity.ID), handlers.ErrNotFound)
+	})
+
+	t.Run("OAuthStates", func(t *testing.T) {
+		s := newStores(t)
+		userID := 3
+
+		require.NoError(t, s.OAuthStates.Create(&handlers.OAuthState{
+			StateHash: "hash-1", Provider: "google", Nonce: "nonce", CodeVerifier: "verifier",
+			UserID: &userID, ExpiresAt: time.Now().Add(time.Minute),
+		}))
+		state, err := s.OAuthStates.Consume("hash-1")
+		require.NoError(t, err)
+		assert.Equal(t, "verifier", state.CodeVerifier)
+		require.NotNil(t, state.UserID)
+		assert.Equal(t, userID, *state.UserID)
+		_, err = s.OAuthStates.Consume("hash-1")
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+	})
+
+	t.Run("Sessions", func(t *testing.T) {
+		s := newStores(t)
+		now := time.Now()
+
+		for _, id := range []string{"a", "b", "c"} {
+			require.NoError(t, s.Sessions.Create(&handlers.Session{ID: id, UserID: 1, UserAgent: "agent", IP: "10.0.0.1", LastSeenAt: now.Add(-time.Hour)}))
+		}
+		require.NoError(t, s.Sessions.Create(&handlers.Session{ID: "d", UserID: 2, LastSeenAt: now}))
+		assert.ErrorIs(t, s.Sessions.Create(&handlers.Session{ID: "a", UserID: 1}), handlers.ErrConflict)
+
+		require.NoError(t, s.Sessions.Touch(map[string]time.Time{"b": now, "c": now.Add(-2 * time.Hour)}))
+		sessions, err := s.Sessions.ListByUser(1, now.Add(-24*time.Hour))
+		require.NoError(t, err)
+		require.Len(t, sessions, 3)
+		assert.Equal(t, "b", sessions[0].ID, "most recently seen first")
+		assert.WithinDuration(t, now.Add(-time.Hour), sessions[2].LastSeenAt, time.Second, "touch never moves last seen back")
+		assert.Equal(t, "agent", sessions[1].UserAgent)
+
+		sessions, _ = s.Sessions.ListByUser(1, now.Add(-time.Minute))
+		assert.Len(t, sessions, 1)
+
+		require.NoError(t, s.Sessions.Revoke(1, "a", now))
+		assert.ErrorIs(t, s.Sessions.Revoke(1, "a", now), handlers.ErrNotFound)
+		assert.ErrorIs(t, s.Sessions.Revoke(1, "d", now), handlers.ErrNotFound)
+
+		revoked, err := s.Sessions.RevokeOthers(1, "b", now)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"c"}, revoked)
+		sessions, _ = s.Sessions.ListByUser(1, now.Add(-24*time.Hour))
+		require.Len(t, sessions, 1)
+		assert.Equal(t, "b", sessions[0].ID)
+	})
+
+	t.Run("Accounts", func(t *testing.T) {
+		s := newStores(t)
+		now := time.Now()
+
+		alice := handlers.User{Username: "alice", Email: "alice@example.com"}
+		bob := handlers.User{Username: "bob"}
+		require.NoError(t, s.Users.Create(&alice))
+		require.NoError(t, s.Users.Create(&bob))
+		post := handlers.Post{UserID: alice.ID, Content: "hello"}
+		require.NoError(t, s.Posts.Create(&post))
+		require.NoError(t, s.Engagements.Create(&handlers.Engagement{PostID: post.ID, UserID: bob.ID, Like: true}))
+		require.NoError(t, s.Follows.Create(&handlers.Follow{FollowerID: bob.ID, FollowingID: alice.ID}))
+		require.NoError(t, s.Notifications.Create(&handlers.Notification{UserID: alice.ID, Message: "hi"}))
+
+		data, err := s.Accounts.Collect(alice.ID)
+		require.NoError(t, err)
+		assert.Len(t, data.Posts, 1)
+		assert.Len(t, data.Followers, 1)
+		assert.Empty(t, data.Followings)
+		assert.Len(t, data.Notifications, 1)
+
+		deleteAfter := now.Add(-time.Minute)
+		alice.DeleteAfter = &deleteAfter
+		require.NoError(t, s.Users.Update(&alice))
+		due, err := s.Accounts.DueForDeletion(now)
+		require.NoError(t, err)
+		require.Len(t, due, 1)
+		assert.Equal(t, alice.ID, due[0].ID)
+
+		require.NoError(t, s.Accounts.Erase(alice.ID, true))
+		placeholder, err := s.Users.GetByID(alice.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "deleted-"+strconv.Itoa(alice.ID), placeholder.Username)
+		assert.Empty(t, placeholder.Email)
+		due, _ = s.Accounts.DueForDeletion(now)
+		assert.Empty(t, due, "erased accounts are no longer due")
+		likes, _ := s.Engagements.CountLikes(post.ID)
+		assert.EqualValues(t, 1, likes)
+		data, _ = s.Accounts.Collect(alice.ID)
+		assert.Empty(t, data.Followers)
+		assert.Empty(t, data.Notifications)
+
+		require.NoError(t, s.Accounts.Erase(alice.ID, false))
+		_, err = s.Users.GetByID(alice.ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+		_, err = s.Posts.GetByID(post.ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+	})
+
+	t.Run("AccountExports", func(t *testing.T) {
+		s := newStores(t)
+		now := time.Now()
+		user := handlers.User{Username: "alice"}
+		require.NoError(t, s.Users.Create(&user))
+
+		_, err := s.AccountExports.Latest(user.ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+		export := handlers.AccountExport{UserID: user.ID, Status: handlers.ExportStatusPending}
+		require.NoError(t, s.AccountExports.Create(&export))
+		assert.NotZero(t, export.ID)
+
+		claimed, err := s.AccountExports.ClaimPending(now, now.Add(-time.Hour), 10)
+		require.NoError(t, err)
+		require.Len(t, claimed, 1)
+		assert.Equal(t, handlers.ExportStatusRunning, claimed[0].Status)
+		claimed, _ = s.AccountExports.ClaimPending(now, now.Add(-time.Hour), 10)
+		assert.Empty(t, claimed, "exports are claimed once")
+		claimed, _ = s.AccountExports.ClaimPending(now.Add(2*time.Hour), now.Add(time.Hour), 10)
+		require.Len(t, claimed, 1, "stale exports are claimed again")
+
+		expiresAt := now.Add(time.Hour)
+		export = claimed[0]
+		export.Status = handlers.ExportStatusReady
+		export.Path = "/tmp/export.zip"
+		export.ExpiresAt = &expiresAt
+		require.NoError(t, s.AccountExports.Update(&export))
+		latest, err := s.AccountExports.Latest(user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, handlers.ExportStatusReady, latest.Status)
+		assert.Equal(t, "/tmp/export.zip", latest.Path)
+
+		expired, err := s.AccountExports.DeleteExpired(now)
+		require.NoError(t, err)
+		assert.Empty(t, expired)
+		expired, _ = s.AccountExports.DeleteExpired(now.Add(2 * time.Hour))
+		require.Len(t, expired, 1)
+		assert.Equal(t, "/tmp/export.zip", expired[0].Path)
+
+		require.NoError(t, s.AccountExports.Create(&handlers.AccountExport{UserID: user.ID, Status: handlers.ExportStatusPending}))
+		deleted, err := s.AccountExports.DeleteByUser(user.ID)
+		require.NoError(t, err)
+		assert.Len(t, deleted, 1)
+		_, err = s.AccountExports.Latest(user.ID)
+		assert.ErrorIs(t, err, handlers.ErrNotFound)
+	})
+
+	t.Run("Revocations", func(t *testing.T) {
+		s := newStores(t)
+		now := time.Now()
+
+		require.NoError(t, s.Revocations.Revoke("jti-1", 1, now.Add(time.Hour)))
+		revoked, err := s.Revocations.IsRevoked("jti-1", "", 1, now)
+		require.NoError(t, err)
+		assert.True(t, revoked)
+		revoked, _ = s.Revocations.IsRevoked("jti-2", "", 1, now)
+		assert.False(t, revoked)
+
+		require.NoError(t, s.Revocations.RevokeUser(2, now))
+		revoked, _ = s.Revocations.IsRevoked("jti-3", "", 2, now.Add(-time.Minute))
+		assert.True(t, revoked, "tokens issued before RevokeUser are revoked")
+		revoked, _ = s.Revocations.IsRevoked("jti-4", "", 2, now.Add(time.Minute))
+		assert.False(t, revoked, "tokens issued after RevokeUser stay valid")
+
+		require.NoError(t, s.Revocations.Revoke("session-1", 3, now.Add(time.Hour)))
+		revoked, _ = s.Revocations.IsRevoked("jti-5", "session-1", 3, now)
+		assert.True(t, revoked, "revoking a session revokes its tokens")
+		revoked, _ = s.Revocations.IsRevoked("jti-6", "session-2", 3, now)
+		assert.False(t, revoked)
+	})
+}
@@ -0,0 +1,231 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+// newStreamServer serves the API over HTTP, which streaming needs
+func newStreamServer(t *testing.T, app *testApp) *httptest.Server {
+	server := httptest.NewServer(app.router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// sseEvent is one event read from a Server-Sent Events stream
+type sseEvent struct {
+	id, event, data string
+}
+
+// openSSE connects user to the notification stream and returns its events
+func openSSE(t *testing.T, app *testApp, server *httptest.Server, user handlers.User, lastEventID string) <-chan sseEvent {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/notifications/stream", nil)
+	req.Header.Set("Authorization", "Bearer "+app.token(user))
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		var event sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			field, value, _ := strings.Cut(scanner.Text(), ":")
+			switch field {
+			case "id":
+				event.id = value
+			case "event":
+				event.event = value
+			case "data":
+				event.data = value
+			case "":
+				events <- event
+				event = sseEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+// nextNotification waits for the next notification event of a stream,
+// skipping heartbeats
+func nextNotification(t *testing.T, events <-chan sseEvent) (sseEvent, handlers.Notification) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			require.True(t, ok, "stream ended")
+			if event.event != "notification" {
+				continue
+			}
+			var notification handlers.Notification
+			require.NoError(t, json.Unmarshal([]byte(event.data), &notification))
+			return event, notification
+		case <-timeout:
+			t.Fatal("no notification received")
+		}
+	}
+}
+
+func TestNotificationStream(t *testing.T) {
+	app := newTestApp(t, withConfig(func(cfg *config.Config) {
+		cfg.Notifications.Heartbeat = config.Duration(20 * time.Millisecond)
+	}))
+	stores := app.stores
+	server := newStreamServer(t, app)
+	alice := createUserWithRole(t, stores, "alice", handlers.RoleUser, nil)
+	bob := createUserWithRole(t, stores, "bob", handlers.RoleUser, nil)
+	carol := createUserWithRole(t, stores, "carol", handlers.RoleUser, nil)
+	dave := createUserWithRole(t, stores, "dave", handlers.RoleUser, nil)
+	follow := func(user handlers.User) {
+		require.Equal(t, http.StatusCreated, app.as(user, "POST", "/follow", `{"followingId": `+strconv.Itoa(alice.ID)+`}`).Code)
+	}
+
+	events := openSSE(t, app, server, alice, "")
+	var lastEventID string
+
+	t.Run("Notifications are pushed live", func(t *testing.T) {
+		follow(bob)
+		event, notification := nextNotification(t, events)
+		assert.Equal(t, handlers.NotificationFollow, notification.Type)
+		assert.Equal(t, "bob followed you", notification.Message)
+		assert.NotEmpty(t, event.id)
+		lastEventID = event.id
+	})
+
+	t.Run("Idle streams get heartbeats", func(t *testing.T) {
+		select {
+		case event := <-events:
+			assert.Equal(t, "heartbeat", event.event)
+			assert.Empty(t, event.id, "heartbeats keep the last event ID")
+		case <-time.After(time.Second):
+			t.Fatal("no heartbeat received")
+		}
+	})
+
+	t.Run("A resumed stream replays what it missed", func(t *testing.T) {
+		follow(carol)
+		events := openSSE(t, app, server, alice, lastEventID)
+		_, notification := nextNotification(t, events)
+		assert.Equal(t, "carol and bob followed you", notification.Message, "the group changed since")
+
+		require.NoError(t, stores.Notifications.Create(&handlers.Notification{UserID: alice.ID, Type: handlers.NotificationSystem, Message: "welcome"}))
+		fresh := openSSE(t, app, server, alice, lastEventID)
+		_, notification = nextNotification(t, fresh)
+		assert.Equal(t, "carol and bob followed you", notification.Message)
+		_, notification = nextNotification(t, fresh)
+		assert.Equal(t, "welcome", notification.Message)
+	})
+
+	t.Run("Unknown event IDs are rejected", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", server.URL+"/notifications/stream", nil)
+		req.Header.Set("Authorization", "Bearer "+app.token(alice))
+		req.Header.Set("Last-Event-ID", "garbage")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("Streams only carry their user's notifications", func(t *testing.T) {
+		bobsEvents := openSSE(t, app, server, bob, "")
+		follow(dave)
+		timeout := time.After(100 * time.Millisecond)
+		for {
+			select {
+			case event := <-bobsEvents:
+				require.NotEqual(t, "notification", event.event)
+			case <-timeout:
+				return
+			}
+		}
+	})
+}
+
+func dialNotifications(t *testing.T, app *testApp, server *httptest.Server, user handlers.User, origin string) (*websocket.Conn, error) {
+	t.Helper()
+	wsConfig, err := websocket.NewConfig(strings.Replace(server.URL, "http", "ws", 1)+"/notifications/ws", origin)
+	require.NoError(t, err)
+	wsConfig.Header.Set("Authorization", "Bearer "+app.token(user))
+	ws, err := websocket.DialConfig(wsConfig)
+	if err == nil {
+		t.Cleanup(func() { ws.Close() })
+	}
+	return ws, err
+}
+
+func TestNotificationWebSocket(t *testing.T) {
+	app := newTestApp(t, withConfig(func(cfg *config.Config) {
+		cfg.Notifications.Heartbeat = config.Duration(time.Hour)
+		cfg.Notifications.AllowedOrigins = []string{"https://app.example.com"}
+	}))
+	stores := app.stores
+	server := newStreamServer(t, app)
+	alice := createUserWithRole(t, stores, "alice", handlers.RoleUser, nil)
+	bob := createUserWithRole(t, stores, "bob", handlers.RoleUser, nil)
+
+	_, err := dialNotifications(t, app, server, alice, "https://evil.example.com")
+	assert.Error(t, err, "other sites cannot open the socket")
+	_, err = dialNotifications(t, app, server, alice, "https://app.example.com")
+	assert.NoError(t, err)
+
+	ws, err := dialNotifications(t, app, server, alice, server.URL)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, app.as(bob, "POST", "/follow", `{"followingId": `+strconv.Itoa(alice.ID)+`}`).Code)
+
+	require.NoError(t, ws.SetReadDeadline(time.Now().Add(2*time.Second)))
+	var message struct {
+		Type         string                 `json:"type"`
+		ID           string                 `json:"id"`
+		Notification *handlers.Notification `json:"notification"`
+	}
+	require.NoError(t, websocket.JSON.Receive(ws, &message))
+	assert.Equal(t, "notification", message.Type)
+	assert.NotEmpty(t, message.ID)
+	require.NotNil(t, message.Notification)
+	assert.Equal(t, "bob followed you", message.Notification.Message)
+}
+
+func TestMemoryBroker(t *testing.T) {
+	broker := handlers.NewMemoryBroker()
+	events, cancel := broker.Subscribe(1)
+	other, cancelOther := broker.Subscribe(2)
+	defer cancelOther()
+
+	require.NoError(t, broker.Publish(handlers.Notification{ID: 1, UserID: 1}))
+	assert.Equal(t, 1, (<-events).ID)
+	assert.Empty(t, other)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, broker.Publish(handlers.Notification{ID: i, UserID: 1}))
+	}
+	received := 0
+	for range events {
+		received++
+	}
+	assert.Less(t, received, 100, "a subscriber that falls behind is dropped")
+	cancel()
+}
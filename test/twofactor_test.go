@@ -0,0 +1,178 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/Adnen2/tutorial/firstProject/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, truncated to six digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // "12345678901234567890"
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range vectors {
+		code, err := totp.Code(secret, totp.Step(time.Unix(unix, 0)))
+		require.NoError(t, err)
+		assert.Equal(t, want, code, "at %d", unix)
+	}
+
+	now := time.Unix(1111111109, 0)
+	step, ok := totp.Verify(secret, "081804", now.Add(totp.Period))
+	assert.True(t, ok, "codes of the previous period are accepted")
+	assert.Equal(t, totp.Step(now), step)
+	_, ok = totp.Verify(secret, "081804", now.Add(3*totp.Period))
+	assert.False(t, ok)
+	_, ok = totp.Verify(secret, "12345", now)
+	assert.False(t, ok)
+
+	uri, err := url.Parse(totp.URI("firstProject", "alice", secret))
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/firstProject:alice", uri.Path)
+	assert.Equal(t, secret, uri.Query().Get("secret"))
+	assert.Equal(t, "firstProject", uri.Query().Get("issuer"))
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	app := newTestApp(t)
+	stores := app.stores
+	user := handlers.User{Username: "alice", Password: testPasswordHash}
+	require.NoError(t, stores.Users.Create(&user))
+	login := `{"username": "alice", "password": "password"}`
+
+	var secret string
+	var recoveryCodes []string
+	step := totp.Step(time.Now())
+	codeAt := func(step int64) string {
+		code, err := totp.Code(secret, step)
+		require.NoError(t, err)
+		return code
+	}
+	challenge := func() string {
+		w := app.send("POST", "/login", login)
+		require.Equal(t, http.StatusOK, w.Code)
+		var response map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		require.Equal(t, true, response["two_factor_required"])
+		assert.NotContains(t, response, "access_token")
+		return response["challenge_token"].(string)
+	}
+
+	t.Run("Enrolling does not enforce 2FA until confirmed", func(t *testing.T) {
+		w := app.as(user, "POST", "/2fa/enroll", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			Secret string `json:"secret"`
+			URI    string `json:"uri"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		secret = response.Secret
+		assert.Contains(t, response.URI, "otpauth://totp/")
+		assert.Contains(t, response.URI, "secret="+secret)
+
+		w = app.send("POST", "/login", login)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "access_token")
+	})
+
+	t.Run("Confirming requires a valid code", func(t *testing.T) {
+		w := app.as(user, "POST", "/2fa/confirm", `{"code": "000000"}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = app.as(user, "POST", "/2fa/confirm", `{"code": "`+codeAt(step)+`"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		recoveryCodes = response.RecoveryCodes
+		assert.Len(t, recoveryCodes, app.cfg.Auth.TwoFactor.RecoveryCodes)
+
+		w = app.as(user, "POST", "/2fa/enroll", "")
+		assert.Equal(t, http.StatusConflict, w.Code)
+	})
+
+	t.Run("Login asks for the second factor", func(t *testing.T) {
+		token := challenge()
+
+		w := app.send("GET", "/profile", "", bearer(token))
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "a challenge token is not an access token")
+
+		w = app.send("POST", "/login/2fa", `{"challenge_token": "`+token+`", "code": "`+codeAt(step)+`"}`)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "the code used to confirm cannot be replayed")
+
+		w = app.send("POST", "/login/2fa", `{"challenge_token": "`+token+`", "code": "`+codeAt(step+1)+`"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "access_token")
+	})
+
+	t.Run("Recovery codes work once", func(t *testing.T) {
+		body := func() string {
+			return `{"challenge_token": "` + challenge() + `", "recovery_code": "` + recoveryCodes[0] + `"}`
+		}
+		assert.Equal(t, http.StatusOK, app.send("POST", "/login/2fa", body()).Code)
+		assert.Equal(t, http.StatusUnauthorized, app.send("POST", "/login/2fa", body()).Code)
+
+		w := app.as(user, "GET", "/2fa", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"enabled": true, "recovery_codes_remaining": 9}`, w.Body.String())
+	})
+
+	t.Run("Challenges work once", func(t *testing.T) {
+		token := challenge()
+		w := app.send("POST", "/login/2fa", `{"challenge_token": "`+token+`", "recovery_code": "`+recoveryCodes[2]+`"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		w = app.send("POST", "/login/2fa", `{"challenge_token": "`+token+`", "recovery_code": "`+recoveryCodes[3]+`"}`)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Logging out everywhere cancels pending challenges", func(t *testing.T) {
+		token := challenge()
+		require.Equal(t, http.StatusOK, app.as(user, "POST", "/logout-all", "").Code)
+		w := app.send("POST", "/login/2fa", `{"challenge_token": "`+token+`", "recovery_code": "`+recoveryCodes[3]+`"}`)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+		w = app.send("POST", "/login/2fa", `{"challenge_token": "`+challenge()+`", "recovery_code": "`+recoveryCodes[3]+`"}`)
+		require.Equal(t, http.StatusOK, w.Code, "challenges issued afterwards still work")
+		var response map[string]string
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		app.tokens[user.ID] = response["access_token"]
+	})
+
+	t.Run("Regenerating recovery codes requires the password", func(t *testing.T) {
+		w := app.as(user, "POST", "/2fa/recovery-codes", `{"password": "wrong"}`)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		w = app.as(user, "POST", "/2fa/recovery-codes", `{"password": "password"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		body := `{"challenge_token": "` + challenge() + `", "recovery_code": "` + recoveryCodes[1] + `"}`
+		assert.Equal(t, http.StatusUnauthorized, app.send("POST", "/login/2fa", body).Code, "old codes stop working")
+	})
+
+	t.Run("Disabling requires the password", func(t *testing.T) {
+		token := challenge()
+		w := app.as(user, "POST", "/2fa/disable", `{"password": "wrong"}`)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		w = app.as(user, "POST", "/2fa/disable", `{"password": "password"}`)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		w = app.send("POST", "/login", login)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "access_token")
+		w = app.send("POST", "/login/2fa", `{"challenge_token": "`+token+`", "code": "`+codeAt(step+1)+`"}`)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "outstanding challenges die with 2FA")
+	})
+}
@@ -6,42 +6,31 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 
+	"github.com/Adnen2/tutorial/firstProject/config"
 	handlers "github.com/Adnen2/tutorial/firstProject/handlers"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/bcrypt"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
 )
 
-func setupTestDB() *gorm.DB {
-	dsn := "host=localhost user=admin password=admin dbname=firstdb1 port=5432 sslmode=disable"
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
-	if err != nil {
-		panic("Failed to connect to the database: " + err.Error())
-	}
-
-	err = db.AutoMigrate(&handlers.User{})
-	if err != nil {
-		panic("Failed to run migrations: " + err.Error())
-	}
-
-	return db
+func testAuthConfig() config.AuthConfig {
+	cfg := config.Default().Auth
+	// Ed25519 keys are much faster to generate than RSA ones
+	cfg.Signing.Algorithm = handlers.AlgorithmEdDSA
+	return cfg
 }
 
 func TestRegister(t *testing.T) {
-	db := setupTestDB()
-	defer db.Migrator().DropTable(&handlers.User{}) // Clean up after the test
-	router := gin.New()
-	router.POST("/register", func(c *gin.Context) {
-		handlers.Register(c, db)
-	})
+	app := newTestApp(t)
+	stores, router := app.stores, app.router
 
 	t.Run("RegisterUser", func(t *testing.T) {
 		fmt.Println("Running RegisterUser test")
-		requestBody := []byte(`{"username": "testuser", "password": "testpassword"}`)
+		requestBody := []byte(`{"username": "testuser", "email": "test@example.com", "password": "testpassword"}`)
 		req, err := http.NewRequest("POST", "/register", bytes.NewBuffer(requestBody))
 		assert.NoError(t, err)
 
@@ -53,8 +42,7 @@ func TestRegister(t *testing.T) {
 
 		assert.Equal(t, http.StatusCreated, w.Code)
 
-		var user handlers.User
-		err = db.Where("username = ?", "testuser").First(&user).Error
+		user, err := stores.Users.GetByUsername("testuser")
 		assert.NoError(t, err)
 		assert.Equal(t, "testuser", user.Username)
 		assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(user.Password), []byte("testpassword")))
@@ -62,18 +50,14 @@ func TestRegister(t *testing.T) {
 }
 
 func TestLogin(t *testing.T) {
-	db := setupTestDB()
-	defer db.Migrator().DropTable(&handlers.User{}) // Clean up after the test
-	router := gin.New()
-	router.POST("/login", func(c *gin.Context) {
-		handlers.Login(c, db)
-	})
+	app := newTestApp(t)
+	stores, router := app.stores, app.router
 
 	t.Run("LoginUser", func(t *testing.T) {
 		fmt.Println("Running LoginUser test")
 		hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("testpassword"), bcrypt.DefaultCost)
 		testUser := handlers.User{Username: "testuser", Password: string(hashedPassword)}
-		db.Create(&testUser)
+		stores.Users.Create(&testUser)
 
 		requestBody := []byte(`{"username": "testuser", "password": "testpassword"}`)
 		req, err := http.NewRequest("POST", "/login", bytes.NewBuffer(requestBody))
@@ -91,15 +75,133 @@ func TestLogin(t *testing.T) {
 	})
 }
 
+func TestRefreshToken(t *testing.T) {
+	app := newTestApp(t)
+	stores, router := app.stores, app.router
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("testpassword"), bcrypt.DefaultCost)
+	stores.Users.Create(&handlers.User{Username: "refreshuser", Password: string(hashedPassword)})
+
+	post := func(path string, body string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var response map[string]interface{}
+		_ = json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	code, login := post("/login", `{"username": "refreshuser", "password": "testpassword"}`)
+	assert.Equal(t, http.StatusOK, code)
+	original := login["refresh_token"].(string)
+
+	t.Run("RotateRefreshToken", func(t *testing.T) {
+		code, response := post("/token/refresh", fmt.Sprintf(`{"refresh_token": %q}`, original))
+		assert.Equal(t, http.StatusOK, code)
+		assert.NotEmpty(t, response["access_token"])
+		assert.NotEqual(t, original, response["refresh_token"])
+
+		// Replaying the rotated token revokes the whole family
+		code, _ = post("/token/refresh", fmt.Sprintf(`{"refresh_token": %q}`, original))
+		assert.Equal(t, http.StatusUnauthorized, code)
+
+		code, _ = post("/token/refresh", fmt.Sprintf(`{"refresh_token": %q}`, response["refresh_token"]))
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+}
+
+func TestLogout(t *testing.T) {
+	app := newTestApp(t)
+	stores, router := app.stores, app.router
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("testpassword"), bcrypt.DefaultCost)
+	stores.Users.Create(&handlers.User{Username: "logoutuser", Password: string(hashedPassword)})
+
+	t.Run("LogoutRevokesToken", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/login", bytes.NewBufferString(`{"username": "logoutuser", "password": "testpassword"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		cookies := w.Result().Cookies()
+
+		authed := func(method, path string) int {
+			req, _ := http.NewRequest(method, path, nil)
+			for _, cookie := range cookies {
+				req.AddCookie(cookie)
+				if cookie.Name == "csrf_token" {
+					req.Header.Set("X-CSRF-Token", cookie.Value)
+				}
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w.Code
+		}
+
+		assert.Equal(t, http.StatusOK, authed("GET", "/profile"))
+		assert.Equal(t, http.StatusOK, authed("POST", "/logout"))
+		assert.Equal(t, http.StatusUnauthorized, authed("GET", "/profile"))
+	})
+
+	t.Run("LogoutRevokesTheWholeSession", func(t *testing.T) {
+		require.NoError(t, stores.Users.Create(&handlers.User{Username: "sibling", Password: testPasswordHash}))
+		access, refresh := app.login("sibling")
+		w := app.send("POST", "/token/refresh", fmt.Sprintf(`{"refresh_token": %q}`, refresh))
+		require.Equal(t, http.StatusOK, w.Code)
+		var refreshed map[string]string
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &refreshed))
+		other, _ := app.login("sibling")
+
+		require.Equal(t, http.StatusOK, app.send("POST", "/logout", "", bearer(access)).Code)
+		assert.Equal(t, http.StatusUnauthorized, app.send("GET", "/profile", "", bearer(refreshed["access_token"])).Code,
+			"access tokens refreshed in the same session are revoked")
+		assert.Equal(t, http.StatusOK, app.send("GET", "/profile", "", bearer(other)).Code,
+			"other sessions stay signed in")
+	})
+}
+
+func TestBearerToken(t *testing.T) {
+	app := newTestApp(t)
+	stores, router := app.stores, app.router
+
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("testpassword"), bcrypt.DefaultCost)
+	stores.Users.Create(&handlers.User{Username: "beareruser", Password: string(hashedPassword)})
+
+	req, _ := http.NewRequest("POST", "/login", bytes.NewBufferString(`{"username": "beareruser", "password": "testpassword"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var login map[string]string
+	_ = json.Unmarshal(w.Body.Bytes(), &login)
+	cookies := w.Result().Cookies()
+
+	t.Run("BearerHeaderSkipsCSRF", func(t *testing.T) {
+		req, _ := http.NewRequest("PUT", "/update-profile", bytes.NewBufferString(`{}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+login["access_token"])
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("CookieRequiresCSRF", func(t *testing.T) {
+		req, _ := http.NewRequest("PUT", "/update-profile", bytes.NewBufferString(`{}`))
+		req.Header.Set("Content-Type", "application/json")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
+
 // Import necessary packages and modules
 
 func TestProfile(t *testing.T) {
-	db := setupTestDB()
-	defer db.Migrator().DropTable(&handlers.User{}) // Clean up after the test
-	router := gin.Default()
-	router.GET("/profile", handlers.AuthMiddleware(), func(c *gin.Context) {
-		handlers.Profile(c, db)
-	})
+	router := newTestApp(t).router
 
 	t.Run("UserProfile", func(t *testing.T) {
 		req, err := http.NewRequest("GET", "/profile", nil)
@@ -126,3 +228,30 @@ func TestProfile(t *testing.T) {
 		assert.Equal(t, "Unauthorized", response["error"])
 	})
 }
+
+func TestPublicUsers(t *testing.T) {
+	app := newTestApp(t)
+	stores := app.stores
+	acme := handlers.Company{Name: "Acme"}
+	require.NoError(t, stores.Companies.Create(&acme))
+	acmeID := int(acme.ID)
+	alice := createUserWithRole(t, stores, "alice", handlers.RoleUser, nil)
+	bob := handlers.User{Username: "bob", Email: "bob@example.com", EmailVerified: true, Bio: "Hi", CompanyID: &acmeID}
+	require.NoError(t, stores.Users.Create(&bob))
+
+	w := app.as(alice, "POST", "/search/users", `{"keyword": "bob"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var page handlers.Page[map[string]interface{}]
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	require.Len(t, page.Items, 1)
+	assert.Equal(t, "bob", page.Items[0]["username"])
+	assert.Equal(t, "Hi", page.Items[0]["bio"])
+	assert.NotContains(t, page.Items[0], "email")
+	assert.NotContains(t, page.Items[0], "emailVerified")
+	assert.NotContains(t, w.Body.String(), "bob@example.com")
+
+	w = app.as(alice, "GET", "/companies/"+strconv.Itoa(acmeID), "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"username":"bob"`)
+	assert.NotContains(t, w.Body.String(), "bob@example.com", "teams only show public profiles")
+}
@@ -0,0 +1,354 @@
+package test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Adnen2/tutorial/firstProject/config"
+	"github.com/Adnen2/tutorial/firstProject/handlers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receivedWebhook is a request a webhookReceiver got
+type receivedWebhook struct {
+	Path   string
+	Header http.Header
+	Body   []byte
+	Event  handlers.WebhookEvent
+}
+
+// webhookReceiver records the webhooks posted to it and answers with status
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	received []receivedWebhook
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	receiver := &webhookReceiver{status: http.StatusOK}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var event handlers.WebhookEvent
+		json.Unmarshal(body, &event)
+
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		receiver.received = append(receiver.received, receivedWebhook{Path: r.URL.Path, Header: r.Header.Clone(), Body: body, Event: event})
+		w.WriteHeader(receiver.status)
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver
+}
+
+func (r *webhookReceiver) respondWith(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+// take returns and forgets the webhooks received so far
+func (r *webhookReceiver) take() []receivedWebhook {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	received := r.received
+	r.received = nil
+	return received
+}
+
+// createWebhook creates a webhook as user and returns it with its secret
+func createWebhook(t *testing.T, app *testApp, user handlers.User, body string) (handlers.Webhook, string) {
+	t.Helper()
+	w := app.as(user, "POST", "/webhooks", body)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var created struct {
+		Secret  string           `json:"secret"`
+		Webhook handlers.Webhook `json:"webhook"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	require.NotEmpty(t, created.Secret)
+	return created.Webhook, created.Secret
+}
+
+// deliveriesOf returns the delivery log of a webhook as seen by user
+func deliveriesOf(t *testing.T, app *testApp, user handlers.User, webhookID int, query string) []handlers.WebhookDelivery {
+	t.Helper()
+	w := app.as(user, "GET", "/webhooks/"+strconv.Itoa(webhookID)+"/deliveries"+query, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var page handlers.Page[handlers.WebhookDelivery]
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	return page.Items
+}
+
+func TestWebhooks(t *testing.T) {
+	app := newTestApp(t, withConfig(func(cfg *config.Config) {
+		cfg.Webhooks.MaxAttempts = 3
+		// The receiver listens on loopback
+		cfg.Webhooks.AllowPrivateNetworks = true
+	}))
+	stores, cfg := app.stores, app.cfg.Webhooks
+	worker := handlers.NewWebhookWorker(stores, cfg)
+	receiver := newWebhookReceiver(t)
+
+	acme := handlers.Company{Name: "Acme"}
+	require.NoError(t, stores.Companies.Create(&acme))
+	acmeID := int(acme.ID)
+	admin := createUserWithRole(t, stores, "admin", handlers.RoleCompanyAdmin, &acmeID)
+	alice := createUserWithRole(t, stores, "alice", handlers.RoleUser, nil)
+	alice.CompanyID = &acmeID
+	require.NoError(t, stores.Users.Update(&alice))
+	bob := createUserWithRole(t, stores, "bob", handlers.RoleUser, nil)
+
+	var personal, company handlers.Webhook
+	var personalSecret string
+
+	t.Run("Webhooks are validated", func(t *testing.T) {
+		for _, body := range []string{
+			`{"url": "ftp://example.com", "events": ["post.created"]}`,
+			`{"url": "/relative", "events": ["post.created"]}`,
+			`{"url": "` + receiver.URL + `", "events": []}`,
+			`{"url": "` + receiver.URL + `", "events": ["post.liked"]}`,
+			`{"url": "` + receiver.URL + `", "events": ["webhook.test"]}`,
+		} {
+			assert.Equal(t, http.StatusBadRequest, app.as(alice, "POST", "/webhooks", body).Code, body)
+		}
+	})
+
+	t.Run("Company webhooks need the manage permission", func(t *testing.T) {
+		body := `{"url": "` + receiver.URL + `/acme", "events": ["post.created", "follow.created"], "companyId": ` + strconv.Itoa(acmeID) + `}`
+		assert.Equal(t, http.StatusForbidden, app.as(alice, "POST", "/webhooks", body).Code)
+		assert.Equal(t, http.StatusNotFound, app.as(admin, "POST", "/webhooks", `{"url": "`+receiver.URL+`", "events": ["post.created"], "companyId": 999}`).Code)
+		company, _ = createWebhook(t, app, admin, body)
+		assert.Equal(t, &acmeID, company.CompanyID)
+
+		assert.Equal(t, http.StatusForbidden, app.as(alice, "GET", "/webhooks?companyId="+strconv.Itoa(acmeID), "").Code)
+		w := app.as(admin, "GET", "/webhooks?companyId="+strconv.Itoa(acmeID), "")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), receiver.URL+"/acme")
+		assert.NotContains(t, w.Body.String(), "secret", "secrets are only returned on creation")
+	})
+
+	t.Run("Users manage their own webhooks", func(t *testing.T) {
+		personal, personalSecret = createWebhook(t, app, alice, `{"url": "`+receiver.URL+`/alice", "events": ["post.created", "post.updated", "engagement.created"]}`)
+		assert.Equal(t, &alice.ID, personal.UserID)
+
+		path := "/webhooks/" + strconv.Itoa(personal.ID)
+		assert.Equal(t, http.StatusOK, app.as(alice, "GET", path, "").Code)
+		assert.Equal(t, http.StatusNotFound, app.as(bob, "GET", path, "").Code)
+		assert.Equal(t, http.StatusNotFound, app.as(admin, "GET", path, "").Code, "company admins only see company webhooks")
+		assert.Equal(t, http.StatusNotFound, app.as(bob, "DELETE", path, "").Code)
+		assert.Equal(t, http.StatusOK, app.as(admin, "GET", "/webhooks/"+strconv.Itoa(company.ID), "").Code)
+		assert.Equal(t, http.StatusNotFound, app.as(alice, "GET", "/webhooks/"+strconv.Itoa(company.ID), "").Code)
+
+		w := app.as(alice, "GET", "/webhooks", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var webhooks []handlers.Webhook
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &webhooks))
+		require.Len(t, webhooks, 1)
+		assert.Equal(t, personal.ID, webhooks[0].ID)
+	})
+
+	t.Run("Events are delivered signed to the subscribed webhooks", func(t *testing.T) {
+		require.Equal(t, http.StatusCreated, app.as(alice, "POST", "/create-post", `{"content": "hello"}`).Code)
+		require.Equal(t, http.StatusCreated, app.as(bob, "POST", "/create-post", `{"content": "not watched"}`).Code)
+		require.Equal(t, http.StatusCreated, app.as(bob, "POST", "/follow", `{"followingId": `+strconv.Itoa(alice.ID)+`}`).Code)
+		assert.Empty(t, receiver.take(), "requests do not deliver webhooks themselves")
+
+		delivered, err := worker.DeliverDue(time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, 3, delivered)
+
+		received := map[string][]receivedWebhook{}
+		for _, webhook := range receiver.take() {
+			received[webhook.Header.Get("X-Webhook-Event")] = append(received[webhook.Header.Get("X-Webhook-Event")], webhook)
+		}
+		require.Len(t, received[handlers.WebhookPostCreated], 2, "the personal and the company webhook")
+		require.Len(t, received[handlers.WebhookFollowCreated], 1, "the company of the followed user")
+		assert.Equal(t, "/acme", received[handlers.WebhookFollowCreated][0].Path)
+		first, second := received[handlers.WebhookPostCreated][0], received[handlers.WebhookPostCreated][1]
+		assert.Equal(t, first.Event.ID, second.Event.ID, "deliveries of one event share its id")
+		assert.Contains(t, string(first.Body), `"content":"hello"`)
+		if first.Path != "/alice" {
+			first = second
+		}
+		require.Equal(t, "/alice", first.Path)
+
+		deliveries := deliveriesOf(t, app, alice, personal.ID, "")
+		require.Len(t, deliveries, 1)
+		assert.Equal(t, strconv.Itoa(deliveries[0].ID), first.Header.Get("X-Webhook-Delivery"))
+		assert.Equal(t, "application/json", first.Header.Get("Content-Type"))
+		mac := hmac.New(sha256.New, []byte(personalSecret))
+		mac.Write([]byte(first.Header.Get("X-Webhook-Timestamp") + "."))
+		mac.Write(first.Body)
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), first.Header.Get("X-Webhook-Signature"))
+		assert.Equal(t, handlers.DeliveryStatusSucceeded, deliveries[0].Status)
+		assert.Equal(t, http.StatusOK, deliveries[0].ResponseStatus)
+		assert.NotNil(t, deliveries[0].DeliveredAt)
+	})
+
+	t.Run("Failed deliveries are retried with backoff until dead", func(t *testing.T) {
+		receiver.respondWith(http.StatusInternalServerError)
+		require.Equal(t, http.StatusOK, app.as(alice, "PUT", "/edit-post/1", `{"content": "edited"}`).Code)
+		now := time.Now()
+
+		delivered, err := worker.DeliverDue(now)
+		require.NoError(t, err)
+		assert.Zero(t, delivered)
+		deliveries := deliveriesOf(t, app, alice, personal.ID, "?event=post.updated")
+		require.Len(t, deliveries, 1)
+		assert.Equal(t, handlers.DeliveryStatusPending, deliveries[0].Status)
+		assert.Equal(t, 1, deliveries[0].Attempts)
+		assert.Equal(t, http.StatusInternalServerError, deliveries[0].ResponseStatus)
+		assert.WithinDuration(t, now.Add(cfg.InitialBackoff.Duration()), deliveries[0].NextAttemptAt, time.Second)
+		assert.Len(t, receiver.take(), 1)
+
+		_, err = worker.DeliverDue(now.Add(cfg.InitialBackoff.Duration() - time.Second))
+		require.NoError(t, err)
+		assert.Empty(t, receiver.take(), "not retried before the backoff")
+
+		now = now.Add(cfg.InitialBackoff.Duration())
+		_, err = worker.DeliverDue(now)
+		require.NoError(t, err)
+		deliveries = deliveriesOf(t, app, alice, personal.ID, "?event=post.updated")
+		assert.Equal(t, 2, deliveries[0].Attempts)
+		assert.WithinDuration(t, now.Add(2*cfg.InitialBackoff.Duration()), deliveries[0].NextAttemptAt, time.Second, "the backoff doubles")
+
+		_, err = worker.DeliverDue(now.Add(2 * cfg.InitialBackoff.Duration()))
+		require.NoError(t, err)
+		assert.Len(t, receiver.take(), 2)
+		dead := deliveriesOf(t, app, alice, personal.ID, "?status=dead")
+		require.Len(t, dead, 1)
+		assert.Equal(t, 3, dead[0].Attempts)
+		assert.Contains(t, dead[0].LastError, "500")
+
+		_, err = worker.DeliverDue(now.Add(24 * time.Hour))
+		require.NoError(t, err)
+		assert.Empty(t, receiver.take(), "dead deliveries are not retried")
+		receiver.respondWith(http.StatusOK)
+	})
+
+	t.Run("Test events reach the webhook", func(t *testing.T) {
+		path := "/webhooks/" + strconv.Itoa(personal.ID)
+		assert.Equal(t, http.StatusNotFound, app.as(bob, "POST", path+"/test", "").Code)
+		w := app.as(alice, "POST", path+"/test", "")
+		require.Equal(t, http.StatusAccepted, w.Code)
+		assert.Contains(t, w.Body.String(), `"event":"webhook.test"`)
+
+		_, err := worker.DeliverDue(time.Now())
+		require.NoError(t, err)
+		received := receiver.take()
+		require.Len(t, received, 1)
+		assert.Equal(t, handlers.WebhookTest, received[0].Event.Type)
+		assert.Equal(t, "/alice", received[0].Path)
+	})
+
+	t.Run("Scheduled posts are sent once published", func(t *testing.T) {
+		scheduleTime := time.Now().Add(time.Hour).Format(time.RFC3339)
+		w := app.as(alice, "POST", "/create-post", `{"content": "secret plans", "scheduleTime": "`+scheduleTime+`"}`)
+		require.Equal(t, http.StatusCreated, w.Code)
+		var created struct {
+			PostID int `json:"postId"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+		require.Equal(t, http.StatusOK, app.as(alice, "PUT", "/edit-post/"+strconv.Itoa(created.PostID), `{"content": "final plans"}`).Code)
+		_, err := worker.DeliverDue(time.Now())
+		require.NoError(t, err)
+		assert.Empty(t, receiver.take(), "scheduled posts are not sent")
+
+		publisher := handlers.NewPublisher(stores, handlers.NewFeed(config.Default().Feed, stores.Timelines), config.Default().Publisher)
+		_, err = publisher.PublishDue(time.Now().Add(2 * time.Hour))
+		require.NoError(t, err)
+		delivered, err := worker.DeliverDue(time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, 2, delivered, "the personal and the company webhook")
+		for _, received := range receiver.take() {
+			assert.Equal(t, handlers.WebhookPostCreated, received.Event.Type)
+			assert.Contains(t, string(received.Body), `"content":"final plans"`)
+		}
+	})
+
+	t.Run("Webhooks can be paused, changed and deleted", func(t *testing.T) {
+		path := "/webhooks/" + strconv.Itoa(personal.ID)
+		assert.Equal(t, http.StatusBadRequest, app.as(alice, "PUT", path, `{"events": ["post.liked"]}`).Code)
+		assert.Equal(t, http.StatusBadRequest, app.as(alice, "PUT", path, `{"url": "nope"}`).Code)
+		w := app.as(alice, "PUT", path, `{"active": false}`)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"active":false`)
+		assert.Contains(t, w.Body.String(), `"post.created"`, "fields left out are kept")
+
+		require.Equal(t, http.StatusCreated, app.as(alice, "POST", "/create-post", `{"content": "paused"}`).Code)
+		_, err := worker.DeliverDue(time.Now())
+		require.NoError(t, err)
+		received := receiver.take()
+		require.Len(t, received, 1, "only the company webhook is active")
+		assert.Equal(t, "/acme", received[0].Path)
+
+		require.Equal(t, http.StatusOK, app.as(alice, "DELETE", path, "").Code)
+		assert.Equal(t, http.StatusNotFound, app.as(alice, "GET", path, "").Code)
+	})
+}
+
+func TestWebhookPrivateNetworks(t *testing.T) {
+	app := newTestApp(t)
+	stores, cfg := app.stores, app.cfg.Webhooks
+	receiver := newWebhookReceiver(t)
+	alice := createUserWithRole(t, stores, "alice", handlers.RoleUser, nil)
+
+	t.Run("Private addresses are refused", func(t *testing.T) {
+		for _, target := range []string{
+			receiver.URL,
+			"http://169.254.169.254/latest/meta-data",
+			"http://10.0.0.1/",
+			"http://192.168.1.1:8080/",
+			"http://0.0.0.0/",
+			"http://[::1]/",
+			"http://[fe80::1]/",
+		} {
+			w := app.as(alice, "POST", "/webhooks", `{"url": "`+target+`", "events": ["post.created"]}`)
+			assert.Equal(t, http.StatusBadRequest, w.Code, target)
+		}
+	})
+
+	t.Run("Names resolving to private addresses are not delivered to", func(t *testing.T) {
+		// localhost passes validation but resolves to loopback
+		target := strings.Replace(receiver.URL, "127.0.0.1", "localhost", 1)
+		webhook, _ := createWebhook(t, app, alice, `{"url": "`+target+`", "events": ["post.created"]}`)
+		require.Equal(t, http.StatusAccepted, app.as(alice, "POST", "/webhooks/"+strconv.Itoa(webhook.ID)+"/test", "").Code)
+
+		delivered, err := handlers.NewWebhookWorker(stores, cfg).DeliverDue(time.Now())
+		require.NoError(t, err)
+		assert.Zero(t, delivered)
+		assert.Empty(t, receiver.take())
+		deliveries := deliveriesOf(t, app, alice, webhook.ID, "")
+		require.Len(t, deliveries, 1)
+		assert.Equal(t, "destination address not allowed", deliveries[0].LastError)
+		assert.Zero(t, deliveries[0].ResponseStatus)
+	})
+
+	t.Run("Network errors are not shown", func(t *testing.T) {
+		// Allow loopback so the dial reaches the closed port
+		app.cfg.Webhooks.AllowPrivateNetworks = true
+		allowed := app.cfg.Webhooks
+		closed := httptest.NewServer(http.NotFoundHandler())
+		closed.Close()
+		webhook, _ := createWebhook(t, app, alice, `{"url": "`+closed.URL+`", "events": ["post.created"]}`)
+		require.Equal(t, http.StatusAccepted, app.as(alice, "POST", "/webhooks/"+strconv.Itoa(webhook.ID)+"/test", "").Code)
+
+		_, err := handlers.NewWebhookWorker(stores, allowed).DeliverDue(time.Now())
+		require.NoError(t, err)
+		deliveries := deliveriesOf(t, app, alice, webhook.ID, "")
+		require.Len(t, deliveries, 1)
+		assert.Equal(t, "request failed", deliveries[0].LastError)
+	})
+}